@@ -1,6 +1,6 @@
 module github.com/ergochat/webircproxy
 
-go 1.17
+go 1.21
 
 require (
 	github.com/ergochat/ergo v1.2.1-0.20210919081820-20d8d269ca18
@@ -0,0 +1,112 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// An upstream's address (and tls-server-name) may contain variables, which
+// are substituted for each client before dialing, so that one upstream can
+// send clients to the nearest of several ircds:
+//
+//	{region}  the value of `regions` for the client's country (from the geoip
+//	          database), or its "default" value
+//	{bucket}  a consistent hash of the client's IP, from 0 to `buckets`-1
+//
+// Everything else about the upstream (its name, weight, drains, and metrics)
+// is shared by all the addresses. A jump consistent hash (Lamping and Veach)
+// is used for {bucket}, so that changing `buckets` moves as few clients as
+// possible between ircds.
+
+var (
+	templateVariableRe = regexp.MustCompile(`\{[^{}]*\}`)
+)
+
+const (
+	templateRegion = "{region}"
+	templateBucket = "{bucket}"
+)
+
+// postprocessTemplate validates the variables in the upstream's address,
+// after parseUpstreamAddress (which accepts them as part of the host or path)
+func (upstream *reverseProxyUpstream) postprocessTemplate() error {
+	for _, variable := range templateVariableRe.FindAllString(upstream.Address+upstream.serverName, -1) {
+		switch variable {
+		case templateRegion:
+			if upstream.Regions["default"] == "" {
+				return fmt.Errorf("upstream %s: {region} requires regions, with a default", upstream.Name)
+			}
+		case templateBucket:
+			if upstream.Buckets <= 0 {
+				return fmt.Errorf("upstream %s: {bucket} requires buckets", upstream.Name)
+			}
+		default:
+			return fmt.Errorf("upstream %s: unknown address variable %s", upstream.Name, variable)
+		}
+		upstream.templated = true
+	}
+	if upstream.Buckets < 0 {
+		return fmt.Errorf("upstream %s: buckets must not be negative", upstream.Name)
+	}
+	if upstream.templated && upstream.Prewarm.Connections != 0 {
+		// prewarmed connections are dialed before their clients arrive:
+		return fmt.Errorf("upstream %s: prewarm cannot be used with address variables", upstream.Name)
+	}
+	// country codes are case-insensitive:
+	regions := make(map[string]string, len(upstream.Regions))
+	for country, region := range upstream.Regions {
+		if country != "default" {
+			country = strings.ToUpper(country)
+		}
+		regions[country] = region
+	}
+	upstream.Regions = regions
+	return nil
+}
+
+// forClient returns the upstream with its address variables substituted
+// for the client with the given IP (or the upstream itself, if it has none)
+func (upstream *reverseProxyUpstream) forClient(config *Config, ip net.IP) *reverseProxyUpstream {
+	if !upstream.templated {
+		return upstream
+	}
+	var country string
+	if config.GeoIP.db != nil {
+		country, _ = config.GeoIP.db.lookup(ip)
+	}
+	region, ok := upstream.Regions[strings.ToUpper(country)]
+	if !ok {
+		region = upstream.Regions["default"]
+	}
+	var bucket string
+	if upstream.Buckets != 0 {
+		h := fnv.New64a()
+		h.Write(ip.To16())
+		bucket = strconv.Itoa(jumpHash(h.Sum64(), upstream.Buckets))
+	}
+	replacer := strings.NewReplacer(templateRegion, region, templateBucket, bucket)
+	result := *upstream
+	result.Address = replacer.Replace(upstream.Address)
+	result.serverName = replacer.Replace(upstream.serverName)
+	result.templated = false
+	return &result
+}
+
+// jumpHash maps key to one of buckets buckets; see "A Fast, Minimal Memory,
+// Consistent Hash Algorithm" (Lamping and Veach, 2014)
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
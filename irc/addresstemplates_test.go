@@ -0,0 +1,83 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAddressTemplates(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "geoip.csv")
+	os.WriteFile(filename, []byte("192.0.2.0/24,US,64496\n198.51.100.0/24,JP,\n"), 0600)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy.example.com"),
+		WithYAML(`
+geoip:
+    database: "`+filename+`"
+upstreams:
+    -
+        name: "nearest"
+        address: "ircs://irc-{region}.example.com"
+        regions:
+            us: "us"
+            default: "eu"
+    -
+        name: "hashed"
+        address: "unix:/run/ircd-{bucket}.sock"
+        buckets: 4
+`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nearest := &config.Upstreams[0]
+	assertEqual(nearest.Name, "nearest")
+	us := nearest.forClient(config, net.ParseIP("192.0.2.1"))
+	assertEqual(us.Address, "irc-us.example.com:6697")
+	assertEqual(us.serverName, "irc-us.example.com")
+	assertEqual(nearest.forClient(config, net.ParseIP("198.51.100.1")).Address, "irc-eu.example.com:6697")
+	assertEqual(nearest.forClient(config, net.ParseIP("203.0.113.1")).Address, "irc-eu.example.com:6697")
+	// the configured upstream is unchanged:
+	assertEqual(nearest.Address, "irc-{region}.example.com:6697")
+
+	hashed := &config.Upstreams[1]
+	first := hashed.forClient(config, net.ParseIP("203.0.113.1")).Address
+	assertEqual(hashed.forClient(config, net.ParseIP("203.0.113.1")).Address, first)
+	seen := make(map[string]bool)
+	for i := 0; i < 64; i++ {
+		seen[hashed.forClient(config, net.IPv4(203, 0, 113, byte(i))).Address] = true
+	}
+	assertEqual(len(seen), 4)
+
+	plain := &reverseProxyUpstream{Address: "127.0.0.1:6667"}
+	assertEqual(plain.forClient(config, net.ParseIP("192.0.2.1")), plain)
+
+	for _, invalid := range []string{
+		"address: \"irc-{region}.example.com:6667\"",
+		"address: \"irc-{bucket}.example.com:6667\"\n        buckets: 0",
+		"address: \"irc-{zone}.example.com:6667\"",
+		"address: \"irc-{bucket}.example.com:6667\"\n        buckets: 2\n        prewarm:\n            connections: 1",
+	} {
+		_, err = NewConfig(WithGatewayName("webircproxy.example.com"), WithYAML("upstreams:\n    -\n        "+invalid+"\n"))
+		if err == nil {
+			t.Errorf("%s should be rejected", invalid)
+		}
+	}
+}
+
+func TestJumpHash(t *testing.T) {
+	// growing from 4 buckets to 5 only moves keys to the new bucket:
+	moved := 0
+	for key := uint64(0); key < 1000; key++ {
+		before, after := jumpHash(key*0x9e3779b97f4a7c15, 4), jumpHash(key*0x9e3779b97f4a7c15, 5)
+		if before != after {
+			assertEqual(after, 4)
+			moved++
+		}
+	}
+	assertEqual(moved > 100 && moved < 300, true)
+}
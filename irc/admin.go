@@ -0,0 +1,550 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Admin HTTP API. This is unauthenticated, so it may only listen on
+// loopback addresses or Unix domain sockets:
+//
+//	GET    /connections                 list active connections
+//	GET    /connections/<id>            inspect a connection
+//	DELETE /connections/<id>            kill a connection
+//	GET    /upstreams                   list upstreams, their connection counts, and whether they are drained
+//	GET    /upstreams/<name>            inspect an upstream (e.g., to see whether its drain is complete)
+//	GET    /listeners                   list listeners, their connection counts, and any bind errors
+//	GET    /health                      503 if a listener failed to bind or stopped serving, or if the
+//	                                    proxy appears to be deadlocked
+//	POST   /upstreams/<name>/drain      send no new connections to an upstream, returning how many
+//	                                    remain (with ?kill=true, also kill its existing connections)
+//	POST   /upstreams/<name>/undrain    resume sending connections to an upstream
+//	POST   /upstreams                   add an upstream, from a JSON body: name, address, tls, webirc,
+//	                                    webirc_password, weight (until the next rehash)
+//	DELETE /upstreams/<name>            remove an upstream (with ?kill=true, also kill its connections)
+//	POST   /upstreams/<name>/weight     set an upstream's share of new connections (?weight=N)
+//	GET    /debug/vars                  expvar snapshot: memory stats and the "webircproxy" variable
+//	POST   /rehash                      reload the config file, returning a summary of what changed
+//	                                    (500 if it failed, including if any listener couldn't be bound)
+//	POST   /selftest                    register with each upstream via WEBIRC, reporting the
+//	                                    results (500 if any failed)
+//	GET    /bans                        list automatic bans
+//	GET    /bandwidth                   list the recent usage of client IPs subject to bandwidth quotas
+//	GET    /leaks                       check for leaked proxy goroutines (see leakcheck.go)
+//	GET    /route                       report the upstreams a connection would be routed to, and why,
+//	                                    from ?origin=, host=, ip=, and listener= (see RouteDryRun)
+//	DELETE /bans                        clear all bans
+//	DELETE /bans/<ip>                   clear the ban on an IP
+//	GET    /events                      stream connection events (see Subscribe), as server-sent events
+//
+// Responses are compressed if the client accepts it (see compression.go).
+
+const (
+	adminHealthCheckTimeout = 5 * time.Second
+)
+
+// AdminAPIConfig configures the admin HTTP API.
+type AdminAPIConfig struct {
+	// loopback address (e.g. "localhost:6061") or Unix socket path:
+	Listen string
+}
+
+func (conf *AdminAPIConfig) postprocess() error {
+	if conf.Listen == "" {
+		return nil
+	}
+	local, err := isLocalListenAddress(conf.Listen)
+	if err != nil {
+		return fmt.Errorf("invalid admin-api listen address %s: %w", conf.Listen, err)
+	}
+	if !local {
+		return fmt.Errorf("admin-api must listen on a loopback address or a unix socket, not %s", conf.Listen)
+	}
+	return nil
+}
+
+// isLocalListenAddress returns whether a listen address is a unix socket
+// or a loopback address, i.e., only reachable from this machine
+func isLocalListenAddress(listen string) (bool, error) {
+	addr := strings.TrimPrefix(listen, "unix:")
+	if strings.HasPrefix(addr, "/") {
+		return true, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false, err
+	}
+	if host == "localhost" {
+		return true, nil
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback(), nil
+}
+
+// ConnectionInfo describes an active proxied connection.
+type ConnectionInfo struct {
+	ID       string    `json:"id"`
+	IP       string    `json:"ip"`
+	Listener string    `json:"listener"`
+	Origin   string    `json:"origin,omitempty"`
+	Upstream string    `json:"upstream"`
+	Secure   bool      `json:"secure"`
+	Tags     []string  `json:"tags,omitempty"`
+	Started  time.Time `json:"started"`
+	Duration float64   `json:"duration_seconds"`
+	BytesIn  uint64    `json:"bytes_in"`
+	BytesOut uint64    `json:"bytes_out"`
+}
+
+// UpstreamInfo describes a configured upstream.
+type UpstreamInfo struct {
+	Name        string `json:"name"`
+	Address     string `json:"address"`
+	Drained     bool   `json:"drained"`
+	Weight      int    `json:"weight"`
+	Connections int    `json:"connections"`
+	// drained, and its last connection has closed:
+	DrainComplete bool `json:"drain_complete"`
+}
+
+// connRegistry tracks the active proxied connections
+type connRegistry struct {
+	sync.Mutex // tier 1
+
+	conns map[string]*ReverseProxyConn
+	// active connection counts:
+	byUpstream map[string]int
+	byListener map[string]int
+}
+
+func (cr *connRegistry) add(conn *ReverseProxyConn) {
+	cr.Lock()
+	defer cr.Unlock()
+
+	if cr.conns == nil {
+		cr.conns = make(map[string]*ReverseProxyConn)
+		cr.byUpstream = make(map[string]int)
+		cr.byListener = make(map[string]int)
+	}
+	cr.conns[conn.client.id] = conn
+	cr.byUpstream[conn.upstream.Name]++
+	cr.byListener[conn.client.listener]++
+}
+
+// remove removes the connection, returning whether it was the last one to its
+// upstream
+func (cr *connRegistry) remove(conn *ReverseProxyConn) (last bool) {
+	cr.Lock()
+	defer cr.Unlock()
+
+	if cr.conns[conn.client.id] == conn {
+		delete(cr.conns, conn.client.id)
+		decrementCount(cr.byUpstream, conn.upstream.Name)
+		decrementCount(cr.byListener, conn.client.listener)
+		return cr.byUpstream[conn.upstream.Name] == 0
+	}
+	return false
+}
+
+func decrementCount(counts map[string]int, key string) {
+	counts[key]--
+	if counts[key] <= 0 {
+		delete(counts, key)
+	}
+}
+
+// counts returns copies of the active connection counts per upstream and per listener
+func (cr *connRegistry) counts() (byUpstream, byListener map[string]int) {
+	cr.Lock()
+	defer cr.Unlock()
+
+	byUpstream = make(map[string]int, len(cr.byUpstream))
+	for key, count := range cr.byUpstream {
+		byUpstream[key] = count
+	}
+	byListener = make(map[string]int, len(cr.byListener))
+	for key, count := range cr.byListener {
+		byListener[key] = count
+	}
+	return
+}
+
+// countsFor returns the active connection counts for an upstream and a listener
+func (cr *connRegistry) countsFor(upstream, listener string) (upstreamCount, listenerCount int) {
+	cr.Lock()
+	defer cr.Unlock()
+	return cr.byUpstream[upstream], cr.byListener[listener]
+}
+
+func (cr *connRegistry) get(id string) *ReverseProxyConn {
+	cr.Lock()
+	defer cr.Unlock()
+	return cr.conns[id]
+}
+
+func (cr *connRegistry) all() (result []*ReverseProxyConn) {
+	cr.Lock()
+	defer cr.Unlock()
+
+	result = make([]*ReverseProxyConn, 0, len(cr.conns))
+	for _, conn := range cr.conns {
+		result = append(result, conn)
+	}
+	return
+}
+
+// ListConnections returns information about all active connections, oldest first.
+func (server *Server) ListConnections() (result []ConnectionInfo) {
+	conns := server.conns.all()
+	result = make([]ConnectionInfo, len(conns))
+	for i, conn := range conns {
+		result[i] = conn.Info()
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Started.Before(result[j].Started) })
+	return
+}
+
+// KillConnection disconnects an active connection by ID; it returns false
+// if there was no such connection.
+func (server *Server) KillConnection(id string) bool {
+	conn := server.conns.get(id)
+	if conn == nil {
+		return false
+	}
+	conn.log(LogLevelInfo, "killing connection at admin request")
+	conn.closeWithReason(CloseKilled, nil)
+	return true
+}
+
+// ListenerInfo describes a listener.
+type ListenerInfo struct {
+	Address     string `json:"address"`
+	Connections int    `json:"connections"`
+	// if the listener couldn't be bound, the reason why:
+	Error string `json:"error,omitempty"`
+}
+
+// ListListeners returns information about the configured listeners.
+func (server *Server) ListListeners() (result []ListenerInfo) {
+	_, counts := server.conns.counts()
+
+	server.rehashMutex.Lock()
+	defer server.rehashMutex.Unlock()
+
+	for addr := range server.listeners {
+		result = append(result, ListenerInfo{Address: addr, Connections: counts[addr]})
+	}
+	for addr, err := range server.listenerErrors {
+		result = append(result, ListenerInfo{Address: addr, Error: err.Error()})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Address < result[j].Address })
+	return
+}
+
+// upstreamDrains records which upstreams (by name) are drained; this is
+// runtime state, so it persists across rehashes
+type upstreamDrains struct {
+	sync.Mutex // tier 1
+
+	drained map[string]bool
+}
+
+func (ud *upstreamDrains) set(name string, drained bool) {
+	ud.Lock()
+	defer ud.Unlock()
+
+	if ud.drained == nil {
+		ud.drained = make(map[string]bool)
+	}
+	if drained {
+		ud.drained[name] = true
+	} else {
+		delete(ud.drained, name)
+	}
+}
+
+func (ud *upstreamDrains) isDrained(name string) bool {
+	ud.Lock()
+	defer ud.Unlock()
+	return ud.drained[name]
+}
+
+// DrainUpstream stops (or resumes) sending new connections to an upstream;
+// if kill is set, existing connections to the upstream are also disconnected.
+// It returns false if there is no such upstream.
+func (server *Server) DrainUpstream(name string, drained, kill bool) bool {
+	upstream := server.runtimeUpstreams.get().findUpstream(server.Config(), name)
+	if upstream == nil {
+		return false
+	}
+	server.drains.set(upstream.Name, drained)
+	server.Log(LogComponentServer, LogLevelInfo, "changed upstream drain state", slog.String(logKeyUpstream, upstream.Name), slog.Bool("drained", drained))
+	if drained && kill {
+		server.killUpstreamConnections(upstream.Name, CloseDrained)
+	}
+	return true
+}
+
+// ListUpstreams returns information about the upstreams, including those
+// added at runtime.
+func (server *Server) ListUpstreams() (result []UpstreamInfo) {
+	counts, _ := server.conns.counts()
+	overlay := server.runtimeUpstreams.get()
+	for _, upstream := range overlay.allUpstreams(server.Config()) {
+		result = append(result, server.upstreamInfo(overlay, upstream, counts[upstream.Name]))
+	}
+	return
+}
+
+// GetUpstream returns information about one upstream, by name or address;
+// it returns false if there is no such upstream.
+func (server *Server) GetUpstream(name string) (info UpstreamInfo, ok bool) {
+	overlay := server.runtimeUpstreams.get()
+	upstream := overlay.findUpstream(server.Config(), name)
+	if upstream == nil {
+		return
+	}
+	count, _ := server.conns.countsFor(upstream.Name, "")
+	return server.upstreamInfo(overlay, upstream, count), true
+}
+
+func (server *Server) upstreamInfo(overlay *upstreamOverlay, upstream *reverseProxyUpstream, connections int) UpstreamInfo {
+	drained := server.drains.isDrained(upstream.Name)
+	return UpstreamInfo{
+		Name:          upstream.Name,
+		Address:       upstream.Address,
+		Drained:       drained,
+		Weight:        overlay.weight(upstream),
+		Connections:   connections,
+		DrainComplete: drained && connections == 0,
+	}
+}
+
+func (server *Server) setupAdminListener(config *Config) {
+	listen := config.AdminAPI.Listen
+	if server.adminServer != nil {
+		if listen == "" || listen != server.adminServer.Addr {
+			server.Log(LogComponentServer, LogLevelInfo, fmt.Sprintf("Stopping admin API listener at %s", server.adminServer.Addr))
+			server.adminServer.Close()
+			server.adminServer = nil
+		}
+	}
+	if listen != "" && server.adminServer == nil {
+		// the API is unauthenticated, so don't use unix-bind-mode:
+		listener, err := createBaseListener(listen, 0600, false)
+		if err != nil {
+			server.Log(LogComponentServer, LogLevelError, fmt.Sprintf("couldn't start admin API listener: %v", err))
+			return
+		}
+		as := &http.Server{
+			Addr:         listen,
+			Handler:      compressHandler(http.HandlerFunc(server.handleAdmin)),
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		}
+		go as.Serve(listener)
+		server.adminServer = as
+		server.Log(LogComponentServer, LogLevelInfo, fmt.Sprintf("Started admin API listener: %s", listen))
+	}
+}
+
+// addUpstreamRequest is the body of `POST /upstreams`
+type addUpstreamRequest struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	TLS     bool   `json:"tls"`
+	// WEBIRC is sent if either is set:
+	Webirc         bool   `json:"webirc"`
+	WebircPassword string `json:"webirc_password"`
+	Weight         int    `json:"weight"`
+}
+
+func (req *addUpstreamRequest) options() (opts []UpstreamOption) {
+	opts = append(opts, UpstreamName(req.Name), UpstreamWeight(req.Weight))
+	if req.TLS {
+		opts = append(opts, UpstreamTLS())
+	}
+	if req.Webirc || req.WebircPassword != "" {
+		opts = append(opts, UpstreamWebirc(req.WebircPassword))
+	}
+	return
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func (server *Server) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	method := r.Method
+
+	switch {
+	case len(path) == 1 && path[0] == "connections" && method == http.MethodGet:
+		writeJSON(w, http.StatusOK, server.ListConnections())
+	case len(path) == 2 && path[0] == "connections" && method == http.MethodGet:
+		conn := server.conns.get(path[1])
+		if conn == nil {
+			writeJSONError(w, http.StatusNotFound, "no such connection")
+			return
+		}
+		writeJSON(w, http.StatusOK, conn.Info())
+	case len(path) == 2 && path[0] == "connections" && method == http.MethodDelete:
+		if !server.KillConnection(path[1]) {
+			writeJSONError(w, http.StatusNotFound, "no such connection")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"killed": true})
+	case len(path) == 1 && path[0] == "upstreams" && method == http.MethodGet:
+		writeJSON(w, http.StatusOK, server.ListUpstreams())
+	case len(path) == 1 && path[0] == "upstreams" && method == http.MethodPost:
+		var req addUpstreamRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Address == "" {
+			writeJSONError(w, http.StatusBadRequest, "invalid request: an address is required")
+			return
+		}
+		if err := server.AddUpstream(req.Address, req.options()...); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]bool{"success": true})
+	case len(path) >= 2 && path[0] == "upstreams" && method == http.MethodGet:
+		info, ok := server.GetUpstream(strings.Join(path[1:], "/"))
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "no such upstream")
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	case len(path) >= 2 && path[0] == "upstreams" && method == http.MethodDelete:
+		if !server.RemoveUpstream(strings.Join(path[1:], "/"), r.URL.Query().Get("kill") == "true") {
+			writeJSONError(w, http.StatusNotFound, "no such upstream")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"removed": true})
+	case len(path) >= 3 && path[0] == "upstreams" && path[len(path)-1] == "weight" && method == http.MethodPost:
+		weight, err := strconv.Atoi(r.URL.Query().Get("weight"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid weight")
+			return
+		}
+		if err := server.SetUpstreamWeight(strings.Join(path[1:len(path)-1], "/"), weight); err == errNoSuchUpstream {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"weight": weight})
+	case len(path) == 1 && path[0] == "listeners" && method == http.MethodGet:
+		writeJSON(w, http.StatusOK, server.ListListeners())
+	case len(path) >= 3 && path[0] == "upstreams" && (path[len(path)-1] == "drain" || path[len(path)-1] == "undrain") && method == http.MethodPost:
+		drained := path[len(path)-1] == "drain"
+		// the names of upstreams in profiles contain a slash, e.g. "profile/name":
+		name := strings.Join(path[1:len(path)-1], "/")
+		if !server.DrainUpstream(name, drained, r.URL.Query().Get("kill") == "true") {
+			writeJSONError(w, http.StatusNotFound, "no such upstream")
+			return
+		}
+		info, _ := server.GetUpstream(name)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"drained": drained, "connections": info.Connections})
+	case len(path) == 1 && path[0] == "bandwidth" && method == http.MethodGet:
+		writeJSON(w, http.StatusOK, server.ListBandwidth())
+	case len(path) == 1 && path[0] == "leaks" && method == http.MethodGet:
+		writeJSON(w, http.StatusOK, server.CheckLeaks())
+	case len(path) == 1 && path[0] == "route" && method == http.MethodGet:
+		query := r.URL.Query()
+		report, err := server.RouteDryRun(RouteQuery{
+			Origin:   query.Get("origin"),
+			Host:     query.Get("host"),
+			IP:       query.Get("ip"),
+			Listener: query.Get("listener"),
+		})
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	case len(path) == 1 && path[0] == "events" && method == http.MethodGet:
+		server.streamEvents(w, r)
+	case len(path) == 1 && path[0] == "health" && method == http.MethodGet:
+		if err := server.healthCheck(adminHealthCheckTimeout); err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"healthy": true})
+	case len(path) == 2 && path[0] == "debug" && path[1] == "vars" && method == http.MethodGet:
+		expvar.Handler().ServeHTTP(w, r)
+	case len(path) == 1 && path[0] == "rehash" && method == http.MethodPost:
+		summary, err := server.rehash()
+		if err != nil {
+			if summary != nil {
+				// the rest of the config was applied:
+				writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error(), "changes": summary})
+			} else {
+				writeJSONError(w, http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "changes": summary})
+	case len(path) == 1 && path[0] == "selftest" && method == http.MethodPost:
+		results := server.SelfTest()
+		status := http.StatusOK
+		for _, result := range results {
+			if !result.Success {
+				status = http.StatusInternalServerError
+			}
+		}
+		writeJSON(w, status, results)
+	case len(path) == 1 && path[0] == "bans" && method == http.MethodGet:
+		writeJSON(w, http.StatusOK, server.ListBans())
+	case len(path) == 1 && path[0] == "bans" && method == http.MethodDelete:
+		server.ClearAllBans()
+		writeJSON(w, http.StatusOK, map[string]bool{"success": true})
+	case len(path) == 2 && path[0] == "bans" && method == http.MethodDelete:
+		found, err := server.ClearBan(path[1])
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		} else if !found {
+			writeJSONError(w, http.StatusNotFound, "no such ban")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"success": true})
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (r *ReverseProxyConn) Info() ConnectionInfo {
+	return ConnectionInfo{
+		ID:       r.client.id,
+		IP:       r.client.ip.String(),
+		Listener: r.client.listener,
+		Origin:   r.client.origin,
+		Upstream: r.upstream.Name,
+		Secure:   r.client.secure,
+		Tags:     r.client.tags,
+		Started:  r.started.UTC(),
+		Duration: time.Since(r.started).Seconds(),
+		BytesIn:  atomic.LoadUint64(&r.bytesIn),
+		BytesOut: atomic.LoadUint64(&r.bytesOut),
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminAPIListenAddress(t *testing.T) {
+	for _, listen := range []string{"", "localhost:6061", "127.0.0.1:6061", "[::1]:6061", "/run/webircproxy/admin.sock"} {
+		conf := AdminAPIConfig{Listen: listen}
+		if err := conf.postprocess(); err != nil {
+			t.Errorf("%s should be allowed: %v", listen, err)
+		}
+	}
+	for _, listen := range []string{":6061", "0.0.0.0:6061", "192.0.2.1:6061", "example.com:6061"} {
+		conf := AdminAPIConfig{Listen: listen}
+		if conf.postprocess() == nil {
+			t.Errorf("%s should be rejected", listen)
+		}
+	}
+}
+
+func TestDrainUpstream(t *testing.T) {
+	config := &Config{
+		Upstreams: []reverseProxyUpstream{
+			{Name: "a", Address: "192.0.2.1:6667"},
+			{Name: "b", Address: "192.0.2.2:6667"},
+		},
+	}
+	server := new(Server)
+	server.SetConfig(config)
+
+	assertEqual(server.DrainUpstream("a", true, false), true)
+	assertEqual(server.DrainUpstream("c", true, false), false)
+	for i := 0; i < 10; i++ {
+		assertEqual(server.selectUpstream(config, &clientData{}).Name, "b")
+	}
+	server.DrainUpstream("b", true, false)
+	if server.selectUpstream(config, &clientData{}) != nil {
+		t.Errorf("all upstreams are drained")
+	}
+
+	w := httptest.NewRecorder()
+	server.handleAdmin(w, httptest.NewRequest(http.MethodPost, "/upstreams/a/undrain", nil))
+	assertEqual(w.Code, http.StatusOK)
+	assertEqual(server.selectUpstream(config, &clientData{}).Name, "a")
+
+	w = httptest.NewRecorder()
+	server.handleAdmin(w, httptest.NewRequest(http.MethodGet, "/upstreams", nil))
+	var upstreams []UpstreamInfo
+	json.NewDecoder(w.Body).Decode(&upstreams)
+	assertEqual(len(upstreams), 2)
+	assertEqual(upstreams[0].Drained, false)
+	assertEqual(upstreams[1].Drained, true)
+
+	w = httptest.NewRecorder()
+	server.handleAdmin(w, httptest.NewRequest(http.MethodGet, "/upstreams/b", nil))
+	var info UpstreamInfo
+	json.NewDecoder(w.Body).Decode(&info)
+	assertEqual(info, UpstreamInfo{Name: "b", Address: "192.0.2.2:6667", Drained: true, Weight: 1, DrainComplete: true})
+	w = httptest.NewRecorder()
+	server.handleAdmin(w, httptest.NewRequest(http.MethodGet, "/upstreams/c", nil))
+	assertEqual(w.Code, http.StatusNotFound)
+
+	// the drain isn't complete until the upstream's last connection closes:
+	conn := &ReverseProxyConn{client: &clientData{id: "a1"}, upstream: &config.Upstreams[1]}
+	server.conns.add(conn)
+	info, _ = server.GetUpstream("b")
+	assertEqual(info.Connections, 1)
+	assertEqual(info.DrainComplete, false)
+	assertEqual(server.conns.remove(conn), true)
+	info, _ = server.GetUpstream("b")
+	assertEqual(info.DrainComplete, true)
+
+	w = httptest.NewRecorder()
+	server.handleAdmin(w, httptest.NewRequest(http.MethodDelete, "/connections/nonexistent", nil))
+	assertEqual(w.Code, http.StatusNotFound)
+}
+
+func TestConnRegistryCounts(t *testing.T) {
+	var cr connRegistry
+	a := &reverseProxyUpstream{Name: "a"}
+	b := &reverseProxyUpstream{Name: "b"}
+	conns := []*ReverseProxyConn{
+		{client: &clientData{id: "1", listener: ":8067"}, upstream: a},
+		{client: &clientData{id: "2", listener: ":8067"}, upstream: b},
+		{client: &clientData{id: "3", listener: ":8097"}, upstream: a},
+	}
+	for _, conn := range conns {
+		cr.add(conn)
+	}
+	cr.remove(conns[1])
+	cr.remove(conns[1])
+
+	byUpstream, byListener := cr.counts()
+	assertEqual(byUpstream, map[string]int{"a": 2})
+	assertEqual(byListener, map[string]int{":8067": 1, ":8097": 1})
+}
+
+func TestDebugVars(t *testing.T) {
+	server := &Server{}
+	server.metrics.initialize()
+	server.SetConfig(&Config{Upstreams: []reverseProxyUpstream{{Name: "ircd1", Address: "192.0.2.1:6667"}}})
+	server.publishExpvar()
+	server.countError(errorUpstreamDialFailed, "ircd1")
+
+	w := httptest.NewRecorder()
+	server.handleAdmin(w, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	assertEqual(w.Code, http.StatusOK)
+	var vars struct {
+		Webircproxy DebugStats `json:"webircproxy"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(vars.Webircproxy.Upstreams["ircd1"].DialFailures, uint64(1))
+	if vars.Webircproxy.Goroutines == 0 {
+		t.Errorf("expected a goroutine count")
+	}
+}
+
+func TestListenerBindErrors(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	config := &Config{
+		trueListeners: map[string]listenerConfig{
+			busy.Addr().String(): {},
+			"127.0.0.1:0":        {},
+		},
+	}
+	server := &Server{listeners: make(map[string]*WSListener)}
+	server.SetConfig(config)
+	err = server.setupListeners(config, nil)
+	defer server.listeners["127.0.0.1:0"].Stop()
+	if err == nil {
+		t.Fatal("binding a busy port should fail")
+	}
+	assertEqual(len(server.listeners), 1)
+	if server.healthCheck(time.Second) == nil {
+		t.Errorf("health check should fail after a bind error")
+	}
+
+	w := httptest.NewRecorder()
+	server.handleAdmin(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assertEqual(w.Code, http.StatusServiceUnavailable)
+
+	w = httptest.NewRecorder()
+	server.handleAdmin(w, httptest.NewRequest(http.MethodGet, "/listeners", nil))
+	var listeners []ListenerInfo
+	json.NewDecoder(w.Body).Decode(&listeners)
+	assertEqual(len(listeners), 2)
+	for _, info := range listeners {
+		assertEqual(info.Error != "", info.Address == busy.Addr().String())
+	}
+}
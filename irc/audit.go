@@ -0,0 +1,153 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditLogConfig configures the connection audit log, a JSONL file with one
+// record per connection open and close. It is independent of the regular logs
+// (and their log levels).
+type AuditLogConfig struct {
+	Enabled  bool
+	Filename string
+	Rotate   LogRotateConfig
+}
+
+func (conf *AuditLogConfig) postprocess() error {
+	if conf.Enabled && conf.Filename == "" {
+		return fmt.Errorf("audit log requires a filename")
+	}
+	return nil
+}
+
+func (conf *AuditLogConfig) key() string {
+	if !conf.Enabled {
+		return ""
+	}
+	return fmt.Sprintf("%s %s", conf.Filename, conf.Rotate.key())
+}
+
+type auditEvent string
+
+const (
+	auditEventOpen  auditEvent = "open"
+	auditEventClose auditEvent = "close"
+)
+
+// auditRecord is a line of the audit log
+type auditRecord struct {
+	Time  time.Time  `json:"time"`
+	Event auditEvent `json:"event"`
+	ID    string     `json:"conn_id"`
+	// the IP we received the connection from, and the client IP supplied by
+	// a trusted reverse proxy (if any), and with ip-cloaking, the cloaked IP
+	// sent to the upstream (so that upstream bans can be traced):
+	RealIP    string   `json:"real_ip"`
+	ProxiedIP string   `json:"proxied_ip,omitempty"`
+	SentIP    string   `json:"sent_ip,omitempty"`
+	Listener  string   `json:"listener"`
+	Origin    string   `json:"origin,omitempty"`
+	Secure    bool     `json:"secure"`
+	Tags      []string `json:"tags,omitempty"`
+	Upstream  string   `json:"upstream"`
+
+	// for close events:
+	Started     *time.Time `json:"started,omitempty"`
+	Duration    *float64   `json:"duration_seconds,omitempty"`
+	CloseReason string     `json:"close_reason,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	BytesIn     *uint64    `json:"bytes_in,omitempty"`
+	BytesOut    *uint64    `json:"bytes_out,omitempty"`
+}
+
+func newAuditRecord(event auditEvent, client *clientData, upstream *reverseProxyUpstream) *auditRecord {
+	record := &auditRecord{
+		Time:     time.Now().UTC(),
+		Event:    event,
+		ID:       client.id,
+		RealIP:   client.realIP.String(),
+		Listener: client.listener,
+		Origin:   client.origin,
+		Secure:   client.secure,
+		Tags:     client.tags,
+		Upstream: upstream.Name,
+	}
+	if !client.ip.Equal(client.realIP) {
+		record.ProxiedIP = client.ip.String()
+	}
+	if client.sentIP != nil {
+		record.SentIP = client.sentIP.String()
+	}
+	return record
+}
+
+// setClose fills in the fields of a close record
+func (record *auditRecord) setClose(started time.Time, reason CloseReason, err error, bytesIn, bytesOut uint64) {
+	started = started.UTC()
+	duration := record.Time.Sub(started).Seconds()
+	record.Started = &started
+	record.Duration = &duration
+	record.CloseReason = string(reason)
+	if err != nil {
+		record.Error = err.Error()
+	}
+	record.BytesIn = &bytesIn
+	record.BytesOut = &bytesOut
+}
+
+type auditLog struct {
+	sync.Mutex // tier 1
+
+	key  string
+	sink io.WriteCloser
+}
+
+// ApplyConfig opens, reopens, or closes the audit log file as necessary
+func (al *auditLog) ApplyConfig(conf *AuditLogConfig) error {
+	al.Lock()
+	defer al.Unlock()
+
+	key := conf.key()
+	if key == al.key {
+		return nil
+	}
+	var sink io.WriteCloser
+	if conf.Enabled {
+		file, err := conf.Rotate.open(conf.Filename)
+		if err != nil {
+			return fmt.Errorf("could not open audit log: %w", err)
+		}
+		sink = file
+	}
+	if al.sink != nil {
+		al.sink.Close()
+	}
+	al.key, al.sink = key, sink
+	return nil
+}
+
+func (al *auditLog) write(record *auditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	al.Lock()
+	defer al.Unlock()
+
+	if al.sink == nil {
+		return
+	}
+	if _, err := al.sink.Write(line); err != nil {
+		fmt.Fprintf(os.Stderr, "could not write to audit log: %v\n", err)
+	}
+}
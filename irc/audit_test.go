@@ -0,0 +1,69 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	conf := AuditLogConfig{Enabled: true, Filename: filepath.Join(t.TempDir(), "audit.jsonl")}
+	if err := conf.postprocess(); err != nil {
+		t.Fatal(err)
+	}
+	var al auditLog
+	if err := al.ApplyConfig(&conf); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &clientData{
+		id:       "1",
+		ip:       net.ParseIP("192.0.2.1"),
+		realIP:   net.ParseIP("127.0.0.1"),
+		listener: "/tmp/webircproxy_sock",
+		origin:   "https://example.com",
+	}
+	upstream := &reverseProxyUpstream{Name: "ircd1", Address: "192.0.2.100:6667"}
+	al.write(newAuditRecord(auditEventOpen, client, upstream))
+	record := newAuditRecord(auditEventClose, client, upstream)
+	record.setClose(time.Now().Add(-time.Minute), CloseClientEOF, errors.New("EOF"), 100, 2000)
+	al.write(record)
+
+	// disabling the audit log closes the file:
+	if err := al.ApplyConfig(&AuditLogConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	al.write(record)
+
+	file, err := os.Open(conf.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	assertEqual(len(records), 2)
+	assertEqual(records[0]["event"], "open")
+	assertEqual(records[0]["proxied_ip"], "192.0.2.1")
+	assertEqual(records[0]["real_ip"], "127.0.0.1")
+	assertEqual(records[0]["bytes_in"], nil)
+	assertEqual(records[1]["event"], "close")
+	assertEqual(records[1]["close_reason"], "client_eof")
+	assertEqual(records[1]["bytes_out"], float64(2000))
+	assertEqual(records[1]["upstream"], "ircd1")
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ergochat/ergo/irc/utils"
+)
+
+// Bandwidth quotas: the bytes each client IP sends to the upstreams (summed
+// over all its connections) are counted over a sliding window, approximated
+// as usual by weighting the count of the previous fixed window by how much of
+// it still overlaps the sliding one. Clients over the quota are either slowed
+// down (their messages are delayed until they're within it again) or
+// disconnected.
+
+const (
+	bandwidthActionThrottle   = "throttle"
+	bandwidthActionDisconnect = "disconnect"
+
+	// the longest a throttled client waits before its delay is recomputed
+	// (the estimate is rough, and other connections from its IP may close):
+	maxBandwidthDelay = 10 * time.Second
+)
+
+// BandwidthQuotaConfig configures per-IP bandwidth quotas.
+type BandwidthQuotaConfig struct {
+	Enabled bool
+	// bytes per window:
+	Limit  int64
+	Window time.Duration
+	// throttle or disconnect:
+	Action     string
+	Exempted   []string
+	exemptNets []net.IPNet
+}
+
+func (conf *BandwidthQuotaConfig) postprocess() (err error) {
+	if !conf.Enabled {
+		return nil
+	}
+	if conf.Limit <= 0 {
+		return fmt.Errorf("bandwidth-quotas requires a positive limit")
+	}
+	if conf.Window <= 0 {
+		conf.Window = time.Minute
+	}
+	switch conf.Action {
+	case "":
+		conf.Action = bandwidthActionThrottle
+	case bandwidthActionThrottle, bandwidthActionDisconnect:
+	default:
+		return fmt.Errorf("invalid bandwidth-quotas action %s (expected throttle or disconnect)", conf.Action)
+	}
+	conf.exemptNets, err = utils.ParseNetList(conf.Exempted)
+	if err != nil {
+		return fmt.Errorf("Could not parse bandwidth-quotas exempted nets: %v", err.Error())
+	}
+	return nil
+}
+
+// BandwidthInfo describes the recent usage of a client IP.
+type BandwidthInfo struct {
+	IP string `json:"ip"`
+	// bytes sent to the upstreams within the sliding window:
+	Bytes int64 `json:"bytes"`
+}
+
+type bandwidthEntry struct {
+	windowStart time.Time
+	window      time.Duration
+	current     int64
+	previous    int64
+}
+
+// usage returns the approximate bytes within the sliding window ending now
+func (entry *bandwidthEntry) usage(now time.Time) int64 {
+	entry.advance(now)
+	overlap := 1 - float64(now.Sub(entry.windowStart))/float64(entry.window)
+	return entry.current + int64(float64(entry.previous)*overlap)
+}
+
+// advance moves the fixed windows forward to contain now
+func (entry *bandwidthEntry) advance(now time.Time) {
+	elapsed := now.Sub(entry.windowStart)
+	if elapsed < entry.window {
+		return
+	}
+	if elapsed < 2*entry.window {
+		entry.previous = entry.current
+		entry.windowStart = entry.windowStart.Add(entry.window)
+	} else {
+		entry.previous = 0
+		entry.windowStart = now
+	}
+	entry.current = 0
+}
+
+// bandwidthAccountant tracks the bytes sent by each client IP
+type bandwidthAccountant struct {
+	sync.Mutex // tier 1
+
+	entries   map[string]*bandwidthEntry
+	lastPrune time.Time
+}
+
+// add records bytes sent by the IP, returning how long it must wait to be
+// within the quota (0 if it is within it)
+func (ba *bandwidthAccountant) add(ip net.IP, bytes int64, config *BandwidthQuotaConfig) (delay time.Duration) {
+	if !config.Enabled || utils.IPInNets(ip, config.exemptNets) {
+		return 0
+	}
+
+	ba.Lock()
+	defer ba.Unlock()
+
+	now := time.Now()
+	if ba.entries == nil {
+		ba.entries = make(map[string]*bandwidthEntry)
+	}
+	ba.prune(now)
+
+	key := ip.To16().String()
+	entry := ba.entries[key]
+	if entry == nil || entry.window != config.Window {
+		entry = &bandwidthEntry{windowStart: now, window: config.Window}
+		ba.entries[key] = entry
+	}
+	entry.advance(now)
+	entry.current += bytes
+	excess := entry.usage(now) - config.Limit
+	if excess <= 0 {
+		return 0
+	}
+	// the sliding window drains at about limit bytes per window:
+	return time.Duration(float64(config.Window) * float64(excess) / float64(config.Limit))
+}
+
+// requires ba.Lock
+func (ba *bandwidthAccountant) prune(now time.Time) {
+	if now.Sub(ba.lastPrune) < time.Minute {
+		return
+	}
+	ba.lastPrune = now
+	for key, entry := range ba.entries {
+		if now.Sub(entry.windowStart) >= 2*entry.window {
+			delete(ba.entries, key)
+		}
+	}
+}
+
+// list returns the usage of each IP, highest first
+func (ba *bandwidthAccountant) list() (result []BandwidthInfo) {
+	ba.Lock()
+	defer ba.Unlock()
+
+	now := time.Now()
+	for key, entry := range ba.entries {
+		if usage := entry.usage(now); usage > 0 {
+			result = append(result, BandwidthInfo{IP: key, Bytes: usage})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Bytes != result[j].Bytes {
+			return result[i].Bytes > result[j].Bytes
+		}
+		return result[i].IP < result[j].IP
+	})
+	return
+}
+
+// ListBandwidth returns the recent usage of the client IPs subject to
+// bandwidth quotas, highest first.
+func (server *Server) ListBandwidth() []BandwidthInfo {
+	return server.bandwidth.list()
+}
+
+// applyBandwidthQuota accounts for a line sent by the client, then either
+// delays it until the client is within its quota, or reports that the client
+// must be disconnected
+func (r *ReverseProxyConn) applyBandwidthQuota(bytes int) (disconnect bool) {
+	delay := r.server.bandwidth.add(r.client.ip, int64(bytes), r.bandwidthQuota)
+	if delay == 0 {
+		return false
+	}
+	if r.bandwidthQuota.Action == bandwidthActionDisconnect {
+		return true
+	}
+	if !r.throttled {
+		r.throttled = true
+		r.log(LogLevelInfo, "throttling client over its bandwidth quota")
+	}
+	for delay > 0 {
+		if delay > maxBandwidthDelay {
+			delay = maxBandwidthDelay
+		}
+		time.Sleep(delay)
+		delay = r.server.bandwidth.add(r.client.ip, 0, r.bandwidthQuota)
+	}
+	return false
+}
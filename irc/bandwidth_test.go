@@ -0,0 +1,42 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBandwidthEntry(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	entry := bandwidthEntry{windowStart: start, window: time.Minute}
+	entry.current = 1000
+	assertEqual(entry.usage(start.Add(30*time.Second)), int64(1000))
+	// half of the previous window still overlaps the sliding one:
+	assertEqual(entry.usage(start.Add(90*time.Second)), int64(500))
+	entry.current += 100
+	assertEqual(entry.usage(start.Add(105*time.Second)), int64(350))
+	assertEqual(entry.usage(start.Add(5*time.Minute)), int64(0))
+}
+
+func TestBandwidthAccountant(t *testing.T) {
+	config := BandwidthQuotaConfig{Enabled: true, Limit: 1000, Exempted: []string{"192.0.2.0/24"}}
+	if err := config.postprocess(); err != nil {
+		t.Fatal(err)
+	}
+	var ba bandwidthAccountant
+	ip := net.ParseIP("198.51.100.1")
+	assertEqual(ba.add(ip, 600, &config), time.Duration(0))
+	assertEqual(ba.add(ip, 400, &config), time.Duration(0))
+	delay := ba.add(ip, 500, &config)
+	if delay < 29*time.Second || delay > 30*time.Second {
+		t.Errorf("unexpected delay %v", delay)
+	}
+	assertEqual(ba.add(net.ParseIP("192.0.2.1"), 5000, &config), time.Duration(0))
+	assertEqual(ba.list(), []BandwidthInfo{{IP: "198.51.100.1", Bytes: 1500}})
+
+	config.Action = "drop"
+	assertEqual(config.postprocess() == nil, false)
+}
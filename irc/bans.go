@@ -0,0 +1,288 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ergochat/ergo/irc/utils"
+)
+
+// failureReason classifies a misbehavior that counts towards an automatic ban
+type failureReason uint
+
+const (
+	failureOriginRejected failureReason = iota
+	failureReadLimit
+	failureRateLimited
+	failureHeaderRule
+	failureReputation
+	failureBandwidthQuota
+	failureHookRejected
+	failureUpstreamAuth
+	failureExcessFlood
+)
+
+func (reason failureReason) String() string {
+	switch reason {
+	case failureOriginRejected:
+		return "origin rejected"
+	case failureReadLimit:
+		return "read limit exceeded"
+	case failureRateLimited:
+		return "rate limited"
+	case failureHeaderRule:
+		return "rejected by header rule"
+	case failureReputation:
+		return "rejected by reputation service"
+	case failureBandwidthQuota:
+		return "bandwidth quota exceeded"
+	case failureHookRejected:
+		return "rejected by OnConnect hook"
+	case failureUpstreamAuth:
+		return "upstream authentication failed"
+	case failureExcessFlood:
+		return "disconnected by upstream for flooding"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	numericPasswdMismatch = []byte("464 ")
+	numericSASLFail       = []byte("904 ")
+	excessFlood           = []byte("excess flood")
+)
+
+// upstreamFailure classifies a line from the upstream that shows the client
+// misbehaving: a failed PASS (464 ERR_PASSWDMISMATCH) or SASL authentication
+// (904 ERR_SASLFAIL), or a disconnection for flooding
+func upstreamFailure(line []byte) (reason failureReason, ok bool) {
+	command := skipSource(line)
+	switch {
+	case bytes.HasPrefix(command, numericPasswdMismatch), bytes.HasPrefix(command, numericSASLFail):
+		return failureUpstreamAuth, true
+	case bytes.HasPrefix(command, errorCommand) && bytes.Contains(bytes.ToLower(command), excessFlood):
+		return failureExcessFlood, true
+	}
+	return 0, false
+}
+
+// AutoBanConfig controls fail2ban-style temporary bans of misbehaving IPs
+type AutoBanConfig struct {
+	Enabled     bool
+	MaxFailures int           `yaml:"max-failures"`
+	Window      time.Duration `yaml:"window"`
+	Duration    time.Duration `yaml:"duration"`
+	MaxDuration time.Duration `yaml:"max-duration"`
+	Exempted    []string
+	exemptNets  []net.IPNet
+}
+
+func (conf *AutoBanConfig) postprocess() (err error) {
+	if !conf.Enabled {
+		return nil
+	}
+	if conf.MaxFailures <= 0 {
+		conf.MaxFailures = 10
+	}
+	if conf.Window == 0 {
+		conf.Window = time.Minute
+	}
+	if conf.Duration == 0 {
+		conf.Duration = 10 * time.Minute
+	}
+	if conf.MaxDuration < conf.Duration {
+		conf.MaxDuration = conf.Duration
+	}
+	conf.exemptNets, err = utils.ParseNetList(conf.Exempted)
+	if err != nil {
+		return fmt.Errorf("Could not parse auto-ban exempted nets: %v", err.Error())
+	}
+	return nil
+}
+
+// BanInfo describes an active automatic ban.
+type BanInfo struct {
+	IP      string    `json:"ip"`
+	Expires time.Time `json:"expires"`
+	// how many times this IP has been banned; each ban is twice as long
+	// as the previous one, up to max-duration:
+	Count int `json:"count"`
+}
+
+type banEntry struct {
+	failures    int
+	windowStart time.Time
+	banCount    int
+	bannedUntil time.Time
+}
+
+type banManager struct {
+	sync.Mutex // tier 1
+
+	config    AutoBanConfig
+	entries   map[string]*banEntry
+	lastPrune time.Time
+}
+
+func (bm *banManager) ApplyConfig(config *AutoBanConfig) {
+	bm.Lock()
+	defer bm.Unlock()
+
+	bm.config = *config
+	if !bm.config.Enabled {
+		bm.entries = nil
+	} else if bm.entries == nil {
+		bm.entries = make(map[string]*banEntry)
+	}
+}
+
+func banKey(ip net.IP) string {
+	return ip.To16().String()
+}
+
+// IsBanned returns whether the IP is currently banned, and if so, until when.
+func (bm *banManager) IsBanned(ip net.IP) (banned bool, expires time.Time) {
+	bm.Lock()
+	defer bm.Unlock()
+
+	if !bm.config.Enabled {
+		return
+	}
+	entry, ok := bm.entries[banKey(ip)]
+	if ok && time.Now().Before(entry.bannedUntil) {
+		return true, entry.bannedUntil
+	}
+	return
+}
+
+// RecordFailure counts a failure against an IP; if this pushes it over the
+// threshold, the IP is banned and the duration of the ban is returned.
+func (bm *banManager) RecordFailure(ip net.IP) (banned bool, duration time.Duration) {
+	bm.Lock()
+	defer bm.Unlock()
+
+	if !bm.config.Enabled || utils.IPInNets(ip, bm.config.exemptNets) {
+		return
+	}
+
+	now := time.Now()
+	bm.prune(now)
+
+	key := banKey(ip)
+	entry, ok := bm.entries[key]
+	if !ok {
+		entry = new(banEntry)
+		bm.entries[key] = entry
+	}
+	if now.Before(entry.bannedUntil) {
+		// already banned, nothing to do
+		return
+	}
+	if now.Sub(entry.windowStart) > bm.config.Window {
+		entry.windowStart = now
+		entry.failures = 0
+	}
+	entry.failures++
+	if entry.failures < bm.config.MaxFailures {
+		return
+	}
+
+	// exponential escalation: each repeat offense doubles the ban
+	duration = bm.config.Duration
+	for i := 0; i < entry.banCount && duration < bm.config.MaxDuration; i++ {
+		duration *= 2
+	}
+	if duration > bm.config.MaxDuration {
+		duration = bm.config.MaxDuration
+	}
+	entry.banCount++
+	entry.bannedUntil = now.Add(duration)
+	entry.failures = 0
+	return true, duration
+}
+
+// prune discards entries that are no longer relevant: the ban (if any) has expired,
+// the failure window has elapsed, and the IP has been clean for long enough
+// that its escalation history can be forgotten. requires bm.Lock
+func (bm *banManager) prune(now time.Time) {
+	if now.Sub(bm.lastPrune) < bm.config.Window {
+		return
+	}
+	bm.lastPrune = now
+	for key, entry := range bm.entries {
+		if now.Sub(entry.bannedUntil) > bm.config.MaxDuration && now.Sub(entry.windowStart) > bm.config.Window {
+			delete(bm.entries, key)
+		}
+	}
+}
+
+// List returns all active bans, soonest-expiring first.
+func (bm *banManager) List() (result []BanInfo) {
+	bm.Lock()
+	defer bm.Unlock()
+
+	now := time.Now()
+	for key, entry := range bm.entries {
+		if now.Before(entry.bannedUntil) {
+			result = append(result, BanInfo{IP: key, Expires: entry.bannedUntil, Count: entry.banCount})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Expires.Before(result[j].Expires) })
+	return
+}
+
+// Clear lifts the ban on an IP and forgets its history.
+func (bm *banManager) Clear(ip net.IP) (found bool) {
+	bm.Lock()
+	defer bm.Unlock()
+
+	key := banKey(ip)
+	_, found = bm.entries[key]
+	delete(bm.entries, key)
+	return
+}
+
+// ClearAll lifts all bans.
+func (bm *banManager) ClearAll() {
+	bm.Lock()
+	defer bm.Unlock()
+
+	if bm.entries != nil {
+		bm.entries = make(map[string]*banEntry)
+	}
+}
+
+// ListBans returns the currently active automatic bans.
+func (server *Server) ListBans() []BanInfo {
+	return server.bans.List()
+}
+
+// ClearBan lifts the automatic ban (if any) on the given IP.
+func (server *Server) ClearBan(ipStr string) (found bool, err error) {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return false, fmt.Errorf("invalid IP address: %s", ipStr)
+	}
+	return server.bans.Clear(ip), nil
+}
+
+// ClearAllBans lifts all automatic bans.
+func (server *Server) ClearAllBans() {
+	server.bans.ClearAll()
+}
+
+func (server *Server) recordFailure(ip net.IP, reason failureReason) {
+	if banned, duration := server.bans.RecordFailure(ip); banned {
+		server.Log(LogComponentListener, LogLevelWarn, "temporarily banning IP after repeated failures",
+			slog.String(logKeyRemoteIP, ip.String()), slog.Duration("duration", duration), slog.String("reason", reason.String()))
+	}
+}
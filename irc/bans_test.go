@@ -0,0 +1,192 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newTestBanManager(t *testing.T) *banManager {
+	config := AutoBanConfig{
+		Enabled:     true,
+		MaxFailures: 3,
+		Window:      time.Minute,
+		Duration:    time.Minute,
+		MaxDuration: 3 * time.Minute,
+		Exempted:    []string{"127.0.0.1/8"},
+	}
+	if err := config.postprocess(); err != nil {
+		t.Fatal(err)
+	}
+	bm := new(banManager)
+	bm.ApplyConfig(&config)
+	return bm
+}
+
+func TestAutoBan(t *testing.T) {
+	bm := newTestBanManager(t)
+	ip := net.ParseIP("203.0.113.5")
+
+	for i := 0; i < 2; i++ {
+		banned, _ := bm.RecordFailure(ip)
+		assertEqual(banned, false)
+	}
+	banned, _ := bm.IsBanned(ip)
+	assertEqual(banned, false)
+
+	banned, duration := bm.RecordFailure(ip)
+	assertEqual(banned, true)
+	assertEqual(duration, time.Minute)
+	banned, _ = bm.IsBanned(ip)
+	assertEqual(banned, true)
+	assertEqual(len(bm.List()), 1)
+	assertEqual(bm.List()[0].IP, "203.0.113.5")
+
+	other := net.ParseIP("203.0.113.6")
+	banned, _ = bm.IsBanned(other)
+	assertEqual(banned, false)
+
+	assertEqual(bm.Clear(ip), true)
+	banned, _ = bm.IsBanned(ip)
+	assertEqual(banned, false)
+	assertEqual(len(bm.List()), 0)
+}
+
+func TestAutoBanEscalation(t *testing.T) {
+	bm := newTestBanManager(t)
+	ip := net.ParseIP("2001:db8::1")
+
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute}
+	for _, exp := range expected {
+		var banned bool
+		var duration time.Duration
+		for i := 0; i < 3; i++ {
+			banned, duration = bm.RecordFailure(ip)
+		}
+		assertEqual(banned, true)
+		assertEqual(duration, exp)
+		// simulate expiration of the ban, while retaining the escalation history
+		bm.entries[banKey(ip)].bannedUntil = time.Now().Add(-time.Second)
+	}
+}
+
+func TestAutoBanExempt(t *testing.T) {
+	bm := newTestBanManager(t)
+	ip := net.ParseIP("127.0.0.1")
+	for i := 0; i < 10; i++ {
+		banned, _ := bm.RecordFailure(ip)
+		assertEqual(banned, false)
+	}
+}
+
+func TestUpstreamFailure(t *testing.T) {
+	classify := func(line string) string {
+		if reason, ok := upstreamFailure([]byte(line)); ok {
+			return reason.String()
+		}
+		return ""
+	}
+	assertEqual(classify(":irc.example.com 464 * :Password incorrect"), "upstream authentication failed")
+	assertEqual(classify(":irc.example.com 904 alice :SASL authentication failed"), "upstream authentication failed")
+	assertEqual(classify("ERROR :Closing Link: 192.0.2.1 (Excess Flood)"), "disconnected by upstream for flooding")
+	assertEqual(classify(":irc.example.com ERROR :excess flood"), "disconnected by upstream for flooding")
+	assertEqual(classify("ERROR :Closing Link: 192.0.2.1 (Quit: bye)"), "")
+	assertEqual(classify(":irc.example.com 900 alice alice!u@h alice :You are now logged in as alice"), "")
+	assertEqual(classify(":alice!u@h PRIVMSG bob :464 excess flood"), "")
+}
+
+// TestAutoBanFailures is an end-to-end test of the failures that count
+// towards an automatic ban, and of its escalation
+func TestAutoBanFailures(t *testing.T) {
+	mock := startMockIRCd(t, "")
+	listen := freeAddress(t)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithListener(listen),
+		WithUpstream(mock.Addr()),
+		WithYAML(`
+log-level: error
+lookup-hostnames: false
+auto-ban:
+    enabled: true
+    max-failures: 2
+    duration: 1m
+    max-duration: 10m
+    exempted: []
+`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.RunContext(ctx)
+
+	dial := func() (*websocket.Conn, error) {
+		conn, resp, err := websocket.DefaultDialer.Dial("ws://"+listen+"/webirc", http.Header{"Origin": []string{"https://example.com"}})
+		if err != nil {
+			if resp != nil {
+				assertEqual(resp.StatusCode, http.StatusForbidden)
+			}
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return conn, nil
+	}
+	// the upstream's response to each raw line counts as a failure:
+	for _, raw := range []string{":mock.ircd 464 alice :Password incorrect", "ERROR :Closing Link: (Excess Flood)"} {
+		conn, err := dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range []string{"NICK alice", "USER u 0 * :Alice", "MOCK RAW :" + raw} {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(message) == raw {
+				break
+			}
+		}
+		conn.Close()
+	}
+	_, err = dial()
+	assertEqual(err, websocket.ErrBadHandshake)
+	bans := server.ListBans()
+	assertEqual(len(bans), 1)
+	assertEqual(bans[0].Count, 1)
+
+	// after the ban expires, rejections by the OnConnect hook count too, and
+	// the next ban is twice as long:
+	server.bans.entries[banKey(net.ParseIP("127.0.0.1"))].bannedUntil = time.Now().Add(-time.Second)
+	server.SetHooks(&Hooks{
+		OnConnect: func(conn *ClientInfo) error {
+			return errors.New("go away")
+		},
+	})
+	for i := 0; i < 2; i++ {
+		_, err = dial()
+		assertEqual(err, websocket.ErrBadHandshake)
+	}
+	bans = server.ListBans()
+	assertEqual(len(bans), 1)
+	assertEqual(bans[0].Count, 2)
+	assertEqual(time.Until(bans[0].Expires) > time.Minute, true)
+}
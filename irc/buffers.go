@@ -0,0 +1,176 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Each connection reads from the upstream and from its websocket into
+// buffers that start at buffers.initial-size. The upstream read buffer
+// doubles whenever a line doesn't fit; the websocket read buffer grows
+// according to buffers.growth, either straight to the maximum message size
+// (which avoids copying, at the cost of memory for every client that ever
+// sent a long message) or by doubling. With buffers.shrink-after, a
+// background task releases the websocket read buffers of connections whose
+// clients have sent nothing for that long; the next message allocates a new
+// buffer at the initial size.
+
+const (
+	bufferGrowthMax    = "max"
+	bufferGrowthDouble = "double"
+
+	minInitialBufferSize = 512
+	minShrinkAfter       = time.Second
+	// how often the shrinker checks whether buffers.shrink-after was enabled:
+	shrinkerIdleInterval = time.Minute
+)
+
+type BuffersConfig struct {
+	InitialSize int `yaml:"initial-size"`
+	// "max" (the default) or "double":
+	Growth      string
+	ShrinkAfter time.Duration `yaml:"shrink-after"`
+	growDouble  bool
+}
+
+// postprocess validates the config; maxSize is the maximum size of a buffer
+func (conf *BuffersConfig) postprocess(maxSize int) error {
+	if conf.InitialSize == 0 {
+		conf.InitialSize = initialBufferSize
+	}
+	if conf.InitialSize < minInitialBufferSize || maxSize < conf.InitialSize {
+		return fmt.Errorf("buffers initial-size must be between %d and %d", minInitialBufferSize, maxSize)
+	}
+	switch conf.Growth {
+	case "", bufferGrowthMax:
+		conf.growDouble = false
+	case bufferGrowthDouble:
+		conf.growDouble = true
+	default:
+		return fmt.Errorf("invalid buffers growth policy %#v (must be max or double)", conf.Growth)
+	}
+	if conf.ShrinkAfter != 0 && conf.ShrinkAfter < minShrinkAfter {
+		return fmt.Errorf("buffers shrink-after must be at least %v (with a unit), not %v", minShrinkAfter, conf.ShrinkAfter)
+	}
+	return nil
+}
+
+// wsReadBuffer is the buffer a websocket reader reads messages into; its
+// reader holds it locked except while waiting for the next message, so
+// the shrinker can only release it while it isn't in use
+type wsReadBuffer struct {
+	sync.Mutex // tier 2
+	buf        []byte
+	// when the last message was read into buf:
+	lastUsed    time.Time
+	initialSize int
+	maxSize     int
+	growDouble  bool
+}
+
+func newWSReadBuffer(conf *BuffersConfig, maxSize int) *wsReadBuffer {
+	return &wsReadBuffer{
+		initialSize: conf.InitialSize,
+		maxSize:     maxSize,
+		growDouble:  conf.growDouble,
+	}
+}
+
+// readFrom reads a message into the buffer, growing it as necessary; as with
+// io.ReadFull, a nil error means the buffer was filled to its maximum size
+// (so the message may not have been read in full)
+func (b *wsReadBuffer) readFrom(reader io.Reader) (n int, err error) {
+	b.lastUsed = time.Now()
+	if b.buf == nil {
+		b.buf = make([]byte, b.initialSize)
+	}
+	for {
+		var n2 int
+		n2, err = io.ReadFull(reader, b.buf[n:])
+		n += n2
+		if err != nil || len(b.buf) == b.maxSize {
+			return
+		}
+		newLen := b.maxSize
+		if b.growDouble {
+			newLen = min(2*len(b.buf), b.maxSize)
+		}
+		newBuf := make([]byte, newLen)
+		copy(newBuf, b.buf[:n])
+		b.buf = newBuf
+	}
+}
+
+// shrinkIfIdle releases the buffer if it isn't in use, and no message was
+// read into it since the cutoff
+func (b *wsReadBuffer) shrinkIfIdle(cutoff time.Time) (released bool) {
+	if !b.TryLock() {
+		return false
+	}
+	defer b.Unlock()
+	if b.buf == nil || cutoff.Before(b.lastUsed) {
+		return false
+	}
+	b.buf = nil
+	return true
+}
+
+func (r *ReverseProxyConn) addWSBuffer(b *wsReadBuffer) {
+	r.wsMutex.Lock()
+	defer r.wsMutex.Unlock()
+	r.wsBuffers = append(r.wsBuffers, b)
+}
+
+func (r *ReverseProxyConn) removeWSBuffer(b *wsReadBuffer) {
+	r.wsMutex.Lock()
+	defer r.wsMutex.Unlock()
+	// copy, rather than modifying the slice the shrinker may be reading:
+	buffers := make([]*wsReadBuffer, 0, len(r.wsBuffers))
+	for _, buffer := range r.wsBuffers {
+		if buffer != b {
+			buffers = append(buffers, buffer)
+		}
+	}
+	r.wsBuffers = buffers
+}
+
+// shrinkIdleBuffers releases the websocket read buffers that weren't used
+// since the cutoff, returning how many were released
+func (server *Server) shrinkIdleBuffers(cutoff time.Time) (released int) {
+	for _, conn := range server.conns.all() {
+		conn.wsMutex.Lock()
+		buffers := conn.wsBuffers
+		conn.wsMutex.Unlock()
+		for _, b := range buffers {
+			if b.shrinkIfIdle(cutoff) {
+				released++
+			}
+		}
+	}
+	return
+}
+
+// runBufferShrinker releases idle websocket read buffers, while
+// buffers.shrink-after is set
+func (server *Server) runBufferShrinker() {
+	defer server.HandlePanic()
+
+	for {
+		interval := shrinkerIdleInterval
+		shrinkAfter := server.Config().Buffers.ShrinkAfter
+		if shrinkAfter != 0 {
+			interval = min(shrinkAfter/2, shrinkerIdleInterval)
+		}
+		if !server.sleep(interval) {
+			return
+		}
+		if shrinkAfter = server.Config().Buffers.ShrinkAfter; shrinkAfter != 0 {
+			server.shrinkIdleBuffers(time.Now().Add(-shrinkAfter))
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWSReadBufferGrowth(t *testing.T) {
+	message := strings.Repeat("a", 3000)
+
+	b := newWSReadBuffer(&BuffersConfig{InitialSize: 1024}, 8192)
+	n, err := b.readFrom(strings.NewReader(message))
+	assertEqual(err, io.ErrUnexpectedEOF)
+	assertEqual(string(b.buf[:n]), message)
+	assertEqual(len(b.buf), 8192)
+
+	b = newWSReadBuffer(&BuffersConfig{InitialSize: 1024, growDouble: true}, 8192)
+	n, err = b.readFrom(strings.NewReader(message))
+	assertEqual(err, io.ErrUnexpectedEOF)
+	assertEqual(string(b.buf[:n]), message)
+	assertEqual(len(b.buf), 4096)
+
+	// a message longer than the maximum fills the buffer, without an error:
+	n, err = b.readFrom(bytes.NewReader(make([]byte, 10000)))
+	assertEqual(err, nil)
+	assertEqual(n, 8192)
+}
+
+func TestWSReadBufferShrink(t *testing.T) {
+	b := newWSReadBuffer(&BuffersConfig{InitialSize: 1024}, 8192)
+	b.readFrom(strings.NewReader("PING x"))
+	// used since the cutoff:
+	assertEqual(b.shrinkIfIdle(time.Now().Add(-time.Minute)), false)
+	// in use:
+	b.Lock()
+	assertEqual(b.shrinkIfIdle(time.Now()), false)
+	b.Unlock()
+	assertEqual(b.shrinkIfIdle(time.Now()), true)
+	assertEqual(b.buf == nil, true)
+	// released buffers are reallocated at the initial size:
+	n, err := b.readFrom(strings.NewReader("PING y"))
+	assertEqual(err, io.ErrUnexpectedEOF)
+	assertEqual(string(b.buf[:n]), "PING y")
+	assertEqual(len(b.buf), 1024)
+}
+
+func TestBuffersValidation(t *testing.T) {
+	config, err := NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667"), WithYAML("buffers:\n    growth: double\n    shrink-after: 10m"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(config.Buffers.InitialSize, initialBufferSize)
+	assertEqual(config.Buffers.growDouble, true)
+	for _, yaml := range []string{
+		"buffers:\n    initial-size: 100",
+		"buffers:\n    initial-size: 100000",
+		"buffers:\n    growth: triple",
+		"buffers:\n    shrink-after: 10",
+	} {
+		_, err = NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667"), WithYAML(yaml))
+		assertEqual(err != nil, true)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"hash"
+	"net"
+	"strings"
+
+	"github.com/ergochat/ergo/irc/utils"
+)
+
+var (
+	b32encoder = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+)
+
+// IPCloakConfig controls sending a deterministic cloak of the client IP in WEBIRC,
+// instead of the real IP and hostname. This works like Ergo's ip-cloaking:
+// the same (masked) IP always produces the same cloak, so bans remain effective
+// upstream, but the cloak cannot be reversed without knowledge of the secret.
+// Each upstream can have its own salt, so that a client's cloaks on different
+// networks can't be correlated.
+//
+// By default, the synthetic IP sent in WEBIRC is derived from the cloak within
+// ip-network. With format-preserving, it is instead a prefix-preserving
+// permutation of the (masked) IP, as in Crypto-PAn: IPv4 addresses map to IPv4
+// addresses, and IPs sharing a prefix map to IPs sharing a prefix of the same
+// length, so that the upstream's CIDR bans and limits still correspond to real
+// networks. The real IP then appears only in the audit log (as real_ip,
+// alongside the sent_ip).
+type IPCloakConfig struct {
+	Enabled     bool
+	Netname     string
+	Secret      string
+	CidrLenIPv4 int `yaml:"cidr-len-ipv4"`
+	CidrLenIPv6 int `yaml:"cidr-len-ipv6"`
+	NumBits     int `yaml:"num-bits"`
+	// the IP sent in WEBIRC is synthesized from this network:
+	IPNetwork string `yaml:"ip-network"`
+	// instead, permute the IP, preserving its family and prefixes:
+	FormatPreserving bool `yaml:"format-preserving"`
+
+	ipv4Mask  net.IPMask
+	ipv6Mask  net.IPMask
+	ipNetwork net.IPNet
+}
+
+func (conf *IPCloakConfig) postprocess() (err error) {
+	if !conf.Enabled {
+		return nil
+	}
+	if conf.Secret == "" {
+		return fmt.Errorf("ip-cloaking requires a secret")
+	}
+	if conf.Netname == "" {
+		conf.Netname = "irc"
+	}
+	if !utils.IsHostname(conf.Netname) {
+		return fmt.Errorf("ip-cloaking netname must be a valid hostname: %s", conf.Netname)
+	}
+	if conf.CidrLenIPv4 == 0 {
+		conf.CidrLenIPv4 = 32
+	}
+	if conf.CidrLenIPv6 == 0 {
+		conf.CidrLenIPv6 = 64
+	}
+	if conf.CidrLenIPv4 > 32 || conf.CidrLenIPv6 > 128 || conf.CidrLenIPv4 < 0 || conf.CidrLenIPv6 < 0 {
+		return fmt.Errorf("invalid ip-cloaking cidr length")
+	}
+	conf.ipv4Mask = net.CIDRMask(conf.CidrLenIPv4, 32)
+	conf.ipv6Mask = net.CIDRMask(conf.CidrLenIPv6, 128)
+	if conf.NumBits == 0 {
+		conf.NumBits = 64
+	}
+	if conf.NumBits < 0 || conf.NumBits > 256 {
+		return fmt.Errorf("invalid ip-cloaking num-bits: %d", conf.NumBits)
+	}
+	if conf.IPNetwork == "" {
+		conf.IPNetwork = "fd00::/8"
+	}
+	conf.ipNetwork, err = utils.NormalizedNetFromString(conf.IPNetwork)
+	if err != nil {
+		return fmt.Errorf("invalid ip-cloaking ip-network: %v", err)
+	}
+	if conf.ipNetwork.IP.To4() != nil {
+		return fmt.Errorf("ip-cloaking ip-network must be an IPv6 network")
+	}
+	return nil
+}
+
+// mask returns the masked IP, in its 4-byte form if it is IPv4
+func (conf *IPCloakConfig) mask(ip net.IP) net.IP {
+	if v4ip := ip.To4(); v4ip != nil {
+		return v4ip.Mask(conf.ipv4Mask)
+	}
+	return ip.Mask(conf.ipv6Mask)
+}
+
+// newMAC returns HMAC-SHA256 keyed with the secret, followed by the salt (if any)
+func (conf *IPCloakConfig) newMAC(salt string) hash.Hash {
+	key := conf.Secret
+	if salt != "" {
+		key = conf.Secret + "\x00" + salt
+	}
+	return hmac.New(sha256.New, []byte(key))
+}
+
+// digest computes HMAC-SHA256(secret, masked IP)
+func (conf *IPCloakConfig) digest(ip net.IP, salt string) []byte {
+	mac := conf.newMAC(salt)
+	mac.Write(conf.mask(ip))
+	return mac.Sum(nil)
+}
+
+// ComputeCloak returns the cloaked hostname and synthetic IP for a client IP.
+func (conf *IPCloakConfig) ComputeCloak(ip net.IP) (hostname string, cloakedIP net.IP) {
+	return conf.ComputeSaltedCloak(ip, "")
+}
+
+// ComputeSaltedCloak returns the cloaked hostname and synthetic IP for a
+// client IP, with the salt of an upstream.
+func (conf *IPCloakConfig) ComputeSaltedCloak(ip net.IP, salt string) (hostname string, cloakedIP net.IP) {
+	digest := conf.digest(ip, salt)
+
+	// truncate to the first n bits, rounding up to a whole base32 character
+	b32digest := b32encoder.EncodeToString(digest)
+	numChars := (conf.NumBits + 4) / 5
+	if numChars > len(b32digest) {
+		numChars = len(b32digest)
+	}
+	if numChars == 0 {
+		hostname = conf.Netname
+	} else {
+		hostname = fmt.Sprintf("%s.%s", b32digest[:numChars], conf.Netname)
+	}
+
+	if conf.FormatPreserving {
+		return strings.ToLower(hostname), conf.permute(conf.mask(ip), salt)
+	}
+	// fill in the host bits of the configured network with the digest:
+	cloakedIP = make(net.IP, net.IPv6len)
+	for i := range cloakedIP {
+		cloakedIP[i] = (conf.ipNetwork.IP[i] & conf.ipNetwork.Mask[i]) | (digest[i] &^ conf.ipNetwork.Mask[i])
+	}
+	return strings.ToLower(hostname), cloakedIP
+}
+
+// permute applies a keyed prefix-preserving permutation to the IP (4 or 16
+// bytes): each bit is flipped according to a pseudorandom function of the
+// bits preceding it
+func (conf *IPCloakConfig) permute(ip net.IP, salt string) net.IP {
+	mac := conf.newMAC(salt)
+	result := make(net.IP, len(ip))
+	prefix := make([]byte, len(ip))
+	var sum []byte
+	for i := 0; i < len(ip)*8; i++ {
+		byteIdx, bitMask := i/8, byte(0x80>>(i%8))
+		mac.Reset()
+		// the family and bit position, then the bits so far:
+		mac.Write([]byte{byte(len(ip)), byte(i)})
+		mac.Write(prefix[:byteIdx+1])
+		sum = mac.Sum(sum[:0])
+		bit := ip[byteIdx] & bitMask
+		if sum[0]&1 == 1 {
+			bit ^= bitMask
+		}
+		result[byteIdx] |= bit
+		prefix[byteIdx] |= ip[byteIdx] & bitMask
+	}
+	return result
+}
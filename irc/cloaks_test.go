@@ -0,0 +1,120 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"net"
+	"testing"
+)
+
+func getTestingCloakConfig(t *testing.T) *IPCloakConfig {
+	config := &IPCloakConfig{
+		Enabled: true,
+		Netname: "webchat",
+		Secret:  "NZ0Bx0vKL5cwnTJ4pM8q",
+	}
+	if err := config.postprocess(); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestComputeCloak(t *testing.T) {
+	config := getTestingCloakConfig(t)
+
+	hostname, ip := config.ComputeCloak(net.ParseIP("8.8.8.8"))
+	hostname2, ip2 := config.ComputeCloak(net.ParseIP("8.8.8.8"))
+	assertEqual(hostname, hostname2)
+	assertEqual(ip, ip2)
+	// 64 bits rounds up to 13 base32 characters:
+	assertEqual(len(hostname), len("k3ffqdmtptvni.webchat"))
+	if ip[0] != 0xfd || ip.To4() != nil {
+		t.Errorf("synthetic IP %s is outside the configured network", ip)
+	}
+
+	hostname3, ip3 := config.ComputeCloak(net.ParseIP("8.8.4.4"))
+	if hostname3 == hostname || ip3.Equal(ip) {
+		t.Errorf("distinct IPs produced the same cloak")
+	}
+}
+
+func TestCloakMasking(t *testing.T) {
+	config := getTestingCloakConfig(t)
+
+	// the default ipv6 cidr length is /64:
+	hostname, _ := config.ComputeCloak(net.ParseIP("2001:db8::1"))
+	hostname2, _ := config.ComputeCloak(net.ParseIP("2001:db8::2"))
+	assertEqual(hostname, hostname2)
+	hostname3, _ := config.ComputeCloak(net.ParseIP("2001:db8:0:1::1"))
+	if hostname3 == hostname {
+		t.Errorf("distinct /64s produced the same cloak")
+	}
+}
+
+func TestCloakRequiresSecret(t *testing.T) {
+	config := &IPCloakConfig{Enabled: true}
+	if err := config.postprocess(); err == nil {
+		t.Errorf("cloaking without a secret should be rejected")
+	}
+}
+
+func commonPrefixLen(a, b net.IP) (n int) {
+	for i := range a {
+		for bit := byte(0x80); bit != 0; bit >>= 1 {
+			if a[i]&bit != b[i]&bit {
+				return
+			}
+			n++
+		}
+	}
+	return
+}
+
+func TestFormatPreservingCloak(t *testing.T) {
+	config := getTestingCloakConfig(t)
+	config.FormatPreserving = true
+
+	_, ip := config.ComputeCloak(net.ParseIP("8.8.8.8"))
+	_, ip2 := config.ComputeCloak(net.ParseIP("8.8.4.4"))
+	_, ip3 := config.ComputeCloak(net.ParseIP("8.8.8.9"))
+	if ip.To4() == nil || ip2.To4() == nil {
+		t.Errorf("IPv4 addresses must be cloaked as IPv4 addresses")
+	}
+	if ip.Equal(net.ParseIP("8.8.8.8")) || ip.Equal(ip3) {
+		t.Errorf("IPs were not permuted")
+	}
+	// the cloaks share exactly as long a prefix as the real IPs:
+	assertEqual(commonPrefixLen(ip.To4(), ip2.To4()), 20)
+	assertEqual(commonPrefixLen(ip.To4(), ip3.To4()), 31)
+
+	_, ip6 := config.ComputeCloak(net.ParseIP("2001:db8::1"))
+	_, ip6b := config.ComputeCloak(net.ParseIP("2001:db8:0:1::1"))
+	if ip6.To4() != nil || len(ip6) != net.IPv6len {
+		t.Errorf("IPv6 addresses must be cloaked as IPv6 addresses")
+	}
+	assertEqual(commonPrefixLen(ip6, ip6b), 63)
+	// the host bits are masked before permutation:
+	_, ip6c := config.ComputeCloak(net.ParseIP("2001:db8::2"))
+	assertEqual(ip6, ip6c)
+}
+
+func TestSaltedCloak(t *testing.T) {
+	config := getTestingCloakConfig(t)
+
+	hostname, ip := config.ComputeCloak(net.ParseIP("8.8.8.8"))
+	hostname2, ip2 := config.ComputeSaltedCloak(net.ParseIP("8.8.8.8"), "")
+	assertEqual(hostname, hostname2)
+	assertEqual(ip, ip2)
+	hostname3, ip3 := config.ComputeSaltedCloak(net.ParseIP("8.8.8.8"), "network1")
+	if hostname3 == hostname || ip3.Equal(ip) {
+		t.Errorf("salted and unsalted cloaks should differ")
+	}
+
+	config.FormatPreserving = true
+	_, ip = config.ComputeSaltedCloak(net.ParseIP("8.8.8.8"), "network1")
+	_, ip2 = config.ComputeSaltedCloak(net.ParseIP("8.8.8.8"), "network2")
+	if ip.Equal(ip2) {
+		t.Errorf("cloaks for different upstreams should differ")
+	}
+}
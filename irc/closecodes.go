@@ -0,0 +1,108 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ergochat/irc-go/ircmsg"
+)
+
+// When the upstream disconnects a client, it usually sends an ERROR line
+// explaining why first. Web clients can read that line, but its text differs
+// between ircds, so we classify it and send it again as the code and reason of
+// the websocket close frame, which clients can use to decide whether (and how
+// soon) to reconnect. The codes are in the range reserved for applications.
+
+const (
+	// the upstream closed the connection for some other reason (e.g., QUIT):
+	closeCodeNormal = 1000
+	// the client is banned; it shouldn't reconnect automatically:
+	closeCodeBanned = 4001
+	// an operator disconnected the client:
+	closeCodeKilled = 4002
+	// the client connected too often; it should back off before reconnecting:
+	closeCodeThrottled = 4003
+	// the upstream is shutting down or restarting; reconnecting later may work:
+	closeCodeShuttingDown = 4004
+	// the gateway closed the connection at its maximum lifetime (see
+	// lifetime.go); the client should reconnect right away:
+	closeCodeReconnect = 4005
+	// the gateway closed the connection because the client was idle (see
+	// idletimeout.go); it shouldn't reconnect until its user returns:
+	closeCodeIdle = 4006
+
+	// a close frame's payload is at most 125 bytes, 2 of which are the code:
+	maxCloseReasonLen = 123
+)
+
+var (
+	errorCommand = []byte("ERROR ")
+
+	// lowercased substrings of the ERROR messages of common ircds, in the order
+	// they're checked (e.g., a ban message may mention the server's name):
+	closeCodePatterns = []struct {
+		code     int
+		name     string
+		patterns []string
+	}{
+		{closeCodeBanned, "banned", []string{"banned", "k-lined", "g-lined", "z-lined", "d-lined", "k-line", "g-line", "z-line", "d-line", "akill"}},
+		{closeCodeThrottled, "throttled", []string{"throttled", "too many connection", "reconnecting too fast", "too many clients", "too many host connections"}},
+		{closeCodeKilled, "killed", []string{"killed"}},
+		{closeCodeShuttingDown, "shutting down", []string{"shutting down", "restarting", "server shutdown", "server restart", "terminating"}},
+	}
+)
+
+// classifyUpstreamError returns the websocket close code and reason for an
+// ERROR line from the upstream, or ok=false if the line is not an ERROR
+func classifyUpstreamError(line []byte) (code int, reason string, ok bool) {
+	if !bytes.HasPrefix(skipSource(line), errorCommand) {
+		return 0, "", false
+	}
+	msg, err := ircmsg.ParseLine(string(line))
+	if err != nil || msg.Command != "ERROR" {
+		return 0, "", false
+	}
+	var text string
+	if len(msg.Params) != 0 {
+		// the reason must be valid UTF-8:
+		text = strings.ToValidUTF8(msg.Params[len(msg.Params)-1], "\uFFFD")
+	}
+
+	code, reason = closeCodeNormal, text
+	lowered := strings.ToLower(text)
+outer:
+	for _, class := range closeCodePatterns {
+		for _, pattern := range class.patterns {
+			if strings.Contains(lowered, pattern) {
+				code, reason = class.code, class.name+": "+text
+				break outer
+			}
+		}
+	}
+	return code, truncateUTF8(reason, maxCloseReasonLen), true
+}
+
+// skipSource returns the line without its source, if any
+func skipSource(line []byte) []byte {
+	if len(line) != 0 && line[0] == ':' {
+		if i := bytes.IndexByte(line, ' '); i != -1 {
+			return line[i+1:]
+		}
+	}
+	return line
+}
+
+// truncateUTF8 truncates s to at most maxLen bytes, without splitting a character
+func truncateUTF8(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
+	}
+	for maxLen > 0 && !utf8.RuneStart(s[maxLen]) {
+		maxLen--
+	}
+	return s[:maxLen]
+}
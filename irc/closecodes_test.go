@@ -0,0 +1,33 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClassifyUpstreamError(t *testing.T) {
+	classify := func(line string) [2]interface{} {
+		code, reason, ok := classifyUpstreamError([]byte(line))
+		if !ok {
+			return [2]interface{}{0, ""}
+		}
+		return [2]interface{}{code, reason}
+	}
+	assertEqual(classify("ERROR :Closing Link: 192.0.2.1 (Quit: bye)"), [2]interface{}{closeCodeNormal, "Closing Link: 192.0.2.1 (Quit: bye)"})
+	assertEqual(classify("ERROR :Closing Link: [192.0.2.1] (K-Lined: spam)"), [2]interface{}{closeCodeBanned, "banned: Closing Link: [192.0.2.1] (K-Lined: spam)"})
+	assertEqual(classify(":irc.example.com ERROR :You are banned from this server (spam)"), [2]interface{}{closeCodeBanned, "banned: You are banned from this server (spam)"})
+	assertEqual(classify("ERROR :Closing link: (alice@192.0.2.1) [Killed (oper (flooding))]"), [2]interface{}{closeCodeKilled, "killed: Closing link: (alice@192.0.2.1) [Killed (oper (flooding))]"})
+	assertEqual(classify("ERROR :Trying to reconnect too fast."), [2]interface{}{closeCodeNormal, "Trying to reconnect too fast."})
+	assertEqual(classify("ERROR :Throttled: Reconnecting too fast"), [2]interface{}{closeCodeThrottled, "throttled: Throttled: Reconnecting too fast"})
+	assertEqual(classify("ERROR :Server is shutting down"), [2]interface{}{closeCodeShuttingDown, "shutting down: Server is shutting down"})
+	assertEqual(classify(":irc.example.com NOTICE * :ERROR banned"), [2]interface{}{0, ""})
+	assertEqual(classify("PING :ERROR"), [2]interface{}{0, ""})
+
+	_, reason, _ := classifyUpstreamError([]byte("ERROR :" + strings.Repeat("é", 100)))
+	assertEqual(len(reason), 122)
+	_, reason, _ = classifyUpstreamError([]byte("ERROR :caf\xe9"))
+	assertEqual(reason, "caf�")
+}
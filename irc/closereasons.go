@@ -0,0 +1,85 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+// CloseReason classifies why a connection ended. It is recorded in the logs
+// (as close_reason), the audit log, connection events, DisconnectInfo, and
+// the webircproxy_disconnects_total metric.
+type CloseReason string
+
+const (
+	// the client closed its websocket (or it failed):
+	CloseClientEOF CloseReason = "client_eof"
+	// the upstream closed the connection (or it failed):
+	CloseUpstreamEOF CloseReason = "upstream_eof"
+	// the client sent a message longer than the read limit:
+	CloseReadLimit CloseReason = "read_limit"
+	// a write to the client or to the upstream timed out:
+	CloseWriteTimeout CloseReason = "write_timeout"
+	// a write to the client or to the upstream failed:
+	CloseClientWriteError   CloseReason = "client_write_error"
+	CloseUpstreamWriteError CloseReason = "upstream_write_error"
+	// the client sent nothing within registration-timeout:
+	CloseRegistrationTimeout CloseReason = "registration_timeout"
+	// the upstream sent nothing within upstream-response-timeout:
+	CloseResponseTimeout CloseReason = "upstream_response_timeout"
+	CloseBandwidthQuota  CloseReason = "bandwidth_quota"
+	// killed via the admin API (or Server.KillConnection):
+	CloseKilled CloseReason = "killed"
+	// killed because its upstream was drained or removed:
+	CloseDrained         CloseReason = "drained"
+	CloseUpstreamRemoved CloseReason = "upstream_removed"
+	CloseListenerRemoved CloseReason = "listener_removed"
+	// connection-lifetime was reached:
+	CloseLifetime CloseReason = "lifetime"
+	// the client sent nothing within idle-timeout:
+	CloseIdle CloseReason = "idle"
+	// the client didn't reattach within its reconnect-grace period:
+	CloseGraceExpired CloseReason = "grace_expired"
+	CloseShutdown     CloseReason = "shutdown"
+	// a proxy goroutine panicked:
+	ClosePanic CloseReason = "panic"
+
+	// the connection ended before it was proxied:
+	CloseUpgradeFailed      CloseReason = "upgrade_failed"
+	CloseNoUpstream         CloseReason = "no_upstream"
+	CloseUpstreamDialFailed CloseReason = "upstream_dial_failed"
+	// the websocket was handed to an existing connection:
+	CloseReattached  CloseReason = "reattached"
+	CloseMultiplexed CloseReason = "multiplexed"
+)
+
+var closeReasonDescriptions = map[CloseReason]string{
+	CloseClientEOF:           "error reading from websocket conn",
+	CloseUpstreamEOF:         "error reading from upstream conn",
+	CloseReadLimit:           "websocket conn exceeded the read limit",
+	CloseWriteTimeout:        "timed out writing to websocket or upstream conn",
+	CloseClientWriteError:    "error writing to websocket conn",
+	CloseUpstreamWriteError:  "error writing to upstream conn",
+	CloseRegistrationTimeout: "websocket conn sent no data within registration-timeout, disconnecting",
+	CloseResponseTimeout:     "upstream sent no data within upstream-response-timeout, disconnecting",
+	CloseBandwidthQuota:      "bandwidth quota exceeded, disconnecting",
+	CloseKilled:              "killed by admin",
+	CloseDrained:             "upstream drained",
+	CloseUpstreamRemoved:     "upstream removed",
+	CloseListenerRemoved:     "listener removed",
+	CloseLifetime:            "maximum connection lifetime reached",
+	CloseIdle:                "websocket conn sent no data within idle-timeout, disconnecting",
+	CloseGraceExpired:        "reconnect grace period expired",
+	CloseShutdown:            "server shutting down",
+	ClosePanic:               "proxy goroutine panicked",
+	CloseUpgradeFailed:       "websocket upgrade error",
+	CloseNoUpstream:          "no upstream available",
+	CloseUpstreamDialFailed:  "error connecting to upstream ircd",
+	CloseReattached:          "reattached to an existing session",
+	CloseMultiplexed:         "multiplexed onto the account's existing connection",
+}
+
+// Description returns a human-readable description of the reason.
+func (reason CloseReason) Description() string {
+	if description, ok := closeReasonDescriptions[reason]; ok {
+		return description
+	}
+	return string(reason)
+}
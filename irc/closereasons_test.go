@@ -0,0 +1,89 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCloseReasonDescription(t *testing.T) {
+	assertEqual(CloseKilled.Description(), "killed by admin")
+	// unknown reasons describe themselves:
+	assertEqual(CloseReason("mystery").Description(), "mystery")
+	for reason := range closeReasonDescriptions {
+		assertEqual(reason.Description() != string(reason), true)
+	}
+}
+
+func TestCloseReasons(t *testing.T) {
+	mock := startMockIRCd(t, "")
+	listen := freeAddress(t)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithListener(listen),
+		WithUpstream(mock.Addr()),
+		WithYAML("log-level: error\nlookup-hostnames: false"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := make(chan CloseReason, 1)
+	server.SetHooks(&Hooks{
+		OnDisconnect: func(conn *ClientInfo, info *DisconnectInfo) {
+			reasons <- info.Reason
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.RunContext(ctx)
+
+	connect := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws://"+listen+"/webirc", http.Header{"Origin": []string{"https://example.com"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for _, line := range []string{"NICK alice", "USER u 0 * :Alice"} {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	nextReason := func() CloseReason {
+		select {
+		case reason := <-reasons:
+			return reason
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection was not closed")
+			return ""
+		}
+	}
+
+	conn := connect()
+	conn.Close()
+	assertEqual(nextReason(), CloseClientEOF)
+
+	conn = connect()
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("MOCK DISCONNECT")); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(nextReason(), CloseUpstreamEOF)
+
+	assertEqual(server.metrics.disconnects.Get(string(CloseClientEOF)), uint64(1))
+	assertEqual(server.metrics.disconnects.Get(string(CloseUpstreamEOF)), uint64(1))
+}
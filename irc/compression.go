@@ -0,0 +1,147 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The admin API compresses its responses with gzip or deflate, if the request's
+// Accept-Encoding allows it, since connection listings and the event stream
+// can be large. Only text and JSON responses are compressed; compressed
+// streams are flushed along with the response, so server-sent events are
+// still delivered as they happen.
+
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+)
+
+// negotiateEncoding returns the preferred content coding that an
+// Accept-Encoding header allows, or "" for none
+func negotiateEncoding(acceptEncoding string) string {
+	qualities := make(map[string]float64)
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(item, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		quality := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if q, err := strconv.ParseFloat(value, 64); err == nil {
+				quality = q
+			}
+		}
+		qualities[coding] = quality
+	}
+	best, bestQuality := "", 0.0
+	// gzip is preferred, in case of a tie:
+	for _, coding := range []string{encodingGzip, encodingDeflate} {
+		quality, ok := qualities[coding]
+		if !ok {
+			quality, ok = qualities["*"]
+		}
+		if ok && quality > bestQuality {
+			best, bestQuality = coding, quality
+		}
+	}
+	return best
+}
+
+// compressibleContentType returns whether a response of the content type
+// is worth compressing
+func compressibleContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json"
+}
+
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressingWriter compresses a response, if its content type is compressible
+type compressingWriter struct {
+	http.ResponseWriter
+	encoding    string
+	compressor  flushWriteCloser
+	wroteHeader bool
+}
+
+func (cw *compressingWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	header := cw.Header()
+	if status != http.StatusNoContent && status != http.StatusNotModified &&
+		header.Get("Content-Encoding") == "" && compressibleContentType(header.Get("Content-Type")) {
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+		if cw.encoding == encodingGzip {
+			cw.compressor = gzip.NewWriter(cw.ResponseWriter)
+		} else {
+			cw.compressor = zlib.NewWriter(cw.ResponseWriter)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressingWriter) Write(data []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(data))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.compressor == nil {
+		return cw.ResponseWriter.Write(data)
+	}
+	return cw.compressor.Write(data)
+}
+
+// Flush flushes the compressed stream, then the response
+func (cw *compressingWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.compressor != nil {
+		cw.compressor.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap allows http.ResponseController to reach the underlying response
+func (cw *compressingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *compressingWriter) close() {
+	if cw.compressor != nil {
+		cw.compressor.Close()
+	}
+}
+
+// compressHandler wraps a handler, compressing its responses when the
+// client accepts it
+func compressHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressingWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+		handler.ServeHTTP(cw, r)
+	})
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	assertEqual(negotiateEncoding(""), "")
+	assertEqual(negotiateEncoding("gzip, deflate, br"), "gzip")
+	assertEqual(negotiateEncoding("deflate"), "deflate")
+	assertEqual(negotiateEncoding("gzip;q=0.5, deflate"), "deflate")
+	assertEqual(negotiateEncoding("gzip;q=0"), "")
+	assertEqual(negotiateEncoding("*"), "gzip")
+	assertEqual(negotiateEncoding("br, identity"), "")
+}
+
+func TestCompressHandler(t *testing.T) {
+	handler := compressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/binary" {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte{1, 2, 3})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"hello": "world"})
+	}))
+	get := func(path, acceptEncoding string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Result()
+	}
+	decode := func(body io.Reader) (value map[string]string) {
+		if err := json.NewDecoder(body).Decode(&value); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	resp := get("/", "gzip")
+	assertEqual(resp.Header.Get("Content-Encoding"), "gzip")
+	assertEqual(resp.Header.Get("Content-Type"), "application/json")
+	assertEqual(resp.Header.Get("Vary"), "Accept-Encoding")
+	gzipReader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(decode(gzipReader), map[string]string{"hello": "world"})
+
+	resp = get("/", "deflate")
+	assertEqual(resp.Header.Get("Content-Encoding"), "deflate")
+	zlibReader, err := zlib.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(decode(zlibReader), map[string]string{"hello": "world"})
+
+	resp = get("/", "")
+	assertEqual(resp.Header.Get("Content-Encoding"), "")
+	assertEqual(decode(resp.Body), map[string]string{"hello": "world"})
+
+	// only text and JSON are compressed:
+	resp = get("/binary", "gzip")
+	assertEqual(resp.Header.Get("Content-Encoding"), "")
+	body, _ := io.ReadAll(resp.Body)
+	assertEqual(body, []byte{1, 2, 3})
+}
+
+func TestCompressedEvents(t *testing.T) {
+	server := new(Server)
+	ts := httptest.NewServer(compressHandler(http.HandlerFunc(server.handleAdmin)))
+	defer ts.Close()
+
+	// the client requests gzip, and decompresses the stream transparently:
+	resp, err := http.Get(ts.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assertEqual(resp.Uncompressed, true)
+	assertEqual(resp.Header.Get("Content-Type"), "text/event-stream")
+	server.emitEvent(EventRateLimited, &clientData{id: "abc", ip: net.ParseIP("192.0.2.1")}, nil)
+
+	// the event arrives without waiting for the stream to end:
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(line, "event: rate_limited\n")
+}
@@ -6,10 +6,11 @@ package irc
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"os"
-	"regexp"
 	"strings"
 	"time"
 
@@ -26,6 +27,10 @@ const (
 	DefaultMaxLineLen = 512
 )
 
+var (
+	errUnsupportedEncoding = errors.New("encoding is not supported")
+)
+
 // here's how this works: exported (capitalized) members of the config structs
 // are defined in the YAML file and deserialized directly from there. They may
 // be postprocessed and overwritten by LoadConfig. Unexported (lowercase) members
@@ -47,18 +52,199 @@ type listenerConfigBlock struct {
 	Proxy           bool
 	Tor             bool
 	STSOnly         bool `yaml:"sts-only"`
+	// the TLS port that sts-only redirects to (default 443):
+	STSPort int `yaml:"sts-port"`
+	// overrides the top-level require-secure, if set:
+	RequireSecure *bool `yaml:"require-secure"`
+	// ask clients for a TLS certificate (for the certfp WEBIRC flag):
+	RequestClientCerts bool `yaml:"request-client-certs"`
+	// protocols to advertise via ALPN, in order of preference (by default,
+	// none are, and clients' ALPN offers are ignored):
+	ALPN []string `yaml:"alpn"`
+	// for IPv6 (and wildcard) addresses, accept only IPv6 connections,
+	// instead of IPv6 and IPv4 (dual-stack):
+	IPv6Only bool `yaml:"ipv6-only"`
+	// shed new requests beyond these limits (see overload.go):
+	Overload OverloadConfig
+	// more addresses to listen on, with the same configuration:
+	Addresses []string
+}
+
+// listenerConfig is the internal representation of a listener block;
+// the embedded utils.ListenerConfig is what gets passed to the ReloadableListener,
+// the remaining fields are consumed by WSListener
+type listenerConfig struct {
+	utils.ListenerConfig
+	RequireSecure bool
+	STSPort       int
+	IPv6Only      bool
+	Overload      OverloadConfig
+	// name of the profile the listener belongs to, if any:
+	profile string
 }
 
 type reverseProxyUpstream struct {
+	// optional name for referring to this upstream elsewhere in the config;
+	// defaults to the address:
+	Name string
+	// irc://host:port, ircs://host:port, or unix:/path (see parseUpstreamAddress);
+	// after postprocessing, the address to dial:
 	Address string
 	TLS     bool `yaml:"tls"`
-	Webirc  struct {
+	// the name to verify the upstream's certificate against, if it differs
+	// from the address's host (e.g., when dialing an internal IP):
+	TLSServerName string `yaml:"tls-server-name"`
+	// "tcp" or "unix", and the hostname for verifying the upstream's certificate:
+	network    string
+	serverName string
+	Webirc     struct {
 		Enabled      bool
 		Password     string
 		Cert         string
 		Key          string
 		certificates []tls.Certificate
+		// authenticate with the certificate alone, sending * as the password
+		// (see verifyWebircCerts):
+		CertOnly bool `yaml:"cert-only"`
+		// extended flags to send (see webircflags.go):
+		Flags []string
+		// for rotating the password without a synchronized restart: the
+		// previous password, which is sent until PasswordCutover:
+		PreviousPassword string    `yaml:"previous-password"`
+		PasswordCutover  time.Time `yaml:"password-cutover"`
+	}
+	// relative share of new connections (default 1):
+	Weight int
+	// begin the connection with a PROXY v2 header (see proxyv2.go):
+	SendProxy bool `yaml:"send-proxy"`
+	// for unix sockets, the user and group IDs the upstream must run as:
+	PeerUID *int `yaml:"peer-uid"`
+	PeerGID *int `yaml:"peer-gid"`
+	// socket buffer sizes in bytes (0 for the OS default):
+	ReadBuffer  int `yaml:"read-buffer"`
+	WriteBuffer int `yaml:"write-buffer"`
+	// with ip-cloaking, a salt making this upstream's cloaks distinct:
+	CloakSalt string `yaml:"cloak-salt"`
+	// connections to keep dialed ahead of time (see prewarm.go):
+	Prewarm upstreamPrewarmConfig
+	// values of the {region} and {bucket} address variables (see
+	// addresstemplates.go):
+	Regions   map[string]string
+	Buckets   int
+	templated bool
+}
+
+func (upstream *reverseProxyUpstream) postprocess() (err error) {
+	upstream.network, upstream.Address, upstream.TLS, err = parseUpstreamAddress(upstream.Address, upstream.TLS)
+	if err != nil {
+		return err
+	}
+	if upstream.TLSServerName != "" {
+		upstream.serverName = upstream.TLSServerName
+	} else if upstream.network == "tcp" {
+		upstream.serverName, _, _ = net.SplitHostPort(upstream.Address)
+	}
+	if upstream.Name == "" {
+		upstream.Name = upstream.Address
+	}
+	if upstream.Weight < 0 {
+		return fmt.Errorf("upstream %s has a negative weight", upstream.Name)
+	} else if upstream.Weight == 0 {
+		upstream.Weight = 1
+	}
+	if err := upstream.postprocessSocketOptions(); err != nil {
+		return err
+	}
+	if err := upstream.Prewarm.postprocess(); err != nil {
+		return fmt.Errorf("upstream %s: %w", upstream.Name, err)
+	}
+	if err := upstream.postprocessTemplate(); err != nil {
+		return err
+	}
+	if upstream.Prewarm.Connections != 0 && upstream.SendProxy {
+		// the PROXY header, which carries the client's IP, comes first:
+		return fmt.Errorf("upstream %s: prewarm cannot be used with send-proxy", upstream.Name)
+	}
+	if upstream.Webirc.Enabled {
+		if upstream.Webirc.CertOnly {
+			if upstream.Webirc.Cert == "" || !upstream.TLS {
+				return fmt.Errorf("upstream %s: webirc cert-only requires TLS and a cert", upstream.Name)
+			}
+			if upstream.Webirc.Password != "" || upstream.Webirc.PreviousPassword != "" {
+				return fmt.Errorf("upstream %s: webirc cert-only upstreams cannot have a password", upstream.Name)
+			}
+		}
+		if upstream.Webirc.Password == "" {
+			upstream.Webirc.Password = "*"
+		}
+		if upstream.Webirc.PreviousPassword != "" && upstream.Webirc.PasswordCutover.IsZero() {
+			return fmt.Errorf("upstream %s: webirc previous-password requires password-cutover", upstream.Name)
+		}
+		if upstream.Webirc.Cert != "" {
+			cert, err := loadKeyPair(upstream.Webirc.Cert, upstream.Webirc.Key)
+			if err != nil {
+				return err
+			}
+			upstream.Webirc.certificates = []tls.Certificate{cert}
+		}
+		for _, flag := range upstream.Webirc.Flags {
+			if !webircFlagNames[flag] {
+				return fmt.Errorf("upstream %s: unknown webirc flag %s", upstream.Name, flag)
+			}
+		}
 	}
+	return nil
+}
+
+// webircPassword returns the WEBIRC password to send at the given time
+func (upstream *reverseProxyUpstream) webircPassword(now time.Time) string {
+	if upstream.Webirc.PreviousPassword != "" && now.Before(upstream.Webirc.PasswordCutover) {
+		return upstream.Webirc.PreviousPassword
+	}
+	return upstream.Webirc.Password
+}
+
+// parseUpstreamAddress parses an upstream address, returning the network and
+// address to dial and whether to use TLS. The address is either a URL
+// (irc://host:port, ircs://host:port, or unix:/path), or, for compatibility,
+// a bare host:port (using TLS if tlsSetting is set) or an absolute path.
+func parseUpstreamAddress(address string, tlsSetting bool) (network, dialAddr string, useTLS bool, err error) {
+	scheme, rest, hasScheme := strings.Cut(address, ":")
+	switch {
+	case hasScheme && scheme == "unix":
+		network, dialAddr, useTLS = "unix", rest, tlsSetting
+	case hasScheme && (scheme == "irc" || scheme == "ircs") && strings.HasPrefix(rest, "//"):
+		if scheme == "irc" && tlsSetting {
+			return "", "", false, fmt.Errorf("upstream %s: irc:// addresses cannot have tls; use ircs://", address)
+		}
+		useTLS = scheme == "ircs"
+		defaultPort := "6667"
+		if useTLS {
+			defaultPort = "6697"
+		}
+		hostport := strings.TrimSuffix(strings.TrimPrefix(rest, "//"), "/")
+		if strings.ContainsAny(hostport, "/?#@") {
+			return "", "", false, fmt.Errorf("upstream %s: the address must be of the form %s://host:port", address, scheme)
+		}
+		if _, _, splitErr := net.SplitHostPort(hostport); splitErr != nil {
+			hostport = net.JoinHostPort(strings.Trim(hostport, "[]"), defaultPort)
+		}
+		network, dialAddr = "tcp", hostport
+	case strings.HasPrefix(address, "/"):
+		network, dialAddr, useTLS = "unix", address, tlsSetting
+	default:
+		if _, _, splitErr := net.SplitHostPort(address); splitErr != nil {
+			return "", "", false, fmt.Errorf("upstream %s: invalid address (expected irc://host:port, ircs://host:port, or unix:/path): %w", address, splitErr)
+		}
+		network, dialAddr, useTLS = "tcp", address, tlsSetting
+	}
+	if network == "unix" && !strings.HasPrefix(dialAddr, "/") {
+		return "", "", false, fmt.Errorf("upstream %s: unix socket paths must be absolute", address)
+	}
+	if dialAddr == "" || strings.HasPrefix(dialAddr, ":") {
+		return "", "", false, fmt.Errorf("upstream %s: no host given", address)
+	}
+	return
 }
 
 // Config defines the overall configuration.
@@ -67,40 +253,180 @@ type Config struct {
 	UnixBindMode os.FileMode `yaml:"unix-bind-mode"`
 
 	// they get parsed into this internal representation:
-	trueListeners map[string]utils.ListenerConfig
+	trueListeners map[string]listenerConfig
+	// for a rehash, listener blocks that fail to load (e.g., because of a bad
+	// certificate) are skipped, instead of failing the whole config, and their
+	// errors are recorded here by address:
+	isolateListenerErrors bool
+	listenerLoadErrors    map[string]error
+	// set by NewConfig, for configs that are only served via NewHandler:
+	allowNoListeners bool
+
+	// refuse connections that are not secure on all listeners (except those
+	// that set require-secure themselves):
+	RequireSecure bool `yaml:"require-secure"`
 
 	GatewayName string `yaml:"gateway-name"`
-	dialer      *net.Dialer
-	Upstreams   []reverseProxyUpstream
-	DialTimeout time.Duration `yaml:"dial-timeout"`
+	// sent to each client after its registration (see welcome.go):
+	WelcomeNotice string `yaml:"welcome-notice"`
+	welcomeNotice []string
+	dialer        *net.Dialer
+	Upstreams     []reverseProxyUpstream
+	DialTimeout   time.Duration `yaml:"dial-timeout"`
+	// upstreams to try in all when dials fail (see failover.go):
+	UpstreamDialAttempts int `yaml:"upstream-dial-attempts"`
+	// cache TLS sessions with upstreams for resumption (see tlssessions.go):
+	UpstreamTLSSessionResumption bool `yaml:"upstream-tls-session-resumption"`
+	// upstreams that don't accept a line within this time are disconnected:
+	UpstreamWriteTimeout time.Duration `yaml:"upstream-write-timeout"`
+	// upstreams that send nothing within this time of the client's first
+	// line are disconnected:
+	UpstreamResponseTimeout time.Duration `yaml:"upstream-response-timeout"`
+	// how long to wait to send a close frame to a client, and then for its
+	// acknowledgment:
+	WebsocketCloseTimeout time.Duration `yaml:"websocket-close-timeout"`
+	// clients that send no data at all within this time are disconnected:
+	RegistrationTimeout time.Duration `yaml:"registration-timeout"`
+	// connections are closed (asking the client to reconnect) at this age:
+	ConnectionLifetime ConnectionLifetimeConfig `yaml:"connection-lifetime"`
+	// connections are closed (after a warning) if their clients are idle:
+	IdleTimeout IdleTimeoutConfig `yaml:"idle-timeout"`
+	// after a SIGUSR2 handoff, how long the old process waits for its
+	// connections to close before exiting:
+	HandoffDrainTimeout time.Duration `yaml:"handoff-drain-timeout"`
+	// warnings to clients before they are disconnected (see shutdownnotice.go):
+	ShutdownNotices ShutdownNoticeConfig `yaml:"shutdown-notices"`
+	// a capability describing the gateway, added to CAP LS (see gatewaycap.go):
+	GatewayCapability GatewayCapabilityConfig `yaml:"gateway-capability"`
+
+	IPCloaking IPCloakConfig `yaml:"ip-cloaking"`
 
 	LookupHostnames         bool `yaml:"lookup-hostnames"`
 	ForwardConfirmHostnames bool `yaml:"forward-confirm-hostnames"`
+	// if the lookup takes longer, the IP is used as the hostname:
+	HostnameLookupTimeout time.Duration `yaml:"hostname-lookup-timeout"`
+
+	Ident IdentConfig
+
+	Tor TorConfig
+
+	LocalPing LocalPingConfig `yaml:"local-ping"`
+
+	// IRCv3 tag data limits on lines from clients (see taglimit.go):
+	TagLimits TagLimitConfig `yaml:"tag-limits"`
+
+	StickySessions StickySessionsConfig `yaml:"sticky-sessions"`
+
+	ReconnectGrace ReconnectGraceConfig `yaml:"reconnect-grace"`
+
+	Multiplexing MultiplexingConfig
+
+	// a request header (from a trusted reverse proxy) with the client's
+	// account name, for the account WEBIRC flag:
+	AccountHeader string      `yaml:"account-header"`
+	GeoIP         GeoIPConfig `yaml:"geoip"`
 
 	ProxyAllowedFrom     []string `yaml:"proxy-allowed-from"`
 	proxyAllowedFromNets []net.IPNet
+	// whether to accept requests that reverse proxies forwarded as TLS early
+	// data (see earlydata.go):
+	EarlyData string `yaml:"early-data"`
 
 	MaxLineLen    int `yaml:"max-line-len"`
 	maxReadQBytes int
+	// read buffer sizing (see buffers.go):
+	Buffers BuffersConfig
+
+	// which websocket library to use (see transport.go):
+	WebsocketImplementation string `yaml:"websocket-implementation"`
+	transport               messageTransport
 
-	AllowedOrigins       []string `yaml:"allowed-origins"`
-	allowedOriginRegexps []*regexp.Regexp
+	AllowedOrigins []string       `yaml:"allowed-origins"`
+	OriginPolicies []OriginPolicy `yaml:"origin-policies"`
+	// maps origins (or globs) to the name of the upstream they're proxied to:
+	OriginRoutes       map[string]string `yaml:"origin-routes"`
+	AllowMissingOrigin bool              `yaml:"allow-missing-origin"`
+	// whether to accept origins whose hostname is the request's Host:
+	AllowSameOrigin bool                `yaml:"allow-same-origin"`
+	OpaqueOrigins   OpaqueOriginsConfig `yaml:"opaque-origins"`
+	originPolicies  []*OriginPolicy
+
+	HeaderRules []HeaderRule `yaml:"header-rules"`
+
+	TLSFingerprints struct {
+		Log     bool
+		Forward bool
+	} `yaml:"tls-fingerprints"`
+
+	Reputation ReputationConfig
+
+	AutoBan AutoBanConfig `yaml:"auto-ban"`
+
+	BandwidthQuotas BandwidthQuotaConfig `yaml:"bandwidth-quotas"`
+
+	DownstreamPacing DownstreamPacingConfig `yaml:"downstream-pacing"`
+
+	Tracing TracingConfig
+
+	AdminAPI AdminAPIConfig `yaml:"admin-api"`
+
+	AuditLog AuditLogConfig `yaml:"audit-log"`
+
+	WatchConfig WatchConfigConfig `yaml:"watch-config"`
+
+	PanicReporting PanicReportingConfig `yaml:"panic-reporting"`
+
+	LeakCheck LeakCheckConfig `yaml:"leak-check"`
+
+	Limits LimitsConfig
 
 	PprofListener string `yaml:"pprof-listener"`
+	// if set, the pprof listener requires `Authorization: Bearer <pprof-token>`:
+	PprofToken string `yaml:"pprof-token"`
+
+	MetricsListener string       `yaml:"metrics-listener"`
+	StatsD          StatsDConfig `yaml:"statsd"`
 
 	LogLevel string `yaml:"log-level"`
 	logLevel LogLevel
-
-	Transcoding struct {
-		EnableChardet bool `yaml:"enable-chardet"`
-		detector      *chardet.Detector
-		Encodings     []string
-		encodings     []encoding.Encoding
-	}
+	// per-component overrides of log-level, e.g. `proxy: debug`:
+	LogLevels  map[string]string `yaml:"log-levels"`
+	logLevels  [numLogComponents]LogLevel
+	LogFormat  string            `yaml:"log-format"`
+	LogOutputs []LogOutputConfig `yaml:"log-outputs"`
+	logOutputs []LogOutputConfig
+	logger     *slog.Logger
+	// suppress floods of identical warnings and errors:
+	LogRateLimit LogRateLimitConfig `yaml:"log-rate-limit"`
+	LogPrivacy   LogPrivacyConfig   `yaml:"log-privacy"`
+
+	Transcoding TranscodingConfig
+
+	// log non-fatal problems (unknown encodings, invalid origin patterns) as
+	// warnings and skip the offending entries, instead of refusing the config:
+	Lenient  bool
+	warnings []string
+
+	// independent proxies served by this process; see prepareProfiles:
+	Profiles map[string]map[string]interface{}
+	profiles map[string]*Config
+	// if this is the config of a profile, its name:
+	profileName string
 
 	Filename string
 }
 
+// TranscodingConfig controls how non-UTF8 upstream messages are converted
+// for clients using text frames (and optionally binary frames).
+type TranscodingConfig struct {
+	EnableChardet bool `yaml:"enable-chardet"`
+	detector      *chardet.Detector
+	Encodings     []string
+	encodings     []encoding.Encoding
+	// whether to transcode for clients of the binary subprotocol too:
+	Binary bool
+}
+
 func loadTlsConfig(config listenerConfigBlock) (tlsConfig *tls.Config, err error) {
 	var certificates []tls.Certificate
 	if len(config.TLSCertificates) != 0 {
@@ -126,12 +452,18 @@ func loadTlsConfig(config listenerConfigBlock) (tlsConfig *tls.Config, err error
 	// if Chrome receives a server request for a client certificate
 	// on a websocket connection, it will immediately disconnect:
 	// https://bugs.chromium.org/p/chromium/issues/detail?id=329884
-	// work around this behavior:
+	// work around this behavior, unless client certificates were requested:
 	clientAuth := tls.NoClientCert
+	if config.RequestClientCerts {
+		clientAuth = tls.RequestClientCert
+	}
 	result := tls.Config{
 		Certificates: certificates,
 		ClientAuth:   clientAuth,
 		MinVersion:   tlsMinVersionFromString(config.MinTLSVersion),
+		NextProtos:   config.ALPN,
+		// compute the JA3/JA4 fingerprint of the ClientHello:
+		GetConfigForClient: captureClientHello,
 	}
 	return &result, nil
 }
@@ -159,7 +491,7 @@ func loadCertWithLeaf(certFile, keyFile string) (cert tls.Certificate, err error
 	// "Note: if there are multiple Certificates, and they don't have the
 	// optional field Leaf set, certificate selection will incur a significant
 	// per-handshake performance cost."
-	cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	cert, err = loadKeyPair(certFile, keyFile)
 	if err != nil {
 		return
 	}
@@ -167,27 +499,142 @@ func loadCertWithLeaf(certFile, keyFile string) (cert tls.Certificate, err error
 	return
 }
 
+// loadKeyPair is tls.LoadX509KeyPair, except that the certificate and key
+// may also be inline PEM (as Kubernetes secrets and Vault templates provide
+// them), and if the key is omitted, the certificate must be a bundle that
+// also contains the key.
+func loadKeyPair(cert, key string) (tls.Certificate, error) {
+	certPEM, err := readPEM(cert)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM := certPEM
+	if key != "" {
+		if keyPEM, err = readPEM(key); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	// X509KeyPair skips the blocks of other types in each:
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// readPEM returns the value if it is inline PEM, otherwise the contents of
+// the file it names
+func readPEM(value string) ([]byte, error) {
+	if strings.Contains(value, "-----BEGIN ") {
+		return []byte(value), nil
+	}
+	return os.ReadFile(value)
+}
+
 // prepareListeners populates Config.Server.trueListeners
 func (conf *Config) prepareListeners() (err error) {
-	if len(conf.Listeners) == 0 {
+	if len(conf.Listeners) == 0 && len(conf.profiles) == 0 && !conf.allowNoListeners {
 		return fmt.Errorf("No listeners were configured")
 	}
 
-	conf.trueListeners = make(map[string]utils.ListenerConfig)
+	conf.trueListeners = make(map[string]listenerConfig)
 	for addr, block := range conf.Listeners {
-		var lconf utils.ListenerConfig
-		lconf.ProxyDeadline = time.Minute
-		lconf.Tor = block.Tor
-		lconf.TLSConfig, err = loadTlsConfig(block)
+		blockAddrs := append([]string{addr}, block.Addresses...)
+		for _, blockAddr := range blockAddrs {
+			if _, exists := conf.trueListeners[blockAddr]; exists {
+				return fmt.Errorf("listener %s is configured more than once", blockAddr)
+			}
+			if _, exists := conf.listenerLoadErrors[blockAddr]; exists {
+				return fmt.Errorf("listener %s is configured more than once", blockAddr)
+			}
+		}
+		lconf, err := conf.prepareListener(block)
 		if err != nil {
-			return err
+			err = fmt.Errorf("listener %s: %w", addr, err)
+			if !conf.isolateListenerErrors {
+				return err
+			}
+			if conf.listenerLoadErrors == nil {
+				conf.listenerLoadErrors = make(map[string]error)
+			}
+			for _, blockAddr := range blockAddrs {
+				conf.listenerLoadErrors[blockAddr] = err
+			}
+			continue
+		}
+		for _, blockAddr := range blockAddrs {
+			conf.trueListeners[blockAddr] = lconf
+		}
+	}
+	// the server runs the listeners of every profile:
+	for name, profile := range conf.profiles {
+		for addr, lconf := range profile.trueListeners {
+			if _, exists := conf.trueListeners[addr]; exists {
+				return fmt.Errorf("listener %s is configured more than once (in profile %s)", addr, name)
+			}
+			lconf.profile = name
+			conf.trueListeners[addr] = lconf
+		}
+		for addr, err := range profile.listenerLoadErrors {
+			if conf.listenerLoadErrors == nil {
+				conf.listenerLoadErrors = make(map[string]error)
+			}
+			conf.listenerLoadErrors[addr] = fmt.Errorf("profile %s: %w", name, err)
 		}
-		lconf.RequireProxy = block.Proxy
-		conf.trueListeners[addr] = lconf
 	}
 	return nil
 }
 
+// prepareListener converts a listener block to its internal representation
+func (conf *Config) prepareListener(block listenerConfigBlock) (lconf listenerConfig, err error) {
+	lconf.ProxyDeadline = time.Minute
+	lconf.Tor = block.Tor
+	if block.STSOnly && (block.TLS.Cert != "" || len(block.TLSCertificates) != 0) {
+		return lconf, fmt.Errorf("sts-only listeners cannot have TLS")
+	}
+	for _, protocol := range block.ALPN {
+		if len(protocol) == 0 || len(protocol) > 255 {
+			return lconf, fmt.Errorf("invalid alpn protocol %q (must be 1 to 255 bytes)", protocol)
+		}
+		if protocol == "h2" {
+			// clients would then send websocket handshakes over HTTP/2:
+			return lconf, fmt.Errorf("alpn cannot include h2, since HTTP/2 is not supported")
+		}
+	}
+	lconf.TLSConfig, err = loadTlsConfig(block)
+	if err != nil {
+		return lconf, err
+	}
+	if len(block.ALPN) != 0 && lconf.TLSConfig == nil {
+		return lconf, fmt.Errorf("alpn requires TLS")
+	}
+	lconf.RequireProxy = block.Proxy
+	if block.STSOnly {
+		lconf.STSOnly = true
+		lconf.STSPort = block.STSPort
+		if lconf.STSPort == 0 {
+			lconf.STSPort = 443
+		}
+	}
+	lconf.RequireSecure = conf.RequireSecure
+	if block.RequireSecure != nil {
+		lconf.RequireSecure = *block.RequireSecure
+	}
+	lconf.IPv6Only = block.IPv6Only
+	if err = block.Overload.postprocess(); err != nil {
+		return lconf, err
+	}
+	lconf.Overload = block.Overload
+	return lconf, nil
+}
+
+// retainFailedListeners keeps the previous settings of running listeners
+// whose blocks failed to load, so that they keep serving
+func (conf *Config) retainFailedListeners(oldConfig *Config) {
+	for addr := range conf.listenerLoadErrors {
+		oldConf, ok := oldConfig.trueListeners[addr]
+		if ok && (oldConf.profile == "" || conf.profiles[oldConf.profile] != nil) {
+			conf.trueListeners[addr] = oldConf
+		}
+	}
+}
+
 // LoadRawConfig loads the config without doing any consistency checks or postprocessing
 func LoadRawConfig(filename string) (config *Config, err error) {
 	data, err := os.ReadFile(filename)
@@ -242,6 +689,18 @@ func LoadConfig(filename string) (config *Config, err error) {
 	return postprocessConfig(config)
 }
 
+// loadConfigForRehash is LoadConfig, except that listener blocks that fail
+// to load are skipped (see listenerLoadErrors)
+func loadConfigForRehash(filename string) (config *Config, err error) {
+	config, err = LoadRawConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+	config.Filename = filename
+	config.isolateListenerErrors = true
+	return postprocessConfig(config)
+}
+
 func postprocessConfig(c *Config) (config *Config, err error) {
 	config = c
 
@@ -249,61 +708,271 @@ func postprocessConfig(c *Config) (config *Config, err error) {
 		return nil, fmt.Errorf("gateway name must be valid as a non-final IRC parameter: nonempty, no spaces, no initial :")
 	}
 
-	config.logLevel = parseLogLevel(config.LogLevel)
+	err = config.prepareProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.prepareLogLevels()
+	if err != nil {
+		return nil, err
+	}
+	err = config.LogPrivacy.postprocess()
+	if err != nil {
+		return nil, err
+	}
+	err = config.prepareLogger()
+	if err != nil {
+		return nil, err
+	}
+	config.LogRateLimit.postprocess()
 
 	if config.MaxLineLen < DefaultMaxLineLen {
 		config.MaxLineLen = DefaultMaxLineLen
 	}
 	config.maxReadQBytes = ircmsg.MaxlenClientTagData + config.MaxLineLen + 1024
+	err = config.Buffers.postprocess(config.maxReadQBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	config.transport, err = newMessageTransport(config.WebsocketImplementation)
+	if err != nil {
+		return nil, err
+	}
 
 	err = config.prepareListeners()
 	if err != nil {
 		return nil, fmt.Errorf("failed to prepare listeners: %v", err)
 	}
 
-	if config.DialTimeout == 0 {
-		config.DialTimeout = 5 * time.Second
+	err = config.prepareTimeouts()
+	if err != nil {
+		return nil, err
 	}
 	config.dialer = &net.Dialer{
 		Timeout: config.DialTimeout,
 	}
+	if config.UpstreamDialAttempts < 0 {
+		return nil, fmt.Errorf("upstream-dial-attempts must not be negative")
+	} else if config.UpstreamDialAttempts == 0 {
+		config.UpstreamDialAttempts = defaultUpstreamDialAttempts
+	}
 
-	if len(config.Upstreams) == 0 {
+	if len(config.Upstreams) == 0 && (len(config.Listeners) != 0 || config.allowNoListeners) {
 		return nil, fmt.Errorf("no upstreams configured")
 	}
 
-	for i, upstream := range config.Upstreams {
-		config.Upstreams[i].Address = strings.TrimPrefix(upstream.Address, "unix:")
-		if upstream.Webirc.Enabled {
-			if upstream.Webirc.Password == "" {
-				config.Upstreams[i].Webirc.Password = "*"
-			}
-			if upstream.Webirc.Cert != "" {
-				cert, err := tls.LoadX509KeyPair(upstream.Webirc.Cert, upstream.Webirc.Key)
-				if err != nil {
-					return nil, err
-				}
-				config.Upstreams[i].Webirc.certificates = []tls.Certificate{cert}
-			}
+	for i := range config.Upstreams {
+		if err := config.Upstreams[i].postprocess(); err != nil {
+			return nil, err
 		}
 	}
 
-	for _, glob := range config.AllowedOrigins {
-		globre, err := utils.CompileGlob(glob, false)
-		if err != nil {
-			return nil, fmt.Errorf("invalid websocket allowed-origin expression: %s", glob)
-		}
-		config.allowedOriginRegexps = append(config.allowedOriginRegexps, globre)
+	err = config.prepareOriginPolicies()
+	if err != nil {
+		return nil, err
+	}
+	err = config.Tor.postprocess(config)
+	if err != nil {
+		return nil, err
+	}
+	err = config.GeoIP.postprocess()
+	if err != nil {
+		return nil, err
+	}
+	// profiles share the top-level database, rather than each loading a copy:
+	for _, profile := range config.profiles {
+		profile.GeoIP = config.GeoIP
 	}
 
 	config.proxyAllowedFromNets, err = utils.ParseNetList(config.ProxyAllowedFrom)
 	if err != nil {
 		return nil, fmt.Errorf("Could not parse proxy-allowed-from nets: %v", err.Error())
 	}
+	err = postprocessEarlyData(&config.EarlyData)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range config.HeaderRules {
+		if err := config.HeaderRules[i].postprocess(); err != nil {
+			return nil, err
+		}
+	}
+
+	err = config.IPCloaking.postprocess()
+	if err != nil {
+		return nil, err
+	}
+
+	config.Ident.postprocess()
+	config.LocalPing.postprocess()
+	config.ReconnectGrace.postprocess()
+	config.welcomeNotice = welcomeNoticeLines(config.WelcomeNotice)
+	config.Multiplexing.postprocess()
+	err = config.StickySessions.postprocess()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Reputation.postprocess()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.AutoBan.postprocess()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.DownstreamPacing.postprocess()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.TagLimits.postprocess()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.BandwidthQuotas.postprocess()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Tracing.postprocess()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.AdminAPI.postprocess()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.validatePprofListener()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.AuditLog.postprocess()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.StatsD.postprocess()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.GatewayCapability.postprocess()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.ConnectionLifetime.postprocess()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.IdleTimeout.postprocess()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.ShutdownNotices.postprocess()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.WatchConfig.postprocess()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.PanicReporting.postprocess()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.LeakCheck.postprocess()
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Limits.postprocess()
+	if err != nil {
+		return nil, err
+	}
 
 	return config.postprocessEncodings()
 }
 
+// prepareTimeouts fills in the default of each timeout that isn't set, and
+// checks that the others are in range. yaml reads bare numbers as nanoseconds,
+// so a timeout given without a unit is almost certainly out of range.
+func (config *Config) prepareTimeouts() error {
+	timeouts := []struct {
+		name       string
+		value      *time.Duration
+		defaultVal time.Duration
+		min, max   time.Duration
+	}{
+		{"dial-timeout", &config.DialTimeout, 5 * time.Second, 100 * time.Millisecond, 5 * time.Minute},
+		{"upstream-write-timeout", &config.UpstreamWriteTimeout, time.Minute, 100 * time.Millisecond, time.Hour},
+		{"upstream-response-timeout", &config.UpstreamResponseTimeout, time.Minute, time.Second, time.Hour},
+		{"websocket-close-timeout", &config.WebsocketCloseTimeout, defaultWebsocketCloseTimeout, 10 * time.Millisecond, time.Minute},
+		{"registration-timeout", &config.RegistrationTimeout, time.Minute, time.Second, time.Hour},
+		{"hostname-lookup-timeout", &config.HostnameLookupTimeout, defaultHostnameLookupTimeout, 10 * time.Millisecond, time.Minute},
+		{"handoff-drain-timeout", &config.HandoffDrainTimeout, time.Hour, time.Second, 7 * 24 * time.Hour},
+	}
+	for _, timeout := range timeouts {
+		if *timeout.value == 0 {
+			*timeout.value = timeout.defaultVal
+		} else if *timeout.value < timeout.min || *timeout.value > timeout.max {
+			return fmt.Errorf("%s must be between %v and %v (with a unit, e.g. \"30s\"), not %v", timeout.name, timeout.min, timeout.max, *timeout.value)
+		}
+	}
+	return nil
+}
+
+// lenientError returns err, unless the config is lenient, in which case it
+// records err as a warning and returns nil (the caller skips the entry)
+func (config *Config) lenientError(err error) error {
+	if !config.Lenient {
+		return err
+	}
+	config.warnings = append(config.warnings, err.Error())
+	return nil
+}
+
+// validatePprofListener refuses to expose heap and goroutine dumps to the
+// network without authentication
+func (config *Config) validatePprofListener() error {
+	if config.PprofListener == "" || config.PprofToken != "" {
+		return nil
+	}
+	local, err := isLocalListenAddress(config.PprofListener)
+	if err != nil {
+		return fmt.Errorf("invalid pprof-listener address %s: %w", config.PprofListener, err)
+	}
+	if !local {
+		return fmt.Errorf("pprof-listener %s is not a loopback address or a unix socket, so pprof-token is required", config.PprofListener)
+	}
+	return nil
+}
+
+// getUpstream finds an upstream by its name or address
+func (config *Config) getUpstream(name string) *reverseProxyUpstream {
+	for i := range config.Upstreams {
+		if config.Upstreams[i].Name == name || config.Upstreams[i].Address == name {
+			return &config.Upstreams[i]
+		}
+	}
+	return nil
+}
+
 func (config *Config) postprocessEncodings() (*Config, error) {
 	if config.Transcoding.EnableChardet && len(config.Transcoding.Encodings) != 0 {
 		return nil, fmt.Errorf("Cannot enable both chardet and a static list of encodings")
@@ -317,8 +986,15 @@ func (config *Config) postprocessEncodings() (*Config, error) {
 	if len(config.Transcoding.Encodings) != 0 {
 		for _, encoding := range config.Transcoding.Encodings {
 			e, err := ianaindex.IANA.Encoding(encoding)
+			if err == nil && e == nil {
+				// registered with IANA, but not implemented:
+				err = errUnsupportedEncoding
+			}
 			if err != nil {
-				return nil, fmt.Errorf("Invalid encoding name %s: %v", encoding, err)
+				if err := config.lenientError(fmt.Errorf("Invalid encoding name %s: %v", encoding, err)); err != nil {
+					return nil, err
+				}
+				continue
 			}
 			config.Transcoding.encodings = append(config.Transcoding.encodings, e)
 		}
@@ -0,0 +1,214 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseUpstreamAddress(t *testing.T) {
+	parse := func(address string, tlsSetting bool) [3]interface{} {
+		network, dialAddr, useTLS, err := parseUpstreamAddress(address, tlsSetting)
+		if err != nil {
+			return [3]interface{}{"error", "", false}
+		}
+		return [3]interface{}{network, dialAddr, useTLS}
+	}
+	assertEqual(parse("irc://irc.example.com:6668", false), [3]interface{}{"tcp", "irc.example.com:6668", false})
+	assertEqual(parse("irc://irc.example.com", false), [3]interface{}{"tcp", "irc.example.com:6667", false})
+	assertEqual(parse("ircs://irc.example.com/", false), [3]interface{}{"tcp", "irc.example.com:6697", true})
+	assertEqual(parse("ircs://[2001:db8::1]", false), [3]interface{}{"tcp", "[2001:db8::1]:6697", true})
+	assertEqual(parse("ircs://[2001:db8::1]:7000", false), [3]interface{}{"tcp", "[2001:db8::1]:7000", true})
+	assertEqual(parse("unix:/tmp/ircd_sock", false), [3]interface{}{"unix", "/tmp/ircd_sock", false})
+	// the legacy forms:
+	assertEqual(parse("/tmp/ircd_sock", false), [3]interface{}{"unix", "/tmp/ircd_sock", false})
+	assertEqual(parse("irc.example.com:6697", true), [3]interface{}{"tcp", "irc.example.com:6697", true})
+	assertEqual(parse("127.0.0.1:6667", false), [3]interface{}{"tcp", "127.0.0.1:6667", false})
+
+	assertEqual(parse("irc://irc.example.com", true)[0], "error")
+	assertEqual(parse("ircs://irc.example.com/channel", false)[0], "error")
+	assertEqual(parse("ircs://", false)[0], "error")
+	assertEqual(parse("unix:tmp/ircd_sock", false)[0], "error")
+	assertEqual(parse("irc.example.com", false)[0], "error")
+
+	upstream := reverseProxyUpstream{Address: "ircs://irc.example.com"}
+	if err := upstream.postprocess(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(upstream.Name, "irc.example.com:6697")
+	assertEqual(upstream.serverName, "irc.example.com")
+	assertEqual(upstream.TLS, true)
+
+	upstream = reverseProxyUpstream{Address: "ircs://10.0.0.5", TLSServerName: "irc.example.org"}
+	if err := upstream.postprocess(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(upstream.Address, "10.0.0.5:6697")
+	assertEqual(upstream.serverName, "irc.example.org")
+}
+
+// testCertPEM generates a self-signed certificate (with serial number 1)
+func testCertPEM(t *testing.T) (certPEM, keyPEM string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+	return
+}
+
+func TestLoadKeyPair(t *testing.T) {
+	certPEM, keyPEM := testCertPEM(t)
+
+	dir := t.TempDir()
+	certFile, keyFile, bundleFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "bundle.pem")
+	os.WriteFile(certFile, []byte(certPEM), 0600)
+	os.WriteFile(keyFile, []byte(keyPEM), 0600)
+	os.WriteFile(bundleFile, []byte(keyPEM+certPEM), 0600)
+
+	for _, pair := range [][2]string{
+		{certFile, keyFile},
+		{certPEM, keyPEM},
+		{certPEM, keyFile},
+		{bundleFile, ""},
+		{certPEM + keyPEM, ""},
+	} {
+		cert, err := loadCertWithLeaf(pair[0], pair[1])
+		if err != nil {
+			t.Fatalf("loading %v: %v", pair, err)
+		}
+		assertEqual(cert.Leaf.SerialNumber.Int64(), int64(1))
+	}
+
+	_, err := loadKeyPair(certFile, "")
+	assertEqual(err != nil, true)
+	_, err = loadKeyPair(filepath.Join(dir, "missing.pem"), keyFile)
+	assertEqual(err != nil, true)
+}
+
+func TestLenientConfig(t *testing.T) {
+	settings := `
+transcoding:
+    encodings: ["x-bogus", "ISO-8859-1"]
+allowed-origins: ["regexp:(", "https://example.com"]
+`
+	_, err := NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667"), WithYAML(settings))
+	assertEqual(err != nil, true)
+
+	config, err := NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667"), WithYAML("lenient: true"+settings))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(len(config.warnings), 2)
+	assertEqual(len(config.Transcoding.encodings), 1)
+	_, allowed := config.checkOrigin("https://example.com", "")
+	assertEqual(allowed, true)
+	_, allowed = config.checkOrigin("https://example.org", "")
+	assertEqual(allowed, false)
+}
+
+func TestPrepareTimeouts(t *testing.T) {
+	config, err := NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667"), WithYAML("dial-timeout: 90s\nupstream-write-timeout: 2m"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(config.DialTimeout, 90*time.Second)
+	assertEqual(config.UpstreamWriteTimeout, 2*time.Minute)
+	assertEqual(config.WebsocketCloseTimeout, defaultWebsocketCloseTimeout)
+	assertEqual(config.RegistrationTimeout, time.Minute)
+
+	for _, settings := range []string{
+		// nanoseconds, since there is no unit:
+		"dial-timeout: 90",
+		"websocket-close-timeout: -1s",
+		"registration-timeout: 2h",
+	} {
+		if _, err := NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667"), WithYAML(settings)); err == nil {
+			t.Errorf("%s should be rejected", settings)
+		}
+	}
+}
+
+func TestListenerALPN(t *testing.T) {
+	certPEM, keyPEM := testCertPEM(t)
+	config, err := NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667"),
+		WithListener("127.0.0.1:8097", ListenerTLS(certPEM, keyPEM), ListenerALPN("http/1.1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(config.trueListeners["127.0.0.1:8097"].TLSConfig.NextProtos, []string{"http/1.1"})
+
+	for _, opts := range [][]ListenerOption{
+		{ListenerALPN("http/1.1")},
+		{ListenerTLS(certPEM, keyPEM), ListenerALPN("")},
+		{ListenerTLS(certPEM, keyPEM), ListenerALPN("http/1.1", "h2")},
+	} {
+		_, err := NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667"), WithListener("127.0.0.1:8097", opts...))
+		assertEqual(err != nil, true)
+	}
+}
+
+func TestWebircPasswordRotation(t *testing.T) {
+	cutover := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	config, err := NewConfig(WithGatewayName("webircproxy"),
+		WithUpstream("127.0.0.1:6667", UpstreamWebirc("new"), UpstreamWebircPreviousPassword("old", cutover)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &config.Upstreams[0]
+	assertEqual(upstream.webircPassword(cutover.Add(-time.Second)), "old")
+	assertEqual(upstream.webircPassword(cutover), "new")
+
+	config, err = NewConfig(WithGatewayName("webircproxy"),
+		WithYAML("upstreams:\n    - {address: \"127.0.0.1:6667\", webirc: {enabled: true, password: new, previous-password: old, password-cutover: 2021-06-01T00:00:00Z}}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(config.Upstreams[0].Webirc.PasswordCutover.Equal(cutover), true)
+
+	_, err = NewConfig(WithGatewayName("webircproxy"),
+		WithUpstream("127.0.0.1:6667", UpstreamWebirc("new"), UpstreamWebircPreviousPassword("old", time.Time{})))
+	assertEqual(err != nil, true)
+}
+
+func TestWebircCertOnly(t *testing.T) {
+	certPEM, keyPEM := testCertPEM(t)
+	config, err := NewConfig(WithGatewayName("webircproxy"),
+		WithUpstream("ircs://irc.example.com", UpstreamWebircCertOnly(certPEM, keyPEM)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &config.Upstreams[0]
+	assertEqual(upstream.webircPassword(time.Now()), "*")
+	assertEqual(len(upstream.Webirc.certificates), 1)
+
+	for _, opts := range [][]UpstreamOption{
+		// the certificate is only presented over TLS:
+		{UpstreamWebircCertOnly(certPEM, keyPEM)},
+		{UpstreamTLS(), UpstreamWebircCertOnly("", "")},
+		{UpstreamTLS(), UpstreamWebircCertOnly(certPEM, keyPEM), UpstreamWebirc("hunter2")},
+	} {
+		_, err := NewConfig(WithGatewayName("webircproxy"), WithUpstream("irc.example.com:6697", opts...))
+		assertEqual(err != nil, true)
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// NewConfig builds a config in Go code, for embedding the proxy (see
+// NewHandler) or for tests, without writing a YAML file:
+//
+//	config, err := irc.NewConfig(
+//		irc.WithGatewayName("webchat.example.com"),
+//		irc.WithListener("127.0.0.1:8067"),
+//		irc.WithUpstream("127.0.0.1:6667", irc.UpstreamWebirc("hunter2")),
+//	)
+//
+// WithYAML can set anything else that the config file can.
+
+var (
+	errNoConfigFile = errors.New("the config was not loaded from a file, so it cannot be reloaded")
+)
+
+// ConfigOption sets part of a config built by NewConfig.
+type ConfigOption func(*Config) error
+
+// ListenerOption configures a listener added by WithListener.
+type ListenerOption func(*listenerConfigBlock)
+
+// UpstreamOption configures an upstream added by WithUpstream.
+type UpstreamOption func(*reverseProxyUpstream)
+
+// NewConfig applies the options in order, then validates and postprocesses
+// the result exactly as LoadConfig does; omitted settings get their defaults.
+func NewConfig(opts ...ConfigOption) (*Config, error) {
+	config := new(Config)
+	for _, opt := range opts {
+		if err := opt(config); err != nil {
+			return nil, err
+		}
+	}
+	if config.WatchConfig.Enabled {
+		return nil, fmt.Errorf("watch-config requires a config file")
+	}
+	// the config may only be used via NewHandler:
+	config.allowNoListeners = len(config.Listeners) == 0
+	return postprocessConfig(config)
+}
+
+// WithYAML unmarshals a fragment of a config file (a YAML mapping) onto
+// the config; keys it doesn't mention are left alone.
+func WithYAML(data string) ConfigOption {
+	return func(config *Config) error {
+		if err := yaml.Unmarshal([]byte(data), config); err != nil {
+			return fmt.Errorf("invalid config YAML: %w", err)
+		}
+		return nil
+	}
+}
+
+// WithListener adds a listener on a TCP address or a unix socket path.
+func WithListener(addr string, opts ...ListenerOption) ConfigOption {
+	return func(config *Config) error {
+		if _, exists := config.Listeners[addr]; exists {
+			return fmt.Errorf("listener %s is configured more than once", addr)
+		}
+		var block listenerConfigBlock
+		for _, opt := range opts {
+			opt(&block)
+		}
+		if config.Listeners == nil {
+			config.Listeners = make(map[string]listenerConfigBlock)
+		}
+		config.Listeners[addr] = block
+		return nil
+	}
+}
+
+// ListenerTLS makes the listener terminate TLS with the given certificate;
+// it can be repeated to serve multiple certificates via SNI.
+func ListenerTLS(cert, key string) ListenerOption {
+	return func(block *listenerConfigBlock) {
+		block.TLSCertificates = append(block.TLSCertificates, TLSListenConfig{Cert: cert, Key: key})
+	}
+}
+
+// ListenerMinTLSVersion sets the minimum TLS version, e.g. "1.3".
+func ListenerMinTLSVersion(version string) ListenerOption {
+	return func(block *listenerConfigBlock) {
+		block.MinTLSVersion = version
+	}
+}
+
+// ListenerALPN advertises the protocols via ALPN, e.g. "http/1.1".
+func ListenerALPN(protocols ...string) ListenerOption {
+	return func(block *listenerConfigBlock) {
+		block.ALPN = append(block.ALPN, protocols...)
+	}
+}
+
+// ListenerProxy requires the PROXY protocol on the listener.
+func ListenerProxy() ListenerOption {
+	return func(block *listenerConfigBlock) {
+		block.Proxy = true
+	}
+}
+
+// ListenerTor marks the listener as receiving connections from a Tor
+// hidden service.
+func ListenerTor() ListenerOption {
+	return func(block *listenerConfigBlock) {
+		block.Tor = true
+	}
+}
+
+// ListenerRequireSecure refuses insecure connections on the listener.
+func ListenerRequireSecure() ListenerOption {
+	return func(block *listenerConfigBlock) {
+		requireSecure := true
+		block.RequireSecure = &requireSecure
+	}
+}
+
+// ListenerAllowInsecure accepts insecure connections on the listener,
+// despite the top-level require-secure.
+func ListenerAllowInsecure() ListenerOption {
+	return func(block *listenerConfigBlock) {
+		requireSecure := false
+		block.RequireSecure = &requireSecure
+	}
+}
+
+// ListenerIPv6Only accepts only IPv6 connections on IPv6 and wildcard
+// addresses, instead of both IPv6 and IPv4.
+func ListenerIPv6Only() ListenerOption {
+	return func(block *listenerConfigBlock) {
+		block.IPv6Only = true
+	}
+}
+
+// ListenerAddresses listens on more addresses, with the same configuration.
+func ListenerAddresses(addrs ...string) ListenerOption {
+	return func(block *listenerConfigBlock) {
+		block.Addresses = append(block.Addresses, addrs...)
+	}
+}
+
+// WithUpstream adds an upstream ircd, at irc://host:port, ircs://host:port
+// (with TLS), or unix:/path.
+func WithUpstream(address string, opts ...UpstreamOption) ConfigOption {
+	return func(config *Config) error {
+		upstream := reverseProxyUpstream{Address: address}
+		for _, opt := range opts {
+			opt(&upstream)
+		}
+		config.Upstreams = append(config.Upstreams, upstream)
+		return nil
+	}
+}
+
+// UpstreamName names the upstream, for origin-policies and the admin API.
+func UpstreamName(name string) UpstreamOption {
+	return func(upstream *reverseProxyUpstream) {
+		upstream.Name = name
+	}
+}
+
+// UpstreamTLS connects to the upstream with TLS; it is implied by ircs:// addresses.
+func UpstreamTLS() UpstreamOption {
+	return func(upstream *reverseProxyUpstream) {
+		upstream.TLS = true
+	}
+}
+
+// UpstreamTLSServerName verifies the upstream's certificate against the
+// name, instead of the host in its address.
+func UpstreamTLSServerName(name string) UpstreamOption {
+	return func(upstream *reverseProxyUpstream) {
+		upstream.TLSServerName = name
+	}
+}
+
+// UpstreamWebirc sends WEBIRC with the given password to the upstream.
+func UpstreamWebirc(password string) UpstreamOption {
+	return func(upstream *reverseProxyUpstream) {
+		upstream.Webirc.Enabled = true
+		upstream.Webirc.Password = password
+	}
+}
+
+// UpstreamWebircPreviousPassword sends the previous WEBIRC password until
+// cutover, during a rotation; the password of UpstreamWebirc is sent after.
+func UpstreamWebircPreviousPassword(password string, cutover time.Time) UpstreamOption {
+	return func(upstream *reverseProxyUpstream) {
+		upstream.Webirc.PreviousPassword = password
+		upstream.Webirc.PasswordCutover = cutover
+	}
+}
+
+// UpstreamWebircCert sends a TLS client certificate to the upstream
+// (which must also have UpstreamTLS), for ircds that authenticate WEBIRC
+// gateways by certificate.
+func UpstreamWebircCert(cert, key string) UpstreamOption {
+	return func(upstream *reverseProxyUpstream) {
+		upstream.Webirc.Enabled = true
+		upstream.Webirc.Cert = cert
+		upstream.Webirc.Key = key
+	}
+}
+
+// UpstreamWebircCertOnly authenticates WEBIRC with only a TLS client
+// certificate, sending * as the password; the server checks that the
+// upstream accepts it when the config is applied.
+func UpstreamWebircCertOnly(cert, key string) UpstreamOption {
+	return func(upstream *reverseProxyUpstream) {
+		UpstreamWebircCert(cert, key)(upstream)
+		upstream.Webirc.CertOnly = true
+	}
+}
+
+// UpstreamWeight sets the upstream's relative share of new connections
+// (the default is 1).
+func UpstreamWeight(weight int) UpstreamOption {
+	return func(upstream *reverseProxyUpstream) {
+		upstream.Weight = weight
+	}
+}
+
+// UpstreamPrewarm keeps connections to the upstream dialed ahead of time
+// (see prewarm in the upstream config).
+func UpstreamPrewarm(connections int) UpstreamOption {
+	return func(upstream *reverseProxyUpstream) {
+		upstream.Prewarm.Connections = connections
+	}
+}
+
+// WithGatewayName sets the gateway name sent in WEBIRC; it is required.
+func WithGatewayName(name string) ConfigOption {
+	return func(config *Config) error {
+		config.GatewayName = name
+		return nil
+	}
+}
+
+// WithAllowedOrigins sets the allowed websocket origins (see allowed-origins).
+func WithAllowedOrigins(origins ...string) ConfigOption {
+	return func(config *Config) error {
+		config.AllowedOrigins = origins
+		return nil
+	}
+}
+
+// WithOriginRoute proxies connections from the origin (which may be a glob)
+// to the named upstream only (see origin-routes).
+func WithOriginRoute(origin, upstream string) ConfigOption {
+	return func(config *Config) error {
+		if config.OriginRoutes == nil {
+			config.OriginRoutes = make(map[string]string)
+		}
+		config.OriginRoutes[origin] = upstream
+		return nil
+	}
+}
+
+// WithProxyAllowedFrom sets the IPs and networks that are trusted to send
+// X-Forwarded-For and the PROXY protocol.
+func WithProxyAllowedFrom(nets ...string) ConfigOption {
+	return func(config *Config) error {
+		config.ProxyAllowedFrom = nets
+		return nil
+	}
+}
+
+// WithEncodings transcodes upstream messages from the given encodings
+// (e.g., "ISO-8859-1") for clients using text frames.
+func WithEncodings(encodings ...string) ConfigOption {
+	return func(config *Config) error {
+		config.Transcoding.Encodings = encodings
+		return nil
+	}
+}
+
+// WithChardet transcodes upstream messages from automatically detected
+// encodings for clients using text frames.
+func WithChardet() ConfigOption {
+	return func(config *Config) error {
+		config.Transcoding.EnableChardet = true
+		return nil
+	}
+}
+
+// WithLogLevel sets the log level, e.g. "debug".
+func WithLogLevel(level string) ConfigOption {
+	return func(config *Config) error {
+		config.LogLevel = level
+		return nil
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewConfig(t *testing.T) {
+	config, err := NewConfig(
+		WithListener("127.0.0.1:8067", ListenerRequireSecure()),
+		WithListener("/tmp/webircproxy.sock", ListenerProxy()),
+		WithUpstream("127.0.0.1:6667", UpstreamName("ircd"), UpstreamWebirc("hunter2")),
+		WithGatewayName("webircproxy.example.com"),
+		WithEncodings("ISO-8859-1"),
+		WithYAML("registration-timeout: 30s\nlimits:\n    max-connections: 100\n"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(len(config.trueListeners), 2)
+	assertEqual(config.trueListeners["127.0.0.1:8067"].RequireSecure, true)
+	assertEqual(config.trueListeners["/tmp/webircproxy.sock"].RequireProxy, true)
+	assertEqual(config.getUpstream("ircd").Webirc.Password, "hunter2")
+	assertEqual(len(config.Transcoding.encodings), 1)
+	assertEqual(config.RegistrationTimeout, 30*time.Second)
+	assertEqual(config.Limits.MaxConnections, 100)
+	// defaults are filled in:
+	assertEqual(config.DialTimeout, 5*time.Second)
+	assertEqual(config.MaxLineLen, DefaultMaxLineLen)
+	assertEqual(config.getLogger() != nil, true)
+}
+
+func TestNewConfigErrors(t *testing.T) {
+	_, err := NewConfig(WithListener(":8067"), WithUpstream("127.0.0.1:6667"))
+	assertEqual(err != nil, true)
+	// no listeners is OK, for use with NewHandler:
+	config, err := NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(len(config.trueListeners), 0)
+	_, err = NewConfig(WithGatewayName("webircproxy"))
+	assertEqual(err.Error(), "no upstreams configured")
+	_, err = NewConfig(WithGatewayName("webircproxy"), WithListener(":8067"))
+	assertEqual(err.Error(), "no upstreams configured")
+	_, err = NewConfig(WithGatewayName("webircproxy"), WithListener(":8067"), WithListener(":8067"))
+	assertEqual(err.Error(), "listener :8067 is configured more than once")
+	_, err = NewConfig(WithGatewayName("webircproxy"), WithListener(":8067"), WithUpstream("127.0.0.1:6667"), WithYAML("watch-config: {enabled: true}"))
+	assertEqual(err.Error(), "watch-config requires a config file")
+	_, err = NewConfig(WithYAML("listeners: ["))
+	assertEqual(err != nil, true)
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// WatchConfigConfig controls automatic rehashing when the config file changes,
+// which is convenient when signals are awkward to deliver (e.g., in Kubernetes,
+// with the config file mounted from a ConfigMap).
+type WatchConfigConfig struct {
+	Enabled bool
+	// how often to poll the config file for changes:
+	Interval time.Duration
+}
+
+func (conf *WatchConfigConfig) postprocess() error {
+	if conf.Interval <= 0 {
+		conf.Interval = 5 * time.Second
+	}
+	return nil
+}
+
+// configFileState identifies a version of the config file. os.Stat follows
+// symlinks, so this also detects Kubernetes-style updates, which atomically
+// swap a symlink to a new directory (possibly preserving the mtime).
+type configFileState struct {
+	info os.FileInfo
+}
+
+func statConfigFile(filename string) (state configFileState, err error) {
+	state.info, err = os.Stat(filename)
+	return
+}
+
+func (state configFileState) changedFrom(previous configFileState) bool {
+	if state.info == nil || previous.info == nil {
+		return state.info != previous.info
+	}
+	return !os.SameFile(state.info, previous.info) ||
+		!state.info.ModTime().Equal(previous.info.ModTime()) ||
+		state.info.Size() != previous.info.Size()
+}
+
+// configWatcher polls the config file and rehashes when it changes
+type configWatcher struct {
+	sync.Mutex // tier 1
+
+	server  *Server
+	config  *WatchConfigConfig
+	started bool
+}
+
+func (cw *configWatcher) ApplyConfig(server *Server, config *WatchConfigConfig) {
+	cw.Lock()
+	defer cw.Unlock()
+
+	cw.server = server
+	cw.config = config
+	if config.Enabled && !cw.started {
+		cw.started = true
+		go cw.run(server.configFilename)
+	}
+}
+
+func (cw *configWatcher) getConfig() *WatchConfigConfig {
+	cw.Lock()
+	defer cw.Unlock()
+	return cw.config
+}
+
+func (cw *configWatcher) run(filename string) {
+	defer cw.server.HandlePanic()
+
+	last, err := statConfigFile(filename)
+	if err != nil {
+		cw.server.Log(LogComponentConfig, LogLevelWarn, "could not stat the config file", errAttr(err))
+	}
+	for {
+		config := cw.getConfig()
+		if !config.Enabled {
+			// disabled by a rehash; check again later
+			if !cw.server.sleep(time.Minute) {
+				return
+			}
+			continue
+		}
+		if !cw.server.sleep(config.Interval) {
+			return
+		}
+		current, err := statConfigFile(filename)
+		if err != nil {
+			// the file may be in the middle of being replaced; if it is
+			// still missing next time, we'll log again
+			cw.server.Log(LogComponentConfig, LogLevelWarn, "could not stat the config file", errAttr(err))
+			continue
+		}
+		if !current.changedFrom(last) {
+			continue
+		}
+		// remember the new version even if the rehash fails, so that a
+		// broken config is reported once rather than on every poll:
+		last = current
+		cw.server.Log(LogComponentConfig, LogLevelInfo, "config file changed, rehashing")
+		cw.server.rehash()
+	}
+}
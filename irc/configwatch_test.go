@@ -0,0 +1,46 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigFileChanged(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(filename, []byte("log-level: info\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	first, err := statConfigFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := statConfigFile(filename)
+	assertEqual(second.changedFrom(first), false)
+
+	// same size, different mtime:
+	os.WriteFile(filename, []byte("log-level: warn\n"), 0644)
+	os.Chtimes(filename, time.Now(), first.info.ModTime().Add(time.Second))
+	third, _ := statConfigFile(filename)
+	assertEqual(third.changedFrom(first), true)
+
+	// a replaced file with the same mtime and size (a Kubernetes ConfigMap
+	// update swaps a symlink):
+	replacement := filepath.Join(dir, "config.yaml.new")
+	os.WriteFile(replacement, []byte("log-level: warn\n"), 0644)
+	os.Chtimes(replacement, time.Now(), third.info.ModTime())
+	if err := os.Rename(replacement, filename); err != nil {
+		t.Fatal(err)
+	}
+	fourth, _ := statConfigFile(filename)
+	assertEqual(fourth.info.ModTime().Equal(third.info.ModTime()), true)
+	assertEqual(fourth.changedFrom(third), true)
+
+	// a config file that couldn't be read at startup:
+	assertEqual(fourth.changedFrom(configFileState{}), true)
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/ergochat/ergo/irc/utils"
+)
+
+// TLS 1.3 early data (0-RTT) can be replayed by an attacker, so it is only
+// safe for idempotent requests. The websocket handshake isn't idempotent (a
+// replay opens another upstream connection), so early data is never
+// accepted by default:
+//
+//  1. On our own TLS listeners, Go's TLS implementation declines all early
+//     data (it doesn't support accepting it over TCP), so clients resend it
+//     after the handshake completes.
+//  2. A reverse proxy in proxy-allowed-from that accepts early data (e.g.,
+//     nginx with ssl_early_data) marks the requests it forwards before the
+//     handshake completes with `Early-Data: 1` (RFC 8470). With early-data
+//     set to "reject", they are answered with 425 Too Early, which makes the
+//     reverse proxy (or the client) retry after its handshake completes.
+//
+// In either case, no IRC data can arrive as early data: clients only send
+// it after receiving the websocket handshake's response, by which time
+// their TLS handshake is complete. With early-data set to "allow", a
+// replayed handshake from a reverse proxy is accepted, opening a duplicate
+// connection that the attacker can't use.
+
+const (
+	earlyDataReject = "reject"
+	earlyDataAllow  = "allow"
+)
+
+func postprocessEarlyData(policy *string) error {
+	switch *policy {
+	case "":
+		*policy = earlyDataReject
+	case earlyDataReject, earlyDataAllow:
+	default:
+		return fmt.Errorf("invalid early-data policy %#v (must be reject or allow)", *policy)
+	}
+	return nil
+}
+
+// rejectEarlyData answers a request forwarded as early data by a trusted
+// reverse proxy with 425 Too Early, returning whether it did
+func rejectEarlyData(w http.ResponseWriter, r *http.Request, in *incomingRequest) bool {
+	config := in.config
+	if config.EarlyData != earlyDataReject || r.Header.Get("Early-Data") != "1" ||
+		!utils.IPInNets(in.realIP, config.proxyAllowedFromNets) {
+		return false
+	}
+	http.Error(w, "retry after the TLS handshake", http.StatusTooEarly)
+	return true
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRejectEarlyData(t *testing.T) {
+	check := func(yaml string, realIP string, earlyData bool) int {
+		config, err := NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667"), WithYAML("proxy-allowed-from: [localhost]\n"+yaml))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/webirc", nil)
+		if earlyData {
+			r.Header.Set("Early-Data", "1")
+		}
+		w := httptest.NewRecorder()
+		if rejectEarlyData(w, r, &incomingRequest{config: config, realIP: net.ParseIP(realIP)}) {
+			return w.Code
+		}
+		return 0
+	}
+	assertEqual(check("", "127.0.0.1", true), http.StatusTooEarly)
+	assertEqual(check("", "127.0.0.1", false), 0)
+	// only reverse proxies can mark requests as early data:
+	assertEqual(check("", "192.0.2.1", true), 0)
+	assertEqual(check("early-data: allow", "127.0.0.1", true), 0)
+
+	_, err := NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667"), WithYAML("early-data: sometimes"))
+	assertEqual(err != nil, true)
+}
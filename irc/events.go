@@ -0,0 +1,169 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connection events, for dashboards and orchestration layers that want to
+// react to what the proxy is doing without polling the admin API. Subscribers
+// receive events on a buffered channel; if a subscriber falls behind, events
+// are dropped for it rather than slowing down the proxy.
+
+// EventType is the kind of an Event.
+type EventType string
+
+const (
+	// a connection was proxied to an upstream:
+	EventConnect EventType = "connect"
+	// a proxied connection closed:
+	EventDisconnect EventType = "disconnect"
+	// a connection couldn't be proxied, because dialing its upstream failed:
+	EventUpstreamFailed EventType = "upstream_failed"
+	// a connection was refused by an origin policy's rate limit:
+	EventRateLimited EventType = "rate_limited"
+
+	defaultEventBuffer = 256
+)
+
+// Event describes something that happened to a connection.
+type Event struct {
+	Type     EventType `json:"type"`
+	Time     time.Time `json:"time"`
+	ConnID   string    `json:"conn_id,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	Listener string    `json:"listener,omitempty"`
+	Origin   string    `json:"origin,omitempty"`
+	Upstream string    `json:"upstream,omitempty"`
+	// for disconnect and upstream_failed events:
+	Reason   string `json:"reason,omitempty"`
+	Error    string `json:"error,omitempty"`
+	BytesIn  uint64 `json:"bytes_in,omitempty"`
+	BytesOut uint64 `json:"bytes_out,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+type eventSubscriber struct {
+	events chan Event
+}
+
+// eventBus fans events out to subscribers; the zero value is usable
+type eventBus struct {
+	sync.Mutex // tier 1
+
+	subscribers map[*eventSubscriber]struct{}
+	count       int32 // atomic; len(subscribers), to skip building unwanted events
+}
+
+func (eb *eventBus) subscribe(buffer int) *eventSubscriber {
+	eb.Lock()
+	defer eb.Unlock()
+
+	if eb.subscribers == nil {
+		eb.subscribers = make(map[*eventSubscriber]struct{})
+	}
+	sub := &eventSubscriber{events: make(chan Event, buffer)}
+	eb.subscribers[sub] = struct{}{}
+	atomic.StoreInt32(&eb.count, int32(len(eb.subscribers)))
+	return sub
+}
+
+func (eb *eventBus) unsubscribe(sub *eventSubscriber) {
+	eb.Lock()
+	defer eb.Unlock()
+
+	if _, ok := eb.subscribers[sub]; ok {
+		delete(eb.subscribers, sub)
+		atomic.StoreInt32(&eb.count, int32(len(eb.subscribers)))
+		close(sub.events)
+	}
+}
+
+func (eb *eventBus) active() bool {
+	return atomic.LoadInt32(&eb.count) != 0
+}
+
+func (eb *eventBus) publish(event Event) {
+	eb.Lock()
+	defer eb.Unlock()
+
+	for sub := range eb.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel of connection events, buffering up to buffer
+// of them (or a default, if buffer is not positive); events that don't fit
+// are dropped. The cancel function unsubscribes and closes the channel.
+func (server *Server) Subscribe(buffer int) (events <-chan Event, cancel func()) {
+	if buffer <= 0 {
+		buffer = defaultEventBuffer
+	}
+	sub := server.events.subscribe(buffer)
+	return sub.events, func() { server.events.unsubscribe(sub) }
+}
+
+// emitEvent publishes an event about a client; fill is only called if
+// there are subscribers
+func (server *Server) emitEvent(eventType EventType, client *clientData, fill func(*Event)) {
+	if !server.events.active() {
+		return
+	}
+	event := Event{
+		Type:     eventType,
+		Time:     time.Now().UTC(),
+		ConnID:   client.id,
+		IP:       client.ip.String(),
+		Listener: client.listener,
+		Origin:   client.origin,
+	}
+	if fill != nil {
+		fill(&event)
+	}
+	server.events.publish(event)
+}
+
+// streamEvents serves GET /events on the admin API, as server-sent events
+func (server *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	// the admin API's write timeout would end the stream:
+	controller := http.NewResponseController(w)
+	controller.SetWriteDeadline(time.Time{})
+
+	events, cancel := server.Subscribe(0)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	controller.Flush()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+			controller.Flush()
+		case <-r.Context().Done():
+			return
+		case <-server.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSubscribe(t *testing.T) {
+	server := new(Server)
+	client := &clientData{id: "abc", ip: net.ParseIP("192.0.2.1"), listener: "127.0.0.1:8067"}
+	// no subscribers: fill isn't called
+	server.emitEvent(EventConnect, client, func(*Event) { t.Error("built an unwanted event") })
+
+	events, cancel := server.Subscribe(1)
+	server.emitEvent(EventConnect, client, func(event *Event) { event.Upstream = "ircd1" })
+	// the buffer is full, so this is dropped:
+	server.emitEvent(EventDisconnect, client, nil)
+	event := <-events
+	assertEqual(event.Type, EventConnect)
+	assertEqual(event.ConnID, "abc")
+	assertEqual(event.IP, "192.0.2.1")
+	assertEqual(event.Upstream, "ircd1")
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event %v", event)
+	default:
+	}
+
+	cancel()
+	_, ok := <-events
+	assertEqual(ok, false)
+	// canceling is idempotent:
+	cancel()
+	assertEqual(server.events.active(), false)
+}
+
+func TestAdminEvents(t *testing.T) {
+	server := new(Server)
+	ts := httptest.NewServer(http.HandlerFunc(server.handleAdmin))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assertEqual(resp.Header.Get("Content-Type"), "text/event-stream")
+	// the response headers are sent after subscribing:
+	server.emitEvent(EventRateLimited, &clientData{id: "abc", ip: net.ParseIP("192.0.2.1")}, nil)
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(line, "event: rate_limited\n")
+	line, _ = reader.ReadString('\n')
+	if !strings.HasPrefix(line, `data: {"type":"rate_limited",`) || !strings.Contains(line, `"conn_id":"abc","ip":"192.0.2.1"`) {
+		t.Errorf("unexpected event data %s", line)
+	}
+}
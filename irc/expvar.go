@@ -0,0 +1,83 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"expvar"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Importing expvar serves /debug/vars (including memstats) on the pprof listener
+// (which uses http.DefaultServeMux); the admin API serves it too. We add the
+// "webircproxy" variable, a snapshot of the server's state.
+
+var (
+	expvarOnce   sync.Once
+	expvarServer atomic.Pointer[Server]
+)
+
+// DebugStats is the value of the "webircproxy" expvar.
+type DebugStats struct {
+	Goroutines  int                           `json:"goroutines"`
+	Connections int                           `json:"connections"`
+	BytesIn     uint64                        `json:"bytes_in"`
+	BytesOut    uint64                        `json:"bytes_out"`
+	Listeners   map[string]int                `json:"listeners"`
+	Upstreams   map[string]UpstreamDebugStats `json:"upstreams"`
+	Uptime      float64                       `json:"uptime_seconds"`
+}
+
+// UpstreamDebugStats summarizes the health of an upstream.
+type UpstreamDebugStats struct {
+	Address          string `json:"address"`
+	Drained          bool   `json:"drained"`
+	Connections      int    `json:"connections"`
+	ConnectionsTotal uint64 `json:"connections_total"`
+	DialFailures     uint64 `json:"dial_failures"`
+	WebircFailures   uint64 `json:"webirc_failures"`
+}
+
+func (server *Server) publishExpvar() {
+	expvarServer.Store(server)
+	expvarOnce.Do(func() {
+		expvar.Publish("webircproxy", expvar.Func(func() interface{} {
+			if s := expvarServer.Load(); s != nil {
+				return s.DebugStats()
+			}
+			return nil
+		}))
+	})
+}
+
+// DebugStats returns a snapshot of the server's state.
+func (server *Server) DebugStats() (result DebugStats) {
+	byUpstream, byListener := server.conns.counts()
+	result.Goroutines = runtime.NumGoroutine()
+	for _, count := range byUpstream {
+		result.Connections += count
+	}
+	result.BytesIn = atomic.LoadUint64(&server.metrics.bytesIn)
+	result.BytesOut = atomic.LoadUint64(&server.metrics.bytesOut)
+	result.Listeners = byListener
+	result.Upstreams = make(map[string]UpstreamDebugStats)
+	config := server.Config()
+	if config == nil {
+		return
+	}
+	for _, upstream := range config.allUpstreams() {
+		result.Upstreams[upstream.Name] = UpstreamDebugStats{
+			Address:          upstream.Address,
+			Drained:          server.drains.isDrained(upstream.Name),
+			Connections:      byUpstream[upstream.Name],
+			ConnectionsTotal: server.metrics.connections.Get(upstream.Name),
+			DialFailures:     server.metrics.errors.Get(string(errorUpstreamDialFailed), upstream.Name),
+			WebircFailures:   server.metrics.errors.Get(string(errorWebircWriteFailed), upstream.Name),
+		}
+	}
+	result.Uptime = time.Since(server.startTime).Seconds()
+	return
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// With upstream-dial-attempts greater than 1, a connection whose upstream
+// can't be dialed is sent to another of its available upstreams (chosen by
+// weight, as usual), up to that many dials in all; each upstream is tried at
+// most once. This bounds the work (and the client's wait) when every upstream
+// is down. If all the attempts fail, the connection's error lists each of
+// them (e.g., in the log's close line, the audit log, and DisconnectInfo).
+
+const (
+	defaultUpstreamDialAttempts = 1
+)
+
+// dialAttempt is a failed dial of an upstream
+type dialAttempt struct {
+	upstream string
+	err      error
+}
+
+// dialAttempts is the history of a connection's failed dials; as an error,
+// it describes all of them
+type dialAttempts []dialAttempt
+
+func (attempts dialAttempts) Error() string {
+	descriptions := make([]string, len(attempts))
+	for i, attempt := range attempts {
+		descriptions[i] = fmt.Sprintf("%s: %v", attempt.upstream, attempt.err)
+	}
+	return fmt.Sprintf("all %d dial attempts failed (%s)", len(attempts), strings.Join(descriptions, "; "))
+}
+
+func (attempts dialAttempts) tried(name string) bool {
+	for _, attempt := range attempts {
+		if attempt.upstream == name {
+			return true
+		}
+	}
+	return false
+}
+
+// failoverUpstream chooses the next upstream to dial after the failed
+// attempts, or returns nil if there are no more attempts or upstreams left
+func (server *Server) failoverUpstream(config *Config, client *clientData, attempts dialAttempts) *reverseProxyUpstream {
+	if len(attempts) >= config.UpstreamDialAttempts {
+		return nil
+	}
+	var candidates []*reverseProxyUpstream
+	for _, upstream := range server.availableUpstreams(config, client) {
+		if !attempts.tried(upstream.Name) {
+			candidates = append(candidates, upstream)
+		}
+	}
+	return chooseWeighted(server.runtimeUpstreams.get(), candidates)
+}
+
+// sentIdentity returns the IP to send to the upstream, and with ip-cloaking,
+// the hostname (which depends on the upstream's cloak-salt)
+func (server *Server) sentIdentity(config *Config, client *clientData, upstream *reverseProxyUpstream) (sentIP net.IP, cloakedHostname string) {
+	sentIP = client.ip
+	if client.tor {
+		sentIP = torIP
+	} else if config.IPCloaking.Enabled {
+		cloakedHostname, sentIP = config.IPCloaking.ComputeSaltedCloak(client.ip, upstream.CloakSalt)
+		client.sentIP = sentIP
+	}
+	return
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestFailoverUpstream(t *testing.T) {
+	config := &Config{
+		Upstreams: []reverseProxyUpstream{
+			{Name: "a", Address: "192.0.2.1:6667", Weight: 1},
+			{Name: "b", Address: "192.0.2.2:6667", Weight: 1},
+		},
+		UpstreamDialAttempts: 3,
+	}
+	server := new(Server)
+	server.SetConfig(config)
+
+	attempts := dialAttempts{{upstream: "a", err: errors.New("connection refused")}}
+	assertEqual(server.failoverUpstream(config, &clientData{}, attempts).Name, "b")
+	attempts = append(attempts, dialAttempt{upstream: "b", err: errors.New("i/o timeout")})
+	// each upstream is tried once:
+	assertEqual(server.failoverUpstream(config, &clientData{}, attempts) == nil, true)
+	assertEqual(attempts.Error(), "all 2 dial attempts failed (a: connection refused; b: i/o timeout)")
+
+	config.UpstreamDialAttempts = 1
+	assertEqual(server.failoverUpstream(config, &clientData{}, attempts[:1]) == nil, true)
+}
+
+func TestFailover(t *testing.T) {
+	mock := startMockIRCd(t, "")
+	listen := freeAddress(t)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithListener(listen),
+		WithUpstream(freeAddress(t), UpstreamName("dead1")),
+		WithUpstream(freeAddress(t), UpstreamName("dead2")),
+		WithUpstream(mock.Addr(), UpstreamName("live")),
+		WithYAML("log-level: error\nlookup-hostnames: false\nupstream-dial-attempts: 3"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disconnected := make(chan *DisconnectInfo, 1)
+	var upstreams []string
+	server.SetHooks(&Hooks{
+		OnUpstreamSelected: func(conn *ClientInfo, upstream string) string {
+			return "dead1"
+		},
+		OnDisconnect: func(conn *ClientInfo, info *DisconnectInfo) {
+			upstreams = append(upstreams, conn.Upstream)
+			disconnected <- info
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.RunContext(ctx)
+
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws://"+listen+"/webirc", http.Header{"Origin": []string{"https://example.com"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+
+	// the connection fails over to the live upstream:
+	conn := dial()
+	for _, line := range []string{"NICK alice", "USER u 0 * :Alice"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	info := <-disconnected
+	assertEqual(upstreams[0], "live")
+	assertEqual(info.Reason, CloseClientEOF)
+
+	// without the live upstream, every attempt fails:
+	server.RemoveUpstream("live", false)
+	conn = dial()
+	defer conn.Close()
+	info = <-disconnected
+	assertEqual(info.Reason, CloseUpstreamDialFailed)
+	attempts, ok := info.Error.(dialAttempts)
+	assertEqual(ok, true)
+	assertEqual(len(attempts), 2)
+}
+
+func TestFailoverHostnameLookup(t *testing.T) {
+	mock := startMockIRCd(t, "hunter2")
+	listen := freeAddress(t)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithListener(listen),
+		// the failed upstream doesn't use WEBIRC, but the live one does:
+		WithUpstream(freeAddress(t), UpstreamName("dead")),
+		WithUpstream(mock.Addr(), UpstreamName("live"), UpstreamWebirc("hunter2")),
+		WithYAML("log-level: error\nlookup-hostnames: true\nupstream-dial-attempts: 2"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := lookupHostname(context.Background(), net.ParseIP("127.0.0.1"), config.ForwardConfirmHostnames)
+	if expected == "" {
+		t.Skip("127.0.0.1 has no hostname")
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetHooks(&Hooks{
+		OnUpstreamSelected: func(conn *ClientInfo, upstream string) string {
+			return "dead"
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.RunContext(ctx)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+listen+"/webirc", http.Header{"Origin": []string{"https://example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, line := range []string{"NICK alice", "USER u 0 * :Alice"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	webircs := mock.Webircs()
+	assertEqual(len(webircs), 1)
+	assertEqual(webircs[0].Hostname, expected)
+}
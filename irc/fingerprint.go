@@ -0,0 +1,391 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TLS ClientHello fingerprinting (JA3 and JA4). The ClientHello is not exposed
+// by crypto/tls in raw form, so we record the initial bytes read from each
+// connection on TLS listeners, then parse them once crypto/tls has finished
+// reading the ClientHello (i.e., from GetConfigForClient).
+
+const (
+	// the ClientHello can be at most 2^24 bytes in theory, but in practice
+	// it's always much smaller; give up if it exceeds this:
+	maxRecordedClientHello = 16384
+)
+
+var (
+	errNotClientHello = errors.New("not a TLS ClientHello")
+
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// TLSFingerprint is the JA3 and JA4 fingerprint of a client's ClientHello.
+type TLSFingerprint struct {
+	JA3 string `json:"ja3"`
+	JA4 string `json:"ja4"`
+}
+
+// fingerprintListener wraps the base listener of a TLS listener,
+// returning connections that record the ClientHello
+type fingerprintListener struct {
+	net.Listener
+}
+
+func (fl *fingerprintListener) Accept() (net.Conn, error) {
+	conn, err := fl.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+	return &fingerprintConn{Conn: conn}, nil
+}
+
+type fingerprintConn struct {
+	net.Conn
+
+	sync.Mutex
+	recorded    []byte
+	done        bool
+	fingerprint *TLSFingerprint
+}
+
+func (fc *fingerprintConn) Read(b []byte) (n int, err error) {
+	n, err = fc.Conn.Read(b)
+	if n != 0 {
+		fc.Lock()
+		if !fc.done {
+			fc.recorded = append(fc.recorded, b[:n]...)
+			if len(fc.recorded) > maxRecordedClientHello {
+				fc.done = true
+				fc.recorded = nil
+			}
+		}
+		fc.Unlock()
+	}
+	return
+}
+
+// finish stops recording and computes the fingerprint
+func (fc *fingerprintConn) finish() {
+	fc.Lock()
+	defer fc.Unlock()
+
+	if fc.done {
+		return
+	}
+	fc.done = true
+	hello, err := parseClientHello(skipProxyHeader(fc.recorded))
+	fc.recorded = nil
+	if err == nil {
+		fc.fingerprint = &TLSFingerprint{JA3: hello.ja3(), JA4: hello.ja4()}
+	}
+}
+
+func (fc *fingerprintConn) Fingerprint() *TLSFingerprint {
+	fc.Lock()
+	defer fc.Unlock()
+	return fc.fingerprint
+}
+
+// captureClientHello is installed as tls.Config.GetConfigForClient;
+// it doesn't modify the config, it just triggers fingerprint computation
+func captureClientHello(info *tls.ClientHelloInfo) (*tls.Config, error) {
+	if fc, ok := info.Conn.(*fingerprintConn); ok {
+		fc.finish()
+	}
+	return nil, nil
+}
+
+// getTLSFingerprint retrieves the fingerprint (if any) for an accepted connection
+func getTLSFingerprint(conn net.Conn) *TLSFingerprint {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if fc, ok := tlsConn.NetConn().(*fingerprintConn); ok {
+			return fc.Fingerprint()
+		}
+	}
+	return nil
+}
+
+// if the listener requires PROXY, the recorded bytes begin with the PROXY header
+func skipProxyHeader(data []byte) []byte {
+	if bytes.HasPrefix(data, []byte("PROXY ")) {
+		if idx := bytes.Index(data, crlf); idx != -1 {
+			return data[idx+2:]
+		}
+	} else if bytes.HasPrefix(data, proxyV2Signature) && len(data) >= 16 {
+		length := int(binary.BigEndian.Uint16(data[14:16]))
+		if len(data) >= 16+length {
+			return data[16+length:]
+		}
+	}
+	return data
+}
+
+type clientHello struct {
+	version           uint16
+	ciphers           []uint16
+	extensions        []uint16
+	curves            []uint16
+	pointFormats      []uint8
+	sigAlgs           []uint16
+	alpn              []string
+	hasSNI            bool
+	supportedVersions []uint16
+}
+
+// reassemble the handshake message from one or more TLS records
+func readHandshakeMessage(data []byte) (msg []byte, err error) {
+	var payload []byte
+	for len(data) >= 5 {
+		if data[0] != 0x16 {
+			return nil, errNotClientHello
+		}
+		length := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+length {
+			break
+		}
+		payload = append(payload, data[5:5+length]...)
+		data = data[5+length:]
+		if len(payload) >= 4 {
+			msgLen := int(payload[1])<<16 | int(payload[2])<<8 | int(payload[3])
+			if len(payload) >= 4+msgLen {
+				return payload[:4+msgLen], nil
+			}
+		}
+	}
+	return nil, errNotClientHello
+}
+
+type helloReader struct {
+	data []byte
+	err  bool
+}
+
+func (r *helloReader) bytes(n int) []byte {
+	if r.err || len(r.data) < n {
+		r.err = true
+		return nil
+	}
+	result := r.data[:n]
+	r.data = r.data[n:]
+	return result
+}
+
+func (r *helloReader) uint8() uint8 {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *helloReader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *helloReader) vector16() *helloReader {
+	return &helloReader{data: r.bytes(int(r.uint16())), err: r.err}
+}
+
+func (r *helloReader) uint16List() (result []uint16) {
+	for len(r.data) >= 2 && !r.err {
+		result = append(result, r.uint16())
+	}
+	return
+}
+
+func parseClientHello(data []byte) (hello clientHello, err error) {
+	msg, err := readHandshakeMessage(data)
+	if err != nil {
+		return
+	}
+	if msg[0] != 0x01 {
+		return hello, errNotClientHello
+	}
+	r := &helloReader{data: msg[4:]}
+	hello.version = r.uint16()
+	r.bytes(32)             // random
+	r.bytes(int(r.uint8())) // session ID
+	hello.ciphers = r.vector16().uint16List()
+	r.bytes(int(r.uint8())) // compression methods
+	if len(r.data) != 0 {
+		exts := r.vector16()
+		for len(exts.data) != 0 && !exts.err {
+			extType := exts.uint16()
+			ext := exts.vector16()
+			hello.extensions = append(hello.extensions, extType)
+			switch extType {
+			case 0x0000: // server_name
+				hello.hasSNI = true
+			case 0x000a: // supported_groups
+				hello.curves = ext.vector16().uint16List()
+			case 0x000b: // ec_point_formats
+				hello.pointFormats = ext.bytes(int(ext.uint8()))
+			case 0x000d: // signature_algorithms
+				hello.sigAlgs = ext.vector16().uint16List()
+			case 0x0010: // application_layer_protocol_negotiation
+				protos := ext.vector16()
+				for len(protos.data) != 0 && !protos.err {
+					hello.alpn = append(hello.alpn, string(protos.bytes(int(protos.uint8()))))
+				}
+			case 0x002b: // supported_versions
+				versions := &helloReader{data: ext.bytes(int(ext.uint8()))}
+				hello.supportedVersions = versions.uint16List()
+			}
+		}
+		if exts.err {
+			return hello, errNotClientHello
+		}
+	}
+	if r.err {
+		return hello, errNotClientHello
+	}
+	return hello, nil
+}
+
+// GREASE values (RFC 8701) are ignored by both fingerprint algorithms
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+func stripGREASE(values []uint16) (result []uint16) {
+	for _, v := range values {
+		if !isGREASE(v) {
+			result = append(result, v)
+		}
+	}
+	return
+}
+
+func joinDecimal(values []uint16) string {
+	strs := make([]string, len(values))
+	for i, v := range values {
+		strs[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(strs, "-")
+}
+
+func joinHex(values []uint16) string {
+	strs := make([]string, len(values))
+	for i, v := range values {
+		strs[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(strs, ",")
+}
+
+// https://github.com/salesforce/ja3
+func (hello *clientHello) ja3() string {
+	formats := make([]uint16, len(hello.pointFormats))
+	for i, f := range hello.pointFormats {
+		formats[i] = uint16(f)
+	}
+	fields := []string{
+		strconv.Itoa(int(hello.version)),
+		joinDecimal(stripGREASE(hello.ciphers)),
+		joinDecimal(stripGREASE(hello.extensions)),
+		joinDecimal(stripGREASE(hello.curves)),
+		joinDecimal(formats),
+	}
+	sum := md5.Sum([]byte(strings.Join(fields, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+func ja4Hash(input string) string {
+	if input == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(input))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func isAlnum(b byte) bool {
+	return ('0' <= b && b <= '9') || ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z')
+}
+
+// https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md
+func (hello *clientHello) ja4() string {
+	version := hello.version
+	for _, v := range stripGREASE(hello.supportedVersions) {
+		if v > version {
+			version = v
+		}
+	}
+	var versionStr string
+	switch version {
+	case tls.VersionTLS13:
+		versionStr = "13"
+	case tls.VersionTLS12:
+		versionStr = "12"
+	case tls.VersionTLS11:
+		versionStr = "11"
+	case tls.VersionTLS10:
+		versionStr = "10"
+	case 0x0300:
+		versionStr = "s3"
+	default:
+		versionStr = "00"
+	}
+	sni := "i"
+	if hello.hasSNI {
+		sni = "d"
+	}
+	ciphers := stripGREASE(hello.ciphers)
+	extensions := stripGREASE(hello.extensions)
+	alpn := "00"
+	if len(hello.alpn) != 0 && len(hello.alpn[0]) != 0 {
+		first := hello.alpn[0]
+		if isAlnum(first[0]) && isAlnum(first[len(first)-1]) {
+			alpn = string([]byte{first[0], first[len(first)-1]})
+		} else {
+			h := hex.EncodeToString([]byte(first))
+			alpn = string([]byte{h[0], h[len(h)-1]})
+		}
+	}
+	a := fmt.Sprintf("t%s%s%02d%02d%s", versionStr, sni, min99(len(ciphers)), min99(len(extensions)), alpn)
+
+	sortedCiphers := append([]uint16(nil), ciphers...)
+	sort.Slice(sortedCiphers, func(i, j int) bool { return sortedCiphers[i] < sortedCiphers[j] })
+	b := ja4Hash(joinHex(sortedCiphers))
+
+	var sortedExtensions []uint16
+	for _, ext := range extensions {
+		if ext != 0x0000 && ext != 0x0010 {
+			sortedExtensions = append(sortedExtensions, ext)
+		}
+	}
+	sort.Slice(sortedExtensions, func(i, j int) bool { return sortedExtensions[i] < sortedExtensions[j] })
+	cInput := joinHex(sortedExtensions)
+	if sigAlgs := stripGREASE(hello.sigAlgs); len(sigAlgs) != 0 {
+		cInput = cInput + "_" + joinHex(sigAlgs)
+	}
+	c := ja4Hash(cInput)
+
+	return fmt.Sprintf("%s_%s_%s", a, b, c)
+}
+
+func min99(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
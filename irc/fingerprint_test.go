@@ -0,0 +1,91 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// generate a real ClientHello using crypto/tls
+func captureTestClientHello(t *testing.T, config *tls.Config) []byte {
+	client, server := net.Pipe()
+	go func() {
+		tls.Client(client, config).Handshake()
+	}()
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	var recorded []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := server.Read(buf)
+		recorded = append(recorded, buf[:n]...)
+		if _, err := readHandshakeMessage(recorded); err == nil {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.Close()
+	client.Close()
+	return recorded
+}
+
+func TestParseClientHello(t *testing.T) {
+	data := captureTestClientHello(t, &tls.Config{
+		ServerName: "irc.example.com",
+		NextProtos: []string{"http/1.1"},
+		MinVersion: tls.VersionTLS12,
+	})
+	hello, err := parseClientHello(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(hello.hasSNI, true)
+	assertEqual(hello.alpn, []string{"http/1.1"})
+	if len(hello.ciphers) == 0 || len(hello.sigAlgs) == 0 {
+		t.Errorf("missing ciphers or signature algorithms")
+	}
+
+	ja4 := hello.ja4()
+	if !strings.HasPrefix(ja4, "t13d") || !strings.Contains(ja4, "h1_") {
+		t.Errorf("unexpected ja4 %s", ja4)
+	}
+	assertEqual(len(hello.ja3()), 32)
+
+	// fingerprints are deterministic and independent of the PROXY header:
+	proxied := append([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 5000 443\r\n"), data...)
+	hello2, err := parseClientHello(skipProxyHeader(proxied))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(hello2.ja4(), ja4)
+}
+
+func TestParseClientHelloNoSNI(t *testing.T) {
+	data := captureTestClientHello(t, &tls.Config{InsecureSkipVerify: true})
+	hello, err := parseClientHello(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(hello.hasSNI, false)
+	if !strings.HasPrefix(hello.ja4(), "t13i") || !strings.Contains(hello.ja4(), "00_") {
+		t.Errorf("unexpected ja4 %s", hello.ja4())
+	}
+}
+
+func TestParseInvalidClientHello(t *testing.T) {
+	_, err := parseClientHello([]byte("GET / HTTP/1.1\r\n\r\n"))
+	assertEqual(err, errNotClientHello)
+}
+
+func TestGREASE(t *testing.T) {
+	assertEqual(isGREASE(0x0a0a), true)
+	assertEqual(isGREASE(0xfafa), true)
+	assertEqual(isGREASE(0x1301), false)
+	assertEqual(isGREASE(0x0a1a), false)
+}
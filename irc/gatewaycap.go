@@ -0,0 +1,107 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/ergochat/irc-go/ircmsg"
+)
+
+// With gateway-capability, the upstream's CAP LS replies are amended to
+// advertise a vendored capability describing the gateway, e.g.:
+//
+//	ergo.chat/webircproxy=version=2.1.0,transcoding=fallback
+//
+// so that clients can adapt (e.g., prefer the binary subprotocol if they
+// want the upstream's bytes untouched) without out-of-band configuration.
+// Like sts, it is informational: clients must not request it, and the
+// upstream would refuse the request if they did.
+
+const (
+	defaultGatewayCapName = "ergo.chat/webircproxy"
+)
+
+var (
+	// set by the main package, from its linker flags:
+	Version = ""
+
+	capLSMarker = []byte(" LS ")
+)
+
+type GatewayCapabilityConfig struct {
+	Enabled bool
+	// the capability's name (the default is ergo.chat/webircproxy):
+	Name string
+}
+
+func (conf *GatewayCapabilityConfig) postprocess() error {
+	if conf.Name == "" {
+		conf.Name = defaultGatewayCapName
+	}
+	if strings.ContainsAny(conf.Name, " =,:\r\n") || strings.HasPrefix(conf.Name, "-") {
+		return fmt.Errorf("gateway-capability name is not a valid capability name: %q", conf.Name)
+	}
+	return nil
+}
+
+// gatewayCap returns the capability to advertise (with its value), or ""
+func (config *Config) gatewayCap() string {
+	if !config.GatewayCapability.Enabled {
+		return ""
+	}
+	var values []string
+	if Version != "" {
+		values = append(values, "version="+Version)
+	}
+	values = append(values, "transcoding="+config.Transcoding.mode())
+	return config.GatewayCapability.Name + "=" + strings.Join(values, ",")
+}
+
+// mode describes how lines that aren't UTF-8 are sent to text clients:
+// "none" (they're sent as they are), "fallback" (they're decoded with the
+// configured encodings), or "chardet" (the encoding is detected)
+func (conf *TranscodingConfig) mode() string {
+	switch {
+	case conf.EnableChardet:
+		return "chardet"
+	case len(conf.encodings) != 0:
+		return "fallback"
+	default:
+		return "none"
+	}
+}
+
+// addGatewayCap adds the capability to the line, if it is the final line of
+// a CAP LS reply; otherwise (or if the result would be too long), it returns
+// the line unchanged
+func addGatewayCap(line []byte, capability string, maxLineLen int) []byte {
+	if !bytes.Contains(line, capLSMarker) {
+		return line
+	}
+	msg, err := ircmsg.ParseLine(string(line))
+	// a continuation line has a "*" before the list, so only the final
+	// line has exactly 3 parameters:
+	if err != nil || msg.Command != "CAP" || len(msg.Params) != 3 || !strings.EqualFold(msg.Params[1], "LS") {
+		return line
+	}
+	name, _, _ := strings.Cut(capability, "=")
+	for _, existing := range strings.Fields(msg.Params[2]) {
+		if existing == name || strings.HasPrefix(existing, name+"=") {
+			return line
+		}
+	}
+	if msg.Params[2] == "" {
+		msg.Params[2] = capability
+	} else {
+		msg.Params[2] += " " + capability
+	}
+	amended, err := msg.LineBytesStrict(false, maxLineLen)
+	if err != nil {
+		return line
+	}
+	return bytes.TrimSuffix(amended, crlf)
+}
@@ -0,0 +1,34 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+)
+
+func TestAddGatewayCap(t *testing.T) {
+	capability := "ergo.chat/webircproxy=transcoding=none"
+	add := func(line string) string {
+		return string(addGatewayCap([]byte(line), capability, DefaultMaxLineLen))
+	}
+	assertEqual(add(":irc.example.com CAP * LS :sasl server-time"), ":irc.example.com CAP * LS :sasl server-time ergo.chat/webircproxy=transcoding=none")
+	assertEqual(add(":irc.example.com CAP * LS :"), ":irc.example.com CAP * LS ergo.chat/webircproxy=transcoding=none")
+	// only the final line of a multiline reply:
+	assertEqual(add(":irc.example.com CAP * LS * :sasl server-time"), ":irc.example.com CAP * LS * :sasl server-time")
+	assertEqual(add(":irc.example.com CAP alice ACK :server-time"), ":irc.example.com CAP alice ACK :server-time")
+	assertEqual(add(":alice!u@h PRIVMSG #chan : LS is great"), ":alice!u@h PRIVMSG #chan : LS is great")
+	// already advertised (e.g., by another gateway):
+	assertEqual(add(":irc.example.com CAP * LS :ergo.chat/webircproxy sasl"), ":irc.example.com CAP * LS :ergo.chat/webircproxy sasl")
+}
+
+func TestGatewayCapValue(t *testing.T) {
+	config, err := NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667"), WithEncodings("ISO-8859-1"), WithYAML("gateway-capability: {enabled: true}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(config.gatewayCap(), "ergo.chat/webircproxy=transcoding=fallback")
+
+	_, err = NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667"), WithYAML("gateway-capability: {enabled: true, name: \"bad name\"}"))
+	assertEqual(err != nil, true)
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/ergochat/ergo/irc/utils"
+)
+
+// NewHandler lets a Go web application serve the gateway from its own
+// http.Server (e.g., on a path of its mux), instead of from our listeners.
+
+const (
+	defaultHandlerName = "handler"
+)
+
+// HandlerOption configures a handler created by NewHandler.
+type HandlerOption func(*handlerOptions)
+
+type handlerOptions struct {
+	name          string
+	profile       string
+	requireSecure bool
+}
+
+// WithListenerName sets the name that identifies the handler's connections
+// in logs, metrics, and the admin API, in place of a listener address.
+func WithListenerName(name string) HandlerOption {
+	return func(o *handlerOptions) {
+		o.name = name
+	}
+}
+
+// WithProfile makes the handler's connections use the config of a profile,
+// as if they had been received on one of its listeners.
+func WithProfile(profile string) HandlerOption {
+	return func(o *handlerOptions) {
+		o.profile = profile
+	}
+}
+
+// WithRequireSecure rejects connections that are not over TLS,
+// as does the require-secure listener setting.
+func WithRequireSecure() HandlerOption {
+	return func(o *handlerOptions) {
+		o.requireSecure = true
+	}
+}
+
+// NewHandler returns an http.Handler that accepts IRC-over-websocket
+// connections and proxies them to the server's upstreams, applying the same
+// checks (origins, header rules, bans, etc.) as the server's own listeners.
+// The server's current config is used for each request, so rehashing works
+// as usual. X-Forwarded-For and X-Forwarded-Proto are accepted from the IPs
+// in proxy-allowed-from; TLS fingerprints and the PROXY protocol are not
+// available, since the embedding application owns the connection.
+func NewHandler(server *Server, opts ...HandlerOption) http.Handler {
+	options := handlerOptions{name: defaultHandlerName}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := server.Config()
+		if options.profile != "" {
+			config = config.profiles[options.profile]
+			if config == nil {
+				server.Log(LogComponentListener, LogLevelError, "handler refers to a nonexistent profile", slog.String(logKeyListener, options.name), slog.String("profile", options.profile))
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+		}
+		clientIP, realIP, secure := requestProxyData(r, config)
+		var ident *identQuery
+		if clientIP.Equal(realIP) {
+			ident = requestIdentQuery(r)
+		}
+		server.serveWebSocket(w, r, incomingRequest{
+			config:        config,
+			connID:        newConnID(),
+			listener:      options.name,
+			profile:       options.profile,
+			requireSecure: options.requireSecure,
+			clientIP:      clientIP,
+			realIP:        realIP,
+			secure:        secure,
+			ident:         ident,
+			tlsState:      r.TLS,
+		})
+	})
+}
+
+// requestProxyData is the equivalent of confirmProxyData for a request
+// received by someone else's http.Server
+func requestProxyData(r *http.Request, config *Config) (clientIP, realIP net.IP, secure bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err == nil {
+		realIP = net.ParseIP(host)
+	}
+	if realIP == nil {
+		// e.g., a unix socket
+		realIP = utils.IPv4LoopbackAddress
+	}
+	trusted := utils.IPInNets(realIP, config.proxyAllowedFromNets)
+
+	clientIP = realIP
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		if proxiedIP := utils.HandleXForwardedFor(r.RemoteAddr, xff, config.proxyAllowedFromNets); proxiedIP != nil {
+			clientIP = proxiedIP
+		}
+	}
+	secure = r.TLS != nil || (trusted && r.Header.Get("X-Forwarded-Proto") == "https")
+	return
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ergochat/ergo/irc/utils"
+)
+
+func TestRequestProxyData(t *testing.T) {
+	config := new(Config)
+	var err error
+	config.proxyAllowedFromNets, err = utils.ParseNetList([]string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/webirc", nil)
+	r.RemoteAddr = "192.0.2.1:39000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	clientIP, realIP, secure := requestProxyData(r, config)
+	// not from a trusted proxy:
+	assertEqual(clientIP.String(), "192.0.2.1")
+	assertEqual(realIP.String(), "192.0.2.1")
+	assertEqual(secure, false)
+
+	r.RemoteAddr = "127.0.0.1:39000"
+	clientIP, realIP, secure = requestProxyData(r, config)
+	assertEqual(clientIP.String(), "198.51.100.1")
+	assertEqual(realIP.String(), "127.0.0.1")
+	assertEqual(secure, true)
+
+	r.Header.Del("X-Forwarded-For")
+	r.Header.Del("X-Forwarded-Proto")
+	r.RemoteAddr = "@"
+	clientIP, _, secure = requestProxyData(r, config)
+	assertEqual(clientIP.String(), "127.0.0.1")
+	assertEqual(secure, false)
+
+	r.TLS = &tls.ConnectionState{}
+	_, _, secure = requestProxyData(r, config)
+	assertEqual(secure, true)
+}
+
+func TestHandlerRejectsHTTP2(t *testing.T) {
+	config, err := NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667"), WithYAML("log-level: error"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	ts := httptest.NewUnstartedServer(NewHandler(server))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	response, err := ts.Client().Get(ts.URL + "/webirc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assertEqual(response.ProtoMajor, 2)
+	assertEqual(response.StatusCode, http.StatusHTTPVersionNotSupported)
+}
@@ -0,0 +1,269 @@
+//go:build !windows && !plan9
+
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/okzk/sdnotify"
+)
+
+// Zero-downtime restarts: on SIGUSR2, we start a new copy of the executable,
+// passing it the listening sockets. Once the new process is ready, we stop
+// accepting connections and exit after the existing connections have closed
+// (or handoff-drain-timeout elapses). Listening sockets passed by systemd
+// socket activation (LISTEN_FDS) are also used.
+
+const (
+	envListenFDs = "WEBIRCPROXY_LISTEN_FDS"
+	envReadyFD   = "WEBIRCPROXY_READY_FD"
+	// the first file descriptor passed by exec.Cmd.ExtraFiles or systemd:
+	listenFDsStart = 3
+
+	handoffReadyTimeout = 30 * time.Second
+)
+
+var (
+	errHandoffInProgress = errors.New("a handoff to a new process is in progress")
+
+	inherited struct {
+		sync.Mutex
+		loaded    bool
+		listeners []net.Listener
+	}
+)
+
+func setupHandoffSignal(server *Server) {
+	signal.Notify(server.handoffSignal, syscall.SIGUSR2)
+}
+
+// loadInheritedListeners reads the listening sockets passed by a parent
+// webircproxy process or by systemd; requires inherited.Lock
+func loadInheritedListeners() {
+	if inherited.loaded {
+		return
+	}
+	inherited.loaded = true
+
+	count, _ := strconv.Atoi(os.Getenv(envListenFDs))
+	if count == 0 && os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
+		count, _ = strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	}
+	// don't pass these on to any child processes:
+	for _, env := range []string{envListenFDs, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(env)
+	}
+
+	for i := 0; i < count; i++ {
+		file := os.NewFile(uintptr(listenFDsStart+i), "listener")
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err == nil {
+			inherited.listeners = append(inherited.listeners, listener)
+		}
+	}
+}
+
+// takeInheritedListener returns an inherited listener bound to addr, if there is one
+func takeInheritedListener(addr string) net.Listener {
+	inherited.Lock()
+	defer inherited.Unlock()
+
+	loadInheritedListeners()
+	for i, listener := range inherited.listeners {
+		if listenerAddrMatches(addr, listener.Addr()) {
+			inherited.listeners = append(inherited.listeners[:i], inherited.listeners[i+1:]...)
+			return listener
+		}
+	}
+	return nil
+}
+
+// closeUnusedInheritedListeners closes inherited listeners that aren't in the config
+func closeUnusedInheritedListeners() {
+	inherited.Lock()
+	defer inherited.Unlock()
+
+	for _, listener := range inherited.listeners {
+		listener.Close()
+	}
+	inherited.listeners = nil
+}
+
+// listenerAddrMatches checks whether a listener address from the config
+// (e.g., ":8097" or "/tmp/webircproxy_sock") refers to the bound address
+func listenerAddrMatches(configured string, actual net.Addr) bool {
+	configured = strings.TrimPrefix(configured, "unix:")
+	if actual.Network() == "unix" {
+		return configured == actual.String()
+	}
+	tcpAddr, ok := actual.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	host, port, err := net.SplitHostPort(configured)
+	if err != nil || port != strconv.Itoa(tcpAddr.Port) {
+		return false
+	}
+	if host == "" {
+		return tcpAddr.IP.IsUnspecified()
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if ip.Equal(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// signalHandoffReady tells the parent process (if any) that we're serving
+func signalHandoffReady() {
+	fd, err := strconv.Atoi(os.Getenv(envReadyFD))
+	if err != nil {
+		return
+	}
+	os.Unsetenv(envReadyFD)
+	pipe := os.NewFile(uintptr(fd), "handoff-ready")
+	pipe.Write([]byte{1})
+	pipe.Close()
+}
+
+func listenerFile(listener net.Listener) (*os.File, error) {
+	switch l := listener.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		return l.File()
+	default:
+		return nil, fmt.Errorf("can't pass listener of type %T", listener)
+	}
+}
+
+// handoff starts a new process with our listeners; if it succeeds, we stop
+// listening and exit once the existing connections close.
+func (server *Server) handoff() (err error) {
+	defer server.HandlePanic()
+
+	server.rehashMutex.Lock()
+	defer server.rehashMutex.Unlock()
+
+	if server.handedOff {
+		return errHandoffInProgress
+	}
+	server.Log(LogComponentServer, LogLevelInfo, "Attempting handoff to a new process")
+
+	var addrs []string
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for addr, listener := range server.listeners {
+		file, err := listenerFile(listener.base)
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, addr)
+		files = append(files, file)
+	}
+
+	executable, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyRead.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyWrite)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", envListenFDs, len(files)),
+		fmt.Sprintf("%s=%d", envReadyFD, listenFDsStart+len(files)),
+	)
+	err = cmd.Start()
+	readyWrite.Close()
+	if err != nil {
+		return err
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	ready := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, 1)
+		n, _ := readyRead.Read(buf)
+		ready <- n == 1
+	}()
+	select {
+	case ok := <-ready:
+		if !ok {
+			cmd.Process.Kill()
+			return errors.New("new process exited without becoming ready")
+		}
+	case err := <-exited:
+		return fmt.Errorf("new process exited: %v", err)
+	case <-time.After(handoffReadyTimeout):
+		cmd.Process.Kill()
+		return errors.New("timed out waiting for the new process to become ready")
+	}
+
+	// the new process is serving; tell systemd to track it instead of us
+	server.handedOff = true
+	sdnotify.SdNotify(fmt.Sprintf("MAINPID=%d", cmd.Process.Pid))
+	server.Log(LogComponentServer, LogLevelInfo, "Handed off listeners to new process", slog.Int("pid", cmd.Process.Pid), slog.String("listeners", strings.Join(addrs, ",")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for addr, listener := range server.listeners {
+		if unixListener, ok := listener.base.(*net.UnixListener); ok {
+			// the socket file now belongs to the new process:
+			unixListener.SetUnlinkOnClose(false)
+		}
+		// finish any in-progress websocket upgrades:
+		listener.Shutdown(ctx)
+		delete(server.listeners, addr)
+	}
+	// there will be no new connections to use the pooled ones:
+	server.prewarm.stop()
+
+	drainTimeout := server.Config().HandoffDrainTimeout
+	server.notifyShutdown(nil, time.Now().Add(drainTimeout), "This gateway is restarting")
+	go server.drainAndExit(drainTimeout)
+	return nil
+}
+
+// drainAndExit waits for the proxied connections to close, then exits
+func (server *Server) drainAndExit(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for len(server.conns.all()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+	}
+	server.Log(LogComponentServer, LogLevelInfo, "Finished draining connections after handoff", slog.Int("remaining", len(server.conns.all())))
+	server.exitSignals <- syscall.SIGTERM
+}
@@ -0,0 +1,31 @@
+//go:build windows || plan9
+
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"net"
+)
+
+var (
+	errHandoffInProgress = errors.New("a handoff to a new process is in progress")
+)
+
+// socket handoff is not supported on this platform
+
+func setupHandoffSignal(server *Server) {}
+
+func takeInheritedListener(addr string) net.Listener {
+	return nil
+}
+
+func closeUnusedInheritedListeners() {}
+
+func signalHandoffReady() {}
+
+func (server *Server) handoff() error {
+	return errors.New("socket handoff is not supported on this platform")
+}
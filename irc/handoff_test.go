@@ -0,0 +1,27 @@
+//go:build !windows && !plan9
+
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenerAddrMatches(t *testing.T) {
+	loopback := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8097}
+	unspecified := &net.TCPAddr{IP: net.IPv6unspecified, Port: 8097}
+	unix := &net.UnixAddr{Name: "/tmp/webircproxy_sock", Net: "unix"}
+
+	assertEqual(listenerAddrMatches("127.0.0.1:8097", loopback), true)
+	assertEqual(listenerAddrMatches("127.0.0.1:8098", loopback), false)
+	assertEqual(listenerAddrMatches(":8097", loopback), false)
+	assertEqual(listenerAddrMatches(":8097", unspecified), true)
+	assertEqual(listenerAddrMatches("[::1]:8097", loopback), false)
+	assertEqual(listenerAddrMatches("/tmp/webircproxy_sock", unix), true)
+	assertEqual(listenerAddrMatches("unix:/tmp/webircproxy_sock", unix), true)
+	assertEqual(listenerAddrMatches("/tmp/other_sock", unix), false)
+	assertEqual(listenerAddrMatches("/tmp/webircproxy_sock", loopback), false)
+}
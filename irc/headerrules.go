@@ -0,0 +1,129 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/ergochat/ergo/irc/utils"
+)
+
+type headerRuleAction uint
+
+const (
+	headerRuleReject headerRuleAction = iota
+	headerRuleTag
+)
+
+// HeaderRule matches an HTTP request header of incoming websocket connections
+// (or their TLS fingerprint), then either rejects the connection or tags it
+// (tags are recorded in the logs).
+type HeaderRule struct {
+	Header string
+	// alternately, "ja3" or "ja4" to match the TLS ClientHello fingerprint:
+	TLSFingerprint string `yaml:"tls-fingerprint"`
+	// case-insensitive globs; the rule matches if any of them match the header value:
+	Match []string
+	// match if the header is absent or empty (instead of matching its value).
+	// connections that weren't fingerprinted (plaintext ones, and those whose
+	// TLS was terminated by a reverse proxy) have an absent fingerprint, so
+	// an absent tls-fingerprint rule matches all of them:
+	Absent bool
+	// "reject" or "tag":
+	Action string
+	Tag    string
+
+	matchRegexp *regexp.Regexp
+	action      headerRuleAction
+}
+
+func (rule *HeaderRule) postprocess() (err error) {
+	rule.TLSFingerprint = strings.ToLower(rule.TLSFingerprint)
+	switch rule.TLSFingerprint {
+	case "":
+		if rule.Header == "" {
+			return fmt.Errorf("header rules must specify a header or tls-fingerprint")
+		}
+		rule.Header = http.CanonicalHeaderKey(rule.Header)
+	case "ja3", "ja4":
+		if rule.Header != "" {
+			return fmt.Errorf("header rules cannot specify both a header and tls-fingerprint")
+		}
+	default:
+		return fmt.Errorf("invalid tls-fingerprint type in header rule: %s", rule.TLSFingerprint)
+	}
+	if rule.Absent == (len(rule.Match) != 0) {
+		return fmt.Errorf("header rule for %s must specify exactly one of match or absent", rule.name())
+	}
+	if len(rule.Match) != 0 {
+		globs := make([]string, len(rule.Match))
+		for i, glob := range rule.Match {
+			globs[i] = strings.ToLower(glob)
+		}
+		rule.matchRegexp, err = utils.CompileMasks(globs)
+		if err != nil {
+			return fmt.Errorf("invalid header rule pattern for %s: %v", rule.name(), err)
+		}
+	}
+	switch strings.ToLower(rule.Action) {
+	case "", "reject":
+		rule.action = headerRuleReject
+	case "tag":
+		rule.action = headerRuleTag
+		if rule.Tag == "" {
+			return fmt.Errorf("header rule for %s has action tag, but no tag", rule.name())
+		}
+	default:
+		return fmt.Errorf("invalid header rule action: %s", rule.Action)
+	}
+	return nil
+}
+
+func (rule *HeaderRule) name() string {
+	if rule.TLSFingerprint != "" {
+		return rule.TLSFingerprint
+	}
+	return rule.Header
+}
+
+func (rule *HeaderRule) matches(header http.Header, fingerprint *TLSFingerprint) bool {
+	var value string
+	switch rule.TLSFingerprint {
+	case "":
+		value = strings.TrimSpace(header.Get(rule.Header))
+	case "ja3":
+		if fingerprint != nil {
+			value = fingerprint.JA3
+		}
+	case "ja4":
+		if fingerprint != nil {
+			value = fingerprint.JA4
+		}
+	}
+	if rule.Absent {
+		return value == ""
+	}
+	return rule.matchRegexp.MatchString(strings.ToLower(value))
+}
+
+// applyHeaderRules evaluates all header rules against a request; it returns
+// the tags that apply, or rejected=true and the rule that rejected the request.
+func (config *Config) applyHeaderRules(header http.Header, fingerprint *TLSFingerprint) (tags []string, rejected bool, rejectedBy *HeaderRule) {
+	for i := range config.HeaderRules {
+		rule := &config.HeaderRules[i]
+		if !rule.matches(header, fingerprint) {
+			continue
+		}
+		switch rule.action {
+		case headerRuleReject:
+			return tags, true, rule
+		case headerRuleTag:
+			tags = append(tags, rule.Tag)
+		}
+	}
+	return
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"net/http"
+	"testing"
+)
+
+func testHeaderRulesConfig(t *testing.T, rules ...HeaderRule) *Config {
+	config := &Config{HeaderRules: rules}
+	for i := range config.HeaderRules {
+		if err := config.HeaderRules[i].postprocess(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return config
+}
+
+func TestHeaderRuleMatch(t *testing.T) {
+	config := testHeaderRulesConfig(t,
+		// header names and globs are case-insensitive:
+		HeaderRule{Header: "user-agent", Match: []string{"*Python-Requests*", "curl/*"}, Action: "tag", Tag: "bot"},
+	)
+	rule := &config.HeaderRules[0]
+	assertEqual(rule.Header, "User-Agent")
+	header := http.Header{}
+	header.Set("User-Agent", "python-requests/2.31")
+	assertEqual(rule.matches(header, nil), true)
+	header.Set("User-Agent", "  CURL/8.4.0 ")
+	assertEqual(rule.matches(header, nil), true)
+	header.Set("User-Agent", "Mozilla/5.0 (curl/8.4.0)")
+	assertEqual(rule.matches(header, nil), false)
+	assertEqual(rule.matches(http.Header{}, nil), false)
+}
+
+func TestHeaderRuleAbsent(t *testing.T) {
+	config := testHeaderRulesConfig(t,
+		HeaderRule{Header: "User-Agent", Absent: true},
+		HeaderRule{TLSFingerprint: "JA3", Absent: true},
+		HeaderRule{TLSFingerprint: "ja4", Match: []string{"t13d*"}},
+	)
+	userAgent, ja3, ja4 := &config.HeaderRules[0], &config.HeaderRules[1], &config.HeaderRules[2]
+
+	assertEqual(userAgent.matches(http.Header{}, nil), true)
+	assertEqual(userAgent.matches(http.Header{"User-Agent": []string{" "}}, nil), true)
+	assertEqual(userAgent.matches(http.Header{"User-Agent": []string{"Mozilla/5.0"}}, nil), false)
+
+	// a connection without a fingerprint (e.g., a plaintext one) has an
+	// absent fingerprint, and matches no globs:
+	assertEqual(ja3.matches(http.Header{}, nil), true)
+	assertEqual(ja4.matches(http.Header{}, nil), false)
+	fingerprint := &TLSFingerprint{JA3: "771,4865-4866,0-23,29,0", JA4: "t13d1516h2_8daaf6152771_02713d6af862"}
+	assertEqual(ja3.matches(http.Header{}, fingerprint), false)
+	assertEqual(ja4.matches(http.Header{}, fingerprint), true)
+	assertEqual(ja3.matches(http.Header{}, &TLSFingerprint{JA4: fingerprint.JA4}), true)
+}
+
+func TestApplyHeaderRules(t *testing.T) {
+	config := testHeaderRulesConfig(t,
+		HeaderRule{Header: "User-Agent", Match: []string{"*bot*"}, Action: "tag", Tag: "bot"},
+		HeaderRule{Header: "User-Agent", Match: []string{"evilbot*"}, Action: "reject"},
+		HeaderRule{Header: "User-Agent", Match: []string{"*"}},
+		HeaderRule{Header: "Accept-Language", Absent: true, Action: "tag", Tag: "no-language"},
+	)
+	header := http.Header{}
+	header.Set("User-Agent", "evilbot/1.0")
+	tags, rejected, rejectedBy := config.applyHeaderRules(header, nil)
+	// the first reject applies, keeping the tags before it:
+	assertEqual(tags, []string{"bot"})
+	assertEqual(rejected, true)
+	assertEqual(rejectedBy, &config.HeaderRules[1])
+
+	// the tags of every matching rule apply:
+	config.HeaderRules = append(config.HeaderRules[:2], config.HeaderRules[3])
+	header.Set("User-Agent", "goodbot/1.0")
+	tags, rejected, rejectedBy = config.applyHeaderRules(header, nil)
+	assertEqual(tags, []string{"bot", "no-language"})
+	assertEqual(rejected, false)
+	assertEqual(rejectedBy == nil, true)
+
+	header.Set("User-Agent", "Mozilla/5.0")
+	header.Set("Accept-Language", "en")
+	tags, rejected, _ = config.applyHeaderRules(header, nil)
+	assertEqual(tags == nil, true)
+	assertEqual(rejected, false)
+}
+
+func TestHeaderRulePostprocess(t *testing.T) {
+	for _, tc := range []struct {
+		rule HeaderRule
+		err  string
+	}{
+		{HeaderRule{Match: []string{"*"}}, "header rules must specify a header or tls-fingerprint"},
+		{HeaderRule{Header: "User-Agent", TLSFingerprint: "ja3", Match: []string{"*"}}, "header rules cannot specify both a header and tls-fingerprint"},
+		{HeaderRule{TLSFingerprint: "ja5", Match: []string{"*"}}, "invalid tls-fingerprint type in header rule: ja5"},
+		{HeaderRule{Header: "User-Agent"}, "header rule for User-Agent must specify exactly one of match or absent"},
+		{HeaderRule{TLSFingerprint: "ja4", Match: []string{"*"}, Absent: true}, "header rule for ja4 must specify exactly one of match or absent"},
+		{HeaderRule{Header: "User-Agent", Match: []string{"\xff"}}, "invalid header rule pattern for User-Agent: error parsing regexp: invalid UTF-8: `\uFFFD`"},
+		{HeaderRule{Header: "User-Agent", Absent: true, Action: "tag"}, "header rule for User-Agent has action tag, but no tag"},
+		{HeaderRule{Header: "User-Agent", Absent: true, Action: "ban"}, "invalid header rule action: ban"},
+	} {
+		err := tc.rule.postprocess()
+		if err == nil {
+			t.Fatalf("expected error %q", tc.err)
+		}
+		assertEqual(err.Error(), tc.err)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// Hooks are optional callbacks at points in a connection's lifecycle, for
+// embedders that need custom accounting, authentication, or routing; see
+// (*Server).SetHooks. Each of them may be nil. They are called synchronously
+// by the goroutine handling the connection, so they should return quickly.
+type Hooks struct {
+	// OnConnect is called after the configured checks (origins, bans, etc.)
+	// have accepted a connection, before the websocket upgrade. Returning
+	// an error rejects the connection with status 403.
+	OnConnect func(conn *ClientInfo) error
+	// OnUpstreamSelected is called with the name of the upstream chosen for
+	// the connection, and returns the name of the upstream to use, which
+	// can be any upstream in the connection's config (even a drained one).
+	OnUpstreamSelected func(conn *ClientInfo, upstream string) string
+	// OnDisconnect is called exactly once for each connection that was
+	// accepted by OnConnect, when it closes (or fails to be proxied).
+	OnDisconnect func(conn *ClientInfo, info *DisconnectInfo)
+}
+
+// ClientInfo describes a client connection, for Hooks.
+type ClientInfo struct {
+	ID string
+	// the client's IP (possibly supplied by a trusted reverse proxy), and the
+	// IP the connection was actually received from:
+	IP     net.IP
+	RealIP net.IP
+	Secure bool
+	// listener address (or the name set by WithListenerName), and profile:
+	Listener string
+	Profile  string
+	Origin   string
+	// the headers of the websocket upgrade request:
+	Header http.Header
+	// tags applied by header rules and the reputation service:
+	Tags        []string
+	Fingerprint *TLSFingerprint
+	// name of the upstream, once one has been selected:
+	Upstream string
+	// the client's account (initially from account-header, if configured);
+	// OnConnect can set it, for upstreams that receive the account WEBIRC flag:
+	Account string
+	// for the embedder's use, e.g., to pass state from OnConnect to OnDisconnect:
+	Data interface{}
+}
+
+// DisconnectInfo describes how a connection ended, for OnDisconnect.
+type DisconnectInfo struct {
+	// see closereasons.go:
+	Reason CloseReason
+	Error  error
+	// bytes read from the client and from the upstream, respectively:
+	BytesIn  uint64
+	BytesOut uint64
+	// how long the connection was proxied for (zero if it never was):
+	Duration time.Duration
+}
+
+// SetHooks sets the lifecycle hooks for new connections; nil removes them.
+// Connections in progress keep using the hooks they started with.
+func (server *Server) SetHooks(hooks *Hooks) {
+	if hooks == nil {
+		server.hooks.Store(nil)
+	} else {
+		hooksCopy := *hooks
+		server.hooks.Store(&hooksCopy)
+	}
+}
+
+// finishConnection releases the connection's slot and calls OnDisconnect;
+// it must be called exactly once for each connection that acquired a slot
+func (server *Server) finishConnection(client *clientData, info DisconnectInfo) {
+	server.connSlots.release()
+	server.countDisconnect(info.Reason)
+	if client.hooks != nil && client.hooks.OnDisconnect != nil {
+		client.hooks.OnDisconnect(client.info, &info)
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+)
+
+func TestFinishConnection(t *testing.T) {
+	server := new(Server)
+	var disconnected []*DisconnectInfo
+	hooks := &Hooks{
+		OnDisconnect: func(conn *ClientInfo, info *DisconnectInfo) {
+			assertEqual(conn.ID, "1")
+			disconnected = append(disconnected, info)
+		},
+	}
+	server.SetHooks(hooks)
+	// the server keeps its own copy:
+	hooks.OnDisconnect = nil
+
+	assertEqual(server.connSlots.tryAcquire(0), true)
+	client := &clientData{id: "1", hooks: server.hooks.Load(), info: &ClientInfo{ID: "1"}}
+	server.finishConnection(client, DisconnectInfo{Reason: CloseKilled, BytesIn: 10})
+	assertEqual(server.connSlots.active.Load(), int64(0))
+	assertEqual(len(disconnected), 1)
+	assertEqual(*disconnected[0], DisconnectInfo{Reason: CloseKilled, BytesIn: 10})
+
+	// connections without hooks just release their slot:
+	server.SetHooks(nil)
+	assertEqual(server.connSlots.tryAcquire(0), true)
+	server.finishConnection(&clientData{id: "2", hooks: server.hooks.Load()}, DisconnectInfo{})
+	assertEqual(server.connSlots.active.Load(), int64(0))
+	assertEqual(len(disconnected), 1)
+}
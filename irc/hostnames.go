@@ -0,0 +1,78 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ergochat/ergo/irc/utils"
+)
+
+// Reverse DNS lookups for WEBIRC run while we connect to the upstream, with
+// a timeout, and with a bound on how many run at once (limits.max-hostname-lookups),
+// so that a slow resolver can neither delay connections indefinitely nor pile up
+// goroutines. If a lookup can't start or doesn't finish in time, the client's
+// IP is used as its hostname, as if the lookup had failed.
+
+const (
+	defaultHostnameLookupTimeout = 2 * time.Second
+	defaultMaxHostnameLookups    = 64
+)
+
+// startHostnameLookup looks up the client's hostname in the background;
+// the channel receives the result (or the IP as a hostname, on failure)
+func (server *Server) startHostnameLookup(config *Config, ip net.IP, logAttrs []slog.Attr) <-chan string {
+	result := make(chan string, 1)
+	ipHostname := utils.IPStringToHostname(ip.String())
+	if !server.hostnameLookups.tryAcquire(server.Config().Limits.MaxHostnameLookups) {
+		server.Log(LogComponentProxy, LogLevelWarn, "too many hostname lookups in progress, using the IP as the hostname", logAttrs...)
+		result <- ipHostname
+		return result
+	}
+	go func() {
+		defer server.hostnameLookups.release()
+
+		ctx, cancel := context.WithTimeout(context.Background(), config.HostnameLookupTimeout)
+		defer cancel()
+		hostname, err := lookupHostname(ctx, ip, config.ForwardConfirmHostnames)
+		if hostname == "" {
+			hostname = ipHostname
+			if err != nil && ctx.Err() != nil {
+				server.Log(LogComponentProxy, LogLevelDebug, "hostname lookup timed out", logAttrs...)
+			}
+		}
+		result <- hostname
+	}()
+	return result
+}
+
+// lookupHostname is utils.LookupHostname, but cancelable;
+// it returns "" if the IP has no (confirmed) hostname
+func lookupHostname(ctx context.Context, ip net.IP, forwardConfirm bool) (hostname string, err error) {
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip.String())
+	if err != nil || len(names) == 0 {
+		return "", err
+	}
+	candidate := strings.TrimSuffix(names[0], ".")
+	if !utils.IsHostname(candidate) {
+		return "", nil
+	}
+	if !forwardConfirm {
+		return candidate, nil
+	}
+	addrs, err := net.DefaultResolver.LookupHost(ctx, candidate)
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if forwardIP := net.ParseIP(addr); ip.Equal(forwardIP) {
+			return candidate, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHostnameLookupLimits(t *testing.T) {
+	server := new(Server)
+	config := &Config{HostnameLookupTimeout: time.Nanosecond}
+	config.Limits.MaxHostnameLookups = 1
+	server.SetConfig(config)
+	ip := net.ParseIP("2001:db8::1")
+
+	// the lookup can't finish in time:
+	assertEqual(<-server.startHostnameLookup(config, ip, nil), "2001:db8::1")
+
+	// no lookups are available:
+	for !server.hostnameLookups.tryAcquire(1) {
+		// the first lookup hasn't released its slot yet
+		time.Sleep(time.Millisecond)
+	}
+	config.HostnameLookupTimeout = time.Minute
+	select {
+	case hostname := <-server.startHostnameLookup(config, ip, nil):
+		assertEqual(hostname, "2001:db8::1")
+	case <-time.After(time.Second):
+		t.Error("lookup should not have been attempted")
+	}
+	server.hostnameLookups.release()
+}
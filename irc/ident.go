@@ -0,0 +1,142 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ident (RFC 1413) lookups: we ask an identd on the client's host which user
+// owns its connection to us, as traditional IRC servers do. This only works
+// for direct TCP connections, since for a connection received through a
+// reverse proxy (or the PROXY protocol, or Tor), we don't know the ports.
+
+const (
+	identPort = 113
+	// usernames are truncated to this length, as IRC servers do:
+	identMaxUsernameLen = 32
+)
+
+var (
+	errIdentNoUser = errors.New("ident server returned no user")
+)
+
+// IdentConfig configures ident lookups.
+type IdentConfig struct {
+	Enabled bool
+	Timeout time.Duration
+	// whether to send the username to the upstream, in the WEBIRC flag
+	// ident=<username>; otherwise it is only logged:
+	Forward bool
+}
+
+func (conf *IdentConfig) postprocess() {
+	if conf.Timeout == 0 {
+		conf.Timeout = 2 * time.Second
+	}
+}
+
+// identQuery identifies the client's TCP connection to us
+type identQuery struct {
+	clientIP   net.IP
+	clientPort int
+	serverIP   net.IP
+	serverPort int
+}
+
+// newIdentQuery returns the query for a connection, or nil if it isn't TCP
+func newIdentQuery(remote, local net.Addr) *identQuery {
+	remoteTCP, ok := remote.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	localTCP, ok := local.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	return &identQuery{
+		clientIP:   remoteTCP.IP,
+		clientPort: remoteTCP.Port,
+		serverIP:   localTCP.IP,
+		serverPort: localTCP.Port,
+	}
+}
+
+// requestIdentQuery is newIdentQuery for a request received by someone
+// else's http.Server (see NewHandler)
+func requestIdentQuery(r *http.Request) *identQuery {
+	remote, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return newIdentQuery(remote, local)
+}
+
+// lookupIdent queries the client's identd for the username
+func lookupIdent(query *identQuery, timeout time.Duration) (username string, err error) {
+	dialer := net.Dialer{
+		Timeout: timeout,
+		// the identd may only answer queries from the address it is connected to:
+		LocalAddr: &net.TCPAddr{IP: query.serverIP},
+	}
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(query.clientIP.String(), strconv.Itoa(identPort)))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := fmt.Fprintf(conn, "%d, %d\r\n", query.clientPort, query.serverPort); err != nil {
+		return "", err
+	}
+	// responses are limited to 1000 bytes (RFC 1413, section 6):
+	reader := bufio.NewReaderSize(conn, 1024)
+	line, err := reader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return parseIdentResponse(line, query.clientPort, query.serverPort)
+}
+
+// parseIdentResponse parses e.g. "6193, 23 : USERID : UNIX : stjohns"
+func parseIdentResponse(line string, clientPort, serverPort int) (username string, err error) {
+	fields := strings.SplitN(strings.TrimRight(line, "\r\n"), ":", 4)
+	if len(fields) < 3 {
+		return "", fmt.Errorf("invalid ident response: %q", line)
+	}
+	clientPortStr, serverPortStr, _ := strings.Cut(fields[0], ",")
+	if strings.TrimSpace(clientPortStr) != strconv.Itoa(clientPort) || strings.TrimSpace(serverPortStr) != strconv.Itoa(serverPort) {
+		return "", fmt.Errorf("ident response is for the wrong connection: %q", line)
+	}
+	switch strings.TrimSpace(fields[1]) {
+	case "USERID":
+		if len(fields) != 4 {
+			return "", fmt.Errorf("invalid ident response: %q", line)
+		}
+	case "ERROR":
+		return "", fmt.Errorf("ident error: %s", strings.TrimSpace(fields[2]))
+	default:
+		return "", fmt.Errorf("invalid ident response: %q", line)
+	}
+	// usernames may contain anything, but we log them and forward them in WEBIRC:
+	username = strings.TrimSpace(fields[3])
+	if i := strings.IndexFunc(username, func(r rune) bool { return r <= ' ' || r >= 0x7f || r == ':' || r == '@' }); i != -1 {
+		username = username[:i]
+	}
+	if len(username) > identMaxUsernameLen {
+		username = username[:identMaxUsernameLen]
+	}
+	if username == "" {
+		return "", errIdentNoUser
+	}
+	return username, nil
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseIdentResponse(t *testing.T) {
+	username, err := parseIdentResponse("6193, 23 : USERID : UNIX : stjohns\r\n", 6193, 23)
+	assertEqual(err, nil)
+	assertEqual(username, "stjohns")
+
+	// the username can contain colons, but we truncate at unsafe characters:
+	username, _ = parseIdentResponse("6193,23:USERID:UNIX,UTF-8:a:b", 6193, 23)
+	assertEqual(username, "a")
+	username, _ = parseIdentResponse("6193, 23 : USERID : OTHER : bob smith", 6193, 23)
+	assertEqual(username, "bob")
+	username, _ = parseIdentResponse("6193, 23 : USERID : UNIX : 0123456789012345678901234567890123456789", 6193, 23)
+	assertEqual(username, "01234567890123456789012345678901")
+
+	_, err = parseIdentResponse("6193, 23 : ERROR : NO-USER", 6193, 23)
+	assertEqual(err.Error(), "ident error: NO-USER")
+	_, err = parseIdentResponse("6193, 24 : USERID : UNIX : stjohns", 6193, 23)
+	assertEqual(err == nil, false)
+	_, err = parseIdentResponse("6193, 23 : USERID : UNIX : ", 6193, 23)
+	assertEqual(err, errIdentNoUser)
+	_, err = parseIdentResponse("garbage", 6193, 23)
+	assertEqual(err == nil, false)
+}
+
+func TestNewIdentQuery(t *testing.T) {
+	query := newIdentQuery(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443})
+	assertEqual(query.clientPort, 40000)
+	assertEqual(query.serverIP.String(), "192.0.2.2")
+	assertEqual(query.serverPort, 443)
+	assertEqual(newIdentQuery(&net.UnixAddr{Name: "/tmp/sock"}, &net.UnixAddr{Name: "/tmp/sock"}) == nil, true)
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ergochat/irc-go/ircmsg"
+)
+
+// With idle-timeout, connections whose clients send nothing for a while are
+// closed, with a close frame that tells the client it was idle (so that it
+// doesn't reconnect right away). Before that, the client is warned with
+//
+//	WARN * IDLE_TIMEOUT <time> :<description>
+//
+// where <time> is when it will be disconnected (RFC 3339, in UTC), along with
+// a websocket ping, so that a frontend can show its user "you've been idle"
+// and send something to stay connected. Only messages from the client count
+// as activity, not its answers to websocket pings (which browsers send on
+// their own), so clients that send IRC PINGs as keepalives never become idle.
+
+const (
+	idleTimeoutCode        = "IDLE_TIMEOUT"
+	idleTimeoutCloseReason = "idle"
+	idleTimeoutQuitMessage = "Idle timeout"
+)
+
+type IdleTimeoutConfig struct {
+	// close connections whose clients send nothing for this long (0 to disable):
+	Timeout time.Duration
+	// warn clients this long before closing their connections (0 for no warning):
+	WarnBefore time.Duration `yaml:"warn-before"`
+}
+
+func (conf *IdleTimeoutConfig) postprocess() error {
+	if conf.Timeout < 0 || conf.WarnBefore < 0 {
+		return fmt.Errorf("idle-timeout timeout and warn-before must not be negative")
+	}
+	if conf.Timeout != 0 && conf.Timeout < time.Minute {
+		return fmt.Errorf("idle-timeout timeout must be at least 1m (with a unit), not %v", conf.Timeout)
+	}
+	if conf.WarnBefore >= conf.Timeout && conf.Timeout != 0 {
+		return fmt.Errorf("idle-timeout warn-before must be less than timeout")
+	}
+	return nil
+}
+
+// startIdleTimer starts checking the connection for idleness, if enabled
+func (r *ReverseProxyConn) startIdleTimer(conf *IdleTimeoutConfig) {
+	if conf.Timeout == 0 {
+		return
+	}
+	r.idleTimeout, r.idleWarnBefore = conf.Timeout, conf.WarnBefore
+	r.noteActivity()
+	r.wsMutex.Lock()
+	defer r.wsMutex.Unlock()
+	r.idleTimer = time.AfterFunc(conf.Timeout-conf.WarnBefore, r.checkIdle)
+}
+
+// noteActivity records that the client sent something
+func (r *ReverseProxyConn) noteActivity() {
+	if r.idleTimeout != 0 {
+		r.lastActivity.Store(time.Now().UnixNano())
+	}
+}
+
+// checkIdle runs on idleTimer: it warns the client, or closes the connection,
+// if it has been idle long enough, and otherwise checks again later
+func (r *ReverseProxyConn) checkIdle() {
+	idle := time.Since(time.Unix(0, r.lastActivity.Load()))
+	warnAfter := r.idleTimeout - r.idleWarnBefore
+	warn := false
+
+	r.wsMutex.Lock()
+	if r.closing {
+		r.wsMutex.Unlock()
+		return
+	}
+	switch {
+	case idle >= r.idleTimeout:
+		r.wsMutex.Unlock()
+		r.idleExpired()
+		return
+	case idle < warnAfter:
+		r.idleWarned = false
+		r.idleTimer.Reset(warnAfter - idle)
+	default:
+		warn = !r.idleWarned
+		r.idleWarned = true
+		r.idleTimer.Reset(r.idleTimeout - idle)
+	}
+	r.wsMutex.Unlock()
+
+	if warn {
+		deadline := time.Now().Add(r.idleTimeout - idle).UTC().Format(time.RFC3339)
+		r.log(LogLevelDebug, "warning idle client")
+		notice := ircmsg.MakeMessage(nil, r.gatewayName, "WARN", "*", idleTimeoutCode, deadline,
+			fmt.Sprintf("You have been idle; you will be disconnected at %s unless you send something", deadline))
+		r.pingClients()
+		r.sendGatewayMessage(&notice)
+	}
+}
+
+// pingClients sends a websocket ping to each of the connection's websockets
+func (r *ReverseProxyConn) pingClients() {
+	r.wsMutex.Lock()
+	defer r.wsMutex.Unlock()
+	for _, webConn := range r.multiplexed {
+		writePing(webConn, r.closeTimeout)
+	}
+	if r.webConn != nil {
+		writePing(r.webConn, r.closeTimeout)
+	}
+}
+
+// idleExpired closes the connection politely: the upstream receives a QUIT,
+// and the client a close frame saying that it was idle
+func (r *ReverseProxyConn) idleExpired() {
+	r.log(LogLevelInfo, "closing idle connection")
+	quit := ircmsg.MakeMessage(nil, "", "QUIT", idleTimeoutQuitMessage)
+	if quitLine, err := quit.LineBytesStrict(false, DefaultMaxLineLen); err == nil {
+		r.writeUpstreamLine(quitLine)
+	}
+	r.writeWSClose(closeCodeIdle, idleTimeoutCloseReason)
+	r.closeWithReason(CloseIdle, nil)
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestIdleTimeoutConfig(t *testing.T) {
+	assertEqual((&IdleTimeoutConfig{Timeout: time.Hour, WarnBefore: time.Minute}).postprocess(), nil)
+	assertEqual((&IdleTimeoutConfig{WarnBefore: time.Minute}).postprocess(), nil)
+	for _, bad := range []IdleTimeoutConfig{
+		{Timeout: time.Second},
+		{Timeout: time.Hour, WarnBefore: time.Hour},
+		{Timeout: -time.Hour},
+	} {
+		assertEqual(bad.postprocess() != nil, true)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	mock := startMockIRCd(t, "")
+	listen := freeAddress(t)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithListener(listen),
+		WithUpstream(mock.Addr()),
+		WithYAML("log-level: error\nlookup-hostnames: false\nidle-timeout: {timeout: 1h, warn-before: 10m}"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.RunContext(ctx)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+listen+"/webirc", http.Header{"Origin": []string{"https://example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pinged := make(chan struct{}, 1)
+	conn.SetPingHandler(func(string) error {
+		pinged <- struct{}{}
+		return nil
+	})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, line := range []string{"NICK alice", "USER u 0 * :Alice"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	conns := server.conns.all()
+	assertEqual(len(conns), 1)
+	r := conns[0]
+	r.lastActivity.Store(time.Now().Add(-55 * time.Minute).UnixNano())
+	r.checkIdle()
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(string(message), ":webircproxy WARN * IDLE_TIMEOUT ") {
+			break
+		}
+	}
+	select {
+	case <-pinged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no ping")
+	}
+
+	r.lastActivity.Store(time.Now().Add(-2 * time.Hour).UnixNano())
+	r.checkIdle()
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		closeErr, ok := err.(*websocket.CloseError)
+		if !ok {
+			t.Fatalf("expected a close frame, got %v", err)
+		}
+		assertEqual(closeErr.Code, closeCodeIdle)
+		assertEqual(closeErr.Text, idleTimeoutCloseReason)
+		break
+	}
+}
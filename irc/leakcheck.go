@@ -0,0 +1,172 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// Each connection is proxied by two independent goroutines: one reading
+// from the upstream, and one reading from the websocket (one per websocket,
+// with multiplexing). Either one exiting should close the connection, and
+// closing it should make the other exit, so a goroutine that is missing, or
+// that outlives its connection, is a leak. The leak check compares the
+// registered connections against the goroutines that are running; since
+// connections pass through these states briefly while opening and closing,
+// only the problems that persist for a grace period are reported.
+
+const (
+	leakUpstreamReaderExited  = "the upstream reader exited, but the connection is still registered"
+	leakWebsocketReaderExited = "a websocket has no reader, but the connection is still registered"
+	leakClosedButRegistered   = "the connection was closed, but is still registered"
+
+	defaultLeakCheckInterval = 5 * time.Minute
+	// added to websocket-close-timeout, which bounds how long a closed
+	// connection's websocket reader can legitimately keep running:
+	leakCheckGrace = time.Second
+)
+
+type LeakCheckConfig struct {
+	Enabled bool
+	// how often to check (and log a warning for each leak found):
+	Interval time.Duration
+}
+
+func (conf *LeakCheckConfig) postprocess() error {
+	if conf.Interval == 0 {
+		conf.Interval = defaultLeakCheckInterval
+	}
+	if conf.Interval < time.Second {
+		return fmt.Errorf("leak-check interval must be at least 1s (with a unit), not %v", conf.Interval)
+	}
+	return nil
+}
+
+// LeakReport describes the proxy goroutines that appear to have leaked.
+type LeakReport struct {
+	Connections []ConnectionLeak `json:"connections"`
+	// goroutines still running for connections that were closed:
+	OrphanedGoroutines int64 `json:"orphaned_goroutines"`
+}
+
+// ConnectionLeak describes a registered connection whose goroutines don't
+// match its state.
+type ConnectionLeak struct {
+	ID       string `json:"id"`
+	Upstream string `json:"upstream"`
+	Problem  string `json:"problem"`
+}
+
+// startProxyToUpstream starts a goroutine reading from a websocket
+func (r *ReverseProxyConn) startProxyToUpstream(webConn messageConn, registered bool, debug bool) {
+	r.wsReaders.Add(1)
+	r.server.proxyGoroutines.Add(1)
+	go r.proxyToUpstream(webConn, registered, debug)
+}
+
+// startProxyFromUpstream starts the goroutine reading from the upstream
+func (r *ReverseProxyConn) startProxyFromUpstream(debug bool) {
+	r.upstreamReader.Store(true)
+	r.server.proxyGoroutines.Add(1)
+	go r.proxyFromUpstream(debug)
+}
+
+func (r *ReverseProxyConn) wsReaderDone() {
+	r.wsReaders.Add(-1)
+	r.server.proxyGoroutines.Add(-1)
+}
+
+func (r *ReverseProxyConn) upstreamReaderDone() {
+	r.upstreamReader.Store(false)
+	r.server.proxyGoroutines.Add(-1)
+}
+
+// leakProblem returns what is wrong with the connection's goroutines, if anything,
+// and how many of them are running
+func (r *ReverseProxyConn) leakProblem() (problem string, goroutines int64) {
+	r.wsMutex.Lock()
+	closing := r.closing
+	websockets := len(r.multiplexed)
+	if r.webConn != nil {
+		websockets++
+	}
+	r.wsMutex.Unlock()
+
+	readers := int64(r.wsReaders.Load())
+	goroutines = readers
+	if r.upstreamReader.Load() {
+		goroutines++
+	}
+	switch {
+	case closing:
+		return leakClosedButRegistered, goroutines
+	case !r.upstreamReader.Load():
+		return leakUpstreamReaderExited, goroutines
+	case readers < int64(websockets):
+		return leakWebsocketReaderExited, goroutines
+	default:
+		return "", goroutines
+	}
+}
+
+// checkLeaksOnce returns the registered connections with problems, and how
+// many proxy goroutines don't belong to a registered connection
+func (server *Server) checkLeaksOnce() (leaks map[ConnectionLeak]bool, orphaned int64) {
+	// load the total first, so that goroutines that start during the check
+	// aren't mistaken for orphans:
+	total := server.proxyGoroutines.Load()
+	leaks = make(map[ConnectionLeak]bool)
+	for _, conn := range server.conns.all() {
+		problem, goroutines := conn.leakProblem()
+		total -= goroutines
+		if problem != "" {
+			leaks[ConnectionLeak{ID: conn.client.id, Upstream: conn.upstream.Name, Problem: problem}] = true
+		}
+	}
+	return leaks, max(total, 0)
+}
+
+// CheckLeaks checks for leaked proxy goroutines, reporting the problems that
+// persist for a grace period (so it takes a little longer than that).
+func (server *Server) CheckLeaks() (report LeakReport) {
+	report.Connections = []ConnectionLeak{}
+	first, firstOrphaned := server.checkLeaksOnce()
+	if len(first) == 0 && firstOrphaned == 0 {
+		return
+	}
+	if !server.sleep(server.Config().WebsocketCloseTimeout + leakCheckGrace) {
+		return
+	}
+	second, secondOrphaned := server.checkLeaksOnce()
+	for leak := range second {
+		if first[leak] {
+			report.Connections = append(report.Connections, leak)
+		}
+	}
+	sort.Slice(report.Connections, func(i, j int) bool { return report.Connections[i].ID < report.Connections[j].ID })
+	report.OrphanedGoroutines = min(firstOrphaned, secondOrphaned)
+	return
+}
+
+// runLeakCheck logs the leaks found at each leak-check interval, while
+// leak-check is enabled
+func (server *Server) runLeakCheck() {
+	defer server.HandlePanic()
+
+	for server.sleep(server.Config().LeakCheck.Interval) {
+		if !server.Config().LeakCheck.Enabled {
+			continue
+		}
+		report := server.CheckLeaks()
+		for _, leak := range report.Connections {
+			server.Log(LogComponentServer, LogLevelWarn, "leak check: "+leak.Problem, slog.String(logKeyConnID, leak.ID), slog.String(logKeyUpstream, leak.Upstream))
+		}
+		if report.OrphanedGoroutines != 0 {
+			server.Log(LogComponentServer, LogLevelWarn, "leak check: proxy goroutines are still running for closed connections", slog.Int64("goroutines", report.OrphanedGoroutines))
+		}
+	}
+}
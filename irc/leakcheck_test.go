@@ -0,0 +1,86 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCheckLeaks(t *testing.T) {
+	server := &Server{done: make(chan struct{})}
+	server.SetConfig(&Config{WebsocketCloseTimeout: 10 * time.Millisecond})
+	upstream := &reverseProxyUpstream{Name: "irc"}
+	healthy := &ReverseProxyConn{server: server, client: &clientData{id: "a1"}, upstream: upstream, webConn: new(recordingConn)}
+	healthy.upstreamReader.Store(true)
+	healthy.wsReaders.Store(1)
+	// the upstream reader exited without closing the connection:
+	leaked := &ReverseProxyConn{server: server, client: &clientData{id: "a2"}, upstream: upstream, webConn: new(recordingConn)}
+	leaked.wsReaders.Store(1)
+	server.conns.add(healthy)
+	server.conns.add(leaked)
+	// and a goroutine of a closed connection is still running:
+	server.proxyGoroutines.Store(4)
+
+	report := server.CheckLeaks()
+	assertEqual(report.Connections, []ConnectionLeak{{ID: "a2", Upstream: "irc", Problem: leakUpstreamReaderExited}})
+	assertEqual(report.OrphanedGoroutines, int64(1))
+
+	server.conns.remove(leaked)
+	server.proxyGoroutines.Store(2)
+	report = server.CheckLeaks()
+	assertEqual(len(report.Connections), 0)
+	assertEqual(report.OrphanedGoroutines, int64(0))
+}
+
+func TestNoLeaksEndToEnd(t *testing.T) {
+	mock := startMockIRCd(t, "")
+	listen := freeAddress(t)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithListener(listen),
+		WithUpstream(mock.Addr()),
+		WithYAML("log-level: error\nlookup-hostnames: false"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.RunContext(ctx)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+listen+"/webirc", http.Header{"Origin": []string{"https://example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, line := range []string{"NICK alice", "USER u 0 * :Alice"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(server.proxyGoroutines.Load(), int64(2))
+	report := server.CheckLeaks()
+	assertEqual(len(report.Connections), 0)
+	assertEqual(report.OrphanedGoroutines, int64(0))
+
+	// both goroutines exit once the connection closes:
+	conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); server.proxyGoroutines.Load() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d proxy goroutines are still running", server.proxyGoroutines.Load())
+		}
+	}
+}
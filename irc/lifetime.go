@@ -0,0 +1,63 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/ergochat/irc-go/ircmsg"
+)
+
+// With connection-lifetime, connections are closed once they reach a maximum
+// age, with a close frame asking the client to reconnect right away; this
+// rebalances clients across the upstreams (e.g., after one is added), and
+// bounds how long any connection can keep an old config or upstream.
+
+const (
+	lifetimeCloseReason = "reconnect"
+	lifetimeQuitMessage = "Reconnecting (maximum connection lifetime reached)"
+)
+
+type ConnectionLifetimeConfig struct {
+	// the maximum age of a connection (0 for no maximum):
+	Max time.Duration
+	// up to this much less, chosen at random for each connection, so that
+	// clients that connected together don't all reconnect together:
+	Jitter time.Duration
+}
+
+func (conf *ConnectionLifetimeConfig) postprocess() error {
+	if conf.Max < 0 || conf.Jitter < 0 {
+		return fmt.Errorf("connection-lifetime max and jitter must not be negative")
+	}
+	if conf.Max != 0 && conf.Max < time.Minute {
+		return fmt.Errorf("connection-lifetime max must be at least 1m (with a unit), not %v", conf.Max)
+	}
+	if conf.Jitter >= conf.Max && conf.Max != 0 {
+		return fmt.Errorf("connection-lifetime jitter must be less than max")
+	}
+	return nil
+}
+
+// lifetime returns the maximum age of a new connection (0 for none)
+func (conf *ConnectionLifetimeConfig) lifetime() time.Duration {
+	if conf.Max == 0 || conf.Jitter == 0 {
+		return conf.Max
+	}
+	return conf.Max - time.Duration(rand.Int63n(int64(conf.Jitter)))
+}
+
+// lifetimeExpired closes the connection politely: the upstream receives a
+// QUIT, and the client a close frame asking it to reconnect
+func (r *ReverseProxyConn) lifetimeExpired() {
+	r.log(LogLevelInfo, "closing connection at its maximum lifetime")
+	quit := ircmsg.MakeMessage(nil, "", "QUIT", lifetimeQuitMessage)
+	if quitLine, err := quit.LineBytesStrict(false, DefaultMaxLineLen); err == nil {
+		r.writeUpstreamLine(quitLine)
+	}
+	r.writeWSClose(closeCodeReconnect, lifetimeCloseReason)
+	r.closeWithReason(CloseLifetime, nil)
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestConnectionLifetimeConfig(t *testing.T) {
+	conf := ConnectionLifetimeConfig{Max: time.Hour, Jitter: 10 * time.Minute}
+	assertEqual(conf.postprocess(), nil)
+	for i := 0; i < 100; i++ {
+		if lifetime := conf.lifetime(); lifetime <= 50*time.Minute || lifetime > time.Hour {
+			t.Fatalf("lifetime %v out of range", lifetime)
+		}
+	}
+	assertEqual((&ConnectionLifetimeConfig{}).lifetime(), time.Duration(0))
+
+	for _, bad := range []ConnectionLifetimeConfig{
+		{Max: time.Second},
+		{Max: time.Hour, Jitter: time.Hour},
+		{Max: -time.Hour},
+	} {
+		assertEqual(bad.postprocess() != nil, true)
+	}
+}
+
+func TestLifetimeExpired(t *testing.T) {
+	mock := startMockIRCd(t, "")
+	listen := freeAddress(t)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithListener(listen),
+		WithUpstream(mock.Addr()),
+		WithYAML("log-level: error\nlookup-hostnames: false\nconnection-lifetime: {max: 1h}"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.RunContext(ctx)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+listen+"/webirc", http.Header{"Origin": []string{"https://example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, line := range []string{"NICK alice", "USER u 0 * :Alice"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	conns := server.conns.all()
+	assertEqual(len(conns), 1)
+	conns[0].lifetimeExpired()
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		closeErr, ok := err.(*websocket.CloseError)
+		if !ok {
+			t.Fatalf("expected a close frame, got %v", err)
+		}
+		assertEqual(closeErr.Code, closeCodeReconnect)
+		assertEqual(closeErr.Text, lifetimeCloseReason)
+		break
+	}
+}
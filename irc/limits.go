@@ -0,0 +1,129 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// LimitsConfig bounds the proxy's resource usage, so that it degrades
+// predictably under load (by refusing new connections) instead of being
+// killed by the OOM killer.
+type LimitsConfig struct {
+	// soft limit on the Go runtime's memory usage, as in GOMEMLIMIT
+	// (e.g., "1GiB"); the garbage collector works harder as it is approached:
+	MemoryLimit string `yaml:"memory-limit"`
+	memoryLimit int64
+	// as in GOMAXPROCS:
+	MaxProcs int `yaml:"max-procs"`
+	// maximum number of connections being proxied at once (each one
+	// uses a pair of goroutines); new connections beyond it are refused:
+	MaxConnections int `yaml:"max-connections"`
+	// maximum number of reverse DNS lookups running at once (default 64);
+	// connections beyond it use their IP as their hostname:
+	MaxHostnameLookups int `yaml:"max-hostname-lookups"`
+}
+
+func (conf *LimitsConfig) postprocess() (err error) {
+	if conf.MemoryLimit != "" {
+		conf.memoryLimit, err = parseByteSize(conf.MemoryLimit)
+		if err != nil {
+			return fmt.Errorf("invalid memory-limit %s: %w", conf.MemoryLimit, err)
+		}
+	}
+	if conf.MaxProcs < 0 || conf.MaxConnections < 0 || conf.MaxHostnameLookups < 0 {
+		return fmt.Errorf("max-procs, max-connections, and max-hostname-lookups must not be negative")
+	}
+	if conf.MaxHostnameLookups == 0 {
+		conf.MaxHostnameLookups = defaultMaxHostnameLookups
+	}
+	return nil
+}
+
+// parseByteSize parses a size in the format of GOMEMLIMIT: an integer
+// with an optional suffix of B, KiB, MiB, GiB, or TiB
+func parseByteSize(str string) (int64, error) {
+	str = strings.TrimSpace(str)
+	multiplier := int64(1)
+	for i, suffix := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		if strings.HasSuffix(str, suffix) {
+			multiplier = 1 << (10 * (i + 1))
+			str = strings.TrimSuffix(str, suffix)
+			break
+		}
+	}
+	if multiplier == 1 {
+		str = strings.TrimSuffix(str, "B")
+	}
+	value, err := strconv.ParseInt(strings.TrimSpace(str), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if value <= 0 || value > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size out of range")
+	}
+	return value * multiplier, nil
+}
+
+// runtimeLimits applies memory-limit and max-procs, restoring the
+// original values (from the environment, or the runtime defaults)
+// if they are removed from the config
+type runtimeLimits struct {
+	sync.Mutex // tier 1
+
+	initialized bool
+	memoryLimit int64
+	maxProcs    int
+}
+
+func (rl *runtimeLimits) ApplyConfig(config *LimitsConfig) {
+	rl.Lock()
+	defer rl.Unlock()
+
+	if !rl.initialized {
+		rl.initialized = true
+		// negative arguments query the current values:
+		rl.memoryLimit = debug.SetMemoryLimit(-1)
+		rl.maxProcs = runtime.GOMAXPROCS(0)
+	}
+
+	if config.memoryLimit != 0 {
+		debug.SetMemoryLimit(config.memoryLimit)
+	} else {
+		debug.SetMemoryLimit(rl.memoryLimit)
+	}
+	if config.MaxProcs != 0 {
+		runtime.GOMAXPROCS(config.MaxProcs)
+	} else {
+		runtime.GOMAXPROCS(rl.maxProcs)
+	}
+}
+
+// connectionSlots counts the connections that are being proxied (or are
+// connecting to the upstream), enforcing max-connections; it also counts
+// the hostname lookups in progress
+type connectionSlots struct {
+	active atomic.Int64
+}
+
+// tryAcquire reserves a slot for a new connection (0 means unlimited);
+// if it succeeds, the slot must later be released
+func (cs *connectionSlots) tryAcquire(limit int) bool {
+	if cs.active.Add(1) > int64(limit) && limit != 0 {
+		cs.active.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (cs *connectionSlots) release() {
+	cs.active.Add(-1)
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"runtime"
+	"runtime/debug"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for str, expected := range map[string]int64{
+		"1024":    1024,
+		"512B":    512,
+		"64KiB":   64 << 10,
+		"1GiB":    1 << 30,
+		" 3 MiB ": 3 << 20,
+		"2TiB":    2 << 40,
+	} {
+		size, err := parseByteSize(str)
+		if err != nil {
+			t.Errorf("%s: %v", str, err)
+		}
+		assertEqual(size, expected)
+	}
+	for _, str := range []string{"", "1GB", "-1MiB", "0", "1.5GiB", "99999999999TiB"} {
+		if _, err := parseByteSize(str); err == nil {
+			t.Errorf("%s should be rejected", str)
+		}
+	}
+}
+
+func TestConnectionSlots(t *testing.T) {
+	var slots connectionSlots
+	assertEqual(slots.tryAcquire(2), true)
+	assertEqual(slots.tryAcquire(2), true)
+	assertEqual(slots.tryAcquire(2), false)
+	slots.release()
+	assertEqual(slots.tryAcquire(2), true)
+	// 0 is unlimited:
+	assertEqual(slots.tryAcquire(0), true)
+	assertEqual(slots.active.Load(), int64(3))
+}
+
+func TestRuntimeLimits(t *testing.T) {
+	originalMemoryLimit := debug.SetMemoryLimit(-1)
+	originalMaxProcs := runtime.GOMAXPROCS(0)
+
+	var limits runtimeLimits
+	conf := LimitsConfig{MemoryLimit: "1GiB", MaxProcs: 1}
+	if err := conf.postprocess(); err != nil {
+		t.Fatal(err)
+	}
+	limits.ApplyConfig(&conf)
+	assertEqual(debug.SetMemoryLimit(-1), int64(1<<30))
+	assertEqual(runtime.GOMAXPROCS(0), 1)
+
+	// removing the settings restores the original values:
+	limits.ApplyConfig(&LimitsConfig{})
+	assertEqual(debug.SetMemoryLimit(-1), originalMemoryLimit)
+	assertEqual(runtime.GOMAXPROCS(0), originalMaxProcs)
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/ergochat/irc-go/ircmsg"
+)
+
+// An upstream can advertise a line length limit other than the standard 512
+// bytes with the LINELEN token of RPL_ISUPPORT (e.g., Ergo's
+// limits.linelen.rest), and clients then size the lines they accept by it.
+// The lines the proxy rebuilds from the upstream's lines for its clients
+// (when transcoding, and when splitting the lines of multiline batches) are
+// limited to the advertised length rather than max-line-len, so that they
+// are never longer than the clients can handle (nor truncated when they
+// needn't be). Advertised lengths below the standard 512 are ignored.
+
+var (
+	isupportNumeric = []byte(" 005 ")
+)
+
+const (
+	lineLenToken = "LINELEN"
+)
+
+// parseLineLen returns the line length advertised by an RPL_ISUPPORT line:
+// 0 if the line negates LINELEN, or -1 if it doesn't mention it
+func parseLineLen(line []byte) (lineLen int) {
+	if !bytes.Contains(line, isupportNumeric) {
+		return -1
+	}
+	msg, err := ircmsg.ParseLine(string(line))
+	// the parameters are the nickname, the tokens, and a trailing description:
+	if err != nil || msg.Command != "005" || len(msg.Params) < 3 {
+		return -1
+	}
+	lineLen = -1
+	for _, token := range msg.Params[1 : len(msg.Params)-1] {
+		if token == "-"+lineLenToken {
+			lineLen = 0
+		} else if value, found := strings.CutPrefix(token, lineLenToken+"="); found {
+			if n, err := strconv.Atoi(value); err == nil && DefaultMaxLineLen <= n {
+				lineLen = n
+			}
+		}
+	}
+	return
+}
+
+// observeLineLen updates the length limit for the lines rebuilt from the
+// upstream's lines, if the line advertises one
+func (r *ReverseProxyConn) observeLineLen(line []byte) {
+	switch lineLen := parseLineLen(line); lineLen {
+	case -1:
+	case 0:
+		r.upstreamLineLen = r.maxLineLen
+	default:
+		r.upstreamLineLen = lineLen
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+)
+
+func TestParseLineLen(t *testing.T) {
+	assertEqual(parseLineLen([]byte(":irc.example.com 005 alice CASEMAPPING=ascii LINELEN=2048 NICKLEN=32 :are supported by this server")), 2048)
+	assertEqual(parseLineLen([]byte(":irc.example.com 005 alice -LINELEN :are supported by this server")), 0)
+	assertEqual(parseLineLen([]byte(":irc.example.com 005 alice CASEMAPPING=ascii :are supported by this server")), -1)
+	// below the standard length:
+	assertEqual(parseLineLen([]byte(":irc.example.com 005 alice LINELEN=100 :are supported by this server")), -1)
+	assertEqual(parseLineLen([]byte(":irc.example.com 005 alice LINELEN=x :are supported by this server")), -1)
+	// the description isn't a token:
+	assertEqual(parseLineLen([]byte(":irc.example.com 005 alice NICKLEN=32 LINELEN=2048")), -1)
+	assertEqual(parseLineLen([]byte(":alice!u@example.com PRIVMSG #chan :LINELEN=2048 005")), -1)
+}
+
+func TestObserveLineLen(t *testing.T) {
+	r := &ReverseProxyConn{maxLineLen: DefaultMaxLineLen, upstreamLineLen: DefaultMaxLineLen}
+	r.observeLineLen([]byte(":irc.example.com 005 alice LINELEN=2048 :are supported by this server"))
+	assertEqual(r.upstreamLineLen, 2048)
+	r.observeLineLen([]byte(":irc.example.com 005 alice NICKLEN=32 :are supported by this server"))
+	assertEqual(r.upstreamLineLen, 2048)
+	r.observeLineLen([]byte(":irc.example.com 005 alice -LINELEN :are supported by this server"))
+	assertEqual(r.upstreamLineLen, DefaultMaxLineLen)
+}
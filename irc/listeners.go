@@ -4,16 +4,21 @@
 package irc
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gorilla/websocket"
-
 	"github.com/ergochat/ergo/irc/utils"
 )
 
@@ -21,19 +26,43 @@ var (
 	errCantReloadListener = errors.New("can't switch a listener between stream and websocket")
 )
 
+type wrappedConnKey struct{}
+type connIDKey struct{}
+
+var connCounter uint64
+
+// newConnID returns a short identifier, unique within this process,
+// for correlating the log lines about a connection
+func newConnID() string {
+	return strconv.FormatUint(atomic.AddUint64(&connCounter, 1), 36)
+}
+
 // NewListener creates a new listener according to the specifications in the config file
-func NewListener(server *Server, addr string, config utils.ListenerConfig, bindMode os.FileMode) (result *WSListener, err error) {
-	baseListener, err := createBaseListener(addr, bindMode)
+func NewListener(server *Server, addr string, config listenerConfig, bindMode os.FileMode) (result *WSListener, err error) {
+	rawListener, err := createBaseListener(addr, bindMode, config.IPv6Only)
 	if err != nil {
 		return
 	}
 
-	wrappedListener := utils.NewReloadableListener(baseListener, config)
+	baseListener := rawListener
+	if config.TLSConfig != nil {
+		baseListener = &fingerprintListener{Listener: baseListener}
+	}
+
+	wrappedListener := utils.NewReloadableListener(baseListener, config.ListenerConfig)
 
-	return NewWSListener(server, addr, wrappedListener, config)
+	result, err = NewWSListener(server, addr, wrappedListener, config)
+	if err == nil {
+		result.base = rawListener
+	}
+	return
 }
 
-func createBaseListener(addr string, bindMode os.FileMode) (listener net.Listener, err error) {
+func createBaseListener(addr string, bindMode os.FileMode, ipv6Only bool) (listener net.Listener, err error) {
+	// use the socket passed by the previous process or systemd, if there is one:
+	if inherited := takeInheritedListener(addr); inherited != nil {
+		return inherited, nil
+	}
 	addr = strings.TrimPrefix(addr, "unix:")
 	if strings.HasPrefix(addr, "/") {
 		// https://stackoverflow.com/a/34881585
@@ -43,11 +72,27 @@ func createBaseListener(addr string, bindMode os.FileMode) (listener net.Listene
 			os.Chmod(addr, bindMode)
 		}
 	} else {
-		listener, err = net.Listen("tcp", addr)
+		listener, err = net.Listen(tcpListenNetwork(addr, ipv6Only), addr)
 	}
 	return
 }
 
+// tcpListenNetwork returns the network for listening on a TCP address: for
+// IPv6 and wildcard addresses, "tcp" accepts both IPv6 and IPv4 connections
+// (where the OS supports it), while "tcp6" sets IPV6_V6ONLY
+func tcpListenNetwork(addr string, ipv6Only bool) string {
+	if !ipv6Only {
+		return "tcp"
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+			return "tcp"
+		}
+	}
+	return "tcp6"
+}
+
 // WSListener is a listener for IRC-over-websockets (initially HTTP, then upgraded to a
 // different application protocol that provides a message-based API, possibly with TLS)
 type WSListener struct {
@@ -55,25 +100,64 @@ type WSListener struct {
 	httpServer *http.Server
 	server     *Server
 	addr       string
+	// the underlying TCP or Unix listener:
+	base net.Listener
+	// whether base was bound with IPV6_V6ONLY (which can't change on reload):
+	ipv6Only bool
+	shedder  overloadShedder
+
+	stateMutex sync.Mutex // tier 1
+	// error that caused the listener to stop serving unexpectedly:
+	err error
 }
 
-func NewWSListener(server *Server, addr string, listener *utils.ReloadableListener, config utils.ListenerConfig) (result *WSListener, err error) {
+func NewWSListener(server *Server, addr string, listener *utils.ReloadableListener, config listenerConfig) (result *WSListener, err error) {
 	result = &WSListener{
 		listener: listener,
 		server:   server,
 		addr:     addr,
+		ipv6Only: config.IPv6Only,
 	}
 	result.httpServer = &http.Server{
 		Handler:      http.HandlerFunc(result.handle),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
+		// disable HTTP/2 (see rejectHTTP2); it isn't negotiated anyway, since
+		// the handshake happens inside *utils.WrappedConn, but be explicit:
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		// make the *utils.WrappedConn (with its PROXY and listener data) available
+		// to the handler before the websocket upgrade, and assign the connection an ID:
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			ctx = context.WithValue(ctx, wrappedConnKey{}, c)
+			return context.WithValue(ctx, connIDKey{}, newConnID())
+		},
 	}
-	go result.httpServer.Serve(listener)
+	go result.serve()
 	return
 }
 
-func (wl *WSListener) Reload(config utils.ListenerConfig) error {
-	wl.listener.Reload(config)
+func (wl *WSListener) serve() {
+	err := wl.httpServer.Serve(wl.listener)
+	if err != http.ErrServerClosed {
+		wl.server.Log(LogComponentListener, LogLevelError, "listener stopped serving", slog.String(logKeyListener, wl.addr), errAttr(err))
+		wl.stateMutex.Lock()
+		wl.err = err
+		wl.stateMutex.Unlock()
+	}
+}
+
+// serveError returns the error that stopped the listener, or nil if it is serving
+func (wl *WSListener) serveError() error {
+	wl.stateMutex.Lock()
+	defer wl.stateMutex.Unlock()
+	return wl.err
+}
+
+func (wl *WSListener) Reload(config listenerConfig) error {
+	if config.IPv6Only != wl.ipv6Only {
+		return errors.New("ipv6-only changed; the listener must be recreated")
+	}
+	wl.listener.Reload(config.ListenerConfig)
 	return nil
 }
 
@@ -81,72 +165,369 @@ func (wl *WSListener) Stop() error {
 	return wl.httpServer.Close()
 }
 
+// Shutdown stops the listener, waiting for in-progress requests to complete
+func (wl *WSListener) Shutdown(ctx context.Context) error {
+	return wl.httpServer.Shutdown(ctx)
+}
+
 func (wl *WSListener) handle(w http.ResponseWriter, r *http.Request) {
-	config := wl.server.Config()
+	config := wl.server.Config().forListener(wl.addr)
+	listenerConf := config.trueListeners[wl.addr]
+	if reason := wl.shedder.admit(listenerConf.Overload, time.Now()); reason != "" {
+		wl.server.countShed(wl.addr, reason)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "server is overloaded", http.StatusServiceUnavailable)
+		return
+	}
+	defer wl.shedder.done()
+
 	remoteAddr := r.RemoteAddr
 	xff := r.Header.Get("X-Forwarded-For")
 	xfp := r.Header.Get("X-Forwarded-Proto")
 
-	wsUpgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			if len(config.allowedOriginRegexps) == 0 {
-				return true
-			}
-			origin := strings.TrimSpace(r.Header.Get("Origin"))
-			if len(origin) == 0 {
-				return false
-			}
-			for _, re := range config.allowedOriginRegexps {
-				if re.MatchString(origin) {
-					return true
-				}
-			}
-			return false
-		},
-		Subprotocols: []string{"text.ircv3.net", "binary.ircv3.net"},
+	wConn, ok := r.Context().Value(wrappedConnKey{}).(*utils.WrappedConn)
+	if !ok {
+		wl.server.Log(LogComponentListener, LogLevelInfo, "non-proxied connection", slog.String(logKeyListener, wl.addr))
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
 	}
 
-	conn, err := wsUpgrader.Upgrade(w, r, nil)
-	if err != nil {
-		wl.server.Log(LogLevelInfo, fmt.Sprintf("websocket upgrade error from %s: %v", wl.addr, err))
+	proxiedIP, secure := confirmProxyData(wConn, remoteAddr, xff, xfp, config)
+
+	clientIP := proxiedIP
+	if clientIP == nil {
+		clientIP = utils.AddrToIP(wConn.RemoteAddr())
+	}
+
+	connID, _ := r.Context().Value(connIDKey{}).(string)
+	if listenerConf.STSOnly && !secure {
+		wl.server.serveSTSRedirect(w, r, listenerConf.STSPort, slog.String(logKeyConnID, connID), slog.String(logKeyRemoteIP, clientIP.String()), slog.String(logKeyListener, wl.addr))
 		return
 	}
+	var ident *identQuery
+	if proxiedIP == nil && !wConn.Config.Tor {
+		ident = newIdentQuery(wConn.RemoteAddr(), wConn.LocalAddr())
+	}
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := wConn.Conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		tlsState = &state
+	}
+	wl.server.serveWebSocket(w, r, incomingRequest{
+		config:        config,
+		connID:        connID,
+		listener:      wl.addr,
+		profile:       listenerConf.profile,
+		requireSecure: listenerConf.RequireSecure,
+		clientIP:      clientIP,
+		realIP:        utils.AddrToIP(wConn.RemoteAddr()),
+		secure:        secure,
+		fingerprint:   getTLSFingerprint(wConn.Conn),
+		ident:         ident,
+		tor:           wConn.Config.Tor,
+		tlsState:      tlsState,
+	})
+}
 
-	wConn, ok := conn.UnderlyingConn().(*utils.WrappedConn)
-	if !ok {
-		wl.server.Log(LogLevelInfo, fmt.Sprintf("non-proxied connection from: %s", wl.addr))
-		conn.Close()
+// requestLocalPort returns the port that the request was received on (or 0)
+func requestLocalPort(r *http.Request) int {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// serveSTSRedirect answers a request to an sts-only listener with a redirect
+// to the TLS port; browsers can't follow a redirect from a websocket
+// handshake, but this makes the problem clear to anyone investigating it
+func (server *Server) serveSTSRedirect(w http.ResponseWriter, r *http.Request, port int, attrs ...slog.Attr) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	if host == "" {
+		http.Error(w, "this listener requires TLS", http.StatusForbidden)
+		return
+	}
+	target := url.URL{
+		Scheme:   "https",
+		Host:     host,
+		Path:     r.URL.Path,
+		RawQuery: r.URL.RawQuery,
+	}
+	if port != 443 {
+		target.Host = net.JoinHostPort(host, strconv.Itoa(port))
+	} else if strings.Contains(host, ":") {
+		target.Host = "[" + host + "]"
+	}
+	server.Log(LogComponentListener, LogLevelDebug, "redirected request to the TLS port (sts-only)", attrs...)
+	http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+}
+
+// incomingRequest describes where a websocket request was received: either
+// one of our listeners, or an embedding application's server (see NewHandler)
+type incomingRequest struct {
+	config        *Config
+	connID        string
+	listener      string
+	profile       string
+	requireSecure bool
+	// as in clientData:
+	clientIP    net.IP
+	realIP      net.IP
+	secure      bool
+	fingerprint *TLSFingerprint
+	ident       *identQuery
+	tor         bool
+	// the client's TLS connection to us, if any (r.TLS is nil when TLS was
+	// terminated by our own listener, since it wraps the *tls.Conn):
+	tlsState *tls.ConnectionState
+}
+
+// traceparent returns the request's traceparent header if it came from a trusted
+// proxy; otherwise any client could bypass sample-rate, or choose its trace ID
+func (in *incomingRequest) traceparent(r *http.Request) string {
+	if !utils.IPInNets(in.realIP, in.config.proxyAllowedFromNets) {
+		return ""
+	}
+	return r.Header.Get("traceparent")
+}
+
+// serveWebSocket applies the configured checks to a websocket request,
+// then upgrades it and starts proxying it
+func (server *Server) serveWebSocket(w http.ResponseWriter, r *http.Request, in incomingRequest) {
+	config := in.config
+	clientIP := in.clientIP
+	listenerAttrs := []slog.Attr{slog.String(logKeyConnID, in.connID), slog.String(logKeyRemoteIP, clientIP.String()), slog.String(logKeyListener, in.listener)}
+	if in.profile != "" {
+		listenerAttrs = append(listenerAttrs, slog.String("profile", in.profile))
+	}
+
+	// root span for the lifetime of the connection; nil if tracing is disabled
+	connSpan := server.tracer.StartConnection("webircproxy.connection", in.traceparent(r))
+	for _, attr := range listenerAttrs {
+		connSpan.SetAttrs(config.LogPrivacy.scrubAttr(attr))
+	}
+	connSpan.SetAttrs(slog.String("origin", r.Header.Get("Origin")), slog.Bool("secure", in.secure))
+
+	logReject := func(level LogLevel, reason string, attrs ...slog.Attr) {
+		attrs = append(listenerAttrs[:len(listenerAttrs):len(listenerAttrs)], attrs...)
+		server.Log(LogComponentListener, level, "rejecting connection: "+reason, attrs...)
+		connSpan.End(errors.New("rejected: " + reason))
+	}
+
+	if rejectHTTP2(w, r) {
+		logReject(LogLevelDebug, "HTTP/2 request", slog.String("proto", r.Proto))
+		server.countError(errorUpgradeFailed, "")
 		return
 	}
 
-	confirmProxyData(wConn, remoteAddr, xff, xfp, config)
+	if rejectEarlyData(w, r, &in) {
+		logReject(LogLevelDebug, "request was forwarded as TLS early data")
+		server.countError(errorEarlyData, "")
+		return
+	}
 
-	// avoid a DoS attack from buffering excessively large messages:
-	conn.SetReadLimit(int64(config.maxReadQBytes))
+	if !in.secure && in.requireSecure {
+		logReject(LogLevelInfo, "insecure connection")
+		server.countError(errorInsecureRejected, "")
+		http.Error(w, "secure connection required", http.StatusForbidden)
+		return
+	}
 
-	go wl.server.RunReverseProxyConn(conn, wConn.ProxiedIP, wConn.Secure, config)
+	if banned, expires := server.bans.IsBanned(clientIP); banned {
+		logReject(LogLevelDebug, "IP is banned", slog.Time("ban_expires", expires.UTC()))
+		server.countError(errorBanned, "")
+		http.Error(w, "temporarily banned", http.StatusForbidden)
+		return
+	}
+
+	fingerprint := in.fingerprint
+
+	tags, rejected, rule := config.applyHeaderRules(r.Header, fingerprint)
+	if rejected {
+		logReject(LogLevelInfo, "matched header rule", slog.String("rule", rule.name()))
+		server.countError(errorHeaderRuleRejected, "")
+		server.recordFailure(clientIP, failureHeaderRule)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	policy, allowed := config.checkOrigin(r.Header.Get("Origin"), r.Host)
+	if !allowed {
+		logReject(LogLevelInfo, "disallowed origin", slog.String("origin", r.Header.Get("Origin")))
+		server.countError(errorOriginRejected, "")
+		server.recordFailure(clientIP, failureOriginRejected)
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if policy != nil && !server.throttle.Allow(policy.key, clientIP, policy.RateLimit) {
+		logReject(LogLevelInfo, "rate limit exceeded", slog.String("origin", r.Header.Get("Origin")))
+		server.countError(errorRateLimited, "")
+		server.recordFailure(clientIP, failureRateLimited)
+		server.emitEvent(EventRateLimited, &clientData{id: in.connID, ip: clientIP, listener: in.listener, origin: r.Header.Get("Origin")}, nil)
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+
+	if config.Reputation.Enabled {
+		metadata := ConnectionMetadata{
+			IP:        clientIP.String(),
+			Origin:    r.Header.Get("Origin"),
+			UserAgent: r.Header.Get("User-Agent"),
+			Listener:  in.listener,
+			Secure:    in.secure,
+			Tags:      tags,
+		}
+		if fingerprint != nil {
+			metadata.JA3 = fingerprint.JA3
+			metadata.JA4 = fingerprint.JA4
+		}
+		if config.GeoIP.db != nil {
+			_, metadata.ASN = config.GeoIP.db.lookup(clientIP)
+		}
+		reject, tag, err := server.checkReputation(config, &metadata, listenerAttrs[:len(listenerAttrs):len(listenerAttrs)])
+		if err != nil {
+			server.countError(errorReputationUnavailable, "")
+		}
+		if reject && err != nil {
+			// an outage of the service isn't the client's fault:
+			connSpan.End(fmt.Errorf("rejected: reputation service unavailable: %w", err))
+			http.Error(w, "reputation service unavailable", http.StatusServiceUnavailable)
+			return
+		} else if reject {
+			connSpan.End(errors.New("rejected: low reputation"))
+			server.recordFailure(clientIP, failureReputation)
+			server.countError(errorReputationRejected, "")
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	// the slot is released when the connection closes:
+	if !server.connSlots.tryAcquire(config.Limits.MaxConnections) {
+		logReject(LogLevelWarn, "max-connections reached", slog.Int("max_connections", config.Limits.MaxConnections))
+		server.countError(errorConnectionLimit, "")
+		http.Error(w, "server is at capacity", http.StatusServiceUnavailable)
+		return
+	}
+
+	client := clientData{
+		id:          in.connID,
+		ip:          clientIP,
+		realIP:      in.realIP,
+		secure:      in.secure,
+		listener:    in.listener,
+		origin:      r.Header.Get("Origin"),
+		policy:      policy,
+		tags:        tags,
+		fingerprint: fingerprint,
+		ident:       in.ident,
+		tor:         in.tor,
+		localPort:   requestLocalPort(r),
+		span:        connSpan,
+		hooks:       server.hooks.Load(),
+		info: &ClientInfo{
+			ID:          in.connID,
+			IP:          clientIP,
+			RealIP:      in.realIP,
+			Secure:      in.secure,
+			Listener:    in.listener,
+			Profile:     in.profile,
+			Origin:      r.Header.Get("Origin"),
+			Header:      r.Header,
+			Tags:        tags,
+			Fingerprint: fingerprint,
+		},
+	}
+	if in.tlsState != nil {
+		client.certfp = certificateFingerprint(in.tlsState.PeerCertificates)
+		client.tlsVersion = in.tlsState.Version
+	}
+	if token := r.URL.Query().Get("session"); validSessionToken(token) {
+		client.sessionToken = token
+	}
+	if config.AccountHeader != "" && utils.IPInNets(in.realIP, config.proxyAllowedFromNets) {
+		client.info.Account = r.Header.Get(config.AccountHeader)
+	}
+	if client.hooks != nil && client.hooks.OnConnect != nil {
+		if err := client.hooks.OnConnect(client.info); err != nil {
+			server.connSlots.release()
+			logReject(LogLevelInfo, "rejected by OnConnect hook", errAttr(err))
+			server.countError(errorHookRejected, "")
+			server.recordFailure(clientIP, failureHookRejected)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	var responseHeader http.Header
+	if config.StickySessions.Enabled {
+		client.upstream, responseHeader = server.stickyUpstream(config, &client, r)
+	}
+
+	upgradeSpan := connSpan.StartChild("websocket.upgrade", spanKindInternal)
+	// the websocket implementation is a server-wide setting, not a per-profile one:
+	conn, err := server.Config().transport.upgrade(w, r, int64(config.maxReadQBytes), responseHeader)
+	upgradeSpan.End(err)
+	if err != nil {
+		server.finishConnection(&client, DisconnectInfo{Reason: CloseUpgradeFailed, Error: err})
+		server.Log(LogComponentListener, LogLevelInfo, "websocket upgrade error", append(listenerAttrs, errAttr(err))...)
+		server.countError(errorUpgradeFailed, "")
+		connSpan.End(err)
+		return
+	}
+
+	go server.RunReverseProxyConn(conn, client, config)
+}
+
+// rejectHTTP2 answers requests made over HTTP/2 (or later), returning true
+// if it did. Our listeners never negotiate HTTP/2, but an embedding
+// application's server (see NewHandler) may, and a client may send the HTTP/2
+// preface in cleartext. Websockets over HTTP/2 (RFC 8441's Extended CONNECT)
+// would need a different upgrade path than messageTransport.upgrade, and no
+// implementation supports one yet; until then, the error tells clients (and
+// anyone debugging them) to use HTTP/1.1, instead of gorilla's complaint
+// about missing Connection and Upgrade headers, which HTTP/2 forbids.
+func rejectHTTP2(w http.ResponseWriter, r *http.Request) bool {
+	if r.ProtoMajor < 2 {
+		return false
+	}
+	http.Error(w, "websockets over HTTP/2 are not supported; use HTTP/1.1", http.StatusHTTPVersionNotSupported)
+	return true
 }
 
-// validate conn.ProxiedIP and conn.Secure against config, HTTP headers, etc.
-func confirmProxyData(conn *utils.WrappedConn, remoteAddr, xForwardedFor, xForwardedProto string, config *Config) {
+// confirmProxyData validates conn.ProxiedIP (from the PROXY protocol) and the
+// request's X-Forwarded-For and X-Forwarded-Proto against config, returning
+// the client's IP (nil if it is the connection's own) and whether the request
+// is secure. A connection can carry several requests (with keep-alive), from
+// different clients of a reverse proxy, so conn must not be modified.
+func confirmProxyData(conn *utils.WrappedConn, remoteAddr, xForwardedFor, xForwardedProto string, config *Config) (proxiedIP net.IP, secure bool) {
+	realIP := utils.AddrToIP(conn.RemoteAddr())
+	trusted := utils.IPInNets(realIP, config.proxyAllowedFromNets)
 	if conn.ProxiedIP != nil {
-		if !utils.IPInNets(utils.AddrToIP(conn.RemoteAddr()), config.proxyAllowedFromNets) {
-			conn.ProxiedIP = nil
+		if trusted {
+			proxiedIP = conn.ProxiedIP
 		}
 	} else if xForwardedFor != "" {
-		proxiedIP := utils.HandleXForwardedFor(remoteAddr, xForwardedFor, config.proxyAllowedFromNets)
+		proxiedIP = utils.HandleXForwardedFor(remoteAddr, xForwardedFor, config.proxyAllowedFromNets)
 		// don't set proxied IP if it is redundant with the actual IP
-		if proxiedIP != nil && !proxiedIP.Equal(utils.AddrToIP(conn.RemoteAddr())) {
-			conn.ProxiedIP = proxiedIP
+		if proxiedIP != nil && proxiedIP.Equal(realIP) {
+			proxiedIP = nil
 		}
 	}
 
 	if conn.Config.TLSConfig != nil || conn.Config.Tor {
 		// we terminated our own encryption:
-		conn.Secure = true
+		secure = true
 	} else {
 		// plaintext websocket: trust X-Forwarded-Proto from a trusted source
-		conn.Secure = utils.IPInNets(utils.AddrToIP(conn.RemoteAddr()), config.proxyAllowedFromNets) &&
-			xForwardedProto == "https"
+		secure = trusted && xForwardedProto == "https"
 	}
+	return
 }
@@ -0,0 +1,217 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSTSRedirect(t *testing.T) {
+	server := new(Server)
+	server.SetConfig(&Config{})
+	redirect := func(host string, port int) (int, string) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/webirc?x=1", nil)
+		r.Host = host
+		server.serveSTSRedirect(w, r, port)
+		return w.Code, w.Header().Get("Location")
+	}
+
+	code, location := redirect("irc.example.com:80", 443)
+	assertEqual(code, http.StatusPermanentRedirect)
+	assertEqual(location, "https://irc.example.com/webirc?x=1")
+	_, location = redirect("irc.example.com", 8097)
+	assertEqual(location, "https://irc.example.com:8097/webirc?x=1")
+	_, location = redirect("[2001:db8::1]:80", 443)
+	assertEqual(location, "https://[2001:db8::1]/webirc?x=1")
+	_, location = redirect("[2001:db8::1]", 8097)
+	assertEqual(location, "https://[2001:db8::1]:8097/webirc?x=1")
+	code, _ = redirect("", 443)
+	assertEqual(code, http.StatusForbidden)
+}
+
+func TestSTSOnlyConfig(t *testing.T) {
+	_, err := NewConfig(
+		WithGatewayName("webircproxy.example.com"),
+		WithYAML(`
+listeners:
+    ":8067":
+        sts-only: true
+        tls:
+            cert: fullchain.pem
+            key: privkey.pem
+`),
+		WithUpstream("127.0.0.1:6667"),
+	)
+	assertEqual(err.Error(), "failed to prepare listeners: listener :8067: sts-only listeners cannot have TLS")
+
+	config, err := NewConfig(
+		WithGatewayName("webircproxy.example.com"),
+		WithYAML(`
+listeners:
+    ":8067":
+        sts-only: true
+`),
+		WithUpstream("127.0.0.1:6667"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(config.trueListeners[":8067"].STSOnly, true)
+	assertEqual(config.trueListeners[":8067"].STSPort, 443)
+}
+
+func TestListenerAddresses(t *testing.T) {
+	config, err := NewConfig(
+		WithGatewayName("webircproxy.example.com"),
+		WithListener("0.0.0.0:8067", ListenerIPv6Only(), ListenerAddresses("[::]:8067")),
+		WithUpstream("127.0.0.1:6667"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(len(config.trueListeners), 2)
+	assertEqual(config.trueListeners["[::]:8067"].IPv6Only, true)
+
+	_, err = NewConfig(
+		WithGatewayName("webircproxy.example.com"),
+		WithListener(":8067"),
+		WithListener(":8097", ListenerAddresses(":8067")),
+		WithUpstream("127.0.0.1:6667"),
+	)
+	assertEqual(err != nil, true)
+
+	assertEqual(tcpListenNetwork("[::]:8067", false), "tcp")
+	assertEqual(tcpListenNetwork("[::]:8067", true), "tcp6")
+	assertEqual(tcpListenNetwork(":8067", true), "tcp6")
+	assertEqual(tcpListenNetwork("0.0.0.0:8067", true), "tcp")
+}
+
+// TestRequireSecure connects to plaintext listeners, with and without
+// X-Forwarded-Proto, at global and per-listener scope
+func TestRequireSecure(t *testing.T) {
+	mock := startMockIRCd(t, "")
+	start := func(opts ...ConfigOption) {
+		config, err := NewConfig(append([]ConfigOption{
+			WithGatewayName("webircproxy"),
+			WithUpstream(mock.Addr()),
+		}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := NewServer(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go server.RunContext(ctx)
+	}
+	status := func(listen, xfp string) int {
+		header := http.Header{"Origin": []string{"https://example.com"}}
+		if xfp != "" {
+			header.Set("X-Forwarded-Proto", xfp)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial("ws://"+listen+"/webirc", header)
+		if err == nil {
+			conn.Close()
+		} else if resp == nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	// global require-secure, with a listener that overrides it; the client
+	// isn't a trusted proxy, so its X-Forwarded-Proto is ignored:
+	global, exempt := freeAddress(t), freeAddress(t)
+	start(
+		WithListener(global),
+		WithListener(exempt, ListenerAllowInsecure()),
+		WithYAML("log-level: error\nlookup-hostnames: false\nrequire-secure: true\nproxy-allowed-from: [192.0.2.0/24]"),
+	)
+	assertEqual(status(global, ""), http.StatusForbidden)
+	assertEqual(status(global, "https"), http.StatusForbidden)
+	assertEqual(status(exempt, ""), http.StatusSwitchingProtocols)
+
+	// per-listener require-secure; the client is a trusted proxy:
+	strict, lax := freeAddress(t), freeAddress(t)
+	start(
+		WithListener(strict, ListenerRequireSecure()),
+		WithListener(lax),
+		WithYAML("log-level: error\nlookup-hostnames: false\nproxy-allowed-from: [localhost]"),
+	)
+	assertEqual(status(strict, ""), http.StatusForbidden)
+	assertEqual(status(strict, "http"), http.StatusForbidden)
+	assertEqual(status(strict, "https"), http.StatusSwitchingProtocols)
+	assertEqual(status(lax, ""), http.StatusSwitchingProtocols)
+}
+
+// TestProxyDataPerRequest sends two requests from different clients of a
+// trusted reverse proxy over one keep-alive connection
+func TestProxyDataPerRequest(t *testing.T) {
+	listen := freeAddress(t)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithListener(listen),
+		WithUpstream(freeAddress(t)),
+		WithYAML(`
+log-level: error
+lookup-hostnames: false
+proxy-allowed-from: [localhost]
+allowed-origins: ["https://example.com"]
+`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connected := make(chan *ClientInfo, 1)
+	server.SetHooks(&Hooks{
+		OnConnect: func(conn *ClientInfo) error {
+			connected <- conn
+			return errors.New("go away")
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.RunContext(ctx)
+
+	conn, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	request := func(origin, xff, xfp string) int {
+		fmt.Fprintf(conn, "GET /webirc HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n"+
+			"Origin: %s\r\nX-Forwarded-For: %s\r\nX-Forwarded-Proto: %s\r\n\r\n", listen, origin, xff, xfp)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// the first client is rejected by its origin:
+	assertEqual(request("https://evil.example.com", "192.0.2.1", "https"), http.StatusForbidden)
+	// the second must not inherit its IP, or its secure flag:
+	assertEqual(request("https://example.com", "192.0.2.2", "http"), http.StatusForbidden)
+	info := <-connected
+	assertEqual(info.IP.String(), "192.0.2.2")
+	assertEqual(info.Secure, false)
+}
@@ -0,0 +1,323 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ergochat/irc-go/ircmsg"
+	"github.com/gorilla/websocket"
+)
+
+// Load test: open many websocket connections to a running webircproxy (and
+// through it, to its upstreams), register each one, then send PINGs at a
+// fixed rate, measuring how long the handshake, registration, and each
+// PING/PONG round trip take. This is a client; it doesn't use the config file.
+
+const (
+	loadTestPingPrefix = "loadtest-"
+)
+
+var (
+	errLoadTestUnregistered = errors.New("timed out waiting for registration")
+)
+
+// LoadTestOptions configures a load test.
+type LoadTestOptions struct {
+	// ws:// or wss:// URL of the listener:
+	URL string
+	// number of concurrent connections:
+	Connections int
+	// how long to spread the connection attempts over:
+	RampUp time.Duration
+	// how long each connection sends PINGs for, after registering:
+	Duration time.Duration
+	// PINGs per second, per connection:
+	Rate float64
+	// websocket subprotocols to offer (e.g., text.ircv3.net):
+	Subprotocols []string
+	// Origin header to send (if any):
+	Origin string
+	// don't verify the listener's certificate:
+	InsecureSkipVerify bool
+	// for the handshake, and for registration:
+	Timeout time.Duration
+}
+
+// LatencyStats summarizes a set of latencies.
+type LatencyStats struct {
+	Count int           `json:"count"`
+	Min   time.Duration `json:"min"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+func (stats LatencyStats) String() string {
+	if stats.Count == 0 {
+		return "n=0"
+	}
+	r := func(d time.Duration) time.Duration { return d.Round(time.Microsecond) }
+	return fmt.Sprintf("n=%d min=%v mean=%v p50=%v p90=%v p99=%v max=%v",
+		stats.Count, r(stats.Min), r(stats.Mean), r(stats.P50), r(stats.P90), r(stats.P99), r(stats.Max))
+}
+
+func computeLatencyStats(latencies []time.Duration) (stats LatencyStats) {
+	stats.Count = len(latencies)
+	if stats.Count == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var total time.Duration
+	for _, latency := range latencies {
+		total += latency
+	}
+	percentile := func(p int) time.Duration {
+		return latencies[(len(latencies)-1)*p/100]
+	}
+	stats.Min, stats.Max = latencies[0], latencies[len(latencies)-1]
+	stats.Mean = total / time.Duration(len(latencies))
+	stats.P50, stats.P90, stats.P99 = percentile(50), percentile(90), percentile(99)
+	return
+}
+
+// LoadTestResult is the outcome of a load test.
+type LoadTestResult struct {
+	Connections  int `json:"connections"`
+	Connected    int `json:"connected"`
+	Registered   int `json:"registered"`
+	PingsSent    int `json:"pings_sent"`
+	PongsMissing int `json:"pongs_missing"`
+	// latencies of the websocket handshake, of registration (from the
+	// handshake to 001), and of PING/PONG round trips:
+	Handshake    LatencyStats `json:"handshake"`
+	Registration LatencyStats `json:"registration"`
+	RoundTrip    LatencyStats `json:"round_trip"`
+	// counts of each distinct error:
+	Errors   map[string]int `json:"errors,omitempty"`
+	Duration time.Duration  `json:"duration"`
+}
+
+// loadTestConnResult is what one connection measured
+type loadTestConnResult struct {
+	connected, registered bool
+	handshake             time.Duration
+	registration          time.Duration
+	roundTrips            []time.Duration
+	pingsSent             int
+	err                   error
+}
+
+// LoadTest runs a load test.
+func LoadTest(options LoadTestOptions) (result LoadTestResult) {
+	if options.Timeout == 0 {
+		options.Timeout = selfTestTimeout
+	}
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: options.Timeout,
+		Subprotocols:     options.Subprotocols,
+		TLSClientConfig:  &tls.Config{InsecureSkipVerify: options.InsecureSkipVerify},
+	}
+	header := make(http.Header)
+	if options.Origin != "" {
+		header.Set("Origin", options.Origin)
+	}
+
+	start := time.Now()
+	connResults := make([]loadTestConnResult, options.Connections)
+	var wg sync.WaitGroup
+	for i := 0; i < options.Connections; i++ {
+		if i != 0 && options.RampUp != 0 {
+			time.Sleep(options.RampUp / time.Duration(options.Connections))
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			connResults[i] = runLoadTestConn(dialer, header, &options)
+		}(i)
+	}
+	wg.Wait()
+	result.Duration = time.Since(start)
+
+	result.Connections = options.Connections
+	var handshakes, registrations, roundTrips []time.Duration
+	for _, r := range connResults {
+		if r.connected {
+			result.Connected++
+			handshakes = append(handshakes, r.handshake)
+		}
+		if r.registered {
+			result.Registered++
+			registrations = append(registrations, r.registration)
+		}
+		result.PingsSent += r.pingsSent
+		result.PongsMissing += r.pingsSent - len(r.roundTrips)
+		roundTrips = append(roundTrips, r.roundTrips...)
+		if r.err != nil {
+			if result.Errors == nil {
+				result.Errors = make(map[string]int)
+			}
+			result.Errors[r.err.Error()]++
+		}
+	}
+	result.Handshake = computeLatencyStats(handshakes)
+	result.Registration = computeLatencyStats(registrations)
+	result.RoundTrip = computeLatencyStats(roundTrips)
+	return
+}
+
+func runLoadTestConn(dialer *websocket.Dialer, header http.Header, options *LoadTestOptions) (result loadTestConnResult) {
+	start := time.Now()
+	conn, _, err := dialer.Dial(options.URL, header)
+	if err != nil {
+		result.err = fmt.Errorf("couldn't connect: %w", err)
+		return
+	}
+	defer conn.Close()
+	result.connected = true
+	result.handshake = time.Since(start)
+
+	wsType := websocket.TextMessage
+	if conn.Subprotocol() == "binary.ircv3.net" {
+		wsType = websocket.BinaryMessage
+	}
+	var writeMutex sync.Mutex
+	send := func(msg ircmsg.Message) error {
+		line, err := msg.LineBytesStrict(false, DefaultMaxLineLen)
+		if err != nil {
+			return err
+		}
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		return conn.WriteMessage(wsType, line[:len(line)-2])
+	}
+
+	var nonce [4]byte
+	rand.Read(nonce[:])
+	nick := "loadtest-" + hex.EncodeToString(nonce[:])
+	registerStart := time.Now()
+	if err := send(ircmsg.MakeMessage(nil, "", "NICK", nick)); err != nil {
+		result.err = fmt.Errorf("couldn't send registration: %w", err)
+		return
+	}
+	if err := send(ircmsg.MakeMessage(nil, "", "USER", "loadtest", "0", "*", "webircproxy load test")); err != nil {
+		result.err = fmt.Errorf("couldn't send registration: %w", err)
+		return
+	}
+
+	// the reader records registration and the PONGs, answering PINGs:
+	registered := make(chan struct{})
+	var registration time.Duration
+	readErr := make(chan error, 1)
+	var pongMutex sync.Mutex
+	sentAt := make(map[string]time.Time)
+	var roundTrips []time.Duration
+	go func() {
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			for _, line := range splitWSMessage(nil, message) {
+				msg, err := ircmsg.ParseLine(string(line))
+				if err != nil {
+					continue
+				}
+				switch msg.Command {
+				case "001":
+					if registration == 0 {
+						registration = time.Since(registerStart)
+						close(registered)
+					}
+				case "PING":
+					send(ircmsg.MakeMessage(nil, "", "PONG", msg.Params...))
+				case "PONG":
+					if len(msg.Params) == 0 {
+						continue
+					}
+					token := msg.Params[len(msg.Params)-1]
+					pongMutex.Lock()
+					if sent, ok := sentAt[token]; ok {
+						delete(sentAt, token)
+						roundTrips = append(roundTrips, time.Since(sent))
+					}
+					pongMutex.Unlock()
+				case "ERROR":
+					readErr <- fmt.Errorf("upstream sent ERROR: %s", strings.Join(msg.Params, " "))
+					return
+				}
+			}
+		}
+	}()
+	select {
+	case <-registered:
+		result.registered = true
+		result.registration = registration
+	case err := <-readErr:
+		result.err = fmt.Errorf("error before registration: %w", err)
+		return
+	case <-time.After(options.Timeout):
+		result.err = errLoadTestUnregistered
+		return
+	}
+
+	if options.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / options.Rate))
+		defer ticker.Stop()
+		deadline := time.After(options.Duration)
+	pingLoop:
+		for i := 0; ; i++ {
+			select {
+			case <-ticker.C:
+				token := loadTestPingPrefix + strconv.Itoa(i)
+				pongMutex.Lock()
+				sentAt[token] = time.Now()
+				pongMutex.Unlock()
+				if err := send(ircmsg.MakeMessage(nil, "", "PING", token)); err != nil {
+					result.err = fmt.Errorf("couldn't send PING: %w", err)
+					break pingLoop
+				}
+				result.pingsSent++
+			case err := <-readErr:
+				result.err = fmt.Errorf("connection lost: %w", err)
+				break pingLoop
+			case <-deadline:
+				break pingLoop
+			}
+		}
+	} else {
+		select {
+		case err := <-readErr:
+			result.err = fmt.Errorf("connection lost: %w", err)
+		case <-time.After(options.Duration):
+		}
+	}
+
+	if result.err == nil {
+		// give the last PONGs a chance to arrive:
+		send(ircmsg.MakeMessage(nil, "", "QUIT", "webircproxy load test"))
+		select {
+		case <-readErr:
+		case <-time.After(time.Second):
+		}
+	}
+	conn.Close()
+	pongMutex.Lock()
+	result.roundTrips = append([]time.Duration(nil), roundTrips...)
+	pongMutex.Unlock()
+	return
+}
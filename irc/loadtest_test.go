@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ergochat/irc-go/ircmsg"
+	"github.com/gorilla/websocket"
+)
+
+func TestComputeLatencyStats(t *testing.T) {
+	var latencies []time.Duration
+	for i := 100; i > 0; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	stats := computeLatencyStats(latencies)
+	assertEqual(stats.Count, 100)
+	assertEqual(stats.Min, time.Millisecond)
+	assertEqual(stats.Max, 100*time.Millisecond)
+	assertEqual(stats.P50, 50*time.Millisecond)
+	assertEqual(stats.P99, 99*time.Millisecond)
+	assertEqual(computeLatencyStats(nil), LatencyStats{})
+}
+
+// fakeWebsocketIRCd registers websocket clients and answers their PINGs
+func fakeWebsocketIRCd(t *testing.T) string {
+	upgrader := websocket.Upgrader{Subprotocols: websocketSubprotocols}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			wsType, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			msg, err := ircmsg.ParseLine(string(message))
+			if err != nil {
+				return
+			}
+			switch msg.Command {
+			case "USER":
+				conn.WriteMessage(wsType, []byte(":irc.example.com 001 loadtest :Welcome"))
+			case "PING":
+				conn.WriteMessage(wsType, []byte(":irc.example.com PONG irc.example.com :"+msg.Params[0]))
+			case "QUIT":
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestLoadTest(t *testing.T) {
+	url := fakeWebsocketIRCd(t)
+	result := LoadTest(LoadTestOptions{
+		URL:          url,
+		Connections:  3,
+		Duration:     200 * time.Millisecond,
+		Rate:         20,
+		Subprotocols: []string{"binary.ircv3.net"},
+	})
+	assertEqual(result.Connected, 3)
+	assertEqual(result.Registered, 3)
+	assertEqual(result.PongsMissing, 0)
+	assertEqual(len(result.Errors), 0)
+	assertEqual(result.RoundTrip.Count, result.PingsSent)
+	if result.PingsSent == 0 {
+		t.Errorf("no PINGs were sent")
+	}
+
+	result = LoadTest(LoadTestOptions{URL: "ws://" + freeAddress(t) + "/", Connections: 2, Timeout: time.Second})
+	assertEqual(result.Connected, 0)
+	assertEqual(len(result.Errors), 1)
+}
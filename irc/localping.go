@@ -0,0 +1,194 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+
+	"github.com/ergochat/irc-go/ircmsg"
+)
+
+// With local-ping, the proxy answers the client's PINGs itself, and answers
+// the upstream's PINGs on behalf of clients that have been active recently,
+// saving round trips over slow (e.g., mobile) links and wakeups of idle
+// clients. To stay transparent, the client's PINGs are only answered once the
+// upstream's server name is known (from its 001 numeric), so that the PONG
+// looks exactly like the upstream's own; PINGs with tags (e.g., a
+// labeled-response label) are always forwarded.
+
+const (
+	defaultLocalPingActivityWindow = 5 * time.Minute
+)
+
+// LocalPingConfig configures local-ping.
+type LocalPingConfig struct {
+	Enabled bool
+	// the upstream's PINGs are answered for clients that sent anything (including
+	// a PING) within this time; they are forwarded to clients that didn't, so
+	// that the upstream can still detect dead clients:
+	ActivityWindow time.Duration `yaml:"activity-window"`
+}
+
+func (conf *LocalPingConfig) postprocess() {
+	if conf.ActivityWindow == 0 {
+		conf.ActivityWindow = defaultLocalPingActivityWindow
+	}
+}
+
+var (
+	pingCommand    = []byte("PING ")
+	welcomeNumeric = []byte(" 001 ")
+)
+
+// noteClientActivity records that the client sent a line
+func (r *ReverseProxyConn) noteClientActivity() {
+	atomic.StoreInt64(&r.lastClientActivity, time.Now().UnixNano())
+}
+
+// observeUpstreamLine learns the upstream's server name from its 001
+func (r *ReverseProxyConn) observeUpstreamLine(line []byte) {
+	if r.upstreamServerName.Load() != nil || !bytes.Contains(line, welcomeNumeric) {
+		return
+	}
+	msg, err := ircmsg.ParseLine(string(line))
+	if err == nil && msg.Command == "001" && msg.Prefix != "" {
+		source := msg.Prefix
+		r.upstreamServerName.Store(&source)
+	}
+}
+
+// answerClientPing answers a PING from the client, returning whether it did
+// (in which case the PING must not be forwarded)
+func (r *ReverseProxyConn) answerClientPing(line []byte) (answered bool, err error) {
+	if !bytes.HasPrefix(line, pingCommand) {
+		return false, nil
+	}
+	serverName := r.upstreamServerName.Load()
+	if serverName == nil {
+		return false, nil
+	}
+	msg, err := ircmsg.ParseLine(string(line))
+	if err != nil || len(msg.Params) == 0 {
+		return false, nil
+	}
+	pong := ircmsg.MakeMessage(nil, *serverName, "PONG", *serverName, msg.Params[0])
+	pongLine, err := pong.LineBytesStrict(false, r.maxLineLen)
+	if err != nil {
+		return false, nil
+	}
+	// LineBytesStrict includes the \r\n, which websocket messages don't:
+	return true, r.writeWS(r.messageType, bytes.TrimSuffix(pongLine, crlf))
+}
+
+// absorbUpstreamPing answers a PING from the upstream for an active client,
+// returning whether it did (in which case the PING must not be forwarded)
+func (r *ReverseProxyConn) absorbUpstreamPing(line []byte) (absorbed bool, err error) {
+	if time.Since(time.Unix(0, atomic.LoadInt64(&r.lastClientActivity))) > r.localPing.ActivityWindow {
+		return false, nil
+	}
+	return r.answerUpstreamPing(line)
+}
+
+// answerUpstreamPing answers the line if it is a PING from the upstream,
+// returning whether it was
+func (r *ReverseProxyConn) answerUpstreamPing(line []byte) (answered bool, err error) {
+	// the upstream's PINGs may have a source:
+	command := line
+	if len(command) != 0 && command[0] == ':' {
+		if i := bytes.IndexByte(command, ' '); i != -1 {
+			command = command[i+1:]
+		}
+	}
+	if !bytes.HasPrefix(command, pingCommand) {
+		return false, nil
+	}
+	msg, err := ircmsg.ParseLine(string(line))
+	if err != nil || len(msg.Params) == 0 {
+		return false, nil
+	}
+	pong := ircmsg.MakeMessage(nil, "", "PONG", msg.Params[0])
+	pongLine, err := pong.LineBytesStrict(false, DefaultMaxLineLen)
+	if err != nil {
+		return false, nil
+	}
+	return true, r.writeUpstreamLine(pongLine)
+}
+
+// writeWS writes a message to the client (to each of its websockets, with
+// multiplexing), or buffers it for replay if the client is detached; several
+// goroutines write to it, so the writes must be serialized. A failed write
+// detaches the websocket instead of failing, if the connection can continue
+// without it.
+func (r *ReverseProxyConn) writeWS(mType messageType, data []byte) error {
+	r.wsMutex.Lock()
+	defer r.wsMutex.Unlock()
+	if r.webConn == nil {
+		if r.replay != nil {
+			r.replay.add(data)
+		}
+		return nil
+	}
+	for _, webConn := range r.multiplexed {
+		if webConn.WriteMessage(mType, data) != nil {
+			r.dropMultiplexedLocked(webConn)
+		}
+	}
+	err := r.webConn.WriteMessage(mType, data)
+	if err != nil && r.detachLocked(r.webConn) {
+		// a failed write sends at most part of the line's frame, so the client
+		// didn't receive it; if the client was detached, it is replayed (rather
+		// than lost) when the client reattaches:
+		if r.webConn == nil && r.replay != nil {
+			r.replay.add(data)
+		}
+		return nil
+	}
+	return err
+}
+
+// writeWSClose sends a close frame to the client, if it is attached; when
+// the connection is closed, the websocket is kept open (for up to the close
+// timeout) until the client acknowledges it
+func (r *ReverseProxyConn) writeWSClose(code int, reason string) {
+	r.wsMutex.Lock()
+	webConn := r.webConn
+	if webConn != nil && r.closeSentTo == nil {
+		r.closeSentTo, r.closeAcked = webConn, make(chan struct{})
+	}
+	r.wsMutex.Unlock()
+	if webConn == nil {
+		return
+	}
+	if webConn.WriteClose(code, reason, r.closeTimeout) != nil {
+		// there will be no acknowledgment:
+		r.noteReaderDone(webConn)
+	}
+}
+
+// noteReaderDone records that nothing more will be read from the websocket,
+// so that a close frame sent to it needn't wait for an acknowledgment
+func (r *ReverseProxyConn) noteReaderDone(webConn messageConn) {
+	r.wsMutex.Lock()
+	defer r.wsMutex.Unlock()
+	if r.closeSentTo == webConn && r.closeAcked != nil {
+		close(r.closeAcked)
+		r.closeAcked = nil
+	}
+}
+
+// awaitCloseAck closes a websocket that was sent a close frame, once the
+// client acknowledges it (or after timeout, if it doesn't)
+func awaitCloseAck(webConn messageConn, acked <-chan struct{}, timeout time.Duration) {
+	if acked != nil {
+		timer := time.NewTimer(timeout)
+		select {
+		case <-acked:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	webConn.Close()
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingConn struct {
+	messages    []string
+	closeCode   int
+	closeReason string
+}
+
+func (c *recordingConn) Subprotocol() string               { return "" }
+func (c *recordingConn) NextReader() (io.Reader, error)    { return nil, io.EOF }
+func (c *recordingConn) SetReadDeadline(t time.Time) error { return nil }
+func (c *recordingConn) Close() error                      { return nil }
+func (c *recordingConn) WriteClose(code int, reason string, timeout time.Duration) error {
+	c.closeCode, c.closeReason = code, reason
+	return nil
+}
+func (c *recordingConn) WriteMessage(mType messageType, data []byte) error {
+	c.messages = append(c.messages, string(data))
+	return nil
+}
+
+func TestAnswerClientPing(t *testing.T) {
+	webConn := new(recordingConn)
+	r := &ReverseProxyConn{webConn: webConn, messageType: textMessage, maxLineLen: DefaultMaxLineLen}
+
+	// the upstream's server name isn't known yet:
+	answered, _ := r.answerClientPing([]byte("PING abc"))
+	assertEqual(answered, false)
+
+	r.observeUpstreamLine([]byte(":irc.example.com 002 alice :Your host is irc.example.com"))
+	assertEqual(r.upstreamServerName.Load() == nil, true)
+	r.observeUpstreamLine([]byte(":irc.example.com 001 alice :Welcome to the network"))
+	assertEqual(*r.upstreamServerName.Load(), "irc.example.com")
+
+	answered, err := r.answerClientPing([]byte("PING :abc def"))
+	assertEqual(answered, true)
+	assertEqual(err, nil)
+	assertEqual(webConn.messages, []string{":irc.example.com PONG irc.example.com :abc def"})
+
+	// tagged PINGs are always forwarded:
+	answered, _ = r.answerClientPing([]byte("@label=x PING abc"))
+	assertEqual(answered, false)
+	answered, _ = r.answerClientPing([]byte("PRIVMSG #chan :PING abc"))
+	assertEqual(answered, false)
+}
+
+func TestAbsorbUpstreamPing(t *testing.T) {
+	client, upstream := net.Pipe()
+	defer client.Close()
+	defer upstream.Close()
+	r := &ReverseProxyConn{uConn: client, localPing: &LocalPingConfig{Enabled: true}}
+	r.localPing.postprocess()
+
+	// no activity from the client yet, so the PING is forwarded:
+	absorbed, _ := r.absorbUpstreamPing([]byte("PING :irc.example.com"))
+	assertEqual(absorbed, false)
+
+	r.noteClientActivity()
+	absorbed, _ = r.absorbUpstreamPing([]byte(":irc.example.com NOTICE * :PING"))
+	assertEqual(absorbed, false)
+
+	result := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(upstream).ReadString('\n')
+		result <- line
+	}()
+	absorbed, err := r.absorbUpstreamPing([]byte(":irc.example.com PING :irc.example.com"))
+	assertEqual(absorbed, true)
+	assertEqual(err, nil)
+	assertEqual(<-result, "PONG irc.example.com\r\n")
+}
+
+// the proxy's own PONGs mustn't land between a client's line and its CRLF
+func TestUpstreamPongSerialized(t *testing.T) {
+	uConn := new(chunkConn)
+	r := &ReverseProxyConn{uConn: uConn}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			iovec := net.Buffers{[]byte("PRIVMSG #chan :hi"), crlf}
+			r.writeUpstream(&iovec)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			answered, err := r.answerUpstreamPing([]byte(":irc.example.com PING :keepalive"))
+			assertEqual(answered, true)
+			assertEqual(err, nil)
+		}
+	}()
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(string(uConn.written), "\r\n"), "\r\n")
+	assertEqual(len(lines), 200)
+	for _, line := range lines {
+		if line != "PRIVMSG #chan :hi" && line != "PONG keepalive" {
+			t.Fatalf("interleaved line: %q", line)
+		}
+	}
+}
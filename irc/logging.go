@@ -0,0 +1,350 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ergochat/ergo/irc/utils"
+)
+
+type LogLevel uint
+
+const (
+	LogLevelError LogLevel = iota
+	LogLevelWarn
+	LogLevelInfo
+	LogLevelDebug
+)
+
+// LogComponent is the part of the proxy that a log message is about;
+// each component can have its own log level.
+type LogComponent uint
+
+const (
+	// startup, shutdown, and other general messages:
+	LogComponentServer LogComponent = iota
+	// HTTP requests, websocket upgrades, and accept/reject decisions:
+	LogComponentListener
+	// the data path between the websocket and the upstream:
+	LogComponentProxy
+	// transcoding of upstream messages to UTF-8:
+	LogComponentTranscoding
+	// config loading and rehashing:
+	LogComponentConfig
+
+	numLogComponents
+)
+
+var logComponentNames = [numLogComponents]string{
+	LogComponentServer:      "server",
+	LogComponentListener:    "listener",
+	LogComponentProxy:       "proxy",
+	LogComponentTranscoding: "transcoding",
+	LogComponentConfig:      "config",
+}
+
+// keys for structured log fields:
+const (
+	logKeyConnID    = "conn_id"
+	logKeyRemoteIP  = "remote_ip"
+	logKeyListener  = "listener"
+	logKeyUpstream  = "upstream"
+	logKeyDirection = "direction"
+	logKeyError     = "error"
+	// see closereasons.go:
+	logKeyCloseReason = "close_reason"
+)
+
+var (
+	// serializes writes to stderr across loggers from different configs
+	stderrMutex sync.Mutex
+
+	defaultLogger = slog.New(newTextLogHandler(os.Stderr, &stderrMutex))
+)
+
+func slogLevel(level LogLevel) slog.Level {
+	switch level {
+	case LogLevelError:
+		return slog.LevelError
+	case LogLevelWarn:
+		return slog.LevelWarn
+	case LogLevelInfo:
+		return slog.LevelInfo
+	default:
+		return slog.LevelDebug
+	}
+}
+
+func logLevelFromSlog(level slog.Level) LogLevel {
+	switch {
+	case level >= slog.LevelError:
+		return LogLevelError
+	case level >= slog.LevelWarn:
+		return LogLevelWarn
+	case level >= slog.LevelInfo:
+		return LogLevelInfo
+	default:
+		return LogLevelDebug
+	}
+}
+
+func (component LogComponent) String() string {
+	if component < numLogComponents {
+		return logComponentNames[component]
+	}
+	return "unknown"
+}
+
+func (level LogLevel) String() string {
+	switch level {
+	case LogLevelError:
+		return "error"
+	case LogLevelWarn:
+		return "warn"
+	case LogLevelInfo:
+		return "info"
+	default:
+		return "debug"
+	}
+}
+
+// Logger receives the server's log messages, after filtering by log level
+// and log-rate-limit, and scrubbing per log-privacy; see (*Server).SetLogger.
+type Logger interface {
+	Log(component LogComponent, level LogLevel, message string, attrs ...slog.Attr)
+}
+
+// SetLogger sends the server's log messages to logger, instead of to the
+// configured log-outputs (by default, stderr); nil restores the log-outputs.
+func (server *Server) SetLogger(logger Logger) {
+	if logger == nil {
+		server.logger.Store(nil)
+	} else {
+		server.logger.Store(&logger)
+	}
+}
+
+// NewSlogLogger returns a Logger that writes to an slog.Logger.
+func NewSlogLogger(logger *slog.Logger) Logger {
+	return slogLogger{logger: logger}
+}
+
+// NewTextLogger returns a Logger that writes the default text format to out.
+func NewTextLogger(out io.Writer) Logger {
+	return slogLogger{logger: slog.New(newTextLogHandler(out, new(sync.Mutex)))}
+}
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+func (l slogLogger) Log(component LogComponent, level LogLevel, message string, attrs ...slog.Attr) {
+	l.logger.LogAttrs(context.Background(), slogLevel(level), message, attrs...)
+}
+
+// Log logs a message, with optional structured fields, if the level is enabled
+// for the component.
+func (server *Server) Log(component LogComponent, level LogLevel, message string, attrs ...slog.Attr) {
+	config := server.Config()
+	if config.logEnabled(component, level) && server.sampleLog(config, component, level, message) {
+		server.writeLog(config, component, level, message, attrs)
+	}
+}
+
+// writeLog sends a message that has passed filtering to the Logger set by
+// SetLogger, or else to the configured outputs
+func (server *Server) writeLog(config *Config, component LogComponent, level LogLevel, message string, attrs []slog.Attr) {
+	if logger := server.logger.Load(); logger != nil {
+		if config.LogPrivacy.enabled() {
+			// don't modify the caller's slice:
+			scrubbed := make([]slog.Attr, len(attrs))
+			for i, attr := range attrs {
+				scrubbed[i] = config.LogPrivacy.scrubAttr(attr)
+			}
+			attrs = scrubbed
+		}
+		(*logger).Log(component, level, message, attrs...)
+		return
+	}
+	config.getLogger().LogAttrs(context.Background(), slogLevel(level), message, attrs...)
+}
+
+// errAttr returns a structured field for an error (or an empty, ignored field if it is nil)
+func errAttr(err error) slog.Attr {
+	if err == nil {
+		return slog.Attr{}
+	}
+	return slog.String(logKeyError, err.Error())
+}
+
+func (config *Config) logEnabled(component LogComponent, level LogLevel) bool {
+	return level <= config.logLevels[component]
+}
+
+// prepareLogLevels applies the per-component overrides in log-levels
+// on top of the global log-level
+func (config *Config) prepareLogLevels() error {
+	config.logLevel = parseLogLevel(config.LogLevel)
+	for i := range config.logLevels {
+		config.logLevels[i] = config.logLevel
+	}
+	for name, level := range config.LogLevels {
+		found := false
+		for component, componentName := range logComponentNames {
+			if strings.ToLower(name) == componentName {
+				config.logLevels[component] = parseLogLevel(level)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("invalid log component: %s", name)
+		}
+	}
+	return nil
+}
+
+func (config *Config) getLogger() *slog.Logger {
+	if config.logger != nil {
+		return config.logger
+	}
+	return defaultLogger
+}
+
+func (config *Config) prepareLogger() error {
+	format := strings.ToLower(config.LogFormat)
+	switch format {
+	case "":
+		format = "text"
+	case "text", "json":
+	default:
+		return fmt.Errorf("invalid log-format: %s", config.LogFormat)
+	}
+	config.logOutputs = config.LogOutputs
+	if len(config.logOutputs) == 0 {
+		config.logOutputs = []LogOutputConfig{{Method: "stderr"}}
+	}
+	for i := range config.logOutputs {
+		if err := config.logOutputs[i].postprocess(format); err != nil {
+			return err
+		}
+	}
+	// this logger is used until the server opens the configured outputs
+	// (see (*Server).setupLogging):
+	if format == "json" {
+		config.logger = slog.New(config.wrapLogHandler(newJSONLogHandler(os.Stderr)))
+	} else {
+		config.logger = slog.New(config.wrapLogHandler(defaultLogger.Handler()))
+	}
+	return nil
+}
+
+func newJSONLogHandler(out io.Writer) slog.Handler {
+	return slog.NewJSONHandler(out, &slog.HandlerOptions{
+		// level filtering is done by (*Server).Log
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if attr.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Time(slog.TimeKey, attr.Value.Time().UTC())
+			} else if attr.Key == slog.LevelKey && len(groups) == 0 {
+				return slog.String(slog.LevelKey, strings.ToLower(attr.Value.String()))
+			}
+			return attr
+		},
+	})
+}
+
+// textLogHandler is a slog.Handler that produces the traditional
+// human-readable format: `[ info] [2021-06-01T00:00:00.000Z] message key=value`
+type textLogHandler struct {
+	out    io.Writer
+	mutex  *sync.Mutex
+	prefix string // for groups
+	attrs  string // preformatted
+	// omit the level and timestamp (e.g., because syslog records them):
+	bare bool
+}
+
+func newTextLogHandler(out io.Writer, mutex *sync.Mutex) *textLogHandler {
+	return &textLogHandler{out: out, mutex: mutex}
+}
+
+func (h *textLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+func (h *textLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	var buf strings.Builder
+	timestamp := record.Time
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	if !h.bare {
+		fmt.Fprintf(&buf, "%s [%s] ", logLevelToString(logLevelFromSlog(record.Level)),
+			timestamp.UTC().Format(utils.IRCv3TimestampFormat))
+	}
+	buf.WriteString(record.Message)
+	buf.WriteString(h.attrs)
+	record.Attrs(func(attr slog.Attr) bool {
+		writeTextAttr(&buf, h.prefix, attr)
+		return true
+	})
+	buf.WriteByte('\n')
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	_, err := io.WriteString(h.out, buf.String())
+	return err
+}
+
+func writeTextAttr(buf *strings.Builder, prefix string, attr slog.Attr) {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		groupPrefix := prefix
+		if attr.Key != "" {
+			groupPrefix = prefix + attr.Key + "."
+		}
+		for _, groupAttr := range attr.Value.Group() {
+			writeTextAttr(buf, groupPrefix, groupAttr)
+		}
+		return
+	}
+	value := attr.Value.String()
+	if value == "" || strings.ContainsAny(value, " \t\r\n\"=") {
+		value = strconv.Quote(value)
+	}
+	fmt.Fprintf(buf, " %s%s=%s", prefix, attr.Key, value)
+}
+
+func (h *textLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var buf strings.Builder
+	buf.WriteString(h.attrs)
+	for _, attr := range attrs {
+		writeTextAttr(&buf, h.prefix, attr)
+	}
+	result := *h
+	result.attrs = buf.String()
+	return &result
+}
+
+func (h *textLogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	result := *h
+	result.prefix = h.prefix + name + "."
+	return &result
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTextLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	var mutex sync.Mutex
+	logger := slog.New(newTextLogHandler(&buf, &mutex))
+
+	logger.LogAttrs(context.Background(), slog.LevelWarn, "error reading from upstream conn",
+		slog.String(logKeyRemoteIP, "192.0.2.1"), slog.String("line", "PRIVMSG #a :hi"), errAttr(nil))
+	line := buf.String()
+	if !strings.HasPrefix(line, "[ warn] [") {
+		t.Errorf("unexpected prefix: %s", line)
+	}
+	if !strings.HasSuffix(line, `] error reading from upstream conn remote_ip=192.0.2.1 line="PRIVMSG #a :hi"`+"\n") {
+		t.Errorf("unexpected formatting: %s", line)
+	}
+
+	buf.Reset()
+	logger.With(slog.String(logKeyUpstream, "/tmp/sock")).WithGroup("g").Info("x", errAttr(errors.New("EOF")))
+	if !strings.HasSuffix(buf.String(), "] x upstream=/tmp/sock g.error=EOF\n") {
+		t.Errorf("unexpected formatting: %s", buf.String())
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "webircproxy.log")
+	rf, err := newRotatingFile(filename, 100, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	line := []byte(strings.Repeat("a", 59) + "\n")
+	for i := 0; i < 5; i++ {
+		if _, err := rf.Write(line); err != nil {
+			t.Fatal(err)
+		}
+		// rotated files are distinguished by millisecond timestamps:
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	backups, _ := filepath.Glob(filename + ".*")
+	assertEqual(len(backups), 2)
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(info.Size(), int64(len(line)))
+}
+
+func TestLogOutputConfig(t *testing.T) {
+	conf := LogOutputConfig{Method: "File"}
+	if conf.postprocess("text") == nil {
+		t.Errorf("file output without a filename should be rejected")
+	}
+	conf = LogOutputConfig{Method: "syslog"}
+	if err := conf.postprocess("json"); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(conf.format, "json")
+	assertEqual(conf.Tag, "webircproxy")
+	conf = LogOutputConfig{Method: "carrier-pigeon"}
+	if conf.postprocess("text") == nil {
+		t.Errorf("invalid method should be rejected")
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	config := Config{LogLevel: "info", LogLevels: map[string]string{"Proxy": "debug", "transcoding": "error"}}
+	if err := config.prepareLogLevels(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(config.logEnabled(LogComponentProxy, LogLevelDebug), true)
+	assertEqual(config.logEnabled(LogComponentListener, LogLevelDebug), false)
+	assertEqual(config.logEnabled(LogComponentListener, LogLevelInfo), true)
+	assertEqual(config.logEnabled(LogComponentTranscoding, LogLevelWarn), false)
+
+	config = Config{LogLevels: map[string]string{"bogus": "debug"}}
+	if config.prepareLogLevels() == nil {
+		t.Errorf("invalid component should be rejected")
+	}
+}
+
+func TestConnIDs(t *testing.T) {
+	first, second := newConnID(), newConnID()
+	if first == second || first == "" {
+		t.Errorf("connection IDs should be unique: %s %s", first, second)
+	}
+}
+
+func TestLogSampler(t *testing.T) {
+	conf := LogRateLimitConfig{Enabled: true, Burst: 2, Window: time.Hour}
+	conf.postprocess()
+	var ls logSampler
+	key := logSampleKey{LogComponentProxy, LogLevelError, "error connecting to upstream ircd"}
+	other := logSampleKey{LogComponentProxy, LogLevelError, "error sending WEBIRC to upstream"}
+
+	allowed, flushAt := ls.allow(key, &conf)
+	assertEqual(allowed, true)
+	assertEqual(flushAt.IsZero(), true)
+	allowed, _ = ls.allow(key, &conf)
+	assertEqual(allowed, true)
+	allowed, flushAt = ls.allow(key, &conf)
+	assertEqual(allowed, false)
+	assertEqual(flushAt.IsZero(), false)
+	allowed, flushAt = ls.allow(key, &conf)
+	assertEqual(allowed, false)
+	assertEqual(flushAt.IsZero(), true)
+	allowed, _ = ls.allow(other, &conf)
+	assertEqual(allowed, true)
+
+	assertEqual(ls.flush(key), 2)
+	// a new window begins:
+	allowed, _ = ls.allow(key, &conf)
+	assertEqual(allowed, true)
+}
+
+type capturedLog struct {
+	component LogComponent
+	level     LogLevel
+	message   string
+	attrs     []slog.Attr
+}
+
+type captureLogger struct {
+	logs []capturedLog
+}
+
+func (c *captureLogger) Log(component LogComponent, level LogLevel, message string, attrs ...slog.Attr) {
+	c.logs = append(c.logs, capturedLog{component, level, message, attrs})
+}
+
+func TestSetLogger(t *testing.T) {
+	config := &Config{LogLevel: "info", LogPrivacy: LogPrivacyConfig{Mode: "truncate"}}
+	if err := config.prepareLogLevels(); err != nil {
+		t.Fatal(err)
+	}
+	config.LogPrivacy.postprocess()
+	server := new(Server)
+	server.SetConfig(config)
+
+	var capture captureLogger
+	server.SetLogger(&capture)
+	attrs := []slog.Attr{slog.String(logKeyRemoteIP, "192.0.2.1")}
+	server.Log(LogComponentProxy, LogLevelInfo, "received connection", attrs...)
+	server.Log(LogComponentProxy, LogLevelDebug, "proxied line")
+	assertEqual(len(capture.logs), 1)
+	assertEqual(capture.logs[0].component.String(), "proxy")
+	assertEqual(capture.logs[0].level.String(), "info")
+	assertEqual(capture.logs[0].message, "received connection")
+	assertEqual(capture.logs[0].attrs[0].Value.String(), "192.0.2.0/24")
+	// the caller's fields are unmodified:
+	assertEqual(attrs[0].Value.String(), "192.0.2.1")
+
+	var buf bytes.Buffer
+	server.SetLogger(NewTextLogger(&buf))
+	server.Log(LogComponentServer, LogLevelWarn, "hello", slog.Int("n", 1))
+	assertEqual(strings.HasPrefix(buf.String(), "[ warn] ["), true)
+	assertEqual(strings.HasSuffix(buf.String(), "] hello n=1\n"), true)
+
+	server.SetLogger(nil)
+	assertEqual(server.logger.Load() == nil, true)
+}
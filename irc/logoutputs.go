@@ -0,0 +1,395 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogRotateConfig configures rotation of a log file.
+type LogRotateConfig struct {
+	// rotate when the file exceeds this size (in megabytes):
+	MaxSizeMB int64 `yaml:"max-size-mb"`
+	// rotate when the file is older than this:
+	MaxAge time.Duration `yaml:"max-age"`
+	// number of rotated files to keep (0 for unlimited):
+	MaxBackups int `yaml:"max-backups"`
+}
+
+func (conf *LogRotateConfig) key() string {
+	return fmt.Sprintf("%d %v %d", conf.MaxSizeMB, conf.MaxAge, conf.MaxBackups)
+}
+
+func (conf *LogRotateConfig) open(filename string) (*rotatingFile, error) {
+	return newRotatingFile(filename, conf.MaxSizeMB*1024*1024, conf.MaxAge, conf.MaxBackups)
+}
+
+// LogOutputConfig configures a destination for log output.
+type LogOutputConfig struct {
+	// "stderr", "file", or "syslog":
+	Method string
+	// "text" or "json"; defaults to the global log-format:
+	Format string
+
+	// for method: file
+	Filename string
+	Rotate   LogRotateConfig
+
+	// for method: syslog. network and address are empty for the local syslog
+	// daemon (including journald); otherwise e.g. "udp" and "192.0.2.1:514":
+	Network string
+	Address string
+	Tag     string
+
+	method string
+	format string
+}
+
+// sinkKey identifies an open log destination, so that it can be reused across rehashes
+func (conf *LogOutputConfig) sinkKey() string {
+	switch conf.method {
+	case "file":
+		return fmt.Sprintf("file %s %s", conf.Filename, conf.Rotate.key())
+	case "syslog":
+		return fmt.Sprintf("syslog %s %s %s", conf.Network, conf.Address, conf.Tag)
+	default:
+		return conf.method
+	}
+}
+
+func (conf *LogOutputConfig) postprocess(defaultFormat string) error {
+	conf.method = strings.ToLower(conf.Method)
+	switch conf.method {
+	case "stderr":
+	case "file":
+		if conf.Filename == "" {
+			return fmt.Errorf("file log output requires a filename")
+		}
+	case "syslog":
+		if conf.Tag == "" {
+			conf.Tag = "webircproxy"
+		}
+	default:
+		return fmt.Errorf("invalid log output method: %s", conf.Method)
+	}
+	conf.format = strings.ToLower(conf.Format)
+	if conf.format == "" {
+		conf.format = defaultFormat
+	}
+	switch conf.format {
+	case "text", "json":
+	default:
+		return fmt.Errorf("invalid log format: %s", conf.Format)
+	}
+	return nil
+}
+
+// openSink opens the writer for a file or syslog log output
+func (conf *LogOutputConfig) openSink() (io.WriteCloser, error) {
+	switch conf.method {
+	case "file":
+		return conf.Rotate.open(conf.Filename)
+	case "syslog":
+		sink, err := newSyslogSink(conf.Network, conf.Address, conf.Tag)
+		if err != nil {
+			return nil, err
+		}
+		return sink, nil
+	default:
+		return nil, fmt.Errorf("log output method %s has no sink", conf.method)
+	}
+}
+
+// setupLogging builds config.logger from config.logOutputs, reusing any open
+// files and syslog connections from the previous config. It must be called
+// before the config is activated.
+func (server *Server) setupLogging(config *Config) (err error) {
+	server.logSinksMutex.Lock()
+	defer server.logSinksMutex.Unlock()
+
+	newSinks := make(map[string]io.WriteCloser)
+	defer func() {
+		if err != nil {
+			// close any sinks that we opened, but leave the existing ones alone
+			for key, sink := range newSinks {
+				if _, ok := server.logSinks[key]; !ok {
+					sink.Close()
+				}
+			}
+		}
+	}()
+
+	var handlers []slog.Handler
+	for i := range config.logOutputs {
+		output := &config.logOutputs[i]
+		if output.method == "stderr" {
+			handlers = append(handlers, newFormatHandler(output.format, os.Stderr, &stderrMutex))
+			continue
+		}
+		key := output.sinkKey()
+		sink, ok := newSinks[key]
+		if !ok {
+			sink, ok = server.logSinks[key]
+		}
+		if !ok {
+			sink, err = output.openSink()
+			if err != nil {
+				return fmt.Errorf("could not open log output: %w", err)
+			}
+		}
+		newSinks[key] = sink
+		if syslogSink, ok := sink.(syslogWriter); ok {
+			handlers = append(handlers, newSyslogHandler(output.format, syslogSink))
+		} else {
+			handlers = append(handlers, newFormatHandler(output.format, sink, new(sync.Mutex)))
+		}
+	}
+
+	switch len(handlers) {
+	case 1:
+		config.logger = slog.New(config.wrapLogHandler(handlers[0]))
+	default:
+		config.logger = slog.New(config.wrapLogHandler(multiLogHandler(handlers)))
+	}
+
+	// the old sinks are still in use by the old config, which may still be
+	// referenced by in-flight goroutines; leave a grace period before closing
+	var toClose []io.WriteCloser
+	for key, sink := range server.logSinks {
+		if _, ok := newSinks[key]; !ok {
+			toClose = append(toClose, sink)
+		}
+	}
+	if len(toClose) != 0 {
+		time.AfterFunc(10*time.Second, func() {
+			for _, sink := range toClose {
+				sink.Close()
+			}
+		})
+	}
+	server.logSinks = newSinks
+	return nil
+}
+
+func newFormatHandler(format string, out io.Writer, mutex *sync.Mutex) slog.Handler {
+	if format == "json" {
+		return newJSONLogHandler(&lockedWriter{out: out, mutex: mutex})
+	}
+	return newTextLogHandler(out, mutex)
+}
+
+type lockedWriter struct {
+	out   io.Writer
+	mutex *sync.Mutex
+}
+
+func (lw *lockedWriter) Write(b []byte) (int, error) {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+	return lw.out.Write(b)
+}
+
+// multiLogHandler sends each record to several handlers
+type multiLogHandler []slog.Handler
+
+func (m multiLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+func (m multiLogHandler) Handle(ctx context.Context, record slog.Record) (err error) {
+	for _, h := range m {
+		err = errors.Join(err, h.Handle(ctx, record.Clone()))
+	}
+	return
+}
+
+func (m multiLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	result := make(multiLogHandler, len(m))
+	for i, h := range m {
+		result[i] = h.WithAttrs(attrs)
+	}
+	return result
+}
+
+func (m multiLogHandler) WithGroup(name string) slog.Handler {
+	result := make(multiLogHandler, len(m))
+	for i, h := range m {
+		result[i] = h.WithGroup(name)
+	}
+	return result
+}
+
+// syslogHandler formats each record with an inner handler, then sends it
+// to syslog with the severity corresponding to its level
+type syslogHandler struct {
+	inner  slog.Handler
+	buf    *bytes.Buffer
+	mutex  *sync.Mutex // protects buf
+	writer syslogWriter
+}
+
+func newSyslogHandler(format string, writer syslogWriter) slog.Handler {
+	buf := new(bytes.Buffer)
+	var inner slog.Handler
+	if format == "json" {
+		inner = newJSONLogHandler(buf)
+	} else {
+		inner = &textLogHandler{out: buf, mutex: new(sync.Mutex), bare: true}
+	}
+	return &syslogHandler{inner: inner, buf: buf, mutex: new(sync.Mutex), writer: writer}
+}
+
+func (h *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, record slog.Record) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.buf.Reset()
+	if err := h.inner.Handle(ctx, record); err != nil {
+		return err
+	}
+	message := strings.TrimSuffix(h.buf.String(), "\n")
+	switch logLevelFromSlog(record.Level) {
+	case LogLevelError:
+		return h.writer.Err(message)
+	case LogLevelWarn:
+		return h.writer.Warning(message)
+	case LogLevelInfo:
+		return h.writer.Info(message)
+	default:
+		return h.writer.Debug(message)
+	}
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	result := *h
+	result.inner = h.inner.WithAttrs(attrs)
+	return &result
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	result := *h
+	result.inner = h.inner.WithGroup(name)
+	return &result
+}
+
+// rotatingFile is a log file that is rotated (renamed with a timestamp suffix)
+// when it exceeds a maximum size or age
+type rotatingFile struct {
+	sync.Mutex
+
+	filename   string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func newRotatingFile(filename string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		filename:   filename,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// requires rf.Lock
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	rf.openedAt = time.Now()
+	return nil
+}
+
+func (rf *rotatingFile) Write(b []byte) (n int, err error) {
+	rf.Lock()
+	defer rf.Unlock()
+
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.size != 0 && ((rf.maxSize != 0 && rf.size+int64(len(b)) > rf.maxSize) ||
+		(rf.maxAge != 0 && time.Since(rf.openedAt) > rf.maxAge)) {
+		if err := rf.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "could not rotate log file %s: %v\n", rf.filename, err)
+		}
+	}
+	n, err = rf.file.Write(b)
+	rf.size += int64(n)
+	return
+}
+
+// requires rf.Lock
+func (rf *rotatingFile) rotate() error {
+	rf.file.Close()
+	rotated := fmt.Sprintf("%s.%s", rf.filename, time.Now().UTC().Format("20060102T150405.000"))
+	renameErr := os.Rename(rf.filename, rotated)
+	if err := rf.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	rf.pruneBackups()
+	return nil
+}
+
+// requires rf.Lock
+func (rf *rotatingFile) pruneBackups() {
+	if rf.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(rf.filename + ".*")
+	if err != nil || len(backups) <= rf.maxBackups {
+		return
+	}
+	// the timestamp suffixes sort lexicographically:
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-rf.maxBackups] {
+		os.Remove(backup)
+	}
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.Lock()
+	defer rf.Unlock()
+
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// LogRateLimitConfig limits how many times the same warning or error message
+// can be logged per window; the rest are counted and summarized as
+// "suppressed N similar messages" when the window ends.
+type LogRateLimitConfig struct {
+	Enabled bool
+	// number of identical messages to allow per window:
+	Burst  int
+	Window time.Duration
+}
+
+func (conf *LogRateLimitConfig) postprocess() {
+	if conf.Burst <= 0 {
+		conf.Burst = 10
+	}
+	if conf.Window <= 0 {
+		conf.Window = time.Minute
+	}
+}
+
+// messages are identified by their text, not their structured fields,
+// e.g., repeated dial errors for different connections are "similar"
+type logSampleKey struct {
+	component LogComponent
+	level     LogLevel
+	message   string
+}
+
+type logSampleEntry struct {
+	windowStart time.Time
+	count       int
+	suppressed  int
+}
+
+type logSampler struct {
+	sync.Mutex // tier 1
+
+	entries   map[logSampleKey]*logSampleEntry
+	lastPrune time.Time
+}
+
+// allow returns whether the message should be logged. If this is the first
+// suppressed message in the window, it also returns the time at which the
+// window ends, when the suppressed messages should be summarized.
+func (ls *logSampler) allow(key logSampleKey, conf *LogRateLimitConfig) (allowed bool, flushAt time.Time) {
+	ls.Lock()
+	defer ls.Unlock()
+
+	now := time.Now()
+	if ls.entries == nil {
+		ls.entries = make(map[logSampleKey]*logSampleEntry)
+	}
+	if now.Sub(ls.lastPrune) > conf.Window {
+		ls.lastPrune = now
+		for k, entry := range ls.entries {
+			if entry.suppressed == 0 && now.Sub(entry.windowStart) > conf.Window {
+				delete(ls.entries, k)
+			}
+		}
+	}
+
+	entry, ok := ls.entries[key]
+	if !ok || (entry.suppressed == 0 && now.Sub(entry.windowStart) > conf.Window) {
+		entry = &logSampleEntry{windowStart: now}
+		ls.entries[key] = entry
+	}
+	entry.count++
+	if entry.count <= conf.Burst {
+		return true, time.Time{}
+	}
+	entry.suppressed++
+	if entry.suppressed == 1 {
+		return false, entry.windowStart.Add(conf.Window)
+	}
+	return false, time.Time{}
+}
+
+// flush ends the window for the message, returning how many were suppressed
+func (ls *logSampler) flush(key logSampleKey) (suppressed int) {
+	ls.Lock()
+	defer ls.Unlock()
+
+	if entry, ok := ls.entries[key]; ok {
+		suppressed = entry.suppressed
+		delete(ls.entries, key)
+	}
+	return
+}
+
+// sampleLog applies log-rate-limit to a message that is about to be logged,
+// returning whether to log it
+func (server *Server) sampleLog(config *Config, component LogComponent, level LogLevel, message string) bool {
+	if !config.LogRateLimit.Enabled || level > LogLevelWarn {
+		return true
+	}
+	key := logSampleKey{component: component, level: level, message: message}
+	allowed, flushAt := server.logSampler.allow(key, &config.LogRateLimit)
+	if !flushAt.IsZero() {
+		time.AfterFunc(time.Until(flushAt), func() {
+			if suppressed := server.logSampler.flush(key); suppressed != 0 {
+				server.writeLog(server.Config(), component, level,
+					fmt.Sprintf("suppressed %d similar messages", suppressed), []slog.Attr{slog.String("message", message)})
+			}
+		})
+	}
+	return allowed
+}
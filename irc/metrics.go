@@ -0,0 +1,420 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics in the Prometheus text exposition format:
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+// errorClass is a label value for webircproxy_errors_total
+type errorClass string
+
+const (
+	errorInsecureRejected   errorClass = "insecure_rejected"
+	errorBanned             errorClass = "banned"
+	errorHeaderRuleRejected errorClass = "header_rule_rejected"
+	errorOriginRejected     errorClass = "origin_rejected"
+	errorRateLimited        errorClass = "rate_limited"
+	errorReputationRejected errorClass = "reputation_rejected"
+	// the reputation service couldn't be queried (whether or not fail-open
+	// then accepted the connection):
+	errorReputationUnavailable errorClass = "reputation_unavailable"
+	errorUpgradeFailed         errorClass = "upgrade_failed"
+	errorNoUpstream            errorClass = "no_upstream"
+	errorUpstreamDialFailed    errorClass = "upstream_dial_failed"
+	errorWebircWriteFailed     errorClass = "webirc_write_failed"
+	errorReadLimit             errorClass = "read_limit_exceeded"
+	errorWriteTimeout          errorClass = "write_timeout"
+	errorResponseTimeout       errorClass = "upstream_response_timeout"
+	errorConnectionLimit       errorClass = "connection_limit"
+	errorHookRejected          errorClass = "hook_rejected"
+	errorBandwidthQuota        errorClass = "bandwidth_quota_exceeded"
+	errorTagLimit              errorClass = "tag_limit_exceeded"
+	errorEarlyData             errorClass = "early_data_rejected"
+)
+
+// counterVec is a counter partitioned by a set of labels;
+// the zero value is usable, but has no name
+type counterVec struct {
+	name       string
+	help       string
+	labelNames []string
+
+	sync.Mutex // tier 1
+	values     map[string]*labeledCounter
+}
+
+type labeledCounter struct {
+	labelValues []string
+	value       uint64
+}
+
+func (c *counterVec) initialize(name, help string, labelNames ...string) {
+	c.name = name
+	c.help = help
+	c.labelNames = labelNames
+}
+
+func (c *counterVec) Add(delta uint64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.values == nil {
+		c.values = make(map[string]*labeledCounter)
+	}
+	counter, ok := c.values[key]
+	if !ok {
+		counter = &labeledCounter{labelValues: labelValues}
+		c.values[key] = counter
+	}
+	counter.value += delta
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Get returns the current value for the labels (mainly for testing)
+func (c *counterVec) Get(labelValues ...string) uint64 {
+	c.Lock()
+	defer c.Unlock()
+
+	if counter, ok := c.values[strings.Join(labelValues, "\x00")]; ok {
+		return counter.value
+	}
+	return 0
+}
+
+// each calls f with the labels and value of every counter in the vector
+func (c *counterVec) each(f func(labelValues []string, value uint64)) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, counter := range c.values {
+		f(counter.labelValues, counter.value)
+	}
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		counter := c.values[key]
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labelNames, counter.labelValues), counter.value)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var buf strings.Builder
+	buf.WriteByte('{')
+	for i, name := range names {
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		fmt.Fprintf(&buf, "%s=\"%s\"", name, escapeLabelValue(value))
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+var (
+	// buckets (in seconds) for network latencies:
+	latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+)
+
+// histogramVec is a histogram partitioned by a set of labels;
+// the zero value is usable, but has no name or buckets
+type histogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64 // upper bounds, ascending, excluding +Inf
+
+	sync.Mutex // tier 1
+	values     map[string]*labeledHistogram
+}
+
+type labeledHistogram struct {
+	labelValues []string
+	counts      []uint64 // per bucket, non-cumulative; the last is +Inf
+	sum         float64
+	count       uint64
+}
+
+func (h *histogramVec) initialize(name, help string, buckets []float64, labelNames ...string) {
+	h.name = name
+	h.help = help
+	h.buckets = buckets
+	h.labelNames = labelNames
+}
+
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+
+	h.Lock()
+	defer h.Unlock()
+
+	if h.values == nil {
+		h.values = make(map[string]*labeledHistogram)
+	}
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &labeledHistogram{labelValues: labelValues, counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = hist
+	}
+	bucket := sort.SearchFloat64s(h.buckets, value)
+	hist.counts[bucket]++
+	hist.sum += value
+	hist.count++
+}
+
+func (h *histogramVec) ObserveDuration(duration time.Duration, labelValues ...string) {
+	h.Observe(duration.Seconds(), labelValues...)
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	bucketLabels := append(h.labelNames[:len(h.labelNames):len(h.labelNames)], "le")
+	for _, key := range keys {
+		hist := h.values[key]
+		var cumulative uint64
+		for i, count := range hist.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = strconv.FormatFloat(h.buckets[i], 'g', -1, 64)
+			}
+			labelValues := append(hist.labelValues[:len(hist.labelValues):len(hist.labelValues)], le)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, labelValues), cumulative)
+		}
+		labels := formatLabels(h.labelNames, hist.labelValues)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, strconv.FormatFloat(hist.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, hist.count)
+	}
+}
+
+// serverMetrics holds all the metrics exported by the server
+type serverMetrics struct {
+	errors      counterVec
+	connections counterVec
+	transcoded  counterVec
+	disconnects counterVec
+	shed        counterVec
+	// bytes read from clients and from upstreams, respectively:
+	bytesIn  uint64 // atomic
+	bytesOut uint64 // atomic
+
+	dialDuration      histogramVec
+	firstByteDuration histogramVec
+}
+
+func (m *serverMetrics) initialize() {
+	for _, c := range []struct {
+		vec        *counterVec
+		name       string
+		labelNames []string
+	}{
+		{&m.errors, "webircproxy_errors_total", []string{"class", "upstream"}},
+		{&m.connections, "webircproxy_connections_total", []string{"upstream"}},
+		{&m.transcoded, "webircproxy_transcoded_lines_total", []string{"method"}},
+		{&m.disconnects, "webircproxy_disconnects_total", []string{"reason"}},
+		{&m.shed, "webircproxy_shed_total", []string{"listener", "reason"}},
+	} {
+		c.vec.initialize(c.name, metricHelp[c.name], c.labelNames...)
+	}
+	for _, h := range []struct {
+		vec  *histogramVec
+		name string
+	}{
+		{&m.dialDuration, "webircproxy_upstream_dial_duration_seconds"},
+		{&m.firstByteDuration, "webircproxy_upstream_first_byte_seconds"},
+	} {
+		h.vec.initialize(h.name, metricHelp[h.name], latencyBuckets, "upstream")
+	}
+}
+
+// the following record measurements in the built-in collector, and in the
+// destination set by SetMetrics (if any)
+
+// countError increments the error counter for the class; upstream is the
+// upstream's name, or "" if the failure is not specific to an upstream
+func (server *Server) countError(class errorClass, upstream string) {
+	server.metrics.errors.Inc(string(class), upstream)
+	if external := server.externalMetrics(); external != nil {
+		external.AddCounter(server.metrics.errors.name, 1, MetricLabel{"class", string(class)}, MetricLabel{"upstream", upstream})
+	}
+}
+
+func (server *Server) countConnection(upstream string) {
+	server.metrics.connections.Inc(upstream)
+	if external := server.externalMetrics(); external != nil {
+		external.AddCounter(server.metrics.connections.name, 1, MetricLabel{"upstream", upstream})
+	}
+}
+
+func (server *Server) countTranscoding(method string) {
+	server.metrics.transcoded.Inc(method)
+	if external := server.externalMetrics(); external != nil {
+		external.AddCounter(server.metrics.transcoded.name, 1, MetricLabel{"method", method})
+	}
+}
+
+func (server *Server) countDisconnect(reason CloseReason) {
+	server.metrics.disconnects.Inc(string(reason))
+	if external := server.externalMetrics(); external != nil {
+		external.AddCounter(server.metrics.disconnects.name, 1, MetricLabel{"reason", string(reason)})
+	}
+}
+
+func (server *Server) countShed(listener, reason string) {
+	server.metrics.shed.Inc(listener, reason)
+	if external := server.externalMetrics(); external != nil {
+		external.AddCounter(server.metrics.shed.name, 1, MetricLabel{"listener", listener}, MetricLabel{"reason", reason})
+	}
+}
+
+// countBytes counts bytes proxied from the client (in) or from the upstream
+func (server *Server) countBytes(in bool, n uint64) {
+	direction := "out"
+	if in {
+		atomic.AddUint64(&server.metrics.bytesIn, n)
+		direction = "in"
+	} else {
+		atomic.AddUint64(&server.metrics.bytesOut, n)
+	}
+	if external := server.externalMetrics(); external != nil {
+		external.AddCounter("webircproxy_bytes_total", n, MetricLabel{"direction", direction})
+	}
+}
+
+func (server *Server) observeDuration(h *histogramVec, duration time.Duration, upstream string) {
+	h.ObserveDuration(duration, upstream)
+	if external := server.externalMetrics(); external != nil {
+		external.ObserveHistogram(h.name, duration.Seconds(), MetricLabel{"upstream", upstream})
+	}
+}
+
+// reportActiveConnections updates the external active connection gauges for
+// an upstream and a listener, after a connection to them opened or closed
+// (the built-in collector computes them when it is scraped)
+func (server *Server) reportActiveConnections(upstream, listener string) {
+	if external := server.externalMetrics(); external != nil {
+		upstreamCount, listenerCount := server.conns.countsFor(upstream, listener)
+		external.SetGauge("webircproxy_upstream_connections", float64(upstreamCount), MetricLabel{"upstream", upstream})
+		external.SetGauge("webircproxy_listener_connections", float64(listenerCount), MetricLabel{"listener", listener})
+	}
+}
+
+// writeGauge writes a gauge partitioned by a single label
+func writeGauge(w io.Writer, name, help, labelName string, values map[string]int) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labelNames := []string{labelName}
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(labelNames, []string{key}), values[key])
+	}
+}
+
+func (server *Server) writeMetrics(w io.Writer) {
+	server.metrics.errors.writeTo(w)
+	server.metrics.connections.writeTo(w)
+	server.metrics.transcoded.writeTo(w)
+	server.metrics.disconnects.writeTo(w)
+	server.metrics.shed.writeTo(w)
+	fmt.Fprintf(w, "# HELP webircproxy_bytes_total %s\n# TYPE webircproxy_bytes_total counter\n", metricHelp["webircproxy_bytes_total"])
+	fmt.Fprintf(w, "webircproxy_bytes_total{direction=\"in\"} %d\n", atomic.LoadUint64(&server.metrics.bytesIn))
+	fmt.Fprintf(w, "webircproxy_bytes_total{direction=\"out\"} %d\n", atomic.LoadUint64(&server.metrics.bytesOut))
+	server.metrics.dialDuration.writeTo(w)
+	server.metrics.firstByteDuration.writeTo(w)
+
+	byUpstream, byListener := server.conns.counts()
+	// report zeroes for idle upstreams and listeners, rather than omitting them:
+	config := server.Config()
+	for _, upstream := range config.allUpstreams() {
+		byUpstream[upstream.Name] += 0
+	}
+	for addr := range config.trueListeners {
+		byListener[addr] += 0
+	}
+	writeGauge(w, "webircproxy_upstream_connections", metricHelp["webircproxy_upstream_connections"], "upstream", byUpstream)
+	writeGauge(w, "webircproxy_listener_connections", metricHelp["webircproxy_listener_connections"], "listener", byListener)
+}
+
+func (server *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	server.writeMetrics(w)
+}
+
+func (server *Server) setupMetricsListener(config *Config) {
+	metricsListener := config.MetricsListener
+	if server.metricsServer != nil {
+		if metricsListener == "" || metricsListener != server.metricsServer.Addr {
+			server.Log(LogComponentServer, LogLevelInfo, fmt.Sprintf("Stopping metrics listener at %s", server.metricsServer.Addr))
+			server.metricsServer.Close()
+			server.metricsServer = nil
+		}
+	}
+	if metricsListener != "" && server.metricsServer == nil {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", server.handleMetrics)
+		ms := &http.Server{
+			Addr:         metricsListener,
+			Handler:      mux,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		}
+		go func() {
+			if err := ms.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				server.Log(LogComponentServer, LogLevelError, fmt.Sprintf("metrics listener failed: %v", err))
+			}
+		}()
+		server.metricsServer = ms
+		server.Log(LogComponentServer, LogLevelInfo, fmt.Sprintf("Started metrics listener: %s", metricsListener))
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	var c counterVec
+	c.initialize("webircproxy_errors_total", "Failures.", "class", "upstream")
+	c.Inc(string(errorUpstreamDialFailed), "ircd1")
+	c.Inc(string(errorUpstreamDialFailed), "ircd1")
+	c.Inc(string(errorOriginRejected), "")
+	c.Add(3, string(errorWriteTimeout), `we"ird`)
+	assertEqual(c.Get(string(errorUpstreamDialFailed), "ircd1"), uint64(2))
+	assertEqual(c.Get(string(errorUpstreamDialFailed), "ircd2"), uint64(0))
+
+	var buf strings.Builder
+	c.writeTo(&buf)
+	assertEqual(buf.String(), `# HELP webircproxy_errors_total Failures.
+# TYPE webircproxy_errors_total counter
+webircproxy_errors_total{class="origin_rejected",upstream=""} 1
+webircproxy_errors_total{class="upstream_dial_failed",upstream="ircd1"} 2
+webircproxy_errors_total{class="write_timeout",upstream="we\"ird"} 3
+`)
+}
+
+func TestHistogramVec(t *testing.T) {
+	var h histogramVec
+	h.initialize("webircproxy_upstream_dial_duration_seconds", "Dial time.", []float64{0.01, 0.1, 1}, "upstream")
+	h.Observe(0.005, "ircd1")
+	h.Observe(0.1, "ircd1")
+	h.Observe(5, "ircd1")
+
+	var buf strings.Builder
+	h.writeTo(&buf)
+	assertEqual(buf.String(), `# HELP webircproxy_upstream_dial_duration_seconds Dial time.
+# TYPE webircproxy_upstream_dial_duration_seconds histogram
+webircproxy_upstream_dial_duration_seconds_bucket{upstream="ircd1",le="0.01"} 1
+webircproxy_upstream_dial_duration_seconds_bucket{upstream="ircd1",le="0.1"} 2
+webircproxy_upstream_dial_duration_seconds_bucket{upstream="ircd1",le="1"} 2
+webircproxy_upstream_dial_duration_seconds_bucket{upstream="ircd1",le="+Inf"} 3
+webircproxy_upstream_dial_duration_seconds_sum{upstream="ircd1"} 5.105
+webircproxy_upstream_dial_duration_seconds_count{upstream="ircd1"} 3
+`)
+}
+
+func TestSetMetrics(t *testing.T) {
+	server := new(Server)
+	server.metrics.initialize()
+	server.SetConfig(&Config{})
+	external := NewPrometheusMetrics()
+	server.SetMetrics(external)
+
+	server.countError(errorOriginRejected, "")
+	server.countConnection("ircd1")
+	server.countBytes(true, 10)
+	server.countBytes(false, 20)
+	server.countBytes(false, 5)
+	server.reportActiveConnections("ircd1", "127.0.0.1:8067")
+	assertEqual(server.metrics.connections.Get("ircd1"), uint64(1))
+
+	var buf strings.Builder
+	external.Write(&buf)
+	assertEqual(buf.String(), `# HELP webircproxy_bytes_total Bytes proxied, by direction.
+# TYPE webircproxy_bytes_total counter
+webircproxy_bytes_total{direction="in"} 10
+webircproxy_bytes_total{direction="out"} 25
+# HELP webircproxy_connections_total Connections proxied, by upstream.
+# TYPE webircproxy_connections_total counter
+webircproxy_connections_total{upstream="ircd1"} 1
+# HELP webircproxy_errors_total Failures, by class and upstream (if applicable).
+# TYPE webircproxy_errors_total counter
+webircproxy_errors_total{class="origin_rejected",upstream=""} 1
+# HELP webircproxy_listener_connections Active connections per listener.
+# TYPE webircproxy_listener_connections gauge
+webircproxy_listener_connections{listener="127.0.0.1:8067"} 0
+# HELP webircproxy_upstream_connections Active connections per upstream.
+# TYPE webircproxy_upstream_connections gauge
+webircproxy_upstream_connections{upstream="ircd1"} 0
+`)
+
+	server.SetMetrics(nil)
+	server.countConnection("ircd1")
+	assertEqual(server.metrics.connections.Get("ircd1"), uint64(2))
+	assertEqual(external.counters["webircproxy_connections_total"].Get("ircd1"), uint64(1))
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Embedders can receive the server's measurements in their own telemetry
+// system by passing an implementation of Metrics to (*Server).SetMetrics.
+// The built-in collector (which serves metrics-listener, statsd, and the
+// expvar and admin APIs) is always updated as well. The metric names and
+// labels are the ones documented for metrics-listener, e.g.
+// webircproxy_errors_total{class, upstream}.
+
+// MetricLabel is a label of a measurement.
+type MetricLabel struct {
+	Name  string
+	Value string
+}
+
+// Metrics receives measurements; it must be safe for concurrent use, and
+// its methods should return quickly.
+type Metrics interface {
+	// AddCounter adds delta to a monotonically increasing counter.
+	AddCounter(name string, delta uint64, labels ...MetricLabel)
+	// SetGauge sets the current value of a gauge.
+	SetGauge(name string, value float64, labels ...MetricLabel)
+	// ObserveHistogram records one observation; durations are in seconds.
+	ObserveHistogram(name string, value float64, labels ...MetricLabel)
+}
+
+// NoopMetrics discards all measurements.
+type NoopMetrics struct{}
+
+func (NoopMetrics) AddCounter(name string, delta uint64, labels ...MetricLabel)        {}
+func (NoopMetrics) SetGauge(name string, value float64, labels ...MetricLabel)         {}
+func (NoopMetrics) ObserveHistogram(name string, value float64, labels ...MetricLabel) {}
+
+// SetMetrics sets a destination for measurements, in addition to the
+// built-in collector; nil removes it.
+func (server *Server) SetMetrics(metrics Metrics) {
+	if metrics == nil {
+		server.metricsSink.Store(nil)
+	} else {
+		server.metricsSink.Store(&metrics)
+	}
+}
+
+// externalMetrics returns the destination set by SetMetrics, or nil
+func (server *Server) externalMetrics() Metrics {
+	if metrics := server.metricsSink.Load(); metrics != nil {
+		return *metrics
+	}
+	return nil
+}
+
+var (
+	metricHelp = map[string]string{
+		"webircproxy_errors_total":                   "Failures, by class and upstream (if applicable).",
+		"webircproxy_connections_total":              "Connections proxied, by upstream.",
+		"webircproxy_bytes_total":                    "Bytes proxied, by direction.",
+		"webircproxy_transcoded_lines_total":         "Lines from upstreams that were not valid UTF-8, by the method used to transcode them.",
+		"webircproxy_disconnects_total":              "Connections closed, by the reason they were closed.",
+		"webircproxy_shed_total":                     "Requests shed by overloaded listeners, by listener and reason.",
+		"webircproxy_upstream_dial_duration_seconds": "Time to connect to the upstream (including the TLS handshake, if applicable).",
+		"webircproxy_upstream_first_byte_seconds":    "Time from connecting to the upstream (and sending WEBIRC) to receiving its first line.",
+		"webircproxy_upstream_connections":           "Active connections per upstream.",
+		"webircproxy_listener_connections":           "Active connections per listener.",
+	}
+)
+
+// PrometheusMetrics is an implementation of Metrics that serves the
+// measurements it receives in the Prometheus text exposition format,
+// e.g., for an embedder to mount on its own mux. Each metric's label names
+// are fixed by the first measurement of it; histograms use latency buckets.
+type PrometheusMetrics struct {
+	sync.Mutex // tier 2; the vectors' mutexes are tier 1
+
+	counters   map[string]*counterVec
+	gauges     map[string]*gaugeVec
+	histograms map[string]*histogramVec
+}
+
+// NewPrometheusMetrics returns an empty PrometheusMetrics.
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		counters:   make(map[string]*counterVec),
+		gauges:     make(map[string]*gaugeVec),
+		histograms: make(map[string]*histogramVec),
+	}
+}
+
+func splitLabels(labels []MetricLabel) (names, values []string) {
+	names = make([]string, len(labels))
+	values = make([]string, len(labels))
+	for i, label := range labels {
+		names[i], values[i] = label.Name, label.Value
+	}
+	return
+}
+
+func helpFor(name string) string {
+	if help, ok := metricHelp[name]; ok {
+		return help
+	}
+	return name
+}
+
+func (p *PrometheusMetrics) AddCounter(name string, delta uint64, labels ...MetricLabel) {
+	names, values := splitLabels(labels)
+	p.Lock()
+	c, ok := p.counters[name]
+	if !ok {
+		c = new(counterVec)
+		c.initialize(name, helpFor(name), names...)
+		p.counters[name] = c
+	}
+	p.Unlock()
+	c.Add(delta, values...)
+}
+
+func (p *PrometheusMetrics) SetGauge(name string, value float64, labels ...MetricLabel) {
+	names, values := splitLabels(labels)
+	p.Lock()
+	g, ok := p.gauges[name]
+	if !ok {
+		g = new(gaugeVec)
+		g.initialize(name, helpFor(name), names...)
+		p.gauges[name] = g
+	}
+	p.Unlock()
+	g.Set(value, values...)
+}
+
+func (p *PrometheusMetrics) ObserveHistogram(name string, value float64, labels ...MetricLabel) {
+	names, values := splitLabels(labels)
+	p.Lock()
+	h, ok := p.histograms[name]
+	if !ok {
+		h = new(histogramVec)
+		h.initialize(name, helpFor(name), latencyBuckets, names...)
+		p.histograms[name] = h
+	}
+	p.Unlock()
+	h.Observe(value, values...)
+}
+
+// Write writes all the metrics, sorted by name.
+func (p *PrometheusMetrics) Write(w io.Writer) {
+	p.Lock()
+	writers := make(map[string]func(io.Writer), len(p.counters)+len(p.gauges)+len(p.histograms))
+	for name, c := range p.counters {
+		writers[name] = c.writeTo
+	}
+	for name, g := range p.gauges {
+		writers[name] = g.writeTo
+	}
+	for name, h := range p.histograms {
+		writers[name] = h.writeTo
+	}
+	p.Unlock()
+
+	names := make([]string, 0, len(writers))
+	for name := range writers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writers[name](w)
+	}
+}
+
+func (p *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p.Write(w)
+}
+
+// gaugeVec is a gauge partitioned by a set of labels
+type gaugeVec struct {
+	name       string
+	help       string
+	labelNames []string
+
+	sync.Mutex // tier 1
+	values     map[string]*labeledGauge
+}
+
+type labeledGauge struct {
+	labelValues []string
+	value       float64
+}
+
+func (g *gaugeVec) initialize(name, help string, labelNames ...string) {
+	g.name = name
+	g.help = help
+	g.labelNames = labelNames
+}
+
+func (g *gaugeVec) Set(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+
+	g.Lock()
+	defer g.Unlock()
+
+	if g.values == nil {
+		g.values = make(map[string]*labeledGauge)
+	}
+	gauge, ok := g.values[key]
+	if !ok {
+		gauge = &labeledGauge{labelValues: labelValues}
+		g.values[key] = gauge
+	}
+	gauge.value = value
+}
+
+func (g *gaugeVec) writeTo(w io.Writer) {
+	g.Lock()
+	defer g.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	keys := make([]string, 0, len(g.values))
+	for key := range g.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		gauge := g.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labelNames, gauge.labelValues), strconv.FormatFloat(gauge.value, 'g', -1, 64))
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/ergochat/irc-go/ircmsg"
+	"github.com/ergochat/irc-go/ircreader"
+)
+
+// MockIRCd is a minimal IRC server, to stand in for an upstream in end-to-end
+// tests of the proxy (in CI, or with `webircproxy mockircd` during
+// development). It accepts WEBIRC (checking the password, if one is set),
+// completes registration with 001, answers PING, and echoes PRIVMSG and
+// NOTICE back to their sender. Clients can also ask it to misbehave:
+//
+//	MOCK INVALID-UTF8 :<text>   sends <text> in a NOTICE, encoded as Latin-1
+//	MOCK RAW :<line>            sends <line> verbatim
+//	MOCK DISCONNECT             closes the connection without an ERROR
+//
+// Other commands get 421 ERR_UNKNOWNCOMMAND.
+
+const (
+	mockIRCdName = "mock.ircd"
+)
+
+// MockWebirc is a WEBIRC command that a MockIRCd accepted.
+type MockWebirc struct {
+	Gateway  string
+	Hostname string
+	IP       string
+	// the extended flags, if any (see webircflags.go):
+	Flags string
+}
+
+// MockIRCd is a running mock IRC server; see NewMockIRCd.
+type MockIRCd struct {
+	listener net.Listener
+	// if nonempty, WEBIRC is required, with this password:
+	webircPassword string
+	// for debugging, every line received is written here (if non-nil):
+	trace io.Writer
+
+	sync.Mutex // tier 1
+	webircs    []MockWebirc
+	conns      map[net.Conn]struct{}
+	closed     bool
+}
+
+// NewMockIRCd starts a mock IRC server listening on the TCP address (e.g.,
+// 127.0.0.1:0 for any free port). If webircPassword is nonempty, clients
+// must send WEBIRC with it; trace (if non-nil) receives each line received.
+func NewMockIRCd(addr, webircPassword string, trace io.Writer) (*MockIRCd, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	m := &MockIRCd{
+		listener:       listener,
+		webircPassword: webircPassword,
+		trace:          trace,
+		conns:          make(map[net.Conn]struct{}),
+	}
+	go m.serve()
+	return m, nil
+}
+
+// Addr returns the address the server is listening on.
+func (m *MockIRCd) Addr() string {
+	return m.listener.Addr().String()
+}
+
+// Webircs returns the WEBIRC commands accepted so far.
+func (m *MockIRCd) Webircs() []MockWebirc {
+	m.Lock()
+	defer m.Unlock()
+	return append([]MockWebirc(nil), m.webircs...)
+}
+
+// Clients returns the number of clients currently connected.
+func (m *MockIRCd) Clients() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.conns)
+}
+
+// Close stops the server, disconnecting its clients.
+func (m *MockIRCd) Close() error {
+	m.Lock()
+	m.closed = true
+	for conn := range m.conns {
+		conn.Close()
+	}
+	m.Unlock()
+	return m.listener.Close()
+}
+
+func (m *MockIRCd) serve() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		m.Lock()
+		if m.closed {
+			m.Unlock()
+			conn.Close()
+			return
+		}
+		m.conns[conn] = struct{}{}
+		m.Unlock()
+		go m.handle(conn)
+	}
+}
+
+// mockClient is the state of a connection to a MockIRCd
+type mockClient struct {
+	conn     net.Conn
+	nick     string
+	user     string
+	host     string
+	webircOK bool
+}
+
+func (c *mockClient) send(line string) error {
+	_, err := io.WriteString(c.conn, line+"\r\n")
+	return err
+}
+
+func (c *mockClient) sendMessage(prefix, command string, params ...string) error {
+	msg := ircmsg.MakeMessage(nil, prefix, command, params...)
+	line, err := msg.LineBytesStrict(false, DefaultMaxLineLen)
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(line)
+	return err
+}
+
+func (c *mockClient) nickOrStar() string {
+	if c.nick == "" {
+		return "*"
+	}
+	return c.nick
+}
+
+func (m *MockIRCd) handle(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		m.Lock()
+		delete(m.conns, conn)
+		m.Unlock()
+	}()
+
+	client := &mockClient{conn: conn}
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		client.host = host
+	}
+	var reader ircreader.Reader
+	reader.Initialize(conn, initialBufferSize, DefaultMaxLineLen*4)
+	for {
+		line, err := reader.ReadLine()
+		if err != nil {
+			return
+		}
+		if m.trace != nil {
+			fmt.Fprintf(m.trace, "%s <- %s\n", conn.RemoteAddr(), line)
+		}
+		msg, err := ircmsg.ParseLine(string(line))
+		if err != nil {
+			continue
+		}
+		if err := m.handleMessage(client, msg); err != nil {
+			return
+		}
+	}
+}
+
+var (
+	errMockDisconnect = errors.New("disconnect")
+)
+
+// handleMessage processes a line from the client; an error closes the connection
+func (m *MockIRCd) handleMessage(c *mockClient, msg ircmsg.Message) error {
+	registered := c.nick != "" && c.user != ""
+	switch msg.Command {
+	case "WEBIRC":
+		if registered || len(msg.Params) < 4 {
+			return c.send("ERROR :Invalid WEBIRC command")
+		}
+		if m.webircPassword != "" && msg.Params[0] != m.webircPassword {
+			c.send("ERROR :Invalid WEBIRC password")
+			return errMockDisconnect
+		}
+		webirc := MockWebirc{Gateway: msg.Params[1], Hostname: msg.Params[2], IP: msg.Params[3]}
+		if len(msg.Params) > 4 {
+			webirc.Flags = msg.Params[4]
+		}
+		m.Lock()
+		m.webircs = append(m.webircs, webirc)
+		m.Unlock()
+		c.host, c.webircOK = webirc.Hostname, true
+		return nil
+	case "CAP":
+		// no capabilities, but don't hold up clients that negotiate them:
+		if len(msg.Params) > 0 && strings.ToUpper(msg.Params[0]) == "LS" {
+			return c.sendMessage(mockIRCdName, "CAP", c.nickOrStar(), "LS", "")
+		}
+		return nil
+	case "NICK", "USER":
+		if len(msg.Params) == 0 {
+			return c.sendMessage(mockIRCdName, "461", c.nickOrStar(), msg.Command, "Not enough parameters")
+		}
+		if m.webircPassword != "" && !c.webircOK {
+			c.send("ERROR :WEBIRC is required")
+			return errMockDisconnect
+		}
+		if msg.Command == "NICK" {
+			c.nick = msg.Params[0]
+		} else {
+			c.user = msg.Params[0]
+		}
+		if !registered && c.nick != "" && c.user != "" {
+			return c.sendMessage(mockIRCdName, "001", c.nick, fmt.Sprintf("Welcome to the mock IRC network %s!%s@%s", c.nick, c.user, c.host))
+		}
+		return nil
+	case "PING":
+		return c.sendMessage(mockIRCdName, "PONG", append([]string{mockIRCdName}, msg.Params...)...)
+	case "PONG":
+		return nil
+	case "QUIT":
+		c.send("ERROR :Closing link")
+		return errMockDisconnect
+	}
+
+	if !registered {
+		return c.sendMessage(mockIRCdName, "451", c.nickOrStar(), "You have not registered")
+	}
+	switch msg.Command {
+	case "PRIVMSG", "NOTICE":
+		if len(msg.Params) < 2 {
+			return c.sendMessage(mockIRCdName, "461", c.nick, msg.Command, "Not enough parameters")
+		}
+		return c.sendMessage(fmt.Sprintf("%s!%s@%s", c.nick, c.user, c.host), msg.Command, msg.Params[0], msg.Params[1])
+	case "MOCK":
+		if len(msg.Params) == 0 {
+			return c.sendMessage(mockIRCdName, "461", c.nick, msg.Command, "Not enough parameters")
+		}
+		switch strings.ToUpper(msg.Params[0]) {
+		case "INVALID-UTF8":
+			var text string
+			if len(msg.Params) > 1 {
+				text = msg.Params[1]
+			}
+			return c.send(fmt.Sprintf(":%s NOTICE %s :%s", mockIRCdName, c.nick, encodeLatin1(text)))
+		case "RAW":
+			if len(msg.Params) > 1 {
+				return c.send(msg.Params[1])
+			}
+			return nil
+		case "DISCONNECT":
+			return errMockDisconnect
+		}
+	}
+	return c.sendMessage(mockIRCdName, "421", c.nick, msg.Command, "Unknown command")
+}
+
+// encodeLatin1 encodes text as Latin-1, replacing characters outside it with ?
+func encodeLatin1(text string) string {
+	result := make([]byte, 0, len(text))
+	for _, r := range text {
+		if r < 0x100 {
+			result = append(result, byte(r))
+		} else {
+			result = append(result, '?')
+		}
+	}
+	return string(result)
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func startMockIRCd(t *testing.T, webircPassword string) *MockIRCd {
+	m, err := NewMockIRCd("127.0.0.1:0", webircPassword, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+// TestProxyEndToEnd proxies a websocket client to a MockIRCd
+func TestProxyEndToEnd(t *testing.T) {
+	mock := startMockIRCd(t, "hunter2")
+	listen := freeAddress(t)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithListener(listen),
+		WithUpstream(mock.Addr(), UpstreamWebirc("hunter2")),
+		WithEncodings("ISO-8859-1"),
+		WithYAML("log-level: error\nlookup-hostnames: false"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.RunContext(ctx)
+
+	dialer := websocket.Dialer{Subprotocols: []string{"text.ircv3.net"}}
+	conn, _, err := dialer.Dial("ws://"+listen+"/webirc", http.Header{"Origin": []string{"https://example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	readLine := func() string {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(message)
+	}
+
+	for _, line := range []string{"NICK alice", "USER u 0 * :Alice", "PRIVMSG bob :hi", "MOCK INVALID-UTF8 :café"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertEqual(readLine(), ":mock.ircd 001 alice :Welcome to the mock IRC network alice!u@127.0.0.1")
+	assertEqual(readLine(), ":alice!u@127.0.0.1 PRIVMSG bob hi")
+	// transcoded from Latin-1:
+	assertEqual(readLine(), ":mock.ircd NOTICE alice café")
+
+	webircs := mock.Webircs()
+	assertEqual(len(webircs), 1)
+	assertEqual(webircs[0].Gateway, "webircproxy")
+	assertEqual(webircs[0].IP, "127.0.0.1")
+}
+
+func TestMockIRCdWebircRequired(t *testing.T) {
+	mock := startMockIRCd(t, "hunter2")
+	selfTest := func(opts ...UpstreamOption) SelfTestResult {
+		config, err := NewConfig(WithGatewayName("webircproxy"), WithUpstream(mock.Addr(), opts...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return SelfTest(config)[0]
+	}
+	// the mock refuses registration without WEBIRC:
+	assertEqual(selfTest().Success, false)
+	assertEqual(selfTest(UpstreamWebirc("hunter3")).Success, false)
+	assertEqual(selfTest(UpstreamWebirc("hunter2")).Success, true)
+}
+
+func TestBinaryTranscoding(t *testing.T) {
+	mock := startMockIRCd(t, "")
+	// returns the NOTICE sent to a binary client for Latin-1 text:
+	receive := func(yaml string) string {
+		listen := freeAddress(t)
+		config, err := NewConfig(
+			WithGatewayName("webircproxy"),
+			WithListener(listen),
+			WithUpstream(mock.Addr()),
+			WithEncodings("ISO-8859-1"),
+			WithYAML("log-level: error\nlookup-hostnames: false\n"+yaml),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := NewServer(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go server.RunContext(ctx)
+
+		dialer := websocket.Dialer{Subprotocols: []string{"binary.ircv3.net"}}
+		conn, _, err := dialer.Dial("ws://"+listen+"/webirc", http.Header{"Origin": []string{"https://example.com"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for _, line := range []string{"NICK alice", "USER u 0 * :Alice", "MOCK INVALID-UTF8 :café"} {
+			if err := conn.WriteMessage(websocket.BinaryMessage, []byte(line)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 2; i++ {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(messageType, websocket.BinaryMessage)
+			if i == 1 {
+				return string(message)
+			}
+		}
+		return ""
+	}
+	assertEqual(receive(""), ":mock.ircd NOTICE alice :caf\xe9")
+	assertEqual(receive("transcoding:\n    encodings: [\"ISO-8859-1\"]\n    binary: true"), ":mock.ircd NOTICE alice café")
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"unicode/utf8"
+
+	"github.com/ergochat/irc-go/ircmsg"
+)
+
+// Lines that transcoding makes too long are truncated; inside a
+// draft/multiline batch, that would silently drop part of a message that the
+// client reassembles from the batch's lines (and a truncation in the middle of
+// a character would corrupt it). Instead, such lines are transcoded in full,
+// then split into lines that fit, where each line after the first has the
+// draft/multiline-concat tag, so that the client reassembles the same text.
+
+const (
+	multilineBatchType = "draft/multiline"
+	multilineConcatTag = "draft/multiline-concat"
+)
+
+var (
+	batchCommand = []byte("BATCH ")
+)
+
+// multilineBatches is the set of references of the draft/multiline batches
+// that the upstream has opened (and not yet closed) on a connection
+type multilineBatches map[string]struct{}
+
+// observe updates the set, if the line opens or closes a batch
+func (batches multilineBatches) observe(line []byte) {
+	if !bytes.Contains(line, batchCommand) {
+		return
+	}
+	msg, err := ircmsg.ParseLine(string(line))
+	if err != nil || msg.Command != "BATCH" || len(msg.Params) == 0 || len(msg.Params[0]) < 2 {
+		return
+	}
+	ref := msg.Params[0][1:]
+	switch msg.Params[0][0] {
+	case '+':
+		if len(msg.Params) >= 2 && msg.Params[1] == multilineBatchType {
+			batches[ref] = struct{}{}
+		}
+	case '-':
+		delete(batches, ref)
+	}
+}
+
+// contains returns whether the line belongs to one of the batches
+func (batches multilineBatches) contains(line []byte) bool {
+	if len(batches) == 0 || len(line) == 0 || line[0] != '@' {
+		return false
+	}
+	msg, err := ircmsg.ParseLine(string(line))
+	if err != nil {
+		return false
+	}
+	present, ref := msg.GetTag("batch")
+	if !present {
+		return false
+	}
+	_, ok := batches[ref]
+	return ok
+}
+
+// splitMultilineLine splits a (transcoded) line of a multiline batch into
+// lines whose bodies fit within maxLineLen; lines that can't be split (other
+// than PRIVMSG and NOTICE) are truncated instead, as they would be outside
+// of a batch
+func splitMultilineLine(line []byte, maxLineLen int) [][]byte {
+	msg, err := ircmsg.ParseLine(string(line))
+	if err != nil {
+		return [][]byte{line}
+	}
+	lastParam := len(msg.Params) - 1
+	if (msg.Command != "PRIVMSG" && msg.Command != "NOTICE") || lastParam < 0 {
+		return [][]byte{truncateLine(&msg, line, maxLineLen)}
+	}
+	// the body, other than the text: ":<source> <command> <params> :"
+	overhead := len(msg.Command) + len(" :")
+	if msg.Prefix != "" {
+		overhead += len(":") + len(msg.Prefix) + len(" ")
+	}
+	for _, param := range msg.Params[:lastParam] {
+		overhead += len(" ") + len(param)
+	}
+	budget := maxLineLen - len(crlf) - overhead
+	text := msg.Params[lastParam]
+	if len(text) <= budget {
+		return [][]byte{line}
+	}
+	if budget < utf8.UTFMax {
+		return [][]byte{truncateLine(&msg, line, maxLineLen)}
+	}
+
+	var result [][]byte
+	for len(text) != 0 {
+		end := len(text)
+		if end > budget {
+			end = budget
+			// don't split a character:
+			for !utf8.RuneStart(text[end]) {
+				end--
+			}
+		}
+		msg.Params[lastParam] = text[:end]
+		text = text[end:]
+		if len(result) != 0 {
+			msg.SetTag(multilineConcatTag, "")
+		}
+		msg.ForceTrailing()
+		part, err := msg.LineBytesStrict(false, 0)
+		if err != nil {
+			return [][]byte{line}
+		}
+		result = append(result, bytes.TrimSuffix(part, crlf))
+	}
+	return result
+}
+
+// truncateLine returns the line, truncated to maxLineLen
+func truncateLine(msg *ircmsg.Message, line []byte, maxLineLen int) []byte {
+	truncated, err := msg.LineBytesStrict(false, maxLineLen)
+	if err != nil && err != ircmsg.ErrorBodyTooLong {
+		return line
+	}
+	return bytes.TrimSuffix(truncated, crlf)
+}
+
+// writeMultilineLine transcodes a line of a multiline batch for the client,
+// splitting it if necessary
+func (r *ReverseProxyConn) writeMultilineLine(line []byte) (err error) {
+	transcoded := r.server.transcodeToUTF8With(r.transcoding, line, 0)
+	for _, part := range splitMultilineLine(transcoded, r.upstreamLineLen) {
+		if err = r.writeWS(r.messageType, part); err != nil {
+			return
+		}
+	}
+	return
+}
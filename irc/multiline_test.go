@@ -0,0 +1,64 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/ergochat/irc-go/ircmsg"
+)
+
+func TestMultilineBatches(t *testing.T) {
+	batches := make(multilineBatches)
+	batches.observe([]byte(":irc.example.com BATCH +chathistory chathistory #chan"))
+	batches.observe([]byte(":alice!u@example.com BATCH +ml1 draft/multiline #chan"))
+	assertEqual(len(batches), 1)
+	assertEqual(batches.contains([]byte("@batch=ml1 :alice!u@example.com PRIVMSG #chan :hi")), true)
+	assertEqual(batches.contains([]byte("@batch=chathistory :alice!u@example.com PRIVMSG #chan :hi")), false)
+	assertEqual(batches.contains([]byte(":alice!u@example.com PRIVMSG #chan :hi")), false)
+	batches.observe([]byte(":alice!u@example.com BATCH -ml1"))
+	assertEqual(len(batches), 0)
+}
+
+func TestSplitMultilineLine(t *testing.T) {
+	short := "@batch=ml1 :alice!u@example.com PRIVMSG #chan :hi"
+	assertEqual(splitMultilineLine([]byte(short), 512), [][]byte{[]byte(short)})
+
+	text := strings.Repeat("fromage à la crème ", 40)
+	lines := splitMultilineLine([]byte("@batch=ml1 :alice!u@example.com PRIVMSG #chan :"+text), 512)
+	assertEqual(len(lines) > 1, true)
+	var reassembled strings.Builder
+	for i, line := range lines {
+		msg, err := ircmsg.ParseLine(string(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ref := msg.GetTag("batch")
+		assertEqual(ref, "ml1")
+		assertEqual(msg.HasTag(multilineConcatTag), i != 0)
+		assertEqual(utf8.ValidString(msg.Params[1]), true)
+		body := line[strings.IndexByte(string(line), ' ')+1:]
+		assertEqual(len(body) <= 510, true)
+		reassembled.WriteString(msg.Params[1])
+	}
+	assertEqual(reassembled.String(), text)
+}
+
+func TestTranscodeMultiline(t *testing.T) {
+	server := getTestingServer(false, []string{"windows-1252"})
+	// each Latin-1 character becomes two bytes, so the line no longer fits:
+	line := "@batch=ml1 :alice!u@example.com PRIVMSG #chan :" + strings.Repeat("cr\xe8me ", 80)
+	transcoded := server.transcodeToUTF8With(&server.Config().Transcoding, []byte(line), 0)
+	var reassembled strings.Builder
+	for _, part := range splitMultilineLine(transcoded, 512) {
+		msg, err := ircmsg.ParseLine(string(part))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reassembled.WriteString(msg.Params[1])
+	}
+	assertEqual(reassembled.String(), strings.Repeat("crème ", 80))
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"log/slog"
+)
+
+// Multiplexing: when the account of each client is known (from the trusted
+// reverse proxy's account-header), later websockets from the same account
+// (e.g., from several browser tabs) are attached to the account's existing
+// upstream connection instead of opening new ones. Lines from the upstream
+// are sent to all of the websockets, and lines from any of them are relayed
+// to the upstream. Like a reattached websocket (see sessions.go), an attached
+// websocket receives
+//
+//	:<gateway-name> NOTE * SESSION_REATTACHED :<description>
+//
+// and must not register again. The upstream connection stays open as long
+// as any of its websockets is.
+
+const (
+	defaultMaxMultiplexedConns = 10
+)
+
+// MultiplexingConfig configures connection multiplexing.
+type MultiplexingConfig struct {
+	Enabled bool
+	// the maximum number of websockets attached to one upstream connection:
+	MaxConnections int `yaml:"max-connections"`
+}
+
+func (conf *MultiplexingConfig) postprocess() {
+	if conf.MaxConnections <= 0 {
+		conf.MaxConnections = defaultMaxMultiplexedConns
+	}
+}
+
+// multiplexKey identifies an account's upstream connection (accounts are
+// independent between profiles)
+func multiplexKey(client *clientData) string {
+	return client.info.Profile + "\x00" + client.info.Account
+}
+
+// attachMultiplexed attaches a new websocket to the existing upstream
+// connection of the client's account, if any, returning whether it did
+func (server *Server) attachMultiplexed(webConn messageConn, client *clientData, config *Config) bool {
+	existing := server.accountConns.get(multiplexKey(client))
+	if existing == nil || !existing.attachMultiplexed(webConn, config) {
+		return false
+	}
+	existing.log(LogLevelInfo, "client multiplexed", slog.String("new_conn_id", client.id), slog.String(logKeyRemoteIP, client.ip.String()))
+	client.span.End(nil)
+	server.finishConnection(client, DisconnectInfo{Reason: CloseMultiplexed})
+	return true
+}
+
+// attachMultiplexed adds a websocket to the connection, returning false if
+// that's impossible (the connection is closing or full, or the websocket's
+// message type differs)
+func (r *ReverseProxyConn) attachMultiplexed(webConn messageConn, config *Config) bool {
+	if webConnMessageType(webConn) != r.messageType {
+		return false
+	}
+	r.wsMutex.Lock()
+	defer r.wsMutex.Unlock()
+	if r.closing || len(r.multiplexed)+1 >= r.maxMultiplexed {
+		return false
+	}
+	// send the note before the websocket can receive any upstream lines:
+	r.sendReattachedNoteLocked(webConn, config, "Attached to your account's existing connection")
+	if r.webConn == nil {
+		// the account's only websocket is away, within its reconnect grace:
+		r.webConn = webConn
+		r.stopGraceTimerLocked()
+		if r.replay != nil {
+			r.replayLocked(webConn, config, r.replay.drain())
+		}
+	} else {
+		r.multiplexed = append(r.multiplexed, webConn)
+	}
+	r.startProxyToUpstream(webConn, true, config.logEnabled(LogComponentProxy, LogLevelDebug))
+	return true
+}
+
+// dropMultiplexedLocked removes a multiplexed websocket, if it is one;
+// requires r.wsMutex
+func (r *ReverseProxyConn) dropMultiplexedLocked(webConn messageConn) {
+	for i, conn := range r.multiplexed {
+		if conn == webConn {
+			// copy, since writeWS may be iterating over the old slice:
+			remaining := make([]messageConn, 0, len(r.multiplexed)-1)
+			remaining = append(remaining, r.multiplexed[:i]...)
+			r.multiplexed = append(remaining, r.multiplexed[i+1:]...)
+			webConn.Close()
+			return
+		}
+	}
+}
+
+// promoteMultiplexedLocked replaces the main websocket with a multiplexed
+// one, returning false if there are none; requires r.wsMutex
+func (r *ReverseProxyConn) promoteMultiplexedLocked() bool {
+	if len(r.multiplexed) == 0 {
+		return false
+	}
+	r.webConn = r.multiplexed[0]
+	r.multiplexed = r.multiplexed[1:]
+	return true
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMultiplexing(t *testing.T) {
+	server := &Server{}
+	config := &Config{GatewayName: "webircproxy"}
+	server.SetConfig(config)
+	first, second, third := new(idleConn), new(idleConn), new(idleConn)
+	r := &ReverseProxyConn{
+		server:         server,
+		webConn:        first,
+		messageType:    textMessage,
+		maxLineLen:     DefaultMaxLineLen,
+		buffers:        &config.Buffers,
+		maxMultiplexed: 2,
+	}
+
+	assertEqual(r.attachMultiplexed(second, config), true)
+	assertEqual(second.messages, []string{":webircproxy NOTE * SESSION_REATTACHED :Attached to your account's existing connection"})
+	// the connection is full:
+	assertEqual(r.attachMultiplexed(third, config), false)
+
+	// lines from the upstream are sent to every websocket:
+	assertEqual(r.writeWS(textMessage, []byte(":irc.example.com NOTICE * :hi")), nil)
+	assertEqual(first.messages, []string{":irc.example.com NOTICE * :hi"})
+	assertEqual(len(second.messages), 2)
+
+	// the connection continues while any of its websockets is open:
+	assertEqual(r.detach(first), true)
+	assertEqual(r.webConn == messageConn(second), true)
+	assertEqual(len(r.multiplexed), 0)
+	assertEqual(r.detach(second), false)
+}
+
+func TestMultiplexKey(t *testing.T) {
+	alice := &clientData{info: &ClientInfo{Account: "alice"}}
+	profileAlice := &clientData{info: &ClientInfo{Account: "alice", Profile: "network1"}}
+	assertEqual(multiplexKey(alice) == multiplexKey(profileAlice), false)
+}
+
+// chunkConn is an upstream connection without writev(2), like a TLS one,
+// which records what is written to it
+type chunkConn struct {
+	net.Conn
+
+	sync.Mutex
+	written []byte
+}
+
+func (c *chunkConn) Write(b []byte) (int, error) {
+	c.Lock()
+	c.written = append(c.written, b...)
+	c.Unlock()
+	// give the other writers a chance to interleave:
+	runtime.Gosched()
+	return len(b), nil
+}
+
+func TestWriteUpstreamSerialized(t *testing.T) {
+	uConn := new(chunkConn)
+	r := &ReverseProxyConn{uConn: uConn}
+	var wg sync.WaitGroup
+	for _, line := range []string{"PRIVMSG #a :first tab", "PRIVMSG #b :second tab"} {
+		wg.Add(1)
+		go func(line []byte) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				iovec := net.Buffers{line, crlf}
+				if err := r.writeUpstream(&iovec); err != nil {
+					t.Error(err)
+				}
+			}
+		}([]byte(line))
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(string(uConn.written), "\r\n"), "\r\n")
+	assertEqual(len(lines), 200)
+	for _, line := range lines {
+		if line != "PRIVMSG #a :first tab" && line != "PRIVMSG #b :second tab" {
+			t.Fatalf("interleaved line: %q", line)
+		}
+	}
+}
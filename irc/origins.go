@@ -0,0 +1,243 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ergochat/ergo/irc/utils"
+)
+
+// OriginPolicy is a set of rules applied to websocket connections whose
+// Origin header matches one of the listed origins.
+type OriginPolicy struct {
+	Origins []string
+	// whether this policy also applies to connections that send no Origin header
+	// (browsers always send one, but native clients typically do not):
+	AllowMissing bool `yaml:"allow-missing"`
+	// names or addresses of the upstreams that these connections may be forwarded to;
+	// if empty, any upstream may be used:
+	Upstreams []string
+	// limit on new connections per client IP:
+	RateLimit ThrottleConfig `yaml:"rate-limit"`
+
+	originRegexps []*regexp.Regexp
+	upstreams     []*reverseProxyUpstream
+	// identifies this policy's rate limit state:
+	key string
+}
+
+func (policy *OriginPolicy) postprocess(config *Config) (err error) {
+	for _, pattern := range policy.Origins {
+		re, err := compileOriginPattern(pattern)
+		if err != nil {
+			// with lenient, the pattern is skipped; since a policy only allows
+			// the origins it matches, this fails closed:
+			if err := config.lenientError(fmt.Errorf("invalid websocket allowed-origin expression: %s: %w", pattern, err)); err != nil {
+				return err
+			}
+			continue
+		}
+		policy.originRegexps = append(policy.originRegexps, re)
+	}
+	for _, name := range policy.Upstreams {
+		upstream := config.getUpstream(name)
+		if upstream == nil {
+			return fmt.Errorf("origin policy references unknown upstream: %s", name)
+		}
+		policy.upstreams = append(policy.upstreams, upstream)
+	}
+	policy.key = strings.Join(policy.Origins, " ")
+	return nil
+}
+
+const originRegexpPrefix = "regexp"
+
+// compileOriginPattern compiles an allowed origin, which is either a glob or,
+// with the regexp: prefix, a regular expression (RE2 syntax). Regular
+// expressions are anchored and case-sensitive unless flags are given after
+// a slash: regexp/i: is case-insensitive, regexp/u: is unanchored (it may
+// match any part of the origin), and regexp/iu: is both.
+func compileOriginPattern(pattern string) (*regexp.Regexp, error) {
+	if !isOriginRegexp(pattern) {
+		return utils.CompileGlob(pattern, false)
+	}
+	flags, expr, found := strings.Cut(strings.TrimPrefix(pattern, originRegexpPrefix), ":")
+	if !found {
+		return nil, fmt.Errorf("expected %s[/flags]:expression", originRegexpPrefix)
+	}
+	flags = strings.TrimPrefix(flags, "/")
+	anchored, prefix := true, ""
+	for _, flag := range flags {
+		switch flag {
+		case 'i':
+			prefix = "(?i)"
+		case 'u':
+			anchored = false
+		default:
+			return nil, fmt.Errorf("unknown regexp flag %q", flag)
+		}
+	}
+	if anchored {
+		expr = `^(?:` + expr + `)$`
+	}
+	return regexp.Compile(prefix + expr)
+}
+
+// isOriginRegexp returns whether an allowed origin is a regular expression
+// (regexp:, or regexp/flags:) rather than a glob
+func isOriginRegexp(pattern string) bool {
+	rest, found := strings.CutPrefix(pattern, originRegexpPrefix)
+	return found && (strings.HasPrefix(rest, ":") || strings.HasPrefix(rest, "/"))
+}
+
+func (policy *OriginPolicy) matches(origin string) bool {
+	for _, re := range policy.originRegexps {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	opaqueOriginAllow   = "allow"
+	opaqueOriginMissing = "missing"
+	opaqueOriginReject  = "reject"
+)
+
+// OpaqueOriginsConfig determines how the origins that don't identify a
+// website are treated: `null` (sent by sandboxed pages, and by some browsers
+// for local files) and file:// (sent by Electron-based clients). By default,
+// they are matched like any other origin.
+type OpaqueOriginsConfig struct {
+	// allow (regardless of the policies), missing (treat as if the client
+	// sent no Origin), or reject:
+	Null string
+	File string
+}
+
+func (conf *OpaqueOriginsConfig) postprocess() error {
+	for _, action := range []string{conf.Null, conf.File} {
+		switch action {
+		case "", opaqueOriginAllow, opaqueOriginMissing, opaqueOriginReject:
+		default:
+			return fmt.Errorf("invalid opaque-origins action %s (expected allow, missing, or reject)", action)
+		}
+	}
+	return nil
+}
+
+// action returns the configured action for an origin, or "" if it isn't opaque
+func (conf *OpaqueOriginsConfig) action(origin string) string {
+	if origin == "null" {
+		return conf.Null
+	}
+	if len(origin) >= len("file://") && strings.EqualFold(origin[:len("file://")], "file://") {
+		return conf.File
+	}
+	return ""
+}
+
+func (config *Config) prepareOriginPolicies() (err error) {
+	if err := config.OpaqueOrigins.postprocess(); err != nil {
+		return err
+	}
+	for i := range config.OriginPolicies {
+		policy := &config.OriginPolicies[i]
+		if err := policy.postprocess(config); err != nil {
+			return err
+		}
+		config.originPolicies = append(config.originPolicies, policy)
+	}
+	// each origin route is equivalent to a policy restricted to its upstream:
+	for _, origin := range sortedOriginRoutes(config.OriginRoutes) {
+		policy := &OriginPolicy{Origins: []string{origin}, Upstreams: []string{config.OriginRoutes[origin]}}
+		if err := policy.postprocess(config); err != nil {
+			return fmt.Errorf("origin route %s: %w", origin, err)
+		}
+		config.originPolicies = append(config.originPolicies, policy)
+	}
+	// the legacy allowed-origins list is equivalent to a policy with no other restrictions:
+	if len(config.AllowedOrigins) != 0 {
+		policy := &OriginPolicy{Origins: config.AllowedOrigins}
+		if err := policy.postprocess(config); err != nil {
+			return err
+		}
+		config.originPolicies = append(config.originPolicies, policy)
+	}
+	return nil
+}
+
+// sortedOriginRoutes orders the origins of origin-routes so that the most specific
+// match wins: exact origins first, then globs and regular expressions, longest first
+func sortedOriginRoutes(routes map[string]string) []string {
+	origins := make([]string, 0, len(routes))
+	for origin := range routes {
+		origins = append(origins, origin)
+	}
+	isPattern := func(origin string) bool {
+		return strings.Contains(origin, "*") || isOriginRegexp(origin)
+	}
+	sort.Slice(origins, func(i, j int) bool {
+		iGlob, jGlob := isPattern(origins[i]), isPattern(origins[j])
+		if iGlob != jGlob {
+			return !iGlob
+		}
+		if len(origins[i]) != len(origins[j]) {
+			return len(origins[i]) > len(origins[j])
+		}
+		return origins[i] < origins[j]
+	})
+	return origins
+}
+
+// checkOrigin determines whether a websocket connection with the given Origin
+// header (to the given Host) is allowed, and if so, which policy (possibly nil)
+// applies to it.
+func (config *Config) checkOrigin(origin, host string) (policy *OriginPolicy, allowed bool) {
+	origin = strings.TrimSpace(origin)
+	switch config.OpaqueOrigins.action(origin) {
+	case opaqueOriginAllow:
+		return nil, true
+	case opaqueOriginMissing:
+		origin = ""
+	case opaqueOriginReject:
+		return nil, false
+	}
+	if len(config.originPolicies) == 0 {
+		return nil, true
+	}
+	for _, policy := range config.originPolicies {
+		if origin == "" {
+			if policy.AllowMissing {
+				return policy, true
+			}
+		} else if policy.matches(origin) {
+			return policy, true
+		}
+	}
+	if origin == "" && config.AllowMissingOrigin {
+		return nil, true
+	}
+	if origin != "" && config.AllowSameOrigin && sameOriginHost(origin, host) {
+		return nil, true
+	}
+	return nil, false
+}
+
+// sameOriginHost returns whether the Origin's hostname is the Host's,
+// regardless of their schemes and ports
+func sameOriginHost(origin, host string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+	// Host is host[:port], as in a URL:
+	return strings.EqualFold(u.Hostname(), (&url.URL{Host: host}).Hostname())
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+)
+
+func getTestingOriginConfig(t *testing.T, allowMissingOrigin bool) *Config {
+	config := new(Config)
+	config.Upstreams = []reverseProxyUpstream{
+		{Name: "a", Address: "127.0.0.1:6667"},
+		{Name: "b", Address: "/tmp/ircd_sock"},
+	}
+	config.OriginPolicies = []OriginPolicy{
+		{
+			Origins:   []string{"https://webchat.example.com"},
+			Upstreams: []string{"b"},
+		},
+		{
+			Origins:      []string{"https://native.example.com"},
+			AllowMissing: true,
+			Upstreams:    []string{"127.0.0.1:6667"},
+		},
+	}
+	config.AllowedOrigins = []string{"https://*.example.org"}
+	config.AllowMissingOrigin = allowMissingOrigin
+	if err := config.prepareOriginPolicies(); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestCheckOrigin(t *testing.T) {
+	config := getTestingOriginConfig(t, false)
+
+	policy, allowed := config.checkOrigin("https://webchat.example.com", "")
+	assertEqual(allowed, true)
+	assertEqual(policy.upstreams[0].Name, "b")
+
+	policy, allowed = config.checkOrigin("", "")
+	assertEqual(allowed, true)
+	assertEqual(policy.upstreams[0].Name, "a")
+
+	policy, allowed = config.checkOrigin("https://chat.example.org", "")
+	assertEqual(allowed, true)
+	assertEqual(len(policy.upstreams), 0)
+
+	_, allowed = config.checkOrigin("https://evil.example.net", "")
+	assertEqual(allowed, false)
+}
+
+func TestCheckOriginNoPolicies(t *testing.T) {
+	config := new(Config)
+	if err := config.prepareOriginPolicies(); err != nil {
+		t.Fatal(err)
+	}
+	policy, allowed := config.checkOrigin("", "")
+	assertEqual(allowed, true)
+	assertEqual(policy, (*OriginPolicy)(nil))
+	_, allowed = config.checkOrigin("https://evil.example.net", "")
+	assertEqual(allowed, true)
+}
+
+func TestCheckOriginMissing(t *testing.T) {
+	config := getTestingOriginConfig(t, false)
+	config.OriginPolicies[1].AllowMissing = false
+	_, allowed := config.checkOrigin("", "")
+	assertEqual(allowed, false)
+
+	config.AllowMissingOrigin = true
+	policy, allowed := config.checkOrigin("", "")
+	assertEqual(allowed, true)
+	assertEqual(policy, (*OriginPolicy)(nil))
+}
+
+func TestUnknownUpstreamInPolicy(t *testing.T) {
+	config := new(Config)
+	config.OriginPolicies = []OriginPolicy{{Origins: []string{"*"}, Upstreams: []string{"nonexistent"}}}
+	if err := config.prepareOriginPolicies(); err == nil {
+		t.Errorf("expected error for unknown upstream")
+	}
+}
+
+func TestOriginRoutes(t *testing.T) {
+	config := new(Config)
+	config.Upstreams = []reverseProxyUpstream{
+		{Name: "neta", Address: "192.0.2.1:6667"},
+		{Name: "netb", Address: "192.0.2.2:6667"},
+	}
+	config.OriginRoutes = map[string]string{
+		"https://*.neta.example":       "neta",
+		"https://webchat.neta.example": "netb",
+		"https://*.example":            "netb",
+	}
+	if err := config.prepareOriginPolicies(); err != nil {
+		t.Fatal(err)
+	}
+	upstreamFor := func(origin string) string {
+		policy, allowed := config.checkOrigin(origin, "")
+		if !allowed {
+			return ""
+		}
+		return policy.upstreams[0].Name
+	}
+	// exact origins win, then the longest glob:
+	assertEqual(upstreamFor("https://webchat.neta.example"), "netb")
+	assertEqual(upstreamFor("https://chat.neta.example"), "neta")
+	assertEqual(upstreamFor("https://chat.netb.example"), "netb")
+	assertEqual(upstreamFor("https://evil.example.net"), "")
+
+	config = new(Config)
+	config.OriginRoutes = map[string]string{"https://chat.example": "nonexistent"}
+	assertEqual(config.prepareOriginPolicies().Error(), "origin route https://chat.example: origin policy references unknown upstream: nonexistent")
+}
+
+func TestCheckSameOrigin(t *testing.T) {
+	config := getTestingOriginConfig(t, false)
+	_, allowed := config.checkOrigin("https://chat.example.net", "chat.example.net")
+	assertEqual(allowed, false)
+
+	config.AllowSameOrigin = true
+	policy, allowed := config.checkOrigin("https://chat.example.net", "chat.example.net")
+	assertEqual(allowed, true)
+	assertEqual(policy == nil, true)
+	_, allowed = config.checkOrigin("http://Chat.Example.net:8080", "chat.example.net:443")
+	assertEqual(allowed, true)
+	_, allowed = config.checkOrigin("https://[2001:db8::1]:8443", "[2001:db8::1]")
+	assertEqual(allowed, true)
+	_, allowed = config.checkOrigin("https://evil.example.net", "chat.example.net")
+	assertEqual(allowed, false)
+	_, allowed = config.checkOrigin("null", "chat.example.net")
+	assertEqual(allowed, false)
+	// policies still take precedence:
+	policy, _ = config.checkOrigin("https://webchat.example.com", "webchat.example.com")
+	assertEqual(policy.upstreams[0].Name, "b")
+}
+
+func TestOriginRegexps(t *testing.T) {
+	config := new(Config)
+	config.AllowedOrigins = []string{
+		`regexp:https://([a-z0-9-]+\.)*example\.org(:[0-9]+)?`,
+		`regexp/i:http://localhost:[0-9]+`,
+		`regexp/u:\.example\.net`,
+	}
+	if err := config.prepareOriginPolicies(); err != nil {
+		t.Fatal(err)
+	}
+	for origin, expected := range map[string]bool{
+		"https://example.org":            true,
+		"https://a.b.example.org:8443":   true,
+		"http://a.example.org":           false,
+		"https://example.org.evil.com":   false,
+		"https://A.example.org":          false,
+		"http://LOCALHOST:3000":          true,
+		"http://localhost:3000/evil":     false,
+		"https://chat.example.net:8080":  true,
+		"https://chat.example.network":   true,
+		"https://regexp:example.org":     false,
+		"https://chatexample.net":        false,
+		"https://chat.example.org.":      false,
+		"https://chat.example.org:https": false,
+	} {
+		_, allowed := config.checkOrigin(origin, "")
+		if allowed != expected {
+			t.Errorf("origin %s: expected %t, got %t", origin, expected, allowed)
+		}
+	}
+
+	for _, invalid := range []string{"regexp/x:abc", "regexp:(", "regexp/i"} {
+		if _, err := compileOriginPattern(invalid); err == nil {
+			t.Errorf("expected an error compiling %s", invalid)
+		}
+	}
+	// not regular expressions:
+	assertEqual(isOriginRegexp("regexp.example.com"), false)
+	assertEqual(isOriginRegexp("https://*.example.com"), false)
+}
+
+func TestOpaqueOrigins(t *testing.T) {
+	config := getTestingOriginConfig(t, false)
+	// by default, they're like any other unlisted origin:
+	_, allowed := config.checkOrigin("null", "")
+	assertEqual(allowed, false)
+	_, allowed = config.checkOrigin("file://", "")
+	assertEqual(allowed, false)
+
+	config.OpaqueOrigins = OpaqueOriginsConfig{Null: "missing", File: "allow"}
+	// treated as missing, so the policy with allow-missing applies:
+	policy, allowed := config.checkOrigin("null", "")
+	assertEqual(allowed, true)
+	assertEqual(policy.upstreams[0].Name, "a")
+	policy, allowed = config.checkOrigin("FILE://", "")
+	assertEqual(allowed, true)
+	assertEqual(policy == nil, true)
+
+	config = new(Config)
+	config.OpaqueOrigins.Null = "reject"
+	if err := config.prepareOriginPolicies(); err != nil {
+		t.Fatal(err)
+	}
+	_, allowed = config.checkOrigin("null", "")
+	assertEqual(allowed, false)
+	_, allowed = config.checkOrigin("file://", "")
+	assertEqual(allowed, true)
+
+	config = new(Config)
+	config.OpaqueOrigins.File = "deny"
+	assertEqual(config.prepareOriginPolicies() == nil, false)
+}
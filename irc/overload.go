@@ -0,0 +1,77 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// During a connection flood, queuing new requests behind the ones already
+// being checked and upgraded (reverse DNS, reputation lookups, hooks, TLS)
+// makes everyone wait, and takes CPU from the established connections. A
+// listener with an `overload` block instead sheds the requests beyond its
+// limits right away, with 503 and `Retry-After: 1`, before doing any work
+// for them; shed requests are counted in webircproxy_shed_total.
+
+// OverloadConfig limits the rate of new websocket requests on a listener
+type OverloadConfig struct {
+	// requests accepted per second (0 for no limit):
+	MaxRate int `yaml:"max-rate"`
+	// requests being checked and upgraded at once (0 for no limit):
+	MaxPending int `yaml:"max-pending"`
+}
+
+func (conf *OverloadConfig) postprocess() error {
+	if conf.MaxRate < 0 || conf.MaxPending < 0 {
+		return fmt.Errorf("overload max-rate and max-pending must not be negative")
+	}
+	return nil
+}
+
+// the reasons a request was shed, for webircproxy_shed_total:
+const (
+	shedRate    = "rate"
+	shedPending = "pending"
+)
+
+// overloadShedder tracks a listener's request rate (in fixed one-second
+// windows) and its requests in progress
+type overloadShedder struct {
+	sync.Mutex // tier 1
+
+	windowStart time.Time
+	count       int
+	pending     int
+}
+
+// admit returns "" if the request may proceed, in which case done must be
+// called once it has been upgraded (or rejected), or else why it was shed
+func (s *overloadShedder) admit(conf OverloadConfig, now time.Time) (reason string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if conf.MaxPending != 0 && s.pending >= conf.MaxPending {
+		return shedPending
+	}
+	if conf.MaxRate != 0 {
+		if now.Sub(s.windowStart) >= time.Second {
+			s.windowStart = now
+			s.count = 0
+		}
+		if s.count >= conf.MaxRate {
+			return shedRate
+		}
+		s.count++
+	}
+	s.pending++
+	return ""
+}
+
+func (s *overloadShedder) done() {
+	s.Lock()
+	defer s.Unlock()
+	s.pending--
+}
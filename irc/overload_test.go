@@ -0,0 +1,63 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOverloadShedder(t *testing.T) {
+	var s overloadShedder
+	now := time.Now()
+	conf := OverloadConfig{MaxRate: 3, MaxPending: 2}
+	assertEqual(s.admit(conf, now), "")
+	assertEqual(s.admit(conf, now), "")
+	assertEqual(s.admit(conf, now), shedPending)
+	s.done()
+	assertEqual(s.admit(conf, now), "")
+	s.done()
+	s.done()
+	assertEqual(s.admit(conf, now), shedRate)
+	// a new window:
+	assertEqual(s.admit(conf, now.Add(time.Second)), "")
+	s.done()
+
+	// no limits:
+	for i := 0; i < 10; i++ {
+		assertEqual(s.admit(OverloadConfig{}, now), "")
+	}
+}
+
+func TestOverloadConfig(t *testing.T) {
+	config, err := NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667"), WithYAML(`
+listeners:
+    "127.0.0.1:8067":
+        overload:
+            max-rate: 200
+            max-pending: 100
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(config.trueListeners["127.0.0.1:8067"].Overload, OverloadConfig{MaxRate: 200, MaxPending: 100})
+
+	_, err = NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667"), WithYAML(`
+listeners:
+    "127.0.0.1:8067":
+        overload:
+            max-rate: -1
+`))
+	assertEqual(err != nil, true)
+
+	server := new(Server)
+	server.metrics.initialize()
+	server.SetConfig(config)
+	server.countShed("127.0.0.1:8067", shedRate)
+	var buf bytes.Buffer
+	server.writeMetrics(&buf)
+	assertEqual(strings.Contains(buf.String(), `webircproxy_shed_total{listener="127.0.0.1:8067",reason="rate"} 1`), true)
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"time"
+)
+
+// With downstream-pacing, lines from the upstream are sent to the client in
+// bursts of at most a fixed number of lines per interval, so that a large
+// burst from the upstream (e.g., a long ban list, or NAMES for a large
+// channel) doesn't freeze a low-powered webchat client while it renders them.
+// Pausing the upstream connection's reader pushes back on the upstream, which
+// buffers the lines in its sendq instead.
+
+const (
+	defaultPacingInterval = 100 * time.Millisecond
+)
+
+type DownstreamPacingConfig struct {
+	Enabled bool
+	// at most this many lines are sent to a client per interval:
+	Burst    int
+	Interval time.Duration
+	// overrides burst for clients of the binary subprotocol (0 to not pace
+	// them at all):
+	BinaryBurst int `yaml:"binary-burst"`
+}
+
+func (conf *DownstreamPacingConfig) postprocess() error {
+	if !conf.Enabled {
+		return nil
+	}
+	if conf.Burst <= 0 || conf.BinaryBurst < 0 {
+		return fmt.Errorf("downstream-pacing requires a positive burst (and binary-burst must not be negative)")
+	}
+	if conf.Interval == 0 {
+		conf.Interval = defaultPacingInterval
+	}
+	if conf.Interval < 0 {
+		return fmt.Errorf("downstream-pacing interval must be positive")
+	}
+	return nil
+}
+
+// pacer paces the lines sent to one connection's client; it is only used
+// by the goroutine reading from the upstream
+type pacer struct {
+	burst    int
+	interval time.Duration
+	// lines sent in the current interval, and when it started:
+	sent  int
+	start time.Time
+}
+
+// newPacer returns the pacer for a client, or nil if it isn't paced
+func (conf *DownstreamPacingConfig) newPacer(messageType messageType) *pacer {
+	if !conf.Enabled {
+		return nil
+	}
+	burst := conf.Burst
+	if messageType == binaryMessage {
+		burst = conf.BinaryBurst
+	}
+	if burst == 0 {
+		return nil
+	}
+	return &pacer{burst: burst, interval: conf.Interval}
+}
+
+// wait blocks until the next line can be sent
+func (p *pacer) wait() {
+	now := time.Now()
+	if now.Sub(p.start) >= p.interval {
+		p.start, p.sent = now, 0
+	}
+	if p.sent >= p.burst {
+		time.Sleep(p.start.Add(p.interval).Sub(now))
+		p.start, p.sent = time.Now(), 0
+	}
+	p.sent++
+}
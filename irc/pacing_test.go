@@ -0,0 +1,41 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPacer(t *testing.T) {
+	conf := DownstreamPacingConfig{Enabled: true, Burst: 5, Interval: 50 * time.Millisecond}
+	p := conf.newPacer(textMessage)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		p.wait()
+	}
+	// the first burst isn't delayed:
+	assertEqual(time.Since(start) < 50*time.Millisecond, true)
+	for i := 0; i < 6; i++ {
+		p.wait()
+	}
+	// the 11th line waits for the third interval:
+	assertEqual(time.Since(start) >= 100*time.Millisecond, true)
+
+	assertEqual(conf.newPacer(binaryMessage) == nil, true)
+	conf.BinaryBurst = 100
+	assertEqual(conf.newPacer(binaryMessage).burst, 100)
+	conf.Enabled = false
+	assertEqual(conf.newPacer(textMessage) == nil, true)
+}
+
+func TestDownstreamPacingValidation(t *testing.T) {
+	config, err := NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667"), WithYAML("downstream-pacing:\n    enabled: true\n    burst: 20"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(config.DownstreamPacing.Interval, defaultPacingInterval)
+	_, err = NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667"), WithYAML("downstream-pacing:\n    enabled: true"))
+	assertEqual(err != nil, true)
+}
@@ -4,12 +4,236 @@
 package irc
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
 	"runtime/debug"
+	"strings"
+	"time"
 )
 
-func (server *Server) HandlePanic() {
+const (
+	// drop reports instead of piling up requests if many connections panic at once:
+	maxInflightPanicReports = 4
+)
+
+// PanicReportingConfig configures reporting of recovered panics to Sentry
+// (or a service implementing its API, such as GlitchTip).
+type PanicReportingConfig struct {
+	// e.g. https://<key>@o0.ingest.sentry.io/<project>
+	SentryDSN   string `yaml:"sentry-dsn"`
+	Environment string
+
+	storeURL   string
+	authHeader string
+	client     *http.Client
+}
+
+func (conf *PanicReportingConfig) postprocess() error {
+	if conf.SentryDSN == "" {
+		return nil
+	}
+	u, err := url.Parse(conf.SentryDSN)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User == nil || u.User.Username() == "" {
+		return fmt.Errorf("invalid sentry-dsn: %s", conf.SentryDSN)
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	slash := strings.LastIndexByte(path, '/')
+	project := path[slash+1:]
+	if project == "" {
+		return fmt.Errorf("sentry-dsn has no project ID: %s", conf.SentryDSN)
+	}
+	conf.storeURL = fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, path[:slash], project)
+	conf.authHeader = fmt.Sprintf("Sentry sentry_version=7, sentry_client=webircproxy, sentry_key=%s", u.User.Username())
+	if secret, ok := u.User.Password(); ok {
+		conf.authHeader += ", sentry_secret=" + secret
+	}
+	conf.client = &http.Client{
+		Timeout: 10 * time.Second,
+	}
+	return nil
+}
+
+// PanicReport describes a recovered panic.
+type PanicReport struct {
+	Value interface{}
+	Stack []byte
+	Time  time.Time
+	// context, e.g. the connection ID, client IP, and upstream
+	// if the panic occurred while proxying a connection:
+	Attrs []slog.Attr
+
+	pcs []uintptr
+}
+
+// PanicHook is called synchronously for each recovered panic.
+type PanicHook func(report *PanicReport)
+
+// SetPanicHook sets a function to be called for each recovered panic
+// (in addition to logging it, and reporting it to Sentry if configured).
+func (server *Server) SetPanicHook(hook PanicHook) {
+	if hook == nil {
+		server.panicHook.Store(nil)
+	} else {
+		server.panicHook.Store(&hook)
+	}
+}
+
+// HandlePanic must be deferred; it recovers from a panic, logging and reporting
+// it. attrs describe the context, e.g., the connection being proxied.
+func (server *Server) HandlePanic(attrs ...slog.Attr) {
 	if r := recover(); r != nil {
-		server.Log(LogLevelError, fmt.Sprintf("Panic encountered: %v\n%s", r, debug.Stack()))
+		report := &PanicReport{
+			Value: r,
+			Stack: debug.Stack(),
+			Time:  time.Now().UTC(),
+			Attrs: attrs,
+			pcs:   make([]uintptr, 64),
+		}
+		// skip runtime.Callers and HandlePanic:
+		report.pcs = report.pcs[:runtime.Callers(2, report.pcs)]
+		server.Log(LogComponentServer, LogLevelError, fmt.Sprintf("Panic encountered: %v\n%s", r, report.Stack), attrs...)
+		server.reportPanic(report)
+	}
+}
+
+func (server *Server) reportPanic(report *PanicReport) {
+	config := server.Config()
+	if config != nil && config.LogPrivacy.enabled() {
+		// copy, since the attrs may belong to the connection:
+		scrubbed := make([]slog.Attr, len(report.Attrs))
+		for i, attr := range report.Attrs {
+			scrubbed[i] = config.LogPrivacy.scrubAttr(attr)
+		}
+		report.Attrs = scrubbed
+	}
+
+	if hook := server.panicHook.Load(); hook != nil {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					server.Log(LogComponentServer, LogLevelError, fmt.Sprintf("Panic in panic hook: %v", r))
+				}
+			}()
+			(*hook)(report)
+		}()
+	}
+
+	if config != nil && config.PanicReporting.SentryDSN != "" {
+		if server.panicReportsInflight.Add(1) > maxInflightPanicReports {
+			server.panicReportsInflight.Add(-1)
+			return
+		}
+		go func() {
+			defer server.panicReportsInflight.Add(-1)
+			if err := sendSentryEvent(&config.PanicReporting, makeSentryEvent(&config.PanicReporting, report)); err != nil {
+				server.Log(LogComponentServer, LogLevelWarn, "could not report panic to sentry", errAttr(err))
+			}
+		}()
+	}
+}
+
+// Sentry event payload:
+// https://develop.sentry.dev/sdk/event-payloads/
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+}
+
+type sentryException struct {
+	Type       string `json:"type"`
+	Value      string `json:"value"`
+	Stacktrace struct {
+		Frames []sentryFrame `json:"frames"`
+	} `json:"stacktrace"`
+}
+
+type sentryEvent struct {
+	EventID     string `json:"event_id"`
+	Timestamp   string `json:"timestamp"`
+	Platform    string `json:"platform"`
+	Level       string `json:"level"`
+	Logger      string `json:"logger"`
+	ServerName  string `json:"server_name,omitempty"`
+	Environment string `json:"environment,omitempty"`
+	Exception   struct {
+		Values []sentryException `json:"values"`
+	} `json:"exception"`
+	Extra map[string]string `json:"extra,omitempty"`
+}
+
+func makeSentryEvent(conf *PanicReportingConfig, report *PanicReport) (event sentryEvent) {
+	var id [16]byte
+	rand.Read(id[:])
+	event.EventID = hex.EncodeToString(id[:])
+	event.Timestamp = report.Time.Format(time.RFC3339Nano)
+	event.Platform = "go"
+	event.Level = "error"
+	event.Logger = "webircproxy"
+	event.ServerName, _ = os.Hostname()
+	event.Environment = conf.Environment
+
+	exception := sentryException{Type: "panic", Value: fmt.Sprint(report.Value)}
+	frames := runtime.CallersFrames(report.pcs)
+	for {
+		frame, more := frames.Next()
+		// skip the runtime's panic machinery (gopanic, sigpanic, etc.)
+		// above the frame that panicked:
+		if len(exception.Stacktrace.Frames) == 0 && more && strings.HasPrefix(frame.Function, "runtime.") {
+			continue
+		}
+		exception.Stacktrace.Frames = append(exception.Stacktrace.Frames, sentryFrame{
+			Function: frame.Function,
+			Filename: frame.File,
+			Lineno:   frame.Line,
+		})
+		if !more {
+			break
+		}
+	}
+	// sentry expects the outermost frame first:
+	for i, j := 0, len(exception.Stacktrace.Frames)-1; i < j; i, j = i+1, j-1 {
+		exception.Stacktrace.Frames[i], exception.Stacktrace.Frames[j] = exception.Stacktrace.Frames[j], exception.Stacktrace.Frames[i]
+	}
+	event.Exception.Values = []sentryException{exception}
+
+	event.Extra = make(map[string]string, len(report.Attrs)+1)
+	for _, attr := range report.Attrs {
+		event.Extra[attr.Key] = attr.Value.String()
+	}
+	event.Extra["stack"] = string(report.Stack)
+	return
+}
+
+func sendSentryEvent(conf *PanicReportingConfig, event sentryEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, conf.storeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", conf.authHeader)
+	resp, err := conf.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("sentry returned status %d", resp.StatusCode)
 	}
+	return nil
 }
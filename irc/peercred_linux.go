@@ -0,0 +1,34 @@
+//go:build linux
+
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"net"
+	"syscall"
+)
+
+const peerCredentialsSupported = true
+
+// getPeerCredentials returns the user and group IDs of the process at the
+// other end of a unix socket (as of when it called connect(2) or listen(2))
+func getPeerCredentials(conn *net.UnixConn) (uid, gid int, err error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return
+	}
+	return int(cred.Uid), int(cred.Gid), nil
+}
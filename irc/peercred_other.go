@@ -0,0 +1,18 @@
+//go:build !linux
+
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"net"
+)
+
+// peer credentials are only implemented on Linux (SO_PEERCRED)
+const peerCredentialsSupported = false
+
+func getPeerCredentials(conn *net.UnixConn) (uid, gid int, err error) {
+	return 0, 0, errors.New("peer credentials are not supported on this platform")
+}
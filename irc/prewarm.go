@@ -0,0 +1,325 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Pre-warming: for upstreams with prewarm enabled, we keep a few connections
+// dialed ahead of time (including the TLS handshake), so that a new client
+// can be handed one and its WEBIRC line written immediately; this matters
+// most during reconnect storms, when many clients arrive at once. The pooled
+// connections are unregistered, so they are replaced before the upstream's
+// registration timeout can close them. Each pool belongs to an upstream, so
+// a rehash (which replaces the upstreams) replaces the pools as well.
+
+const (
+	defaultPrewarmMaxIdle = 30 * time.Second
+	// anything the upstream sends before registration (e.g., NOTICEs about
+	// hostname lookups) is kept for the client; this much is unreasonable:
+	prewarmMaxBuffered = 16384
+
+	prewarmMinRetry = time.Second
+	prewarmMaxRetry = time.Minute
+)
+
+var (
+	errPrewarmBufferFull = errors.New("upstream sent too much data before registration")
+)
+
+type upstreamPrewarmConfig struct {
+	// the number of connections to keep ready (0 to disable):
+	Connections int
+	// how long a connection may wait before it is replaced; this should be
+	// less than the upstream's registration timeout:
+	MaxIdle time.Duration `yaml:"max-idle"`
+}
+
+func (conf *upstreamPrewarmConfig) postprocess() error {
+	if conf.Connections < 0 {
+		return fmt.Errorf("prewarm connections must not be negative")
+	}
+	if conf.MaxIdle < 0 {
+		return fmt.Errorf("prewarm max-idle must not be negative")
+	} else if conf.MaxIdle == 0 {
+		conf.MaxIdle = defaultPrewarmMaxIdle
+	}
+	return nil
+}
+
+// pooledConn is a connection waiting in a pool; watch reads from it in the
+// meantime, to notice if the upstream closes it, and to keep what it sent
+type pooledConn struct {
+	net.Conn
+	dialed time.Time
+	// written by watch until done is closed, then by Read:
+	buffered []byte
+	err      error
+	done     chan struct{}
+}
+
+func (pc *pooledConn) watch() {
+	defer close(pc.done)
+	var buf [512]byte
+	for {
+		n, err := pc.Conn.Read(buf[:])
+		pc.buffered = append(pc.buffered, buf[:n]...)
+		if err != nil {
+			pc.err = err
+			return
+		} else if len(pc.buffered) > prewarmMaxBuffered {
+			pc.err = errPrewarmBufferFull
+			return
+		}
+	}
+}
+
+// alive reports whether watch is still waiting for data
+func (pc *pooledConn) alive() bool {
+	select {
+	case <-pc.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// claim stops watch, returning whether the connection is still usable
+func (pc *pooledConn) claim() bool {
+	// interrupt the pending read (this doesn't break TLS connections):
+	pc.Conn.SetReadDeadline(time.Unix(1, 0))
+	<-pc.done
+	pc.Conn.SetReadDeadline(time.Time{})
+	return errors.Is(pc.err, os.ErrDeadlineExceeded)
+}
+
+// Read returns the data received while the connection was pooled first
+func (pc *pooledConn) Read(p []byte) (n int, err error) {
+	if len(pc.buffered) != 0 {
+		n = copy(p, pc.buffered)
+		pc.buffered = pc.buffered[n:]
+		return n, nil
+	}
+	return pc.Conn.Read(p)
+}
+
+// prewarmPool keeps connections to one upstream
+type prewarmPool struct {
+	server *Server
+	// the config (top-level or profile) that the upstream belongs to:
+	config   *Config
+	upstream *reverseProxyUpstream
+	// signaled when a connection is taken or closed by the upstream:
+	wake chan struct{}
+	// closed to stop run:
+	quit chan struct{}
+
+	sync.Mutex // tier 1
+	conns      []*pooledConn
+	closed     bool
+}
+
+func newPrewarmPool(server *Server, config *Config, upstream *reverseProxyUpstream) *prewarmPool {
+	pool := &prewarmPool{
+		server:   server,
+		config:   config,
+		upstream: upstream,
+		wake:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+	}
+	go pool.run()
+	return pool
+}
+
+// run keeps the pool full, replacing connections that are too old or closed
+func (pool *prewarmPool) run() {
+	defer pool.server.HandlePanic(slog.String(logKeyUpstream, pool.upstream.Name))
+
+	settings := pool.upstream.Prewarm
+	var retry time.Duration
+	for {
+		wait := pool.expire()
+		if pool.size() < settings.Connections && !pool.server.drains.isDrained(pool.upstream.Name) {
+			conn, err := dialUpstream(pool.config, pool.upstream, nil, pool.server.upstreamTLSSessions(pool.config, pool.upstream))
+			if err == nil {
+				retry = 0
+				pool.add(conn)
+				continue
+			}
+			if retry == 0 {
+				pool.server.Log(LogComponentProxy, LogLevelWarn, "error pre-warming connection to upstream ircd", slog.String(logKeyUpstream, pool.upstream.Address), errAttr(err))
+				retry = prewarmMinRetry
+			} else {
+				retry = min(2*retry, prewarmMaxRetry)
+			}
+			wait = retry
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-pool.wake:
+		case <-timer.C:
+		case <-pool.quit:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// expire closes the connections that are too old or were closed by the
+// upstream, returning how long until the next one is too old
+func (pool *prewarmPool) expire() (wait time.Duration) {
+	pool.Lock()
+	defer pool.Unlock()
+
+	wait = pool.upstream.Prewarm.MaxIdle
+	kept := pool.conns[:0]
+	for _, pc := range pool.conns {
+		remaining := pool.upstream.Prewarm.MaxIdle - time.Since(pc.dialed)
+		if remaining <= 0 || !pc.alive() {
+			pc.Conn.Close()
+			continue
+		}
+		kept = append(kept, pc)
+		wait = min(wait, remaining)
+	}
+	pool.conns = kept
+	return
+}
+
+func (pool *prewarmPool) size() int {
+	pool.Lock()
+	defer pool.Unlock()
+	return len(pool.conns)
+}
+
+func (pool *prewarmPool) add(conn net.Conn) {
+	pc := &pooledConn{Conn: conn, dialed: time.Now(), done: make(chan struct{})}
+	pool.Lock()
+	defer pool.Unlock()
+	if pool.closed {
+		conn.Close()
+		return
+	}
+	go func() {
+		pc.watch()
+		// if the upstream closed it, replace it:
+		pool.signal()
+	}()
+	pool.conns = append(pool.conns, pc)
+}
+
+// signal wakes run, to refill the pool
+func (pool *prewarmPool) signal() {
+	select {
+	case pool.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take returns a pooled connection, or nil if none is ready
+func (pool *prewarmPool) take() net.Conn {
+	for {
+		pool.Lock()
+		if len(pool.conns) == 0 {
+			pool.Unlock()
+			return nil
+		}
+		// the oldest first, before it expires:
+		pc := pool.conns[0]
+		pool.conns = pool.conns[1:]
+		pool.Unlock()
+
+		pool.signal()
+		if time.Since(pc.dialed) < pool.upstream.Prewarm.MaxIdle && pc.claim() {
+			return pc
+		}
+		pc.Conn.Close()
+	}
+}
+
+func (pool *prewarmPool) close() {
+	pool.Lock()
+	defer pool.Unlock()
+	if pool.closed {
+		return
+	}
+	pool.closed = true
+	close(pool.quit)
+	for _, pc := range pool.conns {
+		pc.Conn.Close()
+	}
+	pool.conns = nil
+}
+
+// prewarmPools holds the pools of the upstreams with prewarm enabled
+type prewarmPools struct {
+	sync.Mutex // tier 2
+	pools      map[*reverseProxyUpstream]*prewarmPool
+	stopped    bool
+}
+
+// update creates and removes pools to match the current upstreams (those of
+// the config, with the runtime changes applied)
+func (pp *prewarmPools) update(server *Server) {
+	config := server.Config()
+	overlay := server.runtimeUpstreams.get()
+	wanted := make(map[*reverseProxyUpstream]*Config)
+	for _, c := range config.allConfigs() {
+		for _, upstream := range overlay.upstreams(c) {
+			if upstream.Prewarm.Connections != 0 {
+				wanted[upstream] = c
+			}
+		}
+	}
+
+	pp.Lock()
+	defer pp.Unlock()
+	if pp.stopped {
+		return
+	}
+	for upstream, pool := range pp.pools {
+		if _, ok := wanted[upstream]; !ok {
+			pool.close()
+			delete(pp.pools, upstream)
+		}
+	}
+	for upstream, c := range wanted {
+		if pp.pools == nil {
+			pp.pools = make(map[*reverseProxyUpstream]*prewarmPool)
+		}
+		if pp.pools[upstream] == nil {
+			pp.pools[upstream] = newPrewarmPool(server, c, upstream)
+		}
+	}
+}
+
+// take returns a pooled connection to the upstream, or nil if none is ready
+func (pp *prewarmPools) take(upstream *reverseProxyUpstream) net.Conn {
+	pp.Lock()
+	pool := pp.pools[upstream]
+	pp.Unlock()
+	if pool == nil {
+		return nil
+	}
+	return pool.take()
+}
+
+// stop closes all the pools, permanently
+func (pp *prewarmPools) stop() {
+	pp.Lock()
+	defer pp.Unlock()
+	pp.stopped = true
+	for upstream, pool := range pp.pools {
+		pool.close()
+		delete(pp.pools, upstream)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPooledConn(t *testing.T) {
+	client, upstream := net.Pipe()
+	defer upstream.Close()
+	pc := &pooledConn{Conn: client, dialed: time.Now(), done: make(chan struct{})}
+	go pc.watch()
+
+	// what the upstream sends while the connection waits is kept:
+	notice, welcome := "NOTICE * :*** Looking up your hostname\r\n", ":irc.example.com 001 alice :Welcome\r\n"
+	if _, err := io.WriteString(upstream, notice); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(pc.alive(), true)
+	assertEqual(pc.claim(), true)
+	go io.WriteString(upstream, welcome)
+	received := make([]byte, len(notice)+len(welcome))
+	if _, err := io.ReadFull(pc, received); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(string(received), notice+welcome)
+
+	client, upstream = net.Pipe()
+	pc = &pooledConn{Conn: client, dialed: time.Now(), done: make(chan struct{})}
+	go pc.watch()
+	upstream.Close()
+	<-pc.done
+	assertEqual(pc.alive(), false)
+	assertEqual(pc.claim(), false)
+}
+
+func TestPrewarmValidation(t *testing.T) {
+	_, err := NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667", UpstreamPrewarm(-1)))
+	assertEqual(err != nil, true)
+	_, err = NewConfig(WithGatewayName("webircproxy"), WithYAML("upstreams:\n    - {address: \"127.0.0.1:6667\", send-proxy: true, prewarm: {connections: 2}}"))
+	assertEqual(err != nil, true)
+}
+
+func TestPrewarmEndToEnd(t *testing.T) {
+	mock := startMockIRCd(t, "hunter2")
+	listen := freeAddress(t)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithListener(listen),
+		WithUpstream(mock.Addr(), UpstreamWebirc("hunter2"), UpstreamPrewarm(2)),
+		WithYAML("log-level: error\nlookup-hostnames: false"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.RunContext(ctx)
+
+	upstream := server.Config().findUpstream(mock.Addr())
+	poolSize := func() int {
+		server.prewarm.Lock()
+		pool := server.prewarm.pools[upstream]
+		server.prewarm.Unlock()
+		if pool == nil {
+			return 0
+		}
+		return pool.size()
+	}
+	waitForPool := func() {
+		for deadline := time.Now().Add(5 * time.Second); poolSize() != 2; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("the pool has %d connections, instead of 2", poolSize())
+			}
+		}
+	}
+	waitForPool()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+listen+"/webirc", http.Header{"Origin": []string{"https://example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, line := range []string{"NICK alice", "USER u 0 * :Alice"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(string(message), ":mock.ircd 001 alice :Welcome to the mock IRC network alice!u@127.0.0.1")
+	assertEqual(len(mock.Webircs()), 1)
+	// the connection that was taken is replaced:
+	waitForPool()
+
+	// the pools of unchanged upstreams are kept:
+	server.prewarm.update(server)
+	assertEqual(poolSize(), 2)
+	server.RemoveUpstream(mock.Addr(), false)
+	assertEqual(poolSize(), 0)
+}
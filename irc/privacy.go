@@ -0,0 +1,180 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"strings"
+)
+
+const (
+	privacyModeNone     = ""
+	privacyModeTruncate = "truncate"
+	privacyModeHash     = "hash"
+)
+
+var (
+	// IPv4 and IPv6 addresses (possibly in brackets) embedded in error messages, e.g.
+	// "write tcp 192.0.2.1:8067->[2001:db8::1]:41234: broken pipe"
+	embeddedIPRegexp = regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}\b|\[?[0-9a-fA-F]{0,4}(:[0-9a-fA-F]{0,4}){2,7}\]?`)
+)
+
+// LogPrivacyConfig controls scrubbing of client IPs from the logs and the
+// audit log. It doesn't affect the IPs sent to the upstream in WEBIRC.
+type LogPrivacyConfig struct {
+	// "truncate" to zero out the low bits of client IPs, or "hash" to replace
+	// them with a keyed hash (which still allows correlating log lines):
+	Mode string
+	// for truncate:
+	IPv4Prefix int `yaml:"ipv4-prefix"`
+	IPv6Prefix int `yaml:"ipv6-prefix"`
+	// for hash:
+	Secret string
+
+	mode string
+}
+
+func (conf *LogPrivacyConfig) postprocess() error {
+	conf.mode = strings.ToLower(conf.Mode)
+	switch conf.mode {
+	case privacyModeNone:
+	case privacyModeTruncate:
+		if conf.IPv4Prefix <= 0 || conf.IPv4Prefix > 32 {
+			conf.IPv4Prefix = 24
+		}
+		if conf.IPv6Prefix <= 0 || conf.IPv6Prefix > 128 {
+			conf.IPv6Prefix = 48
+		}
+	case privacyModeHash:
+		if conf.Secret == "" {
+			return fmt.Errorf("log-privacy mode hash requires a secret")
+		}
+	default:
+		return fmt.Errorf("invalid log-privacy mode: %s", conf.Mode)
+	}
+	return nil
+}
+
+func (conf *LogPrivacyConfig) enabled() bool {
+	return conf.mode != privacyModeNone
+}
+
+// ScrubIP returns the log representation of a client IP
+func (conf *LogPrivacyConfig) ScrubIP(ipStr string) string {
+	if !conf.enabled() || ipStr == "" {
+		return ipStr
+	}
+	ip := net.ParseIP(strings.Trim(ipStr, "[]"))
+	if ip == nil {
+		return ipStr
+	}
+	switch conf.mode {
+	case privacyModeTruncate:
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(conf.IPv4Prefix, 32)).String() + fmt.Sprintf("/%d", conf.IPv4Prefix)
+		}
+		return ip.Mask(net.CIDRMask(conf.IPv6Prefix, 128)).String() + fmt.Sprintf("/%d", conf.IPv6Prefix)
+	default:
+		mac := hmac.New(sha256.New, []byte(conf.Secret))
+		mac.Write([]byte(ip.String()))
+		return "ip-" + hex.EncodeToString(mac.Sum(nil))[:16]
+	}
+}
+
+// scrubText scrubs any IPs embedded in free text (e.g., error messages)
+func (conf *LogPrivacyConfig) scrubText(text string) string {
+	if !conf.enabled() {
+		return text
+	}
+	return embeddedIPRegexp.ReplaceAllStringFunc(text, func(match string) string {
+		if net.ParseIP(strings.Trim(match, "[]")) == nil {
+			return match
+		}
+		return conf.ScrubIP(match)
+	})
+}
+
+func (conf *LogPrivacyConfig) scrubAttr(attr slog.Attr) slog.Attr {
+	attr.Value = attr.Value.Resolve()
+	switch attr.Value.Kind() {
+	case slog.KindGroup:
+		group := attr.Value.Group()
+		scrubbed := make([]slog.Attr, len(group))
+		for i, groupAttr := range group {
+			scrubbed[i] = conf.scrubAttr(groupAttr)
+		}
+		return slog.Attr{Key: attr.Key, Value: slog.GroupValue(scrubbed...)}
+	case slog.KindString:
+		switch attr.Key {
+		case logKeyRemoteIP:
+			return slog.String(attr.Key, conf.ScrubIP(attr.Value.String()))
+		case logKeyError:
+			return slog.String(attr.Key, conf.scrubText(attr.Value.String()))
+		}
+	}
+	return attr
+}
+
+// scrubbingLogHandler scrubs client IPs from log records before passing them on
+type scrubbingLogHandler struct {
+	inner slog.Handler
+	conf  *LogPrivacyConfig
+}
+
+func (h *scrubbingLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *scrubbingLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	// client IPs only appear in structured fields, not in messages:
+	scrubbed := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		scrubbed.AddAttrs(h.conf.scrubAttr(attr))
+		return true
+	})
+	return h.inner.Handle(ctx, scrubbed)
+}
+
+func (h *scrubbingLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	scrubbed := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		scrubbed[i] = h.conf.scrubAttr(attr)
+	}
+	return &scrubbingLogHandler{inner: h.inner.WithAttrs(scrubbed), conf: h.conf}
+}
+
+func (h *scrubbingLogHandler) WithGroup(name string) slog.Handler {
+	return &scrubbingLogHandler{inner: h.inner.WithGroup(name), conf: h.conf}
+}
+
+// wrapLogHandler applies log-privacy to a handler
+func (config *Config) wrapLogHandler(handler slog.Handler) slog.Handler {
+	if !config.LogPrivacy.enabled() {
+		return handler
+	}
+	return &scrubbingLogHandler{inner: handler, conf: &config.LogPrivacy}
+}
+
+// writeAudit writes a record to the audit log, applying log-privacy
+func (server *Server) writeAudit(record *auditRecord) {
+	record.scrub(&server.Config().LogPrivacy)
+	server.audit.write(record)
+}
+
+// scrub applies log-privacy to an audit record
+func (record *auditRecord) scrub(conf *LogPrivacyConfig) {
+	if !conf.enabled() {
+		return
+	}
+	record.RealIP = conf.ScrubIP(record.RealIP)
+	record.ProxiedIP = conf.ScrubIP(record.ProxiedIP)
+	record.Error = conf.scrubText(record.Error)
+}
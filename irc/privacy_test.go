@@ -0,0 +1,58 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestScrubIP(t *testing.T) {
+	conf := LogPrivacyConfig{Mode: "truncate"}
+	if err := conf.postprocess(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(conf.ScrubIP("192.0.2.77"), "192.0.2.0/24")
+	assertEqual(conf.ScrubIP("2001:db8:1:2:3:4:5:6"), "2001:db8:1::/48")
+	assertEqual(conf.ScrubIP("not an ip"), "not an ip")
+	assertEqual(conf.scrubText("write tcp 192.0.2.1:8067->[2001:db8:1:2::9]:41234 at 18:54:52: broken pipe"),
+		"write tcp 192.0.2.0/24:8067->2001:db8:1::/48:41234 at 18:54:52: broken pipe")
+
+	conf = LogPrivacyConfig{Mode: "hash"}
+	if conf.postprocess() == nil {
+		t.Errorf("hash mode requires a secret")
+	}
+	conf.Secret = "hunter2"
+	if err := conf.postprocess(); err != nil {
+		t.Fatal(err)
+	}
+	hashed := conf.ScrubIP("192.0.2.77")
+	assertEqual(strings.HasPrefix(hashed, "ip-"), true)
+	assertEqual(conf.ScrubIP("192.0.2.77"), hashed)
+	if conf.ScrubIP("192.0.2.78") == hashed {
+		t.Errorf("different IPs should hash differently")
+	}
+
+	conf = LogPrivacyConfig{}
+	conf.postprocess()
+	assertEqual(conf.ScrubIP("192.0.2.77"), "192.0.2.77")
+}
+
+func TestScrubbingLogHandler(t *testing.T) {
+	config := Config{LogPrivacy: LogPrivacyConfig{Mode: "truncate"}}
+	config.LogPrivacy.postprocess()
+	var buf bytes.Buffer
+	var mutex sync.Mutex
+	logger := slog.New(config.wrapLogHandler(newTextLogHandler(&buf, &mutex)))
+	logger.With(slog.String(logKeyRemoteIP, "192.0.2.1")).LogAttrs(context.Background(), slog.LevelInfo, "received connection",
+		slog.String(logKeyUpstream, "192.0.2.100:6667"))
+	line := buf.String()
+	if !strings.Contains(line, "remote_ip=192.0.2.0/24 upstream=192.0.2.100:6667") {
+		t.Errorf("unexpected log line: %s", line)
+	}
+}
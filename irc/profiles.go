@@ -0,0 +1,180 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Profiles are independent proxies served by one process (e.g., a hosting
+// provider serving several small networks), each with its own listeners,
+// upstreams, and per-connection settings. A profile's config is the top-level
+// config with the profile's settings overlaid on it; process-wide settings
+// (logging, the admin API, metrics, etc.) can only be set at the top level.
+
+// these are the config keys that can be set in a profile:
+var profileSettings = map[string]bool{
+	"listeners":                 true,
+	"upstreams":                 true,
+	"gateway-name":              true,
+	"welcome-notice":            true,
+	"require-secure":            true,
+	"allowed-origins":           true,
+	"origin-policies":           true,
+	"origin-routes":             true,
+	"allow-missing-origin":      true,
+	"allow-same-origin":         true,
+	"opaque-origins":            true,
+	"proxy-allowed-from":        true,
+	"early-data":                true,
+	"header-rules":              true,
+	"tls-fingerprints":          true,
+	"reputation":                true,
+	"bandwidth-quotas":          true,
+	"downstream-pacing":         true,
+	"ip-cloaking":               true,
+	"lookup-hostnames":          true,
+	"forward-confirm-hostnames": true,
+	"hostname-lookup-timeout":   true,
+	"ident":                     true,
+	"tor":                       true,
+	"local-ping":                true,
+	"sticky-sessions":           true,
+	"reconnect-grace":           true,
+	"multiplexing":              true,
+	"account-header":            true,
+	"transcoding":               true,
+	"max-line-len":              true,
+	"dial-timeout":              true,
+	"upstream-dial-attempts":    true,
+	"registration-timeout":      true,
+	"connection-lifetime":       true,
+	"idle-timeout":              true,
+}
+
+// prepareProfiles builds and postprocesses the config of each profile;
+// it must be called before config itself is postprocessed.
+func (config *Config) prepareProfiles() error {
+	if len(config.Profiles) == 0 {
+		return nil
+	}
+	// round-trip the top-level config through YAML to get a deep copy of it
+	// for each profile to start from:
+	base := *config
+	base.Profiles = nil
+	base.Listeners = nil
+	base.GeoIP = GeoIPConfig{}
+	baseYAML, err := yaml.Marshal(&base)
+	if err != nil {
+		return err
+	}
+
+	config.profiles = make(map[string]*Config, len(config.Profiles))
+	for name, settings := range config.Profiles {
+		if name == "" || strings.ContainsAny(name, "/ ") {
+			return fmt.Errorf("invalid profile name %#v: it must be nonempty, with no slashes or spaces", name)
+		}
+		if listeners, _ := settings["listeners"].(map[interface{}]interface{}); len(listeners) == 0 {
+			return fmt.Errorf("profile %s has no listeners", name)
+		}
+		for key := range settings {
+			if !profileSettings[key] {
+				return fmt.Errorf("profile %s: %s cannot be set per-profile", name, key)
+			}
+		}
+		settingsYAML, err := yaml.Marshal(settings)
+		if err != nil {
+			return err
+		}
+		profile := new(Config)
+		if err := yaml.Unmarshal(baseYAML, profile); err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(settingsYAML, profile); err != nil {
+			return fmt.Errorf("profile %s: %w", name, err)
+		}
+		profile.Filename = config.Filename
+		profile.profileName = name
+		profile.isolateListenerErrors = config.isolateListenerErrors
+		profile, err = postprocessConfig(profile)
+		if err != nil {
+			return fmt.Errorf("profile %s: %w", name, err)
+		}
+		for _, warning := range profile.warnings {
+			config.warnings = append(config.warnings, fmt.Sprintf("profile %s: %s", name, warning))
+		}
+		// keep upstream names and rate limits from colliding across profiles
+		// (origin policies have already resolved their upstreams by name):
+		for i := range profile.Upstreams {
+			profile.Upstreams[i].Name = name + "/" + profile.Upstreams[i].Name
+		}
+		for _, policy := range profile.originPolicies {
+			policy.key = name + "/" + policy.key
+		}
+		config.profiles[name] = profile
+	}
+	return nil
+}
+
+// forListener returns the config that applies to connections on
+// the listener: that of its profile, if it belongs to one
+func (config *Config) forListener(addr string) *Config {
+	if profile := config.trueListeners[addr].profile; profile != "" {
+		return config.profiles[profile]
+	}
+	return config
+}
+
+// hasOwnListeners returns false if all the listeners belong to profiles,
+// in which case the top-level upstreams are only defaults for the profiles
+func (config *Config) hasOwnListeners() bool {
+	return len(config.Listeners) != 0 || len(config.profiles) == 0
+}
+
+// allConfigs returns the configs that have listeners: the top-level
+// config (unless all listeners are in profiles) and each profile's
+func (config *Config) allConfigs() (result []*Config) {
+	if config.hasOwnListeners() {
+		result = append(result, config)
+	}
+	names := make([]string, 0, len(config.profiles))
+	for name := range config.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		result = append(result, config.profiles[name])
+	}
+	return
+}
+
+// allUpstreams returns the upstreams of every profile
+func (config *Config) allUpstreams() (result []*reverseProxyUpstream) {
+	for _, c := range config.allConfigs() {
+		for i := range c.Upstreams {
+			result = append(result, &c.Upstreams[i])
+		}
+	}
+	return
+}
+
+// findUpstream finds an upstream from any profile by its name, or
+// a top-level upstream by its address
+func (config *Config) findUpstream(name string) *reverseProxyUpstream {
+	if config.hasOwnListeners() {
+		if upstream := config.getUpstream(name); upstream != nil {
+			return upstream
+		}
+	}
+	for _, upstream := range config.allUpstreams() {
+		if upstream.Name == name {
+			return upstream
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const profilesConfig = `
+gateway-name: "gateway.example.com"
+registration-timeout: 30s
+listeners:
+    "127.0.0.1:8067":
+upstreams:
+    -
+        name: "main"
+        address: "127.0.0.1:6667"
+profiles:
+    network1:
+        gateway-name: "webchat.network1.example"
+        listeners:
+            "127.0.0.1:8068":
+        upstreams:
+            -
+                name: "irc"
+                address: "irc.network1.example:6697"
+                tls: true
+        origin-policies:
+            -
+                origins: ["https://network1.example"]
+                upstreams: ["irc"]
+        transcoding:
+            encodings: ["windows-1252"]
+    network2:
+        listeners:
+            "127.0.0.1:8069":
+`
+
+func loadTestConfig(t *testing.T, data string) (*Config, error) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadConfig(filename)
+}
+
+func TestProfiles(t *testing.T) {
+	config, err := loadTestConfig(t, profilesConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(len(config.trueListeners), 3)
+	assertEqual(config.forListener("127.0.0.1:8067"), config)
+
+	network1 := config.forListener("127.0.0.1:8068")
+	assertEqual(network1.GatewayName, "webchat.network1.example")
+	assertEqual(len(network1.Upstreams), 1)
+	assertEqual(network1.Upstreams[0].Name, "network1/irc")
+	assertEqual(network1.originPolicies[0].upstreams[0], &network1.Upstreams[0])
+	assertEqual(len(network1.Transcoding.encodings), 1)
+	assertEqual(len(config.Transcoding.encodings), 0)
+	// inherited from the top level:
+	assertEqual(network1.RegistrationTimeout, 30*time.Second)
+
+	network2 := config.forListener("127.0.0.1:8069")
+	assertEqual(network2.GatewayName, "gateway.example.com")
+	assertEqual(network2.Upstreams[0].Name, "network2/main")
+	assertEqual(network2.Upstreams[0].Address, "127.0.0.1:6667")
+
+	var names []string
+	for _, upstream := range config.allUpstreams() {
+		names = append(names, upstream.Name)
+	}
+	assertEqual(names, []string{"main", "network1/irc", "network2/main"})
+	assertEqual(config.findUpstream("network1/irc"), &network1.Upstreams[0])
+	assertEqual(config.findUpstream("main"), &config.Upstreams[0])
+}
+
+func TestProfileErrors(t *testing.T) {
+	for _, profile := range []string{
+		// process-wide settings can't be set per-profile:
+		"        listeners:\n            \"127.0.0.1:8068\":\n        log-level: debug\n",
+		// a listener can't be in two profiles:
+		"        listeners:\n            \"127.0.0.1:8067\":\n",
+		"        upstreams: []\n",
+	} {
+		_, err := loadTestConfig(t, strings.Replace(profilesConfig, "    network2:\n        listeners:\n            \"127.0.0.1:8069\":\n", "    network2:\n"+profile, 1))
+		if err == nil {
+			t.Errorf("config should be rejected:\n%s", profile)
+		}
+	}
+}
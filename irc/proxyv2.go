@@ -0,0 +1,99 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+)
+
+// With send-proxy, connections to an upstream begin with a PROXY protocol v2
+// header (before any TLS handshake), carrying the client's IP, plus TLVs
+// describing the websocket connection, in the range that the spec reserves
+// for custom types:
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+
+const (
+	proxyV2VersionCommand = 0x21 // version 2, PROXY command
+	proxyV2FamilyTCP4     = 0x11
+	proxyV2FamilyTCP6     = 0x21
+
+	// standard TLV: a unique ID for the connection (ours):
+	proxyV2TypeUniqueID = 0x05
+	// custom TLVs:
+	proxyV2TypeGatewayName = 0xE0
+	proxyV2TypeOrigin      = 0xE1
+	proxyV2TypeTLSVersion  = 0xE2
+	proxyV2TypeSubprotocol = 0xE3
+
+	// "The receiver may reject an incoming PROXY protocol v2 header if its
+	// unique ID exceeds 128 bytes":
+	proxyV2MaxUniqueIDLen = 128
+	// values are truncated to this length, to bound the header:
+	proxyV2MaxValueLen = 1024
+)
+
+// proxyHeaderInfo is the information sent in the PROXY header
+type proxyHeaderInfo struct {
+	// the client's IP, as it is sent in WEBIRC:
+	srcIP   net.IP
+	dstPort int
+	// for the TLVs:
+	connID      string
+	gatewayName string
+	origin      string
+	tlsVersion  uint16
+	subprotocol string
+}
+
+// makeProxyV2Header serializes a PROXY v2 header. The client's port is
+// unknown (the connection may have come via another reverse proxy) and
+// sent as 0, as is the destination IP.
+func makeProxyV2Header(info *proxyHeaderInfo) []byte {
+	var family byte
+	var srcIP, dstIP net.IP
+	if ip4 := info.srcIP.To4(); ip4 != nil {
+		family, srcIP, dstIP = proxyV2FamilyTCP4, ip4, net.IPv4zero.To4()
+	} else {
+		family, srcIP, dstIP = proxyV2FamilyTCP6, info.srcIP.To16(), net.IPv6zero
+	}
+
+	var body []byte
+	body = append(body, srcIP...)
+	body = append(body, dstIP...)
+	body = binary.BigEndian.AppendUint16(body, 0)
+	body = binary.BigEndian.AppendUint16(body, uint16(info.dstPort))
+	body = appendProxyV2TLV(body, proxyV2TypeUniqueID, truncateBytes(info.connID, proxyV2MaxUniqueIDLen))
+	body = appendProxyV2TLV(body, proxyV2TypeGatewayName, info.gatewayName)
+	body = appendProxyV2TLV(body, proxyV2TypeOrigin, info.origin)
+	if info.tlsVersion != 0 {
+		body = appendProxyV2TLV(body, proxyV2TypeTLSVersion, tls.VersionName(info.tlsVersion))
+	}
+	body = appendProxyV2TLV(body, proxyV2TypeSubprotocol, info.subprotocol)
+
+	header := make([]byte, 0, len(proxyV2Signature)+4+len(body))
+	header = append(header, proxyV2Signature...)
+	header = append(header, proxyV2VersionCommand, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	return append(header, body...)
+}
+
+// appendProxyV2TLV appends a TLV, unless the value is empty
+func appendProxyV2TLV(buf []byte, tlvType byte, value string) []byte {
+	if value == "" {
+		return buf
+	}
+	value = truncateBytes(value, proxyV2MaxValueLen)
+	buf = append(buf, tlvType)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(value)))
+	return append(buf, value...)
+}
+
+func truncateBytes(s string, maxLen int) string {
+	if len(s) > maxLen {
+		return s[:maxLen]
+	}
+	return s
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ergochat/ergo/irc/utils"
+	"github.com/gorilla/websocket"
+)
+
+func TestMakeProxyV2Header(t *testing.T) {
+	header := makeProxyV2Header(&proxyHeaderInfo{
+		srcIP:       net.ParseIP("192.0.2.1"),
+		dstPort:     443,
+		connID:      "a1",
+		gatewayName: "webircproxy.example.com",
+		origin:      "https://chat.example.com",
+		tlsVersion:  tls.VersionTLS13,
+		subprotocol: "text.ircv3.net",
+	})
+	ip, err := utils.ParseProxyLine(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(ip.String(), "192.0.2.1")
+	assertEqual(header[13], byte(proxyV2FamilyTCP4))
+	// the ports follow the addresses, then the TLVs:
+	assertEqual(header[26:28], []byte{0x01, 0xbb})
+	assertEqual(string(header[28:33]), "\x05\x00\x02a1")
+	assertEqual(string(header[len(header)-17:]), "\xe3\x00\x0etext.ircv3.net")
+
+	header = makeProxyV2Header(&proxyHeaderInfo{srcIP: net.ParseIP("2001:db8::1")})
+	ip, err = utils.ParseProxyLine(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(ip.String(), "2001:db8::1")
+	// no TLVs:
+	assertEqual(len(header), 16+36)
+}
+
+// TestProxyV2TLSVersion connects to a TLS listener, whose TLS version
+// must reach a send-proxy upstream in the PROXY header
+func TestProxyV2TLSVersion(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	headers := make(chan []byte, 1)
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			headers <- nil
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			headers <- nil
+			return
+		}
+		headers <- append(header, body...)
+	}()
+
+	certPEM, keyPEM := testCertPEM(t)
+	listen := freeAddress(t)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithListener(listen, ListenerTLS(certPEM, keyPEM), ListenerMinTLSVersion("1.3")),
+		WithYAML(`
+log-level: error
+lookup-hostnames: false
+upstreams:
+    - {address: "`+upstream.Addr().String()+`", send-proxy: true}
+`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.RunContext(ctx)
+
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	conn, _, err := dialer.Dial("wss://"+listen+"/webirc", http.Header{"Origin": []string{"https://example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, line := range []string{"NICK alice", "USER u 0 * :Alice"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case header := <-headers:
+		if _, err := utils.ParseProxyLine(header); err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(bytes.Contains(header, []byte("\xe2\x00\x07TLS 1.3")), true)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upstream received no PROXY header")
+	}
+}
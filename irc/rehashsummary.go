@@ -0,0 +1,131 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// RehashSummary describes what a rehash changed, so that operators can check
+// that it did what they expected. It is logged, and returned by the admin
+// API's POST /rehash.
+type RehashSummary struct {
+	ListenersAdded   []string `json:"listeners_added,omitempty"`
+	ListenersRemoved []string `json:"listeners_removed,omitempty"`
+	// listeners that were still configured, and were reloaded in place (or,
+	// if that was impossible, e.g. because ipv6-only changed, restarted):
+	ListenersReloaded  []string `json:"listeners_reloaded,omitempty"`
+	ListenersRestarted []string `json:"listeners_restarted,omitempty"`
+	// listeners whose blocks couldn't be loaded (e.g., because of a bad
+	// certificate; those that were already running keep their previous
+	// settings), or that couldn't be bound, with the errors:
+	ListenersFailed map[string]string `json:"listeners_failed,omitempty"`
+	// by name (including those of profiles, e.g., "profile/name"):
+	UpstreamsAdded   []string `json:"upstreams_added,omitempty"`
+	UpstreamsRemoved []string `json:"upstreams_removed,omitempty"`
+	UpstreamsChanged []string `json:"upstreams_changed,omitempty"`
+	// other top-level config keys whose values changed (e.g., "transcoding",
+	// or "profiles" if the settings of any profile changed):
+	SettingsChanged []string `json:"settings_changed,omitempty"`
+	// with lenient, the config problems that were skipped:
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// diffConfigs fills in the upstream and settings changes between two
+// configs; the listener changes are recorded as they are applied
+func (summary *RehashSummary) diffConfigs(oldConfig, newConfig *Config) {
+	oldUpstreams := upstreamSettings(oldConfig)
+	newUpstreams := upstreamSettings(newConfig)
+	for name, settings := range newUpstreams {
+		if oldSettings, ok := oldUpstreams[name]; !ok {
+			summary.UpstreamsAdded = append(summary.UpstreamsAdded, name)
+		} else if oldSettings != settings {
+			summary.UpstreamsChanged = append(summary.UpstreamsChanged, name)
+		}
+	}
+	for name := range oldUpstreams {
+		if _, ok := newUpstreams[name]; !ok {
+			summary.UpstreamsRemoved = append(summary.UpstreamsRemoved, name)
+		}
+	}
+
+	oldSettings, newSettings := configSettings(oldConfig), configSettings(newConfig)
+	for key, value := range newSettings {
+		if !reflect.DeepEqual(oldSettings[key], value) {
+			summary.SettingsChanged = append(summary.SettingsChanged, key)
+		}
+	}
+	for key := range oldSettings {
+		if _, ok := newSettings[key]; !ok {
+			summary.SettingsChanged = append(summary.SettingsChanged, key)
+		}
+	}
+}
+
+// upstreamSettings returns the YAML serialization of each upstream, by name
+func upstreamSettings(config *Config) map[string]string {
+	result := make(map[string]string)
+	for _, upstream := range config.allUpstreams() {
+		settings, err := yaml.Marshal(upstream)
+		if err != nil {
+			continue
+		}
+		result[upstream.Name] = string(settings)
+	}
+	return result
+}
+
+// configSettings returns the top-level config keys and their values, except
+// for the listeners and upstreams, whose changes are reported individually
+func configSettings(config *Config) (result map[string]interface{}) {
+	serialized, err := yaml.Marshal(config)
+	if err == nil {
+		err = yaml.Unmarshal(serialized, &result)
+	}
+	if err != nil {
+		return nil
+	}
+	delete(result, "listeners")
+	delete(result, "upstreams")
+	return
+}
+
+// sort puts each list in a deterministic order
+func (summary *RehashSummary) sort() {
+	for _, list := range []*[]string{
+		&summary.ListenersAdded, &summary.ListenersRemoved, &summary.ListenersReloaded, &summary.ListenersRestarted,
+		&summary.UpstreamsAdded, &summary.UpstreamsRemoved, &summary.UpstreamsChanged, &summary.SettingsChanged,
+	} {
+		sort.Strings(*list)
+	}
+}
+
+// logAttrs returns the nonempty parts of the summary, for logging
+func (summary *RehashSummary) logAttrs() (attrs []slog.Attr) {
+	add := func(key string, list []string) {
+		if len(list) != 0 {
+			attrs = append(attrs, slog.String(key, strings.Join(list, ",")))
+		}
+	}
+	add("listeners_added", summary.ListenersAdded)
+	add("listeners_removed", summary.ListenersRemoved)
+	add("listeners_reloaded", summary.ListenersReloaded)
+	add("listeners_restarted", summary.ListenersRestarted)
+	failed := make([]string, 0, len(summary.ListenersFailed))
+	for addr := range summary.ListenersFailed {
+		failed = append(failed, addr)
+	}
+	sort.Strings(failed)
+	add("listeners_failed", failed)
+	add("upstreams_added", summary.UpstreamsAdded)
+	add("upstreams_removed", summary.UpstreamsRemoved)
+	add("upstreams_changed", summary.UpstreamsChanged)
+	add("settings_changed", summary.SettingsChanged)
+	return
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiffConfigs(t *testing.T) {
+	oldConfig, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithUpstream("127.0.0.1:6667", UpstreamName("irc1")),
+		WithUpstream("127.0.0.1:6668", UpstreamName("irc2")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newConfig, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithUpstream("127.0.0.1:6667", UpstreamName("irc1"), UpstreamWeight(2)),
+		WithUpstream("127.0.0.1:6669", UpstreamName("irc3")),
+		WithEncodings("ISO-8859-1"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary RehashSummary
+	summary.diffConfigs(oldConfig, newConfig)
+	summary.sort()
+	assertEqual(summary.UpstreamsAdded, []string{"irc3"})
+	assertEqual(summary.UpstreamsRemoved, []string{"irc2"})
+	assertEqual(summary.UpstreamsChanged, []string{"irc1"})
+	assertEqual(summary.SettingsChanged, []string{"transcoding"})
+
+	summary = RehashSummary{}
+	summary.diffConfigs(newConfig, newConfig)
+	assertEqual(summary, RehashSummary{})
+}
+
+func TestRehashSummary(t *testing.T) {
+	first, second := freeAddress(t), freeAddress(t)
+	filename := filepath.Join(t.TempDir(), "webircproxy.yaml")
+	writeConfig := func(listener string) {
+		data := fmt.Sprintf("gateway-name: webircproxy\nlog-level: error\nlisteners:\n    %q: {}\nupstreams:\n    - address: \"127.0.0.1:6667\"\n", listener)
+		if err := os.WriteFile(filename, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(first)
+	config, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	summary, err := server.rehash()
+	assertEqual(err, nil)
+	assertEqual(summary, &RehashSummary{ListenersReloaded: []string{first}})
+
+	writeConfig(second)
+	summary, err = server.rehash()
+	assertEqual(err, nil)
+	assertEqual(summary.ListenersAdded, []string{second})
+	assertEqual(summary.ListenersRemoved, []string{first})
+}
+
+func TestRehashListenerLoadFailure(t *testing.T) {
+	first, second, third := freeAddress(t), freeAddress(t), freeAddress(t)
+	filename := filepath.Join(t.TempDir(), "webircproxy.yaml")
+	writeConfig := func(data string) {
+		if err := os.WriteFile(filename, []byte("gateway-name: webircproxy\nlog-level: error\n"+data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(fmt.Sprintf("listeners:\n    %q: {}\n    %q: {}\nupstreams:\n    - address: \"127.0.0.1:6667\"\n", first, second))
+	config, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// a bad certificate for a running listener and for a new one:
+	badTLS := "{tls: {cert: /nonexistent/fullchain.pem, key: /nonexistent/privkey.pem}}"
+	writeConfig(fmt.Sprintf("listeners:\n    %q: %s\n    %q: {}\n    %q: %s\nupstreams:\n    - address: \"127.0.0.1:6668\"\n", first, badTLS, second, third, badTLS))
+	// the file can't be loaded at startup:
+	if _, err := LoadConfig(filename); err == nil {
+		t.Fatal("a bad certificate should fail to load")
+	}
+
+	summary, err := server.rehash()
+	if err == nil {
+		t.Fatal("the rehash should report the failed listeners")
+	}
+	assertEqual(len(summary.ListenersFailed), 2)
+	assertEqual(summary.ListenersReloaded, []string{second})
+	assertEqual(len(summary.UpstreamsChanged), 0)
+	assertEqual(summary.UpstreamsAdded, []string{"127.0.0.1:6668"})
+	// the rest of the config was applied:
+	assertEqual(server.Config().Upstreams[0].Address, "127.0.0.1:6668")
+	// the running listener kept its previous (plaintext) settings:
+	assertEqual(server.listeners[first] != nil, true)
+	assertEqual(server.Config().trueListeners[first].TLSConfig == nil, true)
+	// while the new one is reported as not listening:
+	assertEqual(server.listeners[third] == nil, true)
+	assertEqual(len(server.listenerErrors), 1)
+	assertEqual(server.listenerErrors[third] != nil, true)
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ReputationConfig configures an external reputation (anti-abuse scoring) service.
+// For each incoming connection, webircproxy POSTs a JSON-encoded ConnectionMetadata
+// to the URL, and expects a JSON response of the form {"score": 42}.
+type ReputationConfig struct {
+	Enabled bool
+	URL     string `yaml:"url"`
+	Timeout time.Duration
+	// how long to cache the score for an IP; 0 disables caching:
+	CacheDuration time.Duration `yaml:"cache-duration"`
+	// connections scoring at or above these thresholds are rejected or tagged:
+	RejectThreshold float64 `yaml:"reject-threshold"`
+	TagThreshold    float64 `yaml:"tag-threshold"`
+	Tag             string
+	// whether to accept connections if the service is unreachable or returns an error
+	// (the default, false, rejects them):
+	FailOpen bool `yaml:"fail-open"`
+
+	client *http.Client
+}
+
+func (conf *ReputationConfig) postprocess() (err error) {
+	if !conf.Enabled {
+		return nil
+	}
+	u, err := url.Parse(conf.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid reputation service url: %s", conf.URL)
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = 2 * time.Second
+	}
+	if conf.TagThreshold != 0 && conf.Tag == "" {
+		conf.Tag = "reputation"
+	}
+	conf.client = &http.Client{
+		Timeout: conf.Timeout,
+	}
+	return nil
+}
+
+// ConnectionMetadata is what webircproxy knows about an incoming connection
+// at the time of the websocket upgrade.
+type ConnectionMetadata struct {
+	IP        string   `json:"ip"`
+	Origin    string   `json:"origin,omitempty"`
+	UserAgent string   `json:"user_agent,omitempty"`
+	Listener  string   `json:"listener"`
+	Secure    bool     `json:"secure"`
+	Tags      []string `json:"tags,omitempty"`
+	JA3       string   `json:"ja3,omitempty"`
+	JA4       string   `json:"ja4,omitempty"`
+	// from the geoip database, if configured:
+	ASN string `json:"asn,omitempty"`
+}
+
+type reputationResponse struct {
+	Score float64 `json:"score"`
+}
+
+type reputationCacheEntry struct {
+	score   float64
+	expires time.Time
+}
+
+type reputationCache struct {
+	sync.Mutex // tier 1
+
+	entries   map[string]reputationCacheEntry
+	lastPrune time.Time
+}
+
+func (rc *reputationCache) get(ip string) (score float64, ok bool) {
+	rc.Lock()
+	defer rc.Unlock()
+
+	entry, ok := rc.entries[ip]
+	if ok && time.Now().Before(entry.expires) {
+		return entry.score, true
+	}
+	return 0, false
+}
+
+func (rc *reputationCache) set(ip string, score float64, duration time.Duration) {
+	rc.Lock()
+	defer rc.Unlock()
+
+	now := time.Now()
+	if rc.entries == nil {
+		rc.entries = make(map[string]reputationCacheEntry)
+	}
+	if now.Sub(rc.lastPrune) > duration {
+		rc.lastPrune = now
+		for key, entry := range rc.entries {
+			if now.After(entry.expires) {
+				delete(rc.entries, key)
+			}
+		}
+	}
+	rc.entries[ip] = reputationCacheEntry{score: score, expires: now.Add(duration)}
+}
+
+func queryReputation(conf *ReputationConfig, metadata *ConnectionMetadata) (score float64, err error) {
+	body, err := json.Marshal(metadata)
+	if err != nil {
+		return
+	}
+	resp, err := conf.client.Post(conf.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("reputation service returned status %d", resp.StatusCode)
+	}
+	var result reputationResponse
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&result)
+	return result.Score, err
+}
+
+// checkReputation scores a connection with the reputation service, returning
+// whether it should be rejected and any tag that should be applied, and the
+// error if the service couldn't be queried (in which case the connection is
+// rejected unless fail-open is set, but it doesn't have a low reputation).
+// logAttrs identify the connection in log lines.
+func (server *Server) checkReputation(config *Config, metadata *ConnectionMetadata, logAttrs []slog.Attr) (reject bool, tag string, err error) {
+	conf := &config.Reputation
+	if !conf.Enabled {
+		return
+	}
+
+	score, cached := server.reputation.get(metadata.IP)
+	if !cached {
+		score, err = queryReputation(conf, metadata)
+		if err != nil {
+			server.Log(LogComponentListener, LogLevelWarn, "could not query reputation service", append(logAttrs, errAttr(err))...)
+			return !conf.FailOpen, "", err
+		}
+		if conf.CacheDuration != 0 {
+			server.reputation.set(metadata.IP, score, conf.CacheDuration)
+		}
+	}
+
+	if conf.RejectThreshold != 0 && score >= conf.RejectThreshold {
+		server.Log(LogComponentListener, LogLevelInfo, "rejecting connection: low reputation", append(logAttrs, slog.Float64("score", score))...)
+		return true, "", nil
+	}
+	if conf.TagThreshold != 0 && score >= conf.TagThreshold {
+		return false, conf.Tag, nil
+	}
+	return false, "", nil
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCheckReputation(t *testing.T) {
+	queries := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		var metadata ConnectionMetadata
+		json.NewDecoder(r.Body).Decode(&metadata)
+		scores := map[string]int{"192.0.2.1": 10, "192.0.2.2": 60, "192.0.2.3": 90}
+		fmt.Fprintf(w, `{"score": %d}`, scores[metadata.IP])
+	}))
+	defer ts.Close()
+
+	config := new(Config)
+	config.Reputation = ReputationConfig{
+		Enabled:         true,
+		URL:             ts.URL,
+		CacheDuration:   time.Minute,
+		RejectThreshold: 80,
+		TagThreshold:    50,
+	}
+	if err := config.Reputation.postprocess(); err != nil {
+		t.Fatal(err)
+	}
+	server := new(Server)
+	server.SetConfig(config)
+
+	reject, tag, err := server.checkReputation(config, &ConnectionMetadata{IP: "192.0.2.1"}, nil)
+	assertEqual(reject, false)
+	assertEqual(tag, "")
+	assertEqual(err, nil)
+	reject, tag, err = server.checkReputation(config, &ConnectionMetadata{IP: "192.0.2.2"}, nil)
+	assertEqual(reject, false)
+	assertEqual(tag, "reputation")
+	assertEqual(err, nil)
+	reject, _, err = server.checkReputation(config, &ConnectionMetadata{IP: "192.0.2.3"}, nil)
+	assertEqual(reject, true)
+	assertEqual(err, nil)
+	assertEqual(queries, 3)
+
+	// cached:
+	reject, _, _ = server.checkReputation(config, &ConnectionMetadata{IP: "192.0.2.3"}, nil)
+	assertEqual(reject, true)
+	assertEqual(queries, 3)
+}
+
+func TestReputationFailClosed(t *testing.T) {
+	config := new(Config)
+	config.Reputation = ReputationConfig{
+		Enabled: true,
+		// nothing listens on the discard port:
+		URL:             "http://127.0.0.1:9/score",
+		RejectThreshold: 80,
+	}
+	if err := config.Reputation.postprocess(); err != nil {
+		t.Fatal(err)
+	}
+	server := new(Server)
+	server.SetConfig(config)
+
+	reject, _, err := server.checkReputation(config, &ConnectionMetadata{IP: "192.0.2.1"}, nil)
+	assertEqual(reject, true)
+	assertEqual(err != nil, true)
+	config.Reputation.FailOpen = true
+	reject, _, err = server.checkReputation(config, &ConnectionMetadata{IP: "192.0.2.1"}, nil)
+	assertEqual(reject, false)
+	assertEqual(err != nil, true)
+}
+
+// an outage of the reputation service rejects connections (without
+// fail-open), but doesn't count towards auto-ban
+func TestReputationOutage(t *testing.T) {
+	listen := freeAddress(t)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithListener(listen),
+		WithUpstream(freeAddress(t)),
+		WithYAML(`
+log-level: error
+lookup-hostnames: false
+reputation:
+    enabled: true
+    url: "http://`+freeAddress(t)+`/score"
+    reject-threshold: 80
+auto-ban:
+    enabled: true
+    max-failures: 1
+    exempted: []
+`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.RunContext(ctx)
+
+	for i := 0; i < 2; i++ {
+		_, resp, err := websocket.DefaultDialer.Dial("ws://"+listen+"/webirc", http.Header{"Origin": []string{"https://example.com"}})
+		assertEqual(err, websocket.ErrBadHandshake)
+		assertEqual(resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	assertEqual(len(server.ListBans()), 0)
+}
+
+// TestReputationMetadata checks the metadata sent for a real connection
+func TestReputationMetadata(t *testing.T) {
+	metadatas := make(chan ConnectionMetadata, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var metadata ConnectionMetadata
+		json.NewDecoder(r.Body).Decode(&metadata)
+		metadatas <- metadata
+		fmt.Fprint(w, `{"score": 90}`)
+	}))
+	defer ts.Close()
+	filename := filepath.Join(t.TempDir(), "geoip.csv")
+	os.WriteFile(filename, []byte("127.0.0.0/8,US,64496\n"), 0600)
+
+	listen := freeAddress(t)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithListener(listen),
+		WithUpstream(freeAddress(t)),
+		WithYAML(`
+log-level: error
+lookup-hostnames: false
+geoip:
+    database: "`+filename+`"
+reputation:
+    enabled: true
+    url: "`+ts.URL+`"
+    reject-threshold: 80
+`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.RunContext(ctx)
+
+	header := http.Header{"Origin": []string{"https://example.com"}, "User-Agent": []string{"test"}}
+	_, resp, err := websocket.DefaultDialer.Dial("ws://"+listen+"/webirc", header)
+	assertEqual(err, websocket.ErrBadHandshake)
+	assertEqual(resp.StatusCode, http.StatusForbidden)
+	metadata := <-metadatas
+	assertEqual(metadata.IP, "127.0.0.1")
+	assertEqual(metadata.UserAgent, "test")
+	assertEqual(metadata.ASN, "64496")
+}
@@ -4,17 +4,19 @@
 package irc
 
 import (
+	"bytes"
 	"crypto/tls"
-	"fmt"
+	"errors"
 	"io"
-	"math/rand"
+	"log/slog"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ergochat/irc-go/ircmsg"
 	"github.com/ergochat/irc-go/ircreader"
-	"github.com/gorilla/websocket"
 
 	"github.com/ergochat/ergo/irc/utils"
 )
@@ -25,105 +27,548 @@ const (
 
 var (
 	crlf = []byte("\r\n")
+
+	errNoUpstream = errors.New("no upstream available")
 )
 
-func (server *Server) RunReverseProxyConn(webConn *websocket.Conn, proxiedIP net.IP, secure bool, config *Config) {
-	ip := proxiedIP
-	if ip == nil {
-		ip = utils.AddrToIP(webConn.RemoteAddr())
+// clientData is the information about a client that the listener gathered
+// before the websocket upgrade
+type clientData struct {
+	// unique ID for logging and the admin API:
+	id string
+	// client IP (possibly supplied by a trusted reverse proxy), and the IP
+	// we actually received the connection from:
+	ip     net.IP
+	realIP net.IP
+	secure bool
+	// the cloaked IP sent to the upstream, with ip-cloaking:
+	sentIP   net.IP
+	listener string
+	origin   string
+	// origin policy (if any) that the connection matched:
+	policy *OriginPolicy
+	// tags applied by header rules:
+	tags []string
+	// JA3/JA4 fingerprint, if the client connected via TLS:
+	fingerprint *TLSFingerprint
+	// for ident lookups, if the client connected directly via TCP:
+	ident *identQuery
+	// whether the client connected to a Tor listener:
+	tor bool
+	// for extended WEBIRC flags: the fingerprint of the client's certificate,
+	// and the port it connected to (if known):
+	certfp    string
+	localPort int
+	// the TLS version, if we terminated TLS:
+	tlsVersion uint16
+	// for reconnect-grace, if the client named its session:
+	sessionToken string
+	// the upstream chosen by sticky-sessions (or nil):
+	upstream *reverseProxyUpstream
+	// tracing span for the connection (or nil):
+	span *span
+	// lifecycle hooks (or nil), and the connection's description for them:
+	hooks *Hooks
+	info  *ClientInfo
+}
+
+// selectUpstream chooses an upstream at random (in proportion to the weights)
+// from the ones available to the client. It returns nil if none are available.
+func (server *Server) selectUpstream(config *Config, client *clientData) *reverseProxyUpstream {
+	return chooseWeighted(server.runtimeUpstreams.get(), server.availableUpstreams(config, client))
+}
+
+// availableUpstreams returns the upstreams available to the client (the Tor
+// upstream for Tor clients, its origin policy's upstreams, or all of them),
+// skipping drained and removed upstreams.
+func (server *Server) availableUpstreams(config *Config, client *clientData) []*reverseProxyUpstream {
+	overlay := server.runtimeUpstreams.get()
+	candidates, _ := server.candidateUpstreams(config, client)
+	available := candidates[:0:0]
+	for _, upstream := range candidates {
+		if !server.drains.isDrained(upstream.Name) && !overlay.removed[upstream] {
+			available = append(available, upstream)
+		}
 	}
+	return available
+}
+
+func (server *Server) RunReverseProxyConn(webConn messageConn, client clientData, config *Config) {
+	ip := client.ip
 	ipString := utils.IPStringToHostname(ip.String())
 
-	upstream := config.Upstreams[rand.Intn(len(config.Upstreams))]
-	messageType := websocket.TextMessage
-	if webConn.Subprotocol() == "binary.ircv3.net" {
-		messageType = websocket.BinaryMessage
+	if client.sessionToken != "" && config.ReconnectGrace.Enabled && server.reattachSession(webConn, &client, config) {
+		return
+	}
+	if client.info.Account != "" && config.Multiplexing.Enabled && server.attachMultiplexed(webConn, &client, config) {
+		return
 	}
 
-	server.Log(LogLevelInfo, fmt.Sprintf("received connection from %s, forwarding to %s", webConn.RemoteAddr(), upstream.Address))
+	// with sticky-sessions, the upstream was chosen before the handshake:
+	upstream := client.upstream
+	if upstream == nil {
+		upstream = server.selectUpstream(config, &client)
+	}
+	if upstream == nil {
+		server.Log(LogComponentProxy, LogLevelError, "no upstream available (all are drained)", slog.String(logKeyConnID, client.id), slog.String(logKeyRemoteIP, ip.String()))
+		client.span.End(errNoUpstream)
+		server.countError(errorNoUpstream, "")
+		webConn.Close()
+		server.finishConnection(&client, DisconnectInfo{Reason: CloseNoUpstream, Error: errNoUpstream})
+		return
+	}
+	if client.hooks != nil && client.hooks.OnUpstreamSelected != nil {
+		if name := client.hooks.OnUpstreamSelected(client.info, upstream.Name); name != upstream.Name {
+			if override := server.runtimeUpstreams.get().findUpstream(config, name); override != nil {
+				upstream = override
+			} else {
+				server.Log(LogComponentProxy, LogLevelWarn, "OnUpstreamSelected hook returned a nonexistent upstream", slog.String(logKeyConnID, client.id), slog.String(logKeyUpstream, name))
+			}
+		}
+	}
+	client.info.Upstream = upstream.Name
+	upstream = upstream.forClient(config, ip)
+	messageType := webConnMessageType(webConn)
+
+	logAttrs := []slog.Attr{slog.String(logKeyConnID, client.id), slog.String(logKeyRemoteIP, ip.String()), slog.String(logKeyUpstream, upstream.Address)}
+	connectAttrs := logAttrs
+	if len(client.tags) != 0 {
+		connectAttrs = append(connectAttrs, slog.String("tags", strings.Join(client.tags, ",")))
+	}
+	if client.fingerprint != nil && config.TLSFingerprints.Log {
+		connectAttrs = append(connectAttrs, slog.String("ja3", client.fingerprint.JA3), slog.String("ja4", client.fingerprint.JA4))
+	}
+	server.Log(LogComponentProxy, LogLevelInfo, "received connection", connectAttrs...)
+	started := time.Now()
+
+	// the IP (and with ip-cloaking, the hostname) sent to the upstream:
+	sentIP, cloakedHostname := server.sentIdentity(config, &client, upstream)
+	server.writeAudit(newAuditRecord(auditEventOpen, &client, upstream))
+
+	client.span.SetAttrs(slog.String(logKeyUpstream, upstream.Address))
+	if len(client.tags) != 0 {
+		client.span.SetAttrs(slog.String("tags", strings.Join(client.tags, ",")))
+	}
 
+	// look up the ident concurrently with dialing the upstream:
+	var identResult chan string
+	if config.Ident.Enabled && client.ident != nil {
+		identResult = make(chan string, 1)
+		go func() {
+			identResult <- server.lookupIdent(config, &client, logAttrs)
+		}()
+	}
+
+	// likewise the hostname:
+	var hostnameResult <-chan string
+	wantHostname := config.LookupHostnames && !config.IPCloaking.Enabled && !client.tor
+	if upstream.Webirc.Enabled && wantHostname {
+		hostnameResult = server.startHostnameLookup(config, ip, logAttrs)
+	}
+
+	// if the dial fails, fail over to other upstreams (see failover.go):
+	var attempts dialAttempts
 	var uConn net.Conn
 	var err error
-	proto := "tcp"
-	if strings.HasPrefix(upstream.Address, "/") {
-		proto = "unix"
-	}
-	if upstream.TLS {
-		tlsConf := &tls.Config{
-			ServerName:   upstream.Address,
-			MinVersion:   tls.VersionTLS13,
-			Certificates: upstream.Webirc.certificates,
+	for {
+		var proxyHeader []byte
+		if upstream.SendProxy {
+			proxyHeader = makeProxyV2Header(&proxyHeaderInfo{
+				srcIP:       sentIP,
+				dstPort:     client.localPort,
+				connID:      client.id,
+				gatewayName: config.GatewayName,
+				origin:      client.origin,
+				tlsVersion:  client.tlsVersion,
+				subprotocol: webConn.Subprotocol(),
+			})
+		}
+
+		dialSpan := client.span.StartChild("upstream.dial", spanKindClient)
+		dialSpan.SetAttrs(slog.String(logKeyUpstream, upstream.Address), slog.Bool("tls", upstream.TLS))
+		dialStart := time.Now()
+		err = nil
+		uConn = server.prewarm.take(upstream)
+		if uConn != nil {
+			dialSpan.SetAttrs(slog.Bool("prewarmed", true))
+		} else {
+			uConn, err = dialUpstream(config, upstream, proxyHeader, server.upstreamTLSSessions(config, upstream))
+			if err == nil {
+				server.observeDuration(&server.metrics.dialDuration, time.Since(dialStart), upstream.Name)
+				if upstream.TLS {
+					dialSpan.SetAttrs(slog.Bool("tls_resumed", tlsResumed(uConn)))
+				}
+			}
+		}
+		dialSpan.End(err)
+		if err == nil {
+			break
+		}
+
+		server.Log(LogComponentProxy, LogLevelError, "error connecting to upstream ircd", append(logAttrs, errAttr(err))...)
+		server.countError(errorUpstreamDialFailed, upstream.Name)
+		failedErr := err
+		server.emitEvent(EventUpstreamFailed, &client, func(event *Event) {
+			event.Upstream = upstream.Name
+			event.Reason = string(CloseUpstreamDialFailed)
+			event.Error = failedErr.Error()
+		})
+		attempts = append(attempts, dialAttempt{upstream: upstream.Name, err: err})
+		next := server.failoverUpstream(config, &client, attempts)
+		if next == nil {
+			break
+		}
+		server.Log(LogComponentProxy, LogLevelInfo, "failing over to another upstream", append(logAttrs, slog.String("next_upstream", next.Name), slog.Int("dial_attempts", len(attempts)))...)
+		client.info.Upstream = next.Name
+		upstream = next.forClient(config, ip)
+		logAttrs = []slog.Attr{slog.String(logKeyConnID, client.id), slog.String(logKeyRemoteIP, ip.String()), slog.String(logKeyUpstream, upstream.Address)}
+		sentIP, cloakedHostname = server.sentIdentity(config, &client, upstream)
+		// the failed upstream may not have used WEBIRC, and so not needed the hostname:
+		if hostnameResult == nil && upstream.Webirc.Enabled && wantHostname {
+			hostnameResult = server.startHostnameLookup(config, ip, logAttrs)
 		}
-		uConn, err = tls.DialWithDialer(config.dialer, proto, upstream.Address, tlsConf)
-	} else {
-		uConn, err = config.dialer.Dial(proto, upstream.Address)
 	}
 
 	if err != nil {
-		server.Log(LogLevelError, fmt.Sprintf("error connecting to upstream ircd at %s: %v", upstream.Address, err))
+		if len(attempts) > 1 {
+			err = attempts
+			server.Log(LogComponentProxy, LogLevelError, "giving up on connecting to upstream ircds", append(logAttrs, errAttr(err))...)
+		}
+		record := newAuditRecord(auditEventClose, &client, upstream)
+		record.setClose(started, CloseUpstreamDialFailed, err, 0, 0)
+		server.writeAudit(record)
+		client.span.End(err)
 		webConn.Close()
+		server.finishConnection(&client, DisconnectInfo{Reason: CloseUpstreamDialFailed, Error: err})
 		return
 	}
 
 	if upstream.Webirc.Enabled {
+		webircSpan := client.span.StartChild("webirc.handshake", spanKindInternal)
 		var hostname string
-		if config.LookupHostnames {
-			hostname, _ = utils.LookupHostname(ip, config.ForwardConfirmHostnames)
+		if client.tor {
+			// the peer address is the tor daemon's, and mustn't be looked up:
+			hostname = config.Tor.Hostname
+			ipString = sentIP.String()
+		} else if config.IPCloaking.Enabled {
+			hostname = cloakedHostname
+			ipString = utils.IPStringToHostname(sentIP.String())
+		} else if hostnameResult != nil {
+			hostname = <-hostnameResult
 		} else {
 			hostname = ipString
 		}
-		flags := ""
-		if secure {
-			flags = "secure"
+		var flags []string
+		if client.secure {
+			flags = append(flags, "secure")
+		}
+		if client.fingerprint != nil && config.TLSFingerprints.Forward {
+			flags = append(flags, "ja3="+client.fingerprint.JA3, "ja4="+client.fingerprint.JA4)
+		}
+		flags = append(flags, server.webircFlagsFor(config, upstream, &client)...)
+		if identResult != nil && config.Ident.Forward {
+			if username := <-identResult; username != "" {
+				flags = append(flags, "ident="+username)
+			}
 		}
 		message := ircmsg.MakeMessage(nil, "", "WEBIRC",
-			upstream.Webirc.Password, config.GatewayName, hostname, ipString, flags)
+			upstream.webircPassword(time.Now()), config.GatewayName, hostname, ipString, strings.Join(flags, " "))
 		messageBytes, err := message.LineBytesStrict(false, DefaultMaxLineLen)
 		if err == nil {
 			_, err = uConn.Write(messageBytes)
 		}
+		webircSpan.End(err)
 		if err != nil {
-			server.Log(LogLevelError, fmt.Sprintf("error sending WEBIRC to upstream at %s: %v", upstream.Address, err))
+			server.Log(LogComponentProxy, LogLevelError, "error sending WEBIRC to upstream", append(logAttrs, errAttr(err))...)
+			server.countError(errorWebircWriteFailed, upstream.Name)
 		} // but keep going
 	}
 
-	debug := config.logLevel >= LogLevelDebug
-	NewReverseProxyConn(server, webConn, uConn, messageType, config.MaxLineLen, config.maxReadQBytes, debug)
+	NewReverseProxyConn(server, webConn, uConn, &client, upstream, messageType, config, logAttrs, started)
+}
+
+// lookupIdent looks up and logs the client's ident username ("" if unknown)
+func (server *Server) lookupIdent(config *Config, client *clientData, logAttrs []slog.Attr) string {
+	username, err := lookupIdent(client.ident, config.Ident.Timeout)
+	if err != nil {
+		server.Log(LogComponentProxy, LogLevelDebug, "ident lookup failed", append(logAttrs, errAttr(err))...)
+		return ""
+	}
+	server.Log(LogComponentProxy, LogLevelInfo, "ident lookup", append(logAttrs, slog.String("ident", username))...)
+	return username
+}
+
+// dialUpstream connects to the upstream, applying its socket options and
+// sending proxyHeader (if any) ahead of the TLS handshake; sessions (if not
+// nil) caches its TLS sessions for resumption (see tlssessions.go)
+func dialUpstream(config *Config, upstream *reverseProxyUpstream, proxyHeader []byte, sessions tls.ClientSessionCache) (net.Conn, error) {
+	tlsConf := &tls.Config{
+		ServerName:         upstream.serverName,
+		MinVersion:         tls.VersionTLS13,
+		Certificates:       upstream.Webirc.certificates,
+		ClientSessionCache: sessions,
+	}
+	conn, err := config.dialer.Dial(upstream.network, upstream.Address)
+	if err != nil {
+		return nil, err
+	}
+	if err = upstream.configureSocket(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if proxyHeader == nil && !upstream.TLS {
+		return conn, nil
+	}
+
+	// as with tls.DialWithDialer, the dial timeout also covers the handshake:
+	conn.SetDeadline(time.Now().Add(config.dialer.Timeout))
+	if proxyHeader != nil {
+		_, err = conn.Write(proxyHeader)
+	}
+	if err == nil && upstream.TLS {
+		tlsConn := tls.Client(conn, tlsConf)
+		err = tlsConn.Handshake()
+		conn = tlsConn
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// startResponseTimeout limits the time until the upstream's first line,
+// unless it has already sent one; proxyFromUpstream clears the deadline
+func (r *ReverseProxyConn) startResponseTimeout() {
+	if r.responseTimeout == 0 {
+		return
+	}
+	r.uConn.SetReadDeadline(time.Now().Add(r.responseTimeout))
+	// if proxyFromUpstream saw the first line before the deadline was set:
+	if r.upstreamResponded.Load() {
+		r.uConn.SetReadDeadline(time.Time{})
+	}
+}
+
+// setUpstreamWriteDeadline limits the time the next write to the upstream
+// may take
+func (r *ReverseProxyConn) setUpstreamWriteDeadline() {
+	if r.writeTimeout != 0 {
+		r.uConn.SetWriteDeadline(time.Now().Add(r.writeTimeout))
+	}
+}
+
+// writeUpstream writes the buffers to the upstream. Each websocket's
+// proxyToUpstream writes to it (with multiplexing), as does the proxy itself
+// (PONGs, and QUITs when it closes the connection), so the writes must be
+// serialized: for connections that can't writev(2) (e.g., TLS and prewarmed
+// ones), a line and its CRLF are separate writes, which could otherwise
+// interleave.
+func (r *ReverseProxyConn) writeUpstream(iovec *net.Buffers) (err error) {
+	r.uWriteMutex.Lock()
+	defer r.uWriteMutex.Unlock()
+	r.setUpstreamWriteDeadline()
+	_, err = iovec.WriteTo(r.uConn)
+	return
+}
+
+// writeUpstreamLine writes a line, which includes its CRLF, to the upstream
+func (r *ReverseProxyConn) writeUpstreamLine(line []byte) error {
+	iovec := net.Buffers{line}
+	return r.writeUpstream(&iovec)
+}
+
+// webConnMessageType returns the type of message to send to the client,
+// according to the negotiated subprotocol
+func webConnMessageType(webConn messageConn) messageType {
+	if webConn.Subprotocol() == "binary.ircv3.net" {
+		return binaryMessage
+	}
+	return textMessage
 }
 
 type ReverseProxyConn struct {
-	webConn     *websocket.Conn
+	// the client's websocket; nil while it is detached (see sessions.go):
+	webConn     messageConn // protected by wsMutex
 	uConn       net.Conn
-	messageType int
-	wsBuffer    []byte
+	client      *clientData
+	upstream    *reverseProxyUpstream
+	messageType messageType
 	maxBuffer   int
+	buffers     *BuffersConfig
 	maxLineLen  int
+	// the limit for lines rebuilt from the upstream's lines: maxLineLen, or
+	// the upstream's LINELEN (see linelen.go); used only by proxyFromUpstream:
+	upstreamLineLen int
+	transcoding     *TranscodingConfig
+	// time limit for the client to send its first message:
+	registrationTimeout time.Duration
+	// time limits for writing a line to the upstream (zero for none), and a
+	// close frame to the client:
+	writeTimeout time.Duration
+	closeTimeout time.Duration
+	// time limit for the upstream's first line, after the client's first
+	// line, and whether the upstream has sent one:
+	responseTimeout   time.Duration
+	upstreamResponded atomic.Bool
+	// local-ping state: when the client last sent a line (UnixNano), and
+	// the upstream's server name (once it is known):
+	localPing          *LocalPingConfig
+	lastClientActivity int64 // atomic
+	upstreamServerName atomic.Pointer[string]
+	// the lines of the welcome notice (see welcome.go), until it is sent:
+	welcomeNotice []string
+	gatewayName   string
+	// the capability to add to CAP LS (see gatewaycap.go), if any:
+	gatewayCap string
+	// the upstream's open draft/multiline batches (see multiline.go), for
+	// clients whose lines are transcoded:
+	multiline multilineBatches
+	// serializes writes to the websocket, and protects its replacement:
+	wsMutex sync.Mutex // tier 1
+	// serializes writes to the upstream (see writeUpstream):
+	uWriteMutex sync.Mutex // tier 1
+	// set when the connection starts closing, after which it can't be reattached:
+	closing bool // protected by wsMutex
+	// the websocket that was sent a close frame, if any, and a channel that
+	// is closed when its reader stops (e.g., on the client's acknowledgment):
+	closeSentTo messageConn   // protected by wsMutex
+	closeAcked  chan struct{} // protected by wsMutex
+	// the websockets' read buffers (see buffers.go):
+	wsBuffers []*wsReadBuffer // protected by wsMutex
+	// the goroutines proxying the connection (see leakcheck.go): the upstream
+	// reader, and the websocket readers (several, with multiplexing):
+	upstreamReader atomic.Bool
+	wsReaders      atomic.Int32
+	// closes the connection at its maximum lifetime (see lifetime.go):
+	lifetimeTimer *time.Timer
+	// closes the connection if the client is idle (see idletimeout.go):
+	idleTimeout    time.Duration
+	idleWarnBefore time.Duration
+	idleTimer      *time.Timer // protected by wsMutex
+	idleWarned     bool        // protected by wsMutex
+	// when the client last sent a message, in Unix nanoseconds:
+	lastActivity atomic.Int64
+	// reconnect-grace state (see sessions.go):
+	sessionToken string
+	gracePeriod  time.Duration
+	graceTimer   *time.Timer   // protected by wsMutex
+	replay       *replayBuffer // protected by wsMutex
+	// multiplexing state (see multiplex.go): the websockets other than webConn
+	multiplexed    []messageConn // protected by wsMutex
+	multiplexKey   string
+	maxMultiplexed int
+
+	bandwidthQuota *BandwidthQuotaConfig
+	tagLimits      *TagLimitConfig
+	// paces the lines sent to the client (or nil; see pacing.go):
+	pacer *pacer
+	// whether the client has been throttled by bandwidthQuota:
+	throttled bool
+	// the close code and reason derived from the upstream's ERROR, if any:
+	wsCloseCode   int
+	wsCloseReason string
+	// structured fields included in all log lines about this connection:
+	logAttrs []slog.Attr
+	span     *span
+	started  time.Time
+	// when the upstream connection was established:
+	connected time.Time
+	// bytes read from the client and from the upstream, respectively:
+	bytesIn  uint64 // atomic
+	bytesOut uint64 // atomic
 
 	closeOnce sync.Once
+	// why the connection was closed (for the audit log):
+	closeReason CloseReason
+	closeErr    error
 
 	server *Server
 }
 
-func NewReverseProxyConn(server *Server, webConn *websocket.Conn, uConn net.Conn, messageType int, maxLineLen, maxReadQ int, debug bool) *ReverseProxyConn {
+func NewReverseProxyConn(server *Server, webConn messageConn, uConn net.Conn, client *clientData, upstream *reverseProxyUpstream, messageType messageType, config *Config, logAttrs []slog.Attr, started time.Time) *ReverseProxyConn {
 	result := &ReverseProxyConn{
-		webConn:     webConn,
-		uConn:       uConn,
-		messageType: messageType,
-		server:      server,
-		wsBuffer:    make([]byte, initialBufferSize),
-		maxBuffer:   maxReadQ,
-		maxLineLen:  maxLineLen,
-	}
-	go result.proxyToUpstream(debug)
-	go result.proxyFromUpstream(debug)
+		webConn:             webConn,
+		uConn:               uConn,
+		client:              client,
+		upstream:            upstream,
+		messageType:         messageType,
+		server:              server,
+		maxBuffer:           config.maxReadQBytes,
+		buffers:             &config.Buffers,
+		maxLineLen:          config.MaxLineLen,
+		upstreamLineLen:     config.MaxLineLen,
+		transcoding:         &config.Transcoding,
+		registrationTimeout: config.RegistrationTimeout,
+		writeTimeout:        config.UpstreamWriteTimeout,
+		closeTimeout:        config.WebsocketCloseTimeout,
+		responseTimeout:     config.UpstreamResponseTimeout,
+		localPing:           &config.LocalPing,
+		welcomeNotice:       config.welcomeNotice,
+		gatewayName:         config.GatewayName,
+		gatewayCap:          config.gatewayCap(),
+		multiline:           make(multilineBatches),
+		bandwidthQuota:      &config.BandwidthQuotas,
+		tagLimits:           &config.TagLimits,
+		pacer:               config.DownstreamPacing.newPacer(messageType),
+		logAttrs:            logAttrs,
+		span:                client.span,
+		started:             started,
+		connected:           time.Now(),
+	}
+	if lifetime := config.ConnectionLifetime.lifetime(); lifetime != 0 {
+		result.lifetimeTimer = time.AfterFunc(lifetime, result.lifetimeExpired)
+	}
+	result.startIdleTimer(&config.IdleTimeout)
+	server.conns.add(result)
+	server.countConnection(upstream.Name)
+	server.reportActiveConnections(upstream.Name, client.listener)
+	server.emitEvent(EventConnect, client, func(event *Event) {
+		event.Upstream = upstream.Name
+	})
+	if client.sessionToken != "" && config.ReconnectGrace.Enabled && server.sessions.add(client.sessionToken, result) {
+		result.sessionToken = client.sessionToken
+		result.gracePeriod = config.ReconnectGrace.Period
+		if config.ReconnectGrace.ReplayLines > 0 {
+			result.replay = &replayBuffer{maxLines: config.ReconnectGrace.ReplayLines, maxBytes: config.ReconnectGrace.ReplayBytes}
+		}
+	}
+	if client.info.Account != "" && config.Multiplexing.Enabled && server.accountConns.add(multiplexKey(client), result) {
+		result.multiplexKey = multiplexKey(client)
+		result.maxMultiplexed = config.Multiplexing.MaxConnections
+	}
+	debug := config.logEnabled(LogComponentProxy, LogLevelDebug)
+	result.startProxyToUpstream(webConn, false, debug)
+	result.startProxyFromUpstream(debug)
 	return result
 }
 
-func (r *ReverseProxyConn) proxyToUpstream(debug bool) {
-	var errorMessage string
+func (r *ReverseProxyConn) log(level LogLevel, message string, attrs ...slog.Attr) {
+	r.server.Log(LogComponentProxy, level, message, append(r.logAttrs[:len(r.logAttrs):len(r.logAttrs)], attrs...)...)
+}
+
+// logClose logs the exit of one of the proxy goroutines
+func (r *ReverseProxyConn) logClose(reason CloseReason, direction string, err error) {
+	r.log(LogLevelInfo, reason.Description(), slog.String(logKeyCloseReason, string(reason)), slog.String(logKeyDirection, direction), errAttr(err))
+}
+
+// proxyToUpstream relays lines from a websocket to the upstream; registered
+// is set if the websocket is reattaching to an already registered connection
+func (r *ReverseProxyConn) proxyToUpstream(webConn messageConn, registered bool, debug bool) {
+	// after the connection is closed (see leakcheck.go):
+	defer r.wsReaderDone()
+	var reason CloseReason
+	var err error
+	// if the client's websocket failed, but its session can be reattached:
+	detached := false
 	defer func() {
-		r.Close()
-		r.server.Log(LogLevelInfo, errorMessage)
+		r.noteReaderDone(webConn)
+		if detached {
+			return
+		}
+		r.closeWithReason(reason, err)
+		r.logClose(reason, "input", err)
 	}()
 
 	// XXX writev(2) / (*Buffers).WriteTo dance:
@@ -138,54 +583,139 @@ func (r *ReverseProxyConn) proxyToUpstream(debug bool) {
 	// this is a limitation of the escape analyzer. work around this by
 	// preemptively allocating it a single time on the heap and reusing it:
 	iovec := new(net.Buffers)
+	wsBuffer := newWSReadBuffer(r.buffers, r.maxBuffer)
+	r.addWSBuffer(wsBuffer)
+	defer r.removeWSBuffer(wsBuffer)
+	// see readWSMessage:
+	wsBuffer.Lock()
+	defer wsBuffer.Unlock()
+	// don't let clients hold an upstream connection open without ever sending anything:
+	if !registered {
+		webConn.SetReadDeadline(time.Now().Add(r.registrationTimeout))
+	}
+	var lines [][]byte
 	for {
-		line, err := r.readWSMessage()
+		var message []byte
+		message, err = r.readWSMessage(webConn, wsBuffer)
 		if err != nil {
-			errorMessage = fmt.Sprintf("error reading from websocket conn at %s: %v", r.webConn.RemoteAddr().String(), err)
+			if err == errReadLimit {
+				r.server.recordFailure(r.client.ip, failureReadLimit)
+				r.server.countError(errorReadLimit, r.upstream.Name)
+			}
+			if !registered && isTimeoutError(err) {
+				reason = CloseRegistrationTimeout
+			} else if err == errReadLimit {
+				reason = CloseReadLimit
+			} else {
+				reason = CloseClientEOF
+				detached = registered && r.detach(webConn)
+			}
 			return
 		}
-		if debug {
-			r.server.Log(LogLevelDebug,
-				fmt.Sprintf("input: %s -> %s: %s",
-					r.webConn.RemoteAddr().String(), r.uConn.RemoteAddr().String(), line))
-		}
-		// step 1: reset *iovec to contain a slice of 2 []byte's:
-		*iovec = buffers
-		// step 2: fill in the two desired []byte's:
-		(*iovec)[0] = line
-		(*iovec)[1] = crlf
-		// step 3: (*net.Buffers) prepared, Go will optimize this to writev(2) if possible:
-		_, err = iovec.WriteTo(r.uConn)
-		if err != nil {
-			errorMessage = fmt.Sprintf("error writing to upstream conn at %s: %v", r.uConn.RemoteAddr().String(), err)
-			return
+		r.noteActivity()
+		if !registered {
+			registered = true
+			webConn.SetReadDeadline(time.Time{})
+			r.startResponseTimeout()
 		}
+		// some text clients (incorrectly) send CR/LF, or several lines in one message:
+		lines = lines[:0]
+		if r.messageType == textMessage {
+			lines = splitWSMessage(lines, message)
+		} else {
+			lines = append(lines, message)
+		}
+		for _, line := range lines {
+			if debug {
+				r.log(LogLevelDebug, "proxied line", slog.String(logKeyDirection, "input"), slog.String("line", string(line)))
+			}
+			if r.bandwidthQuota.Enabled && r.applyBandwidthQuota(len(line)+len(crlf)) {
+				r.server.countError(errorBandwidthQuota, r.upstream.Name)
+				r.server.recordFailure(r.client.ip, failureBandwidthQuota)
+				reason = CloseBandwidthQuota
+				return
+			}
+			if r.tagLimits.Enabled {
+				limited := applyTagLimit(line, r.tagLimits)
+				if limited == nil {
+					r.server.countError(errorTagLimit, r.upstream.Name)
+					r.log(LogLevelDebug, "rejected line with oversized tags", slog.String(logKeyDirection, "input"))
+					err = r.rejectTagLimit(line)
+					if err != nil {
+						reason = CloseClientWriteError
+						return
+					}
+					continue
+				}
+				line = limited
+			}
+			if r.localPing.Enabled {
+				r.noteClientActivity()
+				var answered bool
+				answered, err = r.answerClientPing(line)
+				if err != nil {
+					reason = CloseClientWriteError
+					return
+				} else if answered {
+					continue
+				}
+			}
+			// step 1: reset *iovec to contain a slice of 2 []byte's:
+			*iovec = buffers
+			// step 2: fill in the two desired []byte's:
+			(*iovec)[0] = line
+			(*iovec)[1] = crlf
+			// step 3: (*net.Buffers) prepared, Go will optimize this to writev(2) if possible:
+			err = r.writeUpstream(iovec)
+			if err != nil {
+				reason = CloseUpstreamWriteError
+				if isTimeoutError(err) {
+					reason = CloseWriteTimeout
+					r.server.countError(errorWriteTimeout, r.upstream.Name)
+				}
+				return
+			}
+			atomic.AddUint64(&r.bytesIn, uint64(len(line)+len(crlf)))
+			r.server.countBytes(true, uint64(len(line)+len(crlf)))
+		}
+	}
+}
+
+// splitWSMessage appends the lines in a message from a text client to lines,
+// without their terminators (and dropping any empty lines between them)
+func splitWSMessage(lines [][]byte, message []byte) [][]byte {
+	for len(message) != 0 {
+		i := bytes.IndexAny(message, "\r\n")
+		if i == -1 {
+			return append(lines, message)
+		}
+		if i != 0 {
+			lines = append(lines, message[:i])
+		}
+		message = message[i+1:]
 	}
+	return lines
 }
 
-func (r *ReverseProxyConn) readWSMessage() (line []byte, err error) {
-	_, reader, err := r.webConn.NextReader()
+// readWSMessage reads the next message into wsBuffer, which the caller holds
+// locked; it is unlocked while waiting for the message, so that an idle
+// buffer can be released (see buffers.go)
+func (r *ReverseProxyConn) readWSMessage(webConn messageConn, wsBuffer *wsReadBuffer) (line []byte, err error) {
+	wsBuffer.Unlock()
+	reader, err := webConn.NextReader()
+	wsBuffer.Lock()
 	if err != nil {
 		return nil, err
 	}
-	// XXX this is io.ReadFull with a single attempt to resize upwards
-	n, err := io.ReadFull(reader, r.wsBuffer)
-	if err == nil && len(r.wsBuffer) < r.maxBuffer {
-		newBuf := make([]byte, r.maxBuffer)
-		copy(newBuf, r.wsBuffer[:n])
-		r.wsBuffer = newBuf
-		var n2 int
-		n2, err = io.ReadFull(reader, r.wsBuffer[n:])
-		n += n2
-	}
-	line = r.wsBuffer[:n]
+	n, err := wsBuffer.readFrom(reader)
+	line = wsBuffer.buf[:n]
 	switch err {
 	case io.ErrUnexpectedEOF, io.EOF:
 		// good: exhausted the reader without exhausting the buffer
 		return line, nil
-	case nil, websocket.ErrReadLimit:
+	case nil, errReadLimit:
 		// bad: exhausted the buffer but the reader still has data
-		return line, websocket.ErrReadLimit
+		return line, errReadLimit
 	default:
 		// bad: read error
 		return line, err
@@ -193,46 +723,187 @@ func (r *ReverseProxyConn) readWSMessage() (line []byte, err error) {
 }
 
 func (r *ReverseProxyConn) proxyFromUpstream(debug bool) {
-	var errorMessage string
+	defer r.upstreamReaderDone()
+	// every return sets the reason, so it is only unset after a panic:
+	reason := ClosePanic
+	var err error
 	defer func() {
-		r.Close()
-		r.server.Log(LogLevelInfo, errorMessage)
+		r.closeWithReason(reason, err)
+		r.logClose(reason, "output", err)
 	}()
 
 	// in case something sketchy happens in the chardet code:
-	defer r.server.HandlePanic()
+	defer r.server.HandlePanic(r.logAttrs...)
 
 	var reader ircreader.Reader
-	reader.Initialize(r.uConn, initialBufferSize, r.maxBuffer)
+	reader.Initialize(r.uConn, r.buffers.InitialSize, r.maxBuffer)
+	firstLine := true
 	for {
 		// ircreader strips the \r\n:
-		line, err := reader.ReadLine()
+		var line []byte
+		line, err = reader.ReadLine()
 		if err != nil {
-			errorMessage = fmt.Sprintf("error reading from upstream conn at %s: %v", r.uConn.RemoteAddr().String(), err)
+			if firstLine && isTimeoutError(err) {
+				reason = CloseResponseTimeout
+				r.server.countError(errorResponseTimeout, r.upstream.Name)
+				return
+			}
+			reason = CloseUpstreamEOF
+			if r.wsCloseCode != 0 {
+				r.writeWSClose(r.wsCloseCode, r.wsCloseReason)
+			}
 			return
 		}
+		if firstLine {
+			firstLine = false
+			r.upstreamResponded.Store(true)
+			r.uConn.SetReadDeadline(time.Time{})
+			r.server.observeDuration(&r.server.metrics.firstByteDuration, time.Since(r.connected), r.upstream.Name)
+		}
+		atomic.AddUint64(&r.bytesOut, uint64(len(line)+len(crlf)))
+		r.server.countBytes(false, uint64(len(line)+len(crlf)))
 		if debug {
-			r.server.Log(LogLevelDebug,
-				fmt.Sprintf("output: %s -> %s: %s",
-					r.uConn.RemoteAddr().String(), r.webConn.RemoteAddr().String(), line))
+			r.log(LogLevelDebug, "proxied line", slog.String(logKeyDirection, "output"), slog.String("line", string(line)))
+		}
+		if code, reason, ok := classifyUpstreamError(line); ok {
+			r.wsCloseCode, r.wsCloseReason = code, reason
+		}
+		if failure, ok := upstreamFailure(line); ok {
+			r.server.recordFailure(r.client.ip, failure)
+		}
+		detached := r.sessionToken != "" && r.detached()
+		if detached {
+			// keep the connection alive until the client reattaches; the other
+			// lines are buffered for replay by writeWS:
+			var answered bool
+			if answered, err = r.answerUpstreamPing(line); err != nil {
+				reason = CloseUpstreamWriteError
+				return
+			} else if answered {
+				continue
+			}
+		}
+		if r.localPing.Enabled {
+			r.observeUpstreamLine(line)
+			var absorbed bool
+			absorbed, err = r.absorbUpstreamPing(line)
+			if err != nil {
+				reason = CloseUpstreamWriteError
+				return
+			} else if absorbed {
+				continue
+			}
+		}
+		if r.gatewayCap != "" {
+			line = addGatewayCap(line, r.gatewayCap, DefaultMaxLineLen)
+		}
+		if r.pacer != nil && !detached {
+			r.pacer.wait()
 		}
-		if r.messageType == websocket.BinaryMessage {
-			err = r.webConn.WriteMessage(websocket.BinaryMessage, line)
+		if r.messageType == binaryMessage && !r.transcoding.Binary {
+			err = r.writeWS(binaryMessage, line)
 		} else {
-			err = r.webConn.WriteMessage(websocket.TextMessage, r.server.transcodeToUTF8(line, r.maxLineLen))
+			r.observeLineLen(line)
+			r.multiline.observe(line)
+			if r.multiline.contains(line) {
+				err = r.writeMultilineLine(line)
+			} else {
+				err = r.writeWS(r.messageType, r.server.transcodeToUTF8With(r.transcoding, line, r.upstreamLineLen))
+			}
+		}
+		if err == nil && r.welcomeNotice != nil {
+			var sent bool
+			if sent, err = r.sendWelcomeNotice(line); sent {
+				r.welcomeNotice = nil
+			}
 		}
 		if err != nil {
-			errorMessage = fmt.Sprintf("error writing to websocket conn at %s: %v", r.webConn.RemoteAddr().String(), err)
+			reason = CloseClientWriteError
+			if isTimeoutError(err) {
+				reason = CloseWriteTimeout
+				r.server.countError(errorWriteTimeout, r.upstream.Name)
+			}
 			return
 		}
 	}
 }
 
+func isTimeoutError(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
 func (r *ReverseProxyConn) Close() {
-	r.closeOnce.Do(r.realClose)
+	r.closeWithReason(CloseKilled, nil)
+}
+
+// closeWithReason closes the connection; if this is the first call to close it,
+// the reason and error are recorded in the audit log
+func (r *ReverseProxyConn) closeWithReason(reason CloseReason, err error) {
+	r.closeOnce.Do(func() {
+		r.closeReason, r.closeErr = reason, err
+		r.realClose()
+	})
 }
 
 func (r *ReverseProxyConn) realClose() {
-	r.webConn.Close()
+	r.wsMutex.Lock()
+	r.closing = true
+	webConns := r.multiplexed
+	if r.webConn != nil {
+		webConns = append(webConns[:len(webConns):len(webConns)], r.webConn)
+	}
+	r.stopGraceTimerLocked()
+	if r.idleTimer != nil {
+		r.idleTimer.Stop()
+	}
+	closeSentTo, closeAcked := r.closeSentTo, r.closeAcked
+	r.wsMutex.Unlock()
+	if r.lifetimeTimer != nil {
+		r.lifetimeTimer.Stop()
+	}
+	for _, webConn := range webConns {
+		if webConn == closeSentTo {
+			go awaitCloseAck(webConn, closeAcked, r.closeTimeout)
+		} else {
+			webConn.Close()
+		}
+	}
+	if r.sessionToken != "" {
+		r.server.sessions.remove(r.sessionToken, r)
+	}
+	if r.multiplexKey != "" {
+		r.server.accountConns.remove(r.multiplexKey, r)
+	}
 	r.uConn.Close()
+	if r.server.conns.remove(r) && r.server.drains.isDrained(r.upstream.Name) {
+		r.server.Log(LogComponentServer, LogLevelInfo, "upstream drain complete", slog.String(logKeyUpstream, r.upstream.Name))
+	}
+	r.server.reportActiveConnections(r.upstream.Name, r.client.listener)
+	bytesIn, bytesOut := atomic.LoadUint64(&r.bytesIn), atomic.LoadUint64(&r.bytesOut)
+	r.server.emitEvent(EventDisconnect, r.client, func(event *Event) {
+		event.Upstream = r.upstream.Name
+		event.Reason = string(r.closeReason)
+		if r.closeErr != nil {
+			event.Error = r.closeErr.Error()
+		}
+		event.BytesIn, event.BytesOut = bytesIn, bytesOut
+		event.Duration = time.Since(r.connected).String()
+	})
+	r.server.finishConnection(r.client, DisconnectInfo{
+		Reason:   r.closeReason,
+		Error:    r.closeErr,
+		BytesIn:  bytesIn,
+		BytesOut: bytesOut,
+		Duration: time.Since(r.connected),
+	})
+	record := newAuditRecord(auditEventClose, r.client, r.upstream)
+	record.setClose(r.started, r.closeReason, r.closeErr, bytesIn, bytesOut)
+	r.server.writeAudit(record)
+	r.span.SetAttrs(
+		slog.Uint64("bytes_in", bytesIn),
+		slog.Uint64("bytes_out", bytesOut),
+		slog.Int64("duration_ms", time.Since(r.started).Milliseconds()),
+	)
+	r.span.End(nil)
 }
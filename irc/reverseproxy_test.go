@@ -0,0 +1,247 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func splitWSMessageStrings(message string) (result []string) {
+	for _, line := range splitWSMessage(nil, []byte(message)) {
+		result = append(result, string(line))
+	}
+	return
+}
+
+func TestSplitWSMessage(t *testing.T) {
+	assertEqual(splitWSMessageStrings("PRIVMSG #chan :hi"), []string{"PRIVMSG #chan :hi"})
+	assertEqual(splitWSMessageStrings("PRIVMSG #chan :hi\r\n"), []string{"PRIVMSG #chan :hi"})
+	assertEqual(splitWSMessageStrings("PRIVMSG #chan :hi\n"), []string{"PRIVMSG #chan :hi"})
+	assertEqual(splitWSMessageStrings("NICK alice\r\nUSER u 0 * :Alice\r\n"), []string{"NICK alice", "USER u 0 * :Alice"})
+	assertEqual(splitWSMessageStrings("NICK alice\n\r\nUSER u 0 * :Alice\r"), []string{"NICK alice", "USER u 0 * :Alice"})
+	assertEqual(len(splitWSMessageStrings("\r\n")), 0)
+	assertEqual(len(splitWSMessageStrings("")), 0)
+}
+
+func TestUpstreamResponseTimeout(t *testing.T) {
+	// an upstream that accepts connections, but never responds:
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	listen := freeAddress(t)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithListener(listen),
+		WithUpstream(silent.Addr().String()),
+		WithYAML("log-level: error\nlookup-hostnames: false\nupstream-response-timeout: 1s"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.RunContext(ctx)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+listen+"/webirc", http.Header{"Origin": []string{"https://example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("NICK alice")); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if _, ok := err.(*websocket.CloseError); !ok {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatalf("closed too early, after %v", elapsed)
+	}
+}
+
+func TestCloseHandshake(t *testing.T) {
+	mock := startMockIRCd(t, "")
+	listen := freeAddress(t)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithListener(listen),
+		WithUpstream(mock.Addr()),
+		WithYAML("log-level: error\nlookup-hostnames: false\nwebsocket-close-timeout: 1s"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.RunContext(ctx)
+
+	// returns how long after the upstream disconnects the client the TCP
+	// connection is closed, if the client acknowledges the close frame (or not):
+	closedAfter := func(acknowledge bool) time.Duration {
+		conn, _, err := websocket.DefaultDialer.Dial("ws://"+listen+"/webirc", http.Header{"Origin": []string{"https://example.com"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for _, line := range []string{"NICK alice", "USER u 0 * :Alice"} {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range []string{"MOCK RAW :ERROR :Closing Link: (Killed)", "MOCK DISCONNECT"} {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		start := time.Now()
+		if acknowledge {
+			// gorilla acknowledges the close frame as it reads it:
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					closeErr, ok := err.(*websocket.CloseError)
+					if !ok {
+						t.Fatalf("expected a close frame, got %v", err)
+					}
+					assertEqual(closeErr.Code, closeCodeKilled)
+					break
+				}
+			}
+		}
+		buf := make([]byte, 1024)
+		for {
+			if _, err := conn.UnderlyingConn().Read(buf); err != nil {
+				if isTimeoutError(err) {
+					t.Fatal(err)
+				}
+				return time.Since(start)
+			}
+		}
+	}
+	assertEqual(closedAfter(true) < 500*time.Millisecond, true)
+	assertEqual(closedAfter(false) >= 500*time.Millisecond, true)
+}
+
+// waitForClients waits for the number of clients connected to the mock
+// ircd to become n
+func waitForClients(t *testing.T, mock *MockIRCd, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for mock.Clients() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d clients, found %d", n, mock.Clients())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func startRegistrationTimeoutTest(t *testing.T) (mock *MockIRCd, listen string, disconnected chan *DisconnectInfo) {
+	mock = startMockIRCd(t, "")
+	listen = freeAddress(t)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithListener(listen),
+		WithUpstream(mock.Addr()),
+		WithYAML("log-level: error\nlookup-hostnames: false\nregistration-timeout: 1s"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disconnected = make(chan *DisconnectInfo, 1)
+	server.SetHooks(&Hooks{
+		OnDisconnect: func(conn *ClientInfo, info *DisconnectInfo) {
+			disconnected <- info
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go server.RunContext(ctx)
+	return
+}
+
+func TestRegistrationTimeout(t *testing.T) {
+	mock, listen, disconnected := startRegistrationTimeoutTest(t)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+listen+"/webirc", http.Header{"Origin": []string{"https://example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitForClients(t, mock, 1)
+	// send nothing:
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatalf("closed too early, after %v", elapsed)
+	}
+	assertEqual((<-disconnected).Reason, CloseRegistrationTimeout)
+	waitForClients(t, mock, 0)
+}
+
+func TestRegistrationTimeoutCleared(t *testing.T) {
+	mock, listen, disconnected := startRegistrationTimeoutTest(t)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+listen+"/webirc", http.Header{"Origin": []string{"https://example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("NICK alice")); err != nil {
+		t.Fatal(err)
+	}
+	// after the first message, the client may take its time:
+	time.Sleep(1500 * time.Millisecond)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("USER u 0 * :Alice")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(string(message), ":mock.ircd 001 alice :Welcome to the mock IRC network alice!u@127.0.0.1")
+	assertEqual(mock.Clients(), 1)
+	select {
+	case info := <-disconnected:
+		t.Fatalf("unexpected disconnection: %v", info.Reason)
+	default:
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"net"
+)
+
+// RouteQuery describes a hypothetical connection, for RouteDryRun.
+type RouteQuery struct {
+	Origin string
+	// the Host header of the websocket request:
+	Host string
+	// the client's IP (optional):
+	IP string
+	// the address of the listener it connects to (optional; the default is
+	// the top-level config):
+	Listener string
+}
+
+// RouteReport describes how a connection would be routed.
+type RouteReport struct {
+	Profile string `json:"profile,omitempty"`
+	Allowed bool   `json:"allowed"`
+	// why the connection would be rejected, or how its candidate upstreams
+	// were determined:
+	Reason string `json:"reason"`
+	// the origins of the origin policy that applies, if any:
+	OriginPolicy []string         `json:"origin_policy,omitempty"`
+	Candidates   []RouteCandidate `json:"candidates"`
+	// one upstream chosen at random, as a real connection's would be, and
+	// the address it would dial (see addresstemplates.go):
+	Upstream string `json:"upstream,omitempty"`
+	Address  string `json:"address,omitempty"`
+}
+
+// RouteCandidate is an upstream the connection could be routed to.
+type RouteCandidate struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+	// the probability of it being chosen:
+	Share float64 `json:"share"`
+	// why it can't be chosen, if it can't:
+	Excluded string `json:"excluded,omitempty"`
+}
+
+// candidateUpstreams returns the upstreams the client may be routed to
+// (before excluding drained and removed upstreams), and why
+func (server *Server) candidateUpstreams(config *Config, client *clientData) (candidates []*reverseProxyUpstream, reason string) {
+	if client.tor && config.Tor.upstream != nil {
+		return []*reverseProxyUpstream{config.Tor.upstream}, "Tor listener: the Tor upstream"
+	} else if client.policy != nil && len(client.policy.upstreams) != 0 {
+		return client.policy.upstreams, "the origin policy's upstreams"
+	}
+	return server.runtimeUpstreams.get().upstreams(config), "all upstreams"
+}
+
+// RouteDryRun reports which upstreams the routing and load balancing would
+// choose from for a connection, and why, without connecting anything. The
+// OnUpstreamSelected hook and sticky-sessions cookies aren't considered.
+func (server *Server) RouteDryRun(query RouteQuery) (report RouteReport, err error) {
+	config := server.Config()
+	client := &clientData{}
+	if query.Listener != "" {
+		listenerConf, ok := config.trueListeners[query.Listener]
+		if !ok {
+			return report, fmt.Errorf("no such listener: %s", query.Listener)
+		}
+		config = config.forListener(query.Listener)
+		report.Profile = listenerConf.profile
+		client.tor = listenerConf.Tor
+	}
+	report.Candidates = []RouteCandidate{}
+	if query.IP != "" {
+		client.ip = net.ParseIP(query.IP)
+		if client.ip == nil {
+			return report, fmt.Errorf("invalid IP: %s", query.IP)
+		}
+		if banned, _ := server.bans.IsBanned(client.ip); banned {
+			report.Reason = "the IP is banned"
+			return report, nil
+		}
+	}
+	policy, allowed := config.checkOrigin(query.Origin, query.Host)
+	if !allowed {
+		report.Reason = "the origin is not allowed"
+		return report, nil
+	}
+	report.Allowed = true
+	if policy != nil {
+		client.policy = policy
+		report.OriginPolicy = policy.Origins
+	}
+
+	overlay := server.runtimeUpstreams.get()
+	candidates, reason := server.candidateUpstreams(config, client)
+	report.Reason = reason
+	total := 0
+	for _, upstream := range server.availableUpstreams(config, client) {
+		total += overlay.weight(upstream)
+	}
+	for _, upstream := range candidates {
+		candidate := RouteCandidate{Name: upstream.Name, Weight: overlay.weight(upstream)}
+		switch {
+		case overlay.removed[upstream]:
+			candidate.Excluded = "removed"
+		case server.drains.isDrained(upstream.Name):
+			candidate.Excluded = "drained"
+		case total != 0:
+			candidate.Share = float64(candidate.Weight) / float64(total)
+		}
+		report.Candidates = append(report.Candidates, candidate)
+	}
+	if upstream := server.selectUpstream(config, client); upstream != nil {
+		report.Upstream = upstream.Name
+		report.Address = upstream.forClient(config, client.ip).Address
+	} else {
+		report.Reason += " (none are available)"
+	}
+	return report, nil
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouteDryRun(t *testing.T) {
+	config, err := loadTestConfig(t, `
+gateway-name: "gateway.example.com"
+listeners:
+    "127.0.0.1:8067":
+upstreams:
+    -
+        name: "main"
+        address: "192.0.2.1:6667"
+    -
+        name: "backup"
+        address: "192.0.2.2:6667"
+    -
+        name: "other"
+        address: "192.0.2.3:6667"
+origin-policies:
+    -
+        origins: ["https://*.example.com"]
+        upstreams: ["main", "backup"]
+profiles:
+    network1:
+        listeners:
+            "127.0.0.1:8068":
+        upstreams:
+            -
+                name: "irc"
+                address: "irc.network1.example:6697"
+        origin-policies:
+            -
+                origins: ["https://network1.example"]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := new(Server)
+	server.SetConfig(config)
+
+	report, err := server.RouteDryRun(RouteQuery{Origin: "https://www.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(report.Allowed, true)
+	assertEqual(report.Reason, "the origin policy's upstreams")
+	assertEqual(len(report.Candidates), 2)
+	assertEqual(report.Candidates[0], RouteCandidate{Name: "main", Weight: 1, Share: 0.5})
+
+	server.DrainUpstream("main", true, false)
+	report, _ = server.RouteDryRun(RouteQuery{Origin: "https://www.example.com"})
+	assertEqual(report.Candidates[0].Excluded, "drained")
+	assertEqual(report.Candidates[1].Share, 1.0)
+	assertEqual(report.Upstream, "backup")
+
+	report, _ = server.RouteDryRun(RouteQuery{Origin: "https://network1.example", Listener: "127.0.0.1:8068"})
+	assertEqual(report.Profile, "network1")
+	assertEqual(report.Upstream, "network1/irc")
+	report, _ = server.RouteDryRun(RouteQuery{Origin: "https://evil.example"})
+	assertEqual(report.Allowed, false)
+	assertEqual(len(report.Candidates), 0)
+
+	w := httptest.NewRecorder()
+	server.handleAdmin(w, httptest.NewRequest(http.MethodGet, "/route?origin=https://www.example.com&ip=192.0.2.10", nil))
+	assertEqual(w.Code, http.StatusOK)
+	json.NewDecoder(w.Body).Decode(&report)
+	assertEqual(report.Upstream, "backup")
+	w = httptest.NewRecorder()
+	server.handleAdmin(w, httptest.NewRequest(http.MethodGet, "/route?listener=127.0.0.1:9999", nil))
+	assertEqual(w.Code, http.StatusBadRequest)
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ergochat/irc-go/ircmsg"
+	"github.com/ergochat/irc-go/ircreader"
+)
+
+// Self-test: connect to each upstream as a client would, sending WEBIRC for
+// a loopback IP, and check that registration succeeds. This catches wrong
+// WEBIRC passwords and unreachable upstreams before real users do.
+
+const (
+	selfTestTimeout = 15 * time.Second
+)
+
+var (
+	errSelfTestTimeout = errors.New("timed out waiting for registration")
+)
+
+// SelfTestResult is the outcome of testing one upstream.
+type SelfTestResult struct {
+	Upstream string        `json:"upstream"`
+	Success  bool          `json:"success"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// SelfTest tests each upstream in the config (including those of profiles),
+// returning the results in the order the upstreams are configured.
+func SelfTest(config *Config) (results []SelfTestResult) {
+	type target struct {
+		config   *Config
+		upstream *reverseProxyUpstream
+	}
+	var targets []target
+	for _, c := range config.allConfigs() {
+		for i := range c.Upstreams {
+			targets = append(targets, target{c, &c.Upstreams[i]})
+		}
+	}
+	results = make([]SelfTestResult, len(targets))
+	done := make(chan struct{}, len(targets))
+	for i, t := range targets {
+		go func(i int, t target) {
+			results[i] = selfTestUpstream(t.config, t.upstream)
+			done <- struct{}{}
+		}(i, t)
+	}
+	for range targets {
+		<-done
+	}
+	return
+}
+
+// SelfTest tests each upstream in the current config.
+func (server *Server) SelfTest() []SelfTestResult {
+	return SelfTest(server.Config())
+}
+
+// verifyWebircCerts self-tests the upstreams that authenticate WEBIRC with
+// only a client certificate (webirc cert-only), when a config is applied, so
+// that a certificate the ircd doesn't accept is reported right away, instead
+// of when clients are refused
+func (server *Server) verifyWebircCerts(config *Config) {
+	for _, c := range config.allConfigs() {
+		for i := range c.Upstreams {
+			upstream := &c.Upstreams[i]
+			if !upstream.Webirc.Enabled || !upstream.Webirc.CertOnly {
+				continue
+			}
+			result := selfTestUpstream(c, upstream)
+			if result.Success {
+				server.Log(LogComponentServer, LogLevelInfo, "upstream accepted the WEBIRC certificate", slog.String(logKeyUpstream, upstream.Name))
+			} else {
+				server.Log(LogComponentServer, LogLevelError, "couldn't verify the WEBIRC certificate with the upstream", slog.String(logKeyUpstream, upstream.Name), slog.String(logKeyError, result.Error))
+			}
+		}
+	}
+}
+
+func selfTestUpstream(config *Config, upstream *reverseProxyUpstream) (result SelfTestResult) {
+	result.Upstream = upstream.Name
+	start := time.Now()
+	err := runSelfTest(config, upstream)
+	result.Duration = time.Since(start)
+	result.Success = err == nil
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return
+}
+
+func runSelfTest(config *Config, upstream *reverseProxyUpstream) (err error) {
+	var proxyHeader []byte
+	if upstream.SendProxy {
+		proxyHeader = makeProxyV2Header(&proxyHeaderInfo{srcIP: net.IPv4(127, 0, 0, 1), connID: "selftest", gatewayName: config.GatewayName})
+	}
+	// with address variables, test the address for a local client:
+	upstream = upstream.forClient(config, net.IPv4(127, 0, 0, 1))
+	conn, err := dialUpstream(config, upstream, proxyHeader, nil)
+	if err != nil {
+		return fmt.Errorf("couldn't connect: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(selfTestTimeout))
+
+	var nonce [4]byte
+	rand.Read(nonce[:])
+	nick := "selftest-" + hex.EncodeToString(nonce[:])
+	var lines []ircmsg.Message
+	if upstream.Webirc.Enabled {
+		lines = append(lines, ircmsg.MakeMessage(nil, "", "WEBIRC",
+			upstream.webircPassword(time.Now()), config.GatewayName, "localhost", "127.0.0.1", "secure"))
+	}
+	lines = append(lines,
+		ircmsg.MakeMessage(nil, "", "NICK", nick),
+		ircmsg.MakeMessage(nil, "", "USER", "selftest", "0", "*", "webircproxy self-test"),
+	)
+	for _, line := range lines {
+		lineBytes, err := line.LineBytesStrict(false, DefaultMaxLineLen)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(lineBytes); err != nil {
+			return fmt.Errorf("couldn't send registration: %w", err)
+		}
+	}
+
+	var reader ircreader.Reader
+	reader.Initialize(conn, initialBufferSize, DefaultMaxLineLen*4)
+	for {
+		line, err := reader.ReadLine()
+		if err != nil {
+			if isTimeoutError(err) {
+				return errSelfTestTimeout
+			}
+			return fmt.Errorf("error reading from upstream: %w", err)
+		}
+		msg, err := ircmsg.ParseLine(string(line))
+		if err != nil {
+			continue
+		}
+		switch msg.Command {
+		case "001":
+			conn.Write([]byte("QUIT :webircproxy self-test\r\n"))
+			return nil
+		case "PING":
+			// some ircds send a cookie that must be echoed before registration
+			pong := ircmsg.MakeMessage(nil, "", "PONG", msg.Params...)
+			if pongBytes, err := pong.LineBytesStrict(false, DefaultMaxLineLen); err == nil {
+				conn.Write(pongBytes)
+			}
+		case "ERROR", "FAIL":
+			return fmt.Errorf("upstream rejected registration: %s %s", msg.Command, strings.Join(msg.Params, " "))
+		default:
+			// 4xx and 5xx numerics are errors, e.g. 464 ERR_PASSWDMISMATCH
+			if len(msg.Command) == 3 && (msg.Command[0] == '4' || msg.Command[0] == '5') {
+				return fmt.Errorf("upstream rejected registration: %s %s", msg.Command, strings.Join(msg.Params, " "))
+			}
+		}
+	}
+}
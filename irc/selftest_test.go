@@ -0,0 +1,88 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeWebircServer accepts registrations whose WEBIRC password is `password`
+func fakeWebircServer(t *testing.T, password string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				webircOK := false
+				for scanner.Scan() {
+					fields := strings.Fields(scanner.Text())
+					switch fields[0] {
+					case "WEBIRC":
+						webircOK = fields[1] == password && fields[4] == "127.0.0.1"
+					case "USER":
+						if !webircOK {
+							fmt.Fprintf(conn, "ERROR :Invalid WEBIRC password\r\n")
+							return
+						}
+						fmt.Fprintf(conn, "PING :cookie\r\n")
+					case "PONG":
+						fmt.Fprintf(conn, ":irc.example.com 001 selftest :Welcome\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestSelfTest(t *testing.T) {
+	good := fakeWebircServer(t, "hunter2")
+	config := &Config{
+		GatewayName: "webircproxy.example.com",
+		dialer:      &net.Dialer{},
+		Upstreams:   []reverseProxyUpstream{{Name: "good", Address: good}, {Name: "bad", Address: good}, {Name: "down", Address: freeAddress(t)}},
+	}
+	config.Upstreams[0].Webirc.Enabled = true
+	config.Upstreams[0].Webirc.Password = "hunter2"
+	config.Upstreams[1].Webirc.Enabled = true
+	config.Upstreams[1].Webirc.Password = "wrong"
+	for i := range config.Upstreams {
+		if err := config.Upstreams[i].postprocess(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results := SelfTest(config)
+	assertEqual(len(results), 3)
+	assertEqual(results[0].Upstream, "good")
+	assertEqual(results[0].Success, true)
+	assertEqual(results[1].Success, false)
+	assertEqual(results[1].Error, "upstream rejected registration: ERROR Invalid WEBIRC password")
+	assertEqual(results[2].Success, false)
+	assertEqual(strings.HasPrefix(results[2].Error, "couldn't connect"), true)
+}
+
+// freeAddress returns a local address that nothing is listening on
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
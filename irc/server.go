@@ -4,12 +4,20 @@
 package irc
 
 import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
@@ -19,74 +27,209 @@ import (
 	"github.com/ergochat/ergo/irc/utils"
 )
 
+var (
+	errServerStopped = errors.New("the server has been stopped")
+)
+
 // Server is the main Oragono server.
 type Server struct {
 	config         unsafe.Pointer
 	configFilename string
 	listeners      map[string]*WSListener
-	rehashMutex    sync.Mutex // tier 4
+	listenerErrors map[string]error // protected by rehashMutex
+	rehashMutex    sync.Mutex       // tier 4
 	rehashSignal   chan os.Signal
 	pprofServer    *http.Server
 	exitSignals    chan os.Signal
-
-	logMutex sync.Mutex
+	// closed by Stop:
+	done          chan struct{}
+	stopOnce      sync.Once
+	stopped       bool // protected by rehashMutex
+	bans          banManager
+	throttle      ipThrottler
+	bandwidth     bandwidthAccountant
+	reputation    reputationCache
+	tracer        tracer
+	conns         connRegistry
+	sessions      sessionRegistry
+	accountConns  sessionRegistry
+	drains        upstreamDrains
+	adminServer   *http.Server
+	audit         auditLog
+	metrics       serverMetrics
+	metricsServer *http.Server
+	statsd        statsdEmitter
+	configWatch   configWatcher
+	runtimeLimits runtimeLimits
+	connSlots     connectionSlots
+	// reverse DNS lookups in progress:
+	hostnameLookups connectionSlots
+	// upstreams added, removed, or re-weighted at runtime:
+	runtimeUpstreams runtimeUpstreams
+	prewarm          prewarmPools
+	startTime        time.Time
+	handoffSignal    chan os.Signal
+	handedOff        bool       // protected by rehashMutex
+	logSinksMutex    sync.Mutex // tier 1
+	logSinks         map[string]io.WriteCloser
+	logSampler       logSampler
+	// set by SetLogger, overriding the configured log outputs:
+	logger atomic.Pointer[Logger]
+	hooks  atomic.Pointer[Hooks]
+	events eventBus
+	// set by SetMetrics:
+	metricsSink atomic.Pointer[Metrics]
+	panicHook   atomic.Pointer[PanicHook]
+	// number of panic reports being sent to sentry:
+	panicReportsInflight atomic.Int32
+	// running proxy goroutines, for the leak check (see leakcheck.go):
+	proxyGoroutines atomic.Int64
+	// upstream TLS sessions (see tlssessions.go):
+	tlsSessions tls.ClientSessionCache
 }
 
 // NewServer returns a new Oragono server.
 func NewServer(config *Config) (*Server, error) {
 	// initialize data structures
 	server := &Server{
-		listeners:    make(map[string]*WSListener),
-		rehashSignal: make(chan os.Signal, 1),
-		exitSignals:  make(chan os.Signal, len(utils.ServerExitSignals)),
+		listeners:     make(map[string]*WSListener),
+		rehashSignal:  make(chan os.Signal, 1),
+		handoffSignal: make(chan os.Signal, 1),
+		exitSignals:   make(chan os.Signal, len(utils.ServerExitSignals)),
+		done:          make(chan struct{}),
+		tlsSessions:   tls.NewLRUClientSessionCache(tlsSessionCacheSize),
 	}
+	server.startTime = time.Now()
+	server.metrics.initialize()
+	server.publishExpvar()
 
-	if err := server.applyConfig(config); err != nil {
+	if err := server.applyConfig(config, nil); err != nil {
 		return nil, err
 	}
 
 	// Attempt to clean up when receiving these signals.
 	signal.Notify(server.exitSignals, utils.ServerExitSignals...)
 	signal.Notify(server.rehashSignal, syscall.SIGHUP)
+	setupHandoffSignal(server)
+	setupConsoleRehash(server)
+
+	if interval := watchdogInterval(); interval != 0 {
+		go server.runWatchdog(interval)
+	}
+	go server.runLeakCheck()
+	go server.runBufferShrinker()
 
 	return server, nil
 }
 
-// Shutdown shuts down the server.
+// Stop shuts down the server: it closes the listeners (including those of
+// the admin API, metrics, and pprof), disconnects the proxied connections,
+// stops the background tasks, and makes Run or RunContext return. It can be
+// called more than once, from any goroutine; it returns when it is done.
+func (server *Server) Stop() {
+	server.stopOnce.Do(server.stop)
+}
+
+// Shutdown is equivalent to Stop.
 func (server *Server) Shutdown() {
-	sdnotify.Stopping()
-	server.Log(LogLevelInfo, "Exiting")
+	server.Stop()
+}
+
+func (server *Server) stop() {
+	server.rehashMutex.Lock()
+	defer server.rehashMutex.Unlock()
+
+	server.stopped = true
+	close(server.done)
+	signal.Stop(server.exitSignals)
+	signal.Stop(server.rehashSignal)
+	signal.Stop(server.handoffSignal)
+
+	// after a handoff, systemd is tracking the new process:
+	if !server.handedOff {
+		sdnotify.Stopping()
+	}
+	server.Log(LogComponentServer, LogLevelInfo, "Exiting")
+
+	for addr, listener := range server.listeners {
+		listener.Stop()
+		delete(server.listeners, addr)
+	}
+	for _, httpServer := range []*http.Server{server.adminServer, server.metricsServer, server.pprofServer} {
+		if httpServer != nil {
+			httpServer.Close()
+		}
+	}
+	server.adminServer, server.metricsServer, server.pprofServer = nil, nil, nil
+	server.prewarm.stop()
+	for _, conn := range server.conns.all() {
+		conn.closeWithReason(CloseShutdown, nil)
+	}
 }
 
-// Run starts the server.
+// Run runs the server until it receives an exit signal (SIGINT, SIGTERM,
+// or SIGQUIT), handling SIGHUP (rehash) and SIGUSR2 (handoff), then stops it.
 func (server *Server) Run() {
-	defer server.Shutdown()
+	server.RunContext(context.Background())
+}
+
+// RunContext is like Run, but also stops the server when ctx is done
+// or Stop is called.
+func (server *Server) RunContext(ctx context.Context) {
+	defer server.Stop()
 
 	for {
 		select {
+		case <-ctx.Done():
+			return
+		case <-server.done:
+			return
 		case <-server.exitSignals:
 			return
 		case <-server.rehashSignal:
 			go server.rehash()
+		case <-server.handoffSignal:
+			go func() {
+				if err := server.handoff(); err != nil {
+					server.Log(LogComponentServer, LogLevelError, fmt.Sprintf("Failed to hand off to a new process: %v", err))
+				}
+			}()
 		}
 	}
 }
 
-type LogLevel uint
+// Rehash reloads the config file and applies it, as SIGHUP does.
+func (server *Server) Rehash() error {
+	_, err := server.rehash()
+	return err
+}
 
-const (
-	LogLevelError LogLevel = iota
-	LogLevelWarn
-	LogLevelInfo
-	LogLevelDebug
-)
+// sleep waits for d, returning false early if the server is stopped
+func (server *Server) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-server.done:
+		return false
+	}
+}
 
-func (server *Server) Log(level LogLevel, message string) {
-	if level <= server.Config().logLevel {
-		server.logMutex.Lock()
-		fmt.Fprintf(os.Stderr, "%s [%s] %s\n",
-			logLevelToString(level), time.Now().UTC().Format(utils.IRCv3TimestampFormat), message)
-		server.logMutex.Unlock()
+// requestRehash triggers a rehash, as SIGHUP does (for platforms without it)
+func (server *Server) requestRehash() {
+	select {
+	case server.rehashSignal <- syscall.SIGHUP:
+	default:
+		// a rehash is already pending
+	}
+}
+
+// requestExit shuts down the server, as SIGTERM does
+func (server *Server) requestExit() {
+	select {
+	case server.exitSignals <- syscall.SIGTERM:
+	default:
 	}
 }
 
@@ -94,36 +237,59 @@ func (server *Server) Log(level LogLevel, message string) {
 // server functionality
 //
 
-// rehash reloads the config and applies the changes from the config file.
-func (server *Server) rehash() error {
+// rehash reloads the config and applies the changes from the config file,
+// returning a summary of what changed (if it got as far as applying them).
+func (server *Server) rehash() (*RehashSummary, error) {
 	defer server.HandlePanic()
 
-	server.Log(LogLevelInfo, "Attempting rehash")
+	server.Log(LogComponentConfig, LogLevelInfo, "Attempting rehash")
 
 	// only let one REHASH go on at a time
 	server.rehashMutex.Lock()
 	defer server.rehashMutex.Unlock()
 
+	if server.stopped {
+		return nil, errServerStopped
+	} else if server.handedOff {
+		return nil, errHandoffInProgress
+	}
+
 	sdnotify.Reloading()
 	defer sdnotify.Ready()
 
-	config, err := LoadConfig(server.configFilename)
+	if server.configFilename == "" {
+		server.Log(LogComponentConfig, LogLevelError, fmt.Sprintf("Failed to rehash: %v", errNoConfigFile))
+		return nil, errNoConfigFile
+	}
+
+	config, err := loadConfigForRehash(server.configFilename)
 	if err != nil {
-		server.Log(LogLevelError, fmt.Sprintf("Failed to load config file: %v", err.Error()))
-		return err
+		server.Log(LogComponentConfig, LogLevelError, fmt.Sprintf("Failed to load config file: %v", err.Error()))
+		return nil, err
 	}
+	config.retainFailedListeners(server.Config())
 
-	err = server.applyConfig(config)
+	summary := new(RehashSummary)
+	summary.diffConfigs(server.Config(), config)
+	err = server.applyConfig(config, summary)
+	summary.sort()
 	if err != nil {
-		server.Log(LogLevelError, fmt.Sprintf("Failed to rehash: %v", err.Error()))
-		return err
+		if len(summary.ListenersFailed) != 0 {
+			// the rest of the config was applied
+			server.Log(LogComponentConfig, LogLevelError, fmt.Sprintf("Rehash completed with listener errors: %v", err.Error()), summary.logAttrs()...)
+			return summary, err
+		}
+		server.Log(LogComponentConfig, LogLevelError, fmt.Sprintf("Failed to rehash: %v", err.Error()))
+		return nil, err
 	}
 
-	server.Log(LogLevelInfo, "Rehash completed successfully")
-	return nil
+	server.Log(LogComponentConfig, LogLevelInfo, "Rehash completed successfully", summary.logAttrs()...)
+	return summary, nil
 }
 
-func (server *Server) applyConfig(config *Config) (err error) {
+// applyConfig applies a new config; for a rehash, the changes to the listeners
+// are recorded in summary
+func (server *Server) applyConfig(config *Config, summary *RehashSummary) (err error) {
 	oldConfig := server.Config()
 	initial := oldConfig == nil
 
@@ -131,19 +297,55 @@ func (server *Server) applyConfig(config *Config) (err error) {
 		server.configFilename = config.Filename
 	}
 
+	// open the log outputs first, so that a bad log file path fails the rehash
+	if err := server.setupLogging(config); err != nil {
+		return err
+	}
+	if err := server.audit.ApplyConfig(&config.AuditLog); err != nil {
+		return err
+	}
+
 	// activate the new config
 	server.SetConfig(config)
+	if !initial {
+		// the config file is authoritative again:
+		server.runtimeUpstreams.reset()
+	}
+
+	if server.configFilename != "" {
+		server.Log(LogComponentConfig, LogLevelInfo, fmt.Sprintf("Using config file %s", server.configFilename))
+	}
+	// with lenient, the problems that were skipped:
+	for _, warning := range config.warnings {
+		server.Log(LogComponentConfig, LogLevelWarn, fmt.Sprintf("Ignoring config problem: %s", warning))
+	}
+	if summary != nil {
+		summary.Warnings = config.warnings
+	}
 
-	server.Log(LogLevelInfo, fmt.Sprintf("Using config file %s", server.configFilename))
+	server.runtimeLimits.ApplyConfig(&config.Limits)
+	server.bans.ApplyConfig(&config.AutoBan)
+	server.tracer.ApplyConfig(server, &config.Tracing)
 
 	server.setupPprofListener(config)
+	server.setupAdminListener(config)
+	server.setupMetricsListener(config)
+	server.statsd.ApplyConfig(server, &config.StatsD)
+	server.configWatch.ApplyConfig(server, &config.WatchConfig)
+	server.prewarm.update(server)
+	go server.verifyWebircCerts(config)
 
 	// we are now ready to receive connections:
-	err = server.setupListeners(config)
+	err = server.setupListeners(config, summary)
+
+	if initial {
+		closeUnusedInheritedListeners()
+	}
 
 	if initial && err == nil {
-		server.Log(LogLevelInfo, "Server running")
+		server.Log(LogComponentServer, LogLevelInfo, "Server running")
 		sdnotify.Ready()
+		signalHandoffReady()
 	}
 
 	return err
@@ -153,32 +355,72 @@ func (server *Server) setupPprofListener(config *Config) {
 	pprofListener := config.PprofListener
 	if server.pprofServer != nil {
 		if pprofListener == "" || (pprofListener != server.pprofServer.Addr) {
-			server.Log(LogLevelInfo, fmt.Sprintf("Stopping pprof listener at %s", server.pprofServer.Addr))
+			server.Log(LogComponentServer, LogLevelInfo, fmt.Sprintf("Stopping pprof listener at %s", server.pprofServer.Addr))
 			server.pprofServer.Close()
 			server.pprofServer = nil
 		}
 	}
 	if pprofListener != "" && server.pprofServer == nil {
+		// pprof exposes heap dumps, so don't use unix-bind-mode:
+		listener, err := createBaseListener(pprofListener, 0600, false)
+		if err != nil {
+			server.Log(LogComponentServer, LogLevelError, fmt.Sprintf("couldn't start pprof listener: %v", err))
+			return
+		}
 		ps := http.Server{
-			Addr: pprofListener,
+			Addr:    pprofListener,
+			Handler: http.HandlerFunc(server.handlePprof),
 		}
 		go func() {
-			if err := ps.ListenAndServe(); err != nil {
-				server.Log(LogLevelError, fmt.Sprintf("pprof listener failed: %v", err))
+			if err := ps.Serve(listener); err != nil && err != http.ErrServerClosed {
+				server.Log(LogComponentServer, LogLevelError, fmt.Sprintf("pprof listener failed: %v", err))
 			}
 		}()
 		server.pprofServer = &ps
-		server.Log(LogLevelInfo, fmt.Sprintf("Started pprof listener: %s", server.pprofServer.Addr))
+		server.Log(LogComponentServer, LogLevelInfo, fmt.Sprintf("Started pprof listener: %s", server.pprofServer.Addr))
 	}
 }
 
-func (server *Server) setupListeners(config *Config) (err error) {
-	logListener := func(addr string, config utils.ListenerConfig) {
-		server.Log(LogLevelInfo,
-			fmt.Sprintf("now listening on %s, tls=%t, proxy=%t, tor=%t", addr, (config.TLSConfig != nil), config.RequireProxy, config.Tor),
+// handlePprof serves the pprof and expvar handlers (registered on the default
+// mux), checking pprof-token if it is set
+func (server *Server) handlePprof(w http.ResponseWriter, r *http.Request) {
+	if token := server.Config().PprofToken; token != "" {
+		provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	http.DefaultServeMux.ServeHTTP(w, r)
+}
+
+func (server *Server) setupListeners(config *Config, summary *RehashSummary) error {
+	if summary == nil {
+		// initial startup; nothing to compare against
+		summary = new(RehashSummary)
+	}
+	restarting := make(map[string]bool)
+	logListener := func(addr string, config listenerConfig) {
+		server.Log(LogComponentListener, LogLevelInfo,
+			fmt.Sprintf("now listening on %s, tls=%t, proxy=%t, tor=%t, require-secure=%t", addr, (config.TLSConfig != nil), config.RequireProxy, config.Tor, config.RequireSecure),
 		)
 	}
 
+	// listeners whose blocks failed to load keep running with their previous
+	// settings (see retainFailedListeners), if they were running at all:
+	var retainedErrors []string
+	for addr, loadErr := range config.listenerLoadErrors {
+		server.Log(LogComponentListener, LogLevelError, fmt.Sprintf("couldn't load listener %s", addr), errAttr(loadErr))
+		if summary.ListenersFailed == nil {
+			summary.ListenersFailed = make(map[string]string)
+		}
+		summary.ListenersFailed[addr] = loadErr.Error()
+		if _, retained := config.trueListeners[addr]; retained {
+			retainedErrors = append(retainedErrors, loadErr.Error())
+		}
+	}
+
 	// update or destroy all existing listeners
 	for addr := range server.listeners {
 		currentListener := server.listeners[addr]
@@ -187,20 +429,33 @@ func (server *Server) setupListeners(config *Config) (err error) {
 		if stillConfigured {
 			if reloadErr := currentListener.Reload(newConfig); reloadErr == nil {
 				logListener(addr, newConfig)
+				if config.listenerLoadErrors[addr] == nil {
+					summary.ListenersReloaded = append(summary.ListenersReloaded, addr)
+				}
 			} else {
 				// stop the listener; we will attempt to replace it below
 				currentListener.Stop()
 				delete(server.listeners, addr)
+				restarting[addr] = true
 			}
 		} else {
 			currentListener.Stop()
 			delete(server.listeners, addr)
-			server.Log(LogLevelInfo, fmt.Sprintf("stopped listening on %s.", addr))
+			server.Log(LogComponentListener, LogLevelInfo, fmt.Sprintf("stopped listening on %s.", addr))
+			summary.ListenersRemoved = append(summary.ListenersRemoved, addr)
+			server.notifyListenerRemoved(addr)
 		}
 	}
 
 	// create new listeners that were not previously configured,
 	// or that couldn't be reloaded above:
+	server.listenerErrors = make(map[string]error)
+	for addr, loadErr := range config.listenerLoadErrors {
+		if _, retained := config.trueListeners[addr]; !retained {
+			// there is nothing listening on the address:
+			server.listenerErrors[addr] = loadErr
+		}
+	}
 	for newAddr, newConfig := range config.trueListeners {
 		_, exists := server.listeners[newAddr]
 		if !exists {
@@ -209,12 +464,40 @@ func (server *Server) setupListeners(config *Config) (err error) {
 			if newErr == nil {
 				server.listeners[newAddr] = newListener
 				logListener(newAddr, newConfig)
+				if restarting[newAddr] {
+					summary.ListenersRestarted = append(summary.ListenersRestarted, newAddr)
+				} else {
+					summary.ListenersAdded = append(summary.ListenersAdded, newAddr)
+				}
 			} else {
-				server.Log(LogLevelInfo, fmt.Sprintf("couldn't listen on %s: %v", newAddr, newErr))
-				err = newErr
+				server.Log(LogComponentListener, LogLevelError, fmt.Sprintf("couldn't listen on %s", newAddr), errAttr(newErr))
+				server.listenerErrors[newAddr] = newErr
+				if summary.ListenersFailed == nil {
+					summary.ListenersFailed = make(map[string]string)
+				}
+				summary.ListenersFailed[newAddr] = newErr.Error()
 			}
 		}
 	}
 
-	return
+	if len(retainedErrors) != 0 {
+		sort.Strings(retainedErrors)
+		retainedErr := fmt.Errorf("couldn't load %d listeners, which kept their previous settings: %s", len(retainedErrors), strings.Join(retainedErrors, "; "))
+		return errors.Join(server.listenerBindError(), retainedErr)
+	}
+	return server.listenerBindError()
+}
+
+// listenerBindError summarizes the listeners that failed to bind during
+// the last rehash (or startup); requires rehashMutex
+func (server *Server) listenerBindError() error {
+	if len(server.listenerErrors) == 0 {
+		return nil
+	}
+	failed := make([]string, 0, len(server.listenerErrors))
+	for addr, err := range server.listenerErrors {
+		failed = append(failed, fmt.Sprintf("%s: %v", addr, err))
+	}
+	sort.Strings(failed)
+	return fmt.Errorf("couldn't listen on %d of %d listeners: %s", len(failed), len(server.listenerErrors)+len(server.listeners), strings.Join(failed, "; "))
 }
@@ -0,0 +1,99 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPprofListenerValidation(t *testing.T) {
+	for _, listen := range []string{"", "localhost:6060", "127.0.0.1:6060", "unix:/run/webircproxy/pprof.sock"} {
+		config := Config{PprofListener: listen}
+		if err := config.validatePprofListener(); err != nil {
+			t.Errorf("%s should be allowed: %v", listen, err)
+		}
+	}
+	for _, listen := range []string{":6060", "0.0.0.0:6060", "192.0.2.1:6060"} {
+		config := Config{PprofListener: listen}
+		if config.validatePprofListener() == nil {
+			t.Errorf("%s should require a token", listen)
+		}
+		config.PprofToken = "0123456789abcdef"
+		if err := config.validatePprofListener(); err != nil {
+			t.Errorf("%s should be allowed with a token: %v", listen, err)
+		}
+	}
+}
+
+func TestPprofToken(t *testing.T) {
+	server := new(Server)
+	server.SetConfig(&Config{PprofListener: ":6060", PprofToken: "0123456789abcdef"})
+
+	request := func(authorization string) int {
+		r := httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		server.handlePprof(w, r)
+		return w.Code
+	}
+	assertEqual(request(""), http.StatusUnauthorized)
+	assertEqual(request("Bearer wrong"), http.StatusUnauthorized)
+	assertEqual(request("0123456789abcdef"), http.StatusUnauthorized)
+	assertEqual(request("Bearer 0123456789abcdef"), http.StatusOK)
+}
+
+func TestRunContextAndStop(t *testing.T) {
+	listen := freeAddress(t)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithListener(listen),
+		WithUpstream("127.0.0.1:6667"),
+		WithYAML("log-level: error"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// there is no config file to reload:
+	assertEqual(server.Rehash(), errNoConfigFile)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	returned := make(chan struct{})
+	go func() {
+		server.RunContext(ctx)
+		close(returned)
+	}()
+	conn, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	cancel()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunContext did not return")
+	}
+	// the listener was closed, so its address can be reused:
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	assertEqual(server.Rehash(), errServerStopped)
+	assertEqual(server.sleep(time.Hour), false)
+	// Stop is idempotent:
+	server.Stop()
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+)
+
+var (
+	errServiceNotSupported = errors.New("Windows services are only supported on Windows")
+)
+
+// on unix, SIGHUP rehashes; see service_windows.go for the alternatives
+
+func setupConsoleRehash(server *Server) {}
+
+func RunService(configFile string) error {
+	return errServiceNotSupported
+}
+
+func InstallService(configFile string) error {
+	return errServiceNotSupported
+}
+
+func UninstallService() error {
+	return errServiceNotSupported
+}
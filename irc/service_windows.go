@@ -0,0 +1,256 @@
+//go:build windows
+
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// Windows has no SIGHUP, so rehashing is triggered by Ctrl+Break in a console,
+// or by the "paramchange" service control (`sc control webircproxy paramchange`)
+// when running as a service. (The admin API's /rehash and watch-config also work.)
+// The service API is called directly, since we don't vendor golang.org/x/sys.
+
+const (
+	serviceName        = "webircproxy"
+	serviceDisplayName = "webircproxy (IRC WebSocket proxy)"
+
+	ctrlBreakEvent = 1
+
+	scManagerConnect       = 0x0001
+	scManagerCreateService = 0x0002
+	serviceAllAccess       = 0xF01FF
+	accessDelete           = 0x10000
+
+	serviceWin32OwnProcess = 0x10
+	serviceAutoStart       = 2
+	serviceErrorNormal     = 1
+
+	serviceStopped      = 1
+	serviceStartPending = 2
+	serviceStopPending  = 3
+	serviceRunning      = 4
+
+	serviceAcceptStop        = 0x1
+	serviceAcceptShutdown    = 0x4
+	serviceAcceptParamChange = 0x8
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+	serviceControlParamChange = 6
+
+	errorCallNotImplemented = 120
+)
+
+var (
+	kernel32                  = syscall.NewLazyDLL("kernel32.dll")
+	procSetConsoleCtrlHandler = kernel32.NewProc("SetConsoleCtrlHandler")
+
+	advapi32                          = syscall.NewLazyDLL("advapi32.dll")
+	procStartServiceCtrlDispatcherW   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerExW = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus              = advapi32.NewProc("SetServiceStatus")
+	procOpenSCManagerW                = advapi32.NewProc("OpenSCManagerW")
+	procCreateServiceW                = advapi32.NewProc("CreateServiceW")
+	procOpenServiceW                  = advapi32.NewProc("OpenServiceW")
+	procDeleteService                 = advapi32.NewProc("DeleteService")
+	procCloseServiceHandle            = advapi32.NewProc("CloseServiceHandle")
+)
+
+// setupConsoleRehash makes Ctrl+Break rehash, as SIGHUP does elsewhere.
+// Our handler runs before the Go runtime's, which would treat it as SIGINT.
+func setupConsoleRehash(server *Server) {
+	procSetConsoleCtrlHandler.Call(syscall.NewCallback(func(ctrlType uintptr) uintptr {
+		if ctrlType == ctrlBreakEvent {
+			server.requestRehash()
+			return 1
+		}
+		return 0
+	}), 1)
+}
+
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// windowsService is the state of the service; the callbacks from the
+// service control manager can't carry Go pointers, so there is only one.
+type windowsService struct {
+	configFile string
+	handle     uintptr
+	server     atomic.Pointer[Server]
+	state      atomic.Uint32
+	err        error
+}
+
+var currentService windowsService
+
+func (svc *windowsService) setStatus(state uint32, exitCode uint32) {
+	svc.state.Store(state)
+	status := serviceStatus{
+		serviceType:   serviceWin32OwnProcess,
+		currentState:  state,
+		win32ExitCode: exitCode,
+	}
+	if state == serviceRunning {
+		status.controlsAccepted = serviceAcceptStop | serviceAcceptShutdown | serviceAcceptParamChange
+	}
+	procSetServiceStatus.Call(svc.handle, uintptr(unsafe.Pointer(&status)))
+}
+
+// RunService runs the proxy as a Windows service; it must be invoked by the
+// service control manager (see InstallService).
+func RunService(configFile string) error {
+	name, err := syscall.UTF16PtrFromString(serviceName)
+	if err != nil {
+		return err
+	}
+	currentService.configFile = configFile
+	table := []serviceTableEntry{
+		{name: name, proc: syscall.NewCallback(serviceMain)},
+		{},
+	}
+	// this blocks until the service stops:
+	if r, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0]))); r == 0 {
+		return fmt.Errorf("couldn't connect to the service control manager (this command must be run as a service): %w", err)
+	}
+	return currentService.err
+}
+
+func serviceMain(argc, argv uintptr) uintptr {
+	svc := &currentService
+	name, _ := syscall.UTF16PtrFromString(serviceName)
+	handle, _, err := procRegisterServiceCtrlHandlerExW.Call(uintptr(unsafe.Pointer(name)), syscall.NewCallback(serviceControlHandler), 0)
+	if handle == 0 {
+		svc.err = fmt.Errorf("couldn't register the service control handler: %w", err)
+		return 0
+	}
+	svc.handle = handle
+	svc.setStatus(serviceStartPending, 0)
+
+	config, err := LoadConfig(svc.configFile)
+	if err != nil {
+		svc.err = fmt.Errorf("Config file did not load successfully: %w", err)
+		svc.setStatus(serviceStopped, 1)
+		return 0
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		svc.err = fmt.Errorf("Could not load server: %w", err)
+		svc.setStatus(serviceStopped, 1)
+		return 0
+	}
+	svc.server.Store(server)
+	svc.setStatus(serviceRunning, 0)
+	server.Run()
+	svc.setStatus(serviceStopped, 0)
+	return 0
+}
+
+func serviceControlHandler(control, eventType, eventData, context uintptr) uintptr {
+	svc := &currentService
+	server := svc.server.Load()
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		svc.setStatus(serviceStopPending, 0)
+		if server != nil {
+			server.requestExit()
+		}
+	case serviceControlParamChange:
+		if server != nil {
+			server.requestRehash()
+		}
+	case serviceControlInterrogate:
+		svc.setStatus(svc.state.Load(), 0)
+	default:
+		return errorCallNotImplemented
+	}
+	return 0
+}
+
+// InstallService registers webircproxy as a Windows service that starts
+// automatically with the given config file.
+func InstallService(configFile string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	configPath, err := filepath.Abs(configFile)
+	if err != nil {
+		return err
+	}
+	if _, err := LoadConfig(configPath); err != nil {
+		return fmt.Errorf("Config file did not load successfully: %w", err)
+	}
+	scm, err := openSCManager(scManagerConnect | scManagerCreateService)
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(scm)
+
+	name, _ := syscall.UTF16PtrFromString(serviceName)
+	displayName, _ := syscall.UTF16PtrFromString(serviceDisplayName)
+	binaryPath, err := syscall.UTF16PtrFromString(fmt.Sprintf(`"%s" service "%s"`, exe, configPath))
+	if err != nil {
+		return err
+	}
+	service, _, err := procCreateServiceW.Call(scm,
+		uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(displayName)),
+		serviceAllAccess, serviceWin32OwnProcess, serviceAutoStart, serviceErrorNormal,
+		uintptr(unsafe.Pointer(binaryPath)),
+		0, 0, 0, 0, 0, // no load order group or dependencies; run as LocalSystem
+	)
+	if service == 0 {
+		return fmt.Errorf("couldn't create the service: %w", err)
+	}
+	procCloseServiceHandle.Call(service)
+	return nil
+}
+
+// UninstallService removes the Windows service.
+func UninstallService() error {
+	scm, err := openSCManager(scManagerConnect)
+	if err != nil {
+		return err
+	}
+	defer procCloseServiceHandle.Call(scm)
+
+	name, _ := syscall.UTF16PtrFromString(serviceName)
+	service, _, err := procOpenServiceW.Call(scm, uintptr(unsafe.Pointer(name)), accessDelete)
+	if service == 0 {
+		return fmt.Errorf("couldn't open the service: %w", err)
+	}
+	defer procCloseServiceHandle.Call(service)
+	if r, _, err := procDeleteService.Call(service); r == 0 {
+		return fmt.Errorf("couldn't delete the service: %w", err)
+	}
+	return nil
+}
+
+func openSCManager(access uintptr) (uintptr, error) {
+	scm, _, err := procOpenSCManagerW.Call(0, 0, access)
+	if scm == 0 {
+		return 0, fmt.Errorf("couldn't connect to the service control manager (are you an administrator?): %w", err)
+	}
+	return scm, nil
+}
@@ -0,0 +1,292 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ergochat/ergo/irc/utils"
+	"github.com/ergochat/irc-go/ircmsg"
+)
+
+// Reconnect grace: a client can name its session with a random token, in the
+// `session` query parameter of the websocket URL (e.g., one generated per tab
+// and kept in sessionStorage). If its websocket then closes, its upstream
+// connection is held open for the grace period (answering the upstream's
+// PINGs on its behalf), and a new websocket with the same token reattaches to
+// it, so that a transient network problem doesn't cause a QUIT and a rejoin.
+// On reattaching, the proxy sends the client
+//
+//	:<gateway-name> NOTE * SESSION_REATTACHED :<description>
+//
+// and the client must not register again. With replay-lines, the last lines
+// from the upstream during the gap are then replayed, in a batch (the client
+// must support the batch capability):
+//
+//	:<gateway-name> BATCH +<ref> ergo.chat/replay
+//	@batch=<ref> <line>
+//	:<gateway-name> BATCH -<ref>
+//
+// Without it, or beyond its limits, lines from the upstream during the gap
+// are lost. The upstream connection is read by the same goroutine (and
+// ircreader) throughout, so a partially received line is completed after the
+// gap, rather than lost or duplicated; the line whose write revealed the
+// failure is the first line of the gap.
+
+const (
+	defaultReconnectGracePeriod = 30 * time.Second
+	defaultReplayBytes          = 64 * 1024
+
+	replayBatchType = "ergo.chat/replay"
+
+	minSessionTokenLen = 16
+	maxSessionTokenLen = 128
+)
+
+// ReconnectGraceConfig configures reconnect grace.
+type ReconnectGraceConfig struct {
+	Enabled bool
+	// how long an upstream connection is held open without a client:
+	Period time.Duration
+	// the upstream's lines during the gap that are replayed (0 for none),
+	// limited both by number and total size:
+	ReplayLines int `yaml:"replay-lines"`
+	ReplayBytes int `yaml:"replay-bytes"`
+}
+
+func (conf *ReconnectGraceConfig) postprocess() {
+	if conf.Period == 0 {
+		conf.Period = defaultReconnectGracePeriod
+	}
+	if conf.ReplayLines > 0 && conf.ReplayBytes <= 0 {
+		conf.ReplayBytes = defaultReplayBytes
+	}
+}
+
+// replayBuffer holds the last lines sent to a detached client
+type replayBuffer struct {
+	lines    [][]byte
+	size     int
+	maxLines int
+	maxBytes int
+}
+
+// add appends a copy of the line, discarding the oldest lines beyond the limits
+func (rb *replayBuffer) add(line []byte) {
+	if len(line) > rb.maxBytes {
+		return
+	}
+	rb.lines = append(rb.lines, append([]byte(nil), line...))
+	rb.size += len(line)
+	for len(rb.lines) > rb.maxLines || rb.size > rb.maxBytes {
+		rb.size -= len(rb.lines[0])
+		rb.lines[0] = nil
+		rb.lines = rb.lines[1:]
+	}
+}
+
+// drain returns the buffered lines and empties the buffer
+func (rb *replayBuffer) drain() (lines [][]byte) {
+	lines = rb.lines
+	rb.lines, rb.size = nil, 0
+	return
+}
+
+// validSessionToken checks that a session token is long enough to be
+// unguessable, and consists of URL-safe base64 characters
+func validSessionToken(token string) bool {
+	if len(token) < minSessionTokenLen || len(token) > maxSessionTokenLen {
+		return false
+	}
+	for i := 0; i < len(token); i++ {
+		c := token[i]
+		if !(('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// sessionRegistry maps keys (session tokens, or accounts for multiplexing)
+// to their connections
+type sessionRegistry struct {
+	sync.Mutex // tier 1
+
+	sessions map[string]*ReverseProxyConn
+}
+
+// add registers the connection's session, returning false if the token is
+// already in use
+func (sr *sessionRegistry) add(token string, conn *ReverseProxyConn) bool {
+	sr.Lock()
+	defer sr.Unlock()
+
+	if sr.sessions == nil {
+		sr.sessions = make(map[string]*ReverseProxyConn)
+	}
+	if _, exists := sr.sessions[token]; exists {
+		return false
+	}
+	sr.sessions[token] = conn
+	return true
+}
+
+func (sr *sessionRegistry) remove(token string, conn *ReverseProxyConn) {
+	sr.Lock()
+	defer sr.Unlock()
+
+	if sr.sessions[token] == conn {
+		delete(sr.sessions, token)
+	}
+}
+
+func (sr *sessionRegistry) get(token string) *ReverseProxyConn {
+	sr.Lock()
+	defer sr.Unlock()
+	return sr.sessions[token]
+}
+
+// reattachSession attaches a new websocket to the client's existing session,
+// if any, returning whether it did
+func (server *Server) reattachSession(webConn messageConn, client *clientData, config *Config) bool {
+	existing := server.sessions.get(client.sessionToken)
+	if existing == nil || existing.client.info.Profile != client.info.Profile {
+		return false
+	}
+	if !existing.reattach(webConn, config) {
+		return false
+	}
+	existing.log(LogLevelInfo, "client reattached", slog.String("new_conn_id", client.id), slog.String(logKeyRemoteIP, client.ip.String()))
+	client.span.End(nil)
+	server.finishConnection(client, DisconnectInfo{Reason: CloseReattached})
+	return true
+}
+
+// reattach replaces the connection's websocket, returning false if that's
+// impossible (the connection is closing, or the websocket's message type differs)
+func (r *ReverseProxyConn) reattach(webConn messageConn, config *Config) bool {
+	if webConnMessageType(webConn) != r.messageType {
+		return false
+	}
+	r.wsMutex.Lock()
+	if r.closing {
+		r.wsMutex.Unlock()
+		return false
+	}
+	old := r.webConn
+	r.webConn = webConn
+	r.stopGraceTimerLocked()
+	r.sendReattachedNoteLocked(webConn, config, "Reattached to your existing connection")
+	if r.replay != nil {
+		r.replayLocked(webConn, config, r.replay.drain())
+	}
+	r.wsMutex.Unlock()
+
+	if old != nil {
+		// its proxyToUpstream will exit when the read fails:
+		old.Close()
+	}
+	r.startProxyToUpstream(webConn, true, config.logEnabled(LogComponentProxy, LogLevelDebug))
+	return true
+}
+
+// sendReattachedNoteLocked tells a websocket that it was attached to an
+// already registered connection; requires r.wsMutex
+func (r *ReverseProxyConn) sendReattachedNoteLocked(webConn messageConn, config *Config, description string) {
+	note := ircmsg.MakeMessage(nil, config.GatewayName, "NOTE", "*", "SESSION_REATTACHED", description)
+	if noteLine, err := note.LineBytesStrict(false, r.maxLineLen); err == nil {
+		webConn.WriteMessage(r.messageType, noteLine[:len(noteLine)-len(crlf)])
+	}
+}
+
+// replayLocked sends the lines buffered during the gap to a reattached
+// websocket, in a batch; requires r.wsMutex
+func (r *ReverseProxyConn) replayLocked(webConn messageConn, config *Config, lines [][]byte) {
+	if len(lines) == 0 {
+		return
+	}
+	ref := utils.GenerateSecretToken()
+	start := ircmsg.MakeMessage(nil, config.GatewayName, "BATCH", "+"+ref, replayBatchType)
+	if startLine, err := start.LineBytesStrict(false, r.maxLineLen); err == nil {
+		webConn.WriteMessage(r.messageType, startLine[:len(startLine)-len(crlf)])
+	}
+	for _, line := range lines {
+		// lines that can't be tagged are replayed outside the batch:
+		if msg, err := ircmsg.ParseLine(string(line)); err == nil {
+			msg.SetTag("batch", ref)
+			if tagged, err := msg.LineBytesStrict(false, r.maxLineLen); err == nil {
+				line = tagged[:len(tagged)-len(crlf)]
+			}
+		}
+		webConn.WriteMessage(r.messageType, line)
+	}
+	end := ircmsg.MakeMessage(nil, config.GatewayName, "BATCH", "-"+ref)
+	if endLine, err := end.LineBytesStrict(false, r.maxLineLen); err == nil {
+		webConn.WriteMessage(r.messageType, endLine[:len(endLine)-len(crlf)])
+	}
+}
+
+// requires r.wsMutex
+func (r *ReverseProxyConn) stopGraceTimerLocked() {
+	if r.graceTimer != nil {
+		r.graceTimer.Stop()
+		r.graceTimer = nil
+	}
+}
+
+// detach handles the failure of a websocket: if other websockets are
+// multiplexed onto the connection, the websocket is dropped; if the
+// connection has a session, the websocket is closed and the upstream
+// connection is held open for the grace period. It returns false if the
+// whole connection should be closed.
+func (r *ReverseProxyConn) detach(webConn messageConn) bool {
+	r.wsMutex.Lock()
+	defer r.wsMutex.Unlock()
+	return r.detachLocked(webConn)
+}
+
+// requires r.wsMutex
+func (r *ReverseProxyConn) detachLocked(webConn messageConn) bool {
+	if r.closing {
+		return false
+	}
+	if r.webConn != webConn {
+		// multiplexed, or already detached, or superseded by a reattached websocket:
+		r.dropMultiplexedLocked(webConn)
+		return true
+	}
+	if r.promoteMultiplexedLocked() {
+		webConn.Close()
+		return true
+	}
+	if r.sessionToken == "" {
+		return false
+	}
+	r.webConn = nil
+	webConn.Close()
+	r.graceTimer = time.AfterFunc(r.gracePeriod, r.graceExpired)
+	r.log(LogLevelInfo, "client disconnected, holding the upstream connection for its reconnect", slog.Duration("grace_period", r.gracePeriod))
+	return true
+}
+
+func (r *ReverseProxyConn) graceExpired() {
+	r.wsMutex.Lock()
+	if r.webConn != nil || r.closing {
+		r.wsMutex.Unlock()
+		return
+	}
+	// don't let a client reattach to a connection that's about to close:
+	r.closing = true
+	r.wsMutex.Unlock()
+	r.closeWithReason(CloseGraceExpired, nil)
+}
+
+// detached returns whether the connection's client is currently disconnected
+func (r *ReverseProxyConn) detached() bool {
+	r.wsMutex.Lock()
+	defer r.wsMutex.Unlock()
+	return r.webConn == nil
+}
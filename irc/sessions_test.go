@@ -0,0 +1,263 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ergochat/irc-go/ircmsg"
+	"github.com/gorilla/websocket"
+)
+
+// idleConn is a websocket whose client never sends anything
+type idleConn struct {
+	recordingConn
+}
+
+func (c *idleConn) NextReader() (io.Reader, error) {
+	select {}
+}
+
+func TestValidSessionToken(t *testing.T) {
+	assertEqual(validSessionToken(""), false)
+	assertEqual(validSessionToken("short"), false)
+	assertEqual(validSessionToken("dGhpcyBpcyBhIHRva2Vu_-0"), true)
+	assertEqual(validSessionToken("dGhpcyBpcyBhIHRva2Vu+/0="), false)
+	assertEqual(validSessionToken(string(make([]byte, maxSessionTokenLen+1))), false)
+}
+
+func TestSessionRegistry(t *testing.T) {
+	var sr sessionRegistry
+	a, b := new(ReverseProxyConn), new(ReverseProxyConn)
+	assertEqual(sr.add("token", a), true)
+	assertEqual(sr.add("token", b), false)
+	assertEqual(sr.get("token"), a)
+	// a stale connection can't remove its successor's session:
+	sr.remove("token", b)
+	assertEqual(sr.get("token"), a)
+	sr.remove("token", a)
+	assertEqual(sr.get("token") == nil, true)
+}
+
+func TestDetachReattach(t *testing.T) {
+	server := &Server{}
+	config := &Config{GatewayName: "webircproxy"}
+	server.SetConfig(config)
+	first, second := new(recordingConn), new(idleConn)
+	r := &ReverseProxyConn{
+		server:       server,
+		webConn:      first,
+		messageType:  textMessage,
+		maxLineLen:   DefaultMaxLineLen,
+		buffers:      &config.Buffers,
+		sessionToken: "dGhpcyBpcyBhIHRva2Vu",
+		gracePeriod:  time.Hour,
+	}
+
+	assertEqual(r.detach(first), true)
+	assertEqual(r.detached(), true)
+	// writes are dropped while the client is away:
+	assertEqual(r.writeWS(textMessage, []byte("PING :lost")), nil)
+	assertEqual(len(first.messages), 0)
+
+	assertEqual(r.reattach(second, config), true)
+	assertEqual(second.messages, []string{":webircproxy NOTE * SESSION_REATTACHED :Reattached to your existing connection"})
+
+	// a closing connection can't be reattached:
+	r.wsMutex.Lock()
+	r.closing = true
+	r.wsMutex.Unlock()
+	assertEqual(r.reattach(new(recordingConn), config), false)
+	assertEqual(r.detach(second), false)
+}
+
+func TestReplayBuffer(t *testing.T) {
+	rb := replayBuffer{maxLines: 3, maxBytes: 10}
+	rb.add([]byte("aaaa"))
+	rb.add([]byte("bbbb"))
+	// over the byte limit, so the oldest is dropped:
+	rb.add([]byte("cccc"))
+	// too long to be buffered at all:
+	rb.add([]byte("ddddddddddd"))
+	assertEqual(rb.drain(), [][]byte{[]byte("bbbb"), []byte("cccc")})
+	assertEqual(len(rb.drain()), 0)
+
+	rb.add([]byte("a"))
+	rb.add([]byte("b"))
+	rb.add([]byte("c"))
+	rb.add([]byte("d"))
+	assertEqual(rb.drain(), [][]byte{[]byte("b"), []byte("c"), []byte("d")})
+}
+
+func TestReattachReplay(t *testing.T) {
+	server := &Server{}
+	config := &Config{GatewayName: "webircproxy"}
+	server.SetConfig(config)
+	first, second := new(recordingConn), new(idleConn)
+	r := &ReverseProxyConn{
+		server:       server,
+		webConn:      first,
+		messageType:  textMessage,
+		maxLineLen:   DefaultMaxLineLen,
+		buffers:      &config.Buffers,
+		sessionToken: "dGhpcyBpcyBhIHRva2Vu",
+		gracePeriod:  time.Hour,
+		replay:       &replayBuffer{maxLines: 10, maxBytes: 1024},
+	}
+
+	assertEqual(r.detach(first), true)
+	r.writeWS(textMessage, []byte(":alice!a@example.com PRIVMSG #chan :hi"))
+	r.writeWS(textMessage, []byte("@time=2021-01-01T00:00:00.000Z :bob!b@example.com PRIVMSG #chan :hello"))
+	assertEqual(r.reattach(second, config), true)
+
+	assertEqual(len(second.messages), 5)
+	assertEqual(second.messages[0], ":webircproxy NOTE * SESSION_REATTACHED :Reattached to your existing connection")
+	ref := strings.TrimPrefix(strings.Fields(second.messages[1])[2], "+")
+	assertEqual(second.messages[1], ":webircproxy BATCH +"+ref+" ergo.chat/replay")
+	assertEqual(second.messages[2], "@batch="+ref+" :alice!a@example.com PRIVMSG #chan hi")
+	msg, err := ircmsg.ParseLine(second.messages[3])
+	assertEqual(err, nil)
+	assertEqual(msg.AllTags(), map[string]string{"batch": ref, "time": "2021-01-01T00:00:00.000Z"})
+	assertEqual(second.messages[4], ":webircproxy BATCH -"+ref)
+}
+
+type brokenConn struct {
+	recordingConn
+}
+
+func (c *brokenConn) WriteMessage(mType messageType, data []byte) error {
+	return io.ErrClosedPipe
+}
+
+func TestReplayFailedWrite(t *testing.T) {
+	server := &Server{}
+	config := &Config{GatewayName: "webircproxy"}
+	server.SetConfig(config)
+	first, second := new(brokenConn), new(idleConn)
+	r := &ReverseProxyConn{
+		server:       server,
+		webConn:      first,
+		messageType:  textMessage,
+		maxLineLen:   DefaultMaxLineLen,
+		buffers:      &config.Buffers,
+		sessionToken: "dGhpcyBpcyBhIHRva2Vu",
+		gracePeriod:  time.Hour,
+		replay:       &replayBuffer{maxLines: 10, maxBytes: 1024},
+	}
+
+	// the write that fails detaches the client, which receives the line on reattaching:
+	assertEqual(r.writeWS(textMessage, []byte(":alice!a@example.com PRIVMSG #chan :hi")), nil)
+	assertEqual(r.detached(), true)
+	r.writeWS(textMessage, []byte(":alice!a@example.com PRIVMSG #chan :still there?"))
+	assertEqual(r.reattach(second, config), true)
+
+	assertEqual(len(second.messages), 5)
+	assertEqual(strings.HasSuffix(second.messages[2], ":alice!a@example.com PRIVMSG #chan hi"), true)
+	assertEqual(strings.HasSuffix(second.messages[3], ":alice!a@example.com PRIVMSG #chan :still there?"), true)
+}
+
+// TestReplayFromUpstream detaches a client, then sends lines (and PINGs)
+// from the upstream, which must be replayed when the client reattaches
+func TestReplayFromUpstream(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	upstreamConns := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := upstream.Accept(); err == nil {
+			upstreamConns <- conn
+		}
+	}()
+
+	listen := freeAddress(t)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithListener(listen),
+		WithUpstream(upstream.Addr().String()),
+		WithYAML("log-level: error\nlookup-hostnames: false\nreconnect-grace: {enabled: true, replay-lines: 10}"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.RunContext(ctx)
+
+	const token = "dGhpcyBpcyBhIHRva2Vu"
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws://"+listen+"/webirc?session="+token, http.Header{"Origin": []string{"https://example.com"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+	readLine := func(conn *websocket.Conn) string {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(message)
+	}
+
+	conn := dial()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("NICK alice")); err != nil {
+		t.Fatal(err)
+	}
+	var uConn net.Conn
+	select {
+	case uConn = <-upstreamConns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no upstream connection")
+	}
+	defer uConn.Close()
+	uConn.SetDeadline(time.Now().Add(5 * time.Second))
+	uReader := bufio.NewReader(uConn)
+	readUpstream := func() string {
+		line, err := uReader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSuffix(line, "\r\n")
+	}
+	assertEqual(readUpstream(), "NICK alice")
+	io.WriteString(uConn, ":irc.example.com 001 alice :Welcome\r\n")
+	assertEqual(readLine(conn), ":irc.example.com 001 alice :Welcome")
+
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for r := server.sessions.get(token); r == nil || !r.detached(); r = server.sessions.get(token) {
+		if time.Now().After(deadline) {
+			t.Fatal("the client was not detached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the gap: PINGs are answered, and the other lines are buffered:
+	io.WriteString(uConn, ":bob!b@example.com PRIVMSG alice :one\r\nPING :a\r\n:bob!b@example.com PRIVMSG alice :two\r\nPING :b\r\n")
+	assertEqual(readUpstream(), "PONG a")
+	assertEqual(readUpstream(), "PONG b")
+
+	conn = dial()
+	defer conn.Close()
+	assertEqual(readLine(conn), ":webircproxy NOTE * SESSION_REATTACHED :Reattached to your existing connection")
+	start := readLine(conn)
+	ref := strings.TrimPrefix(strings.Fields(start)[2], "+")
+	assertEqual(start, ":webircproxy BATCH +"+ref+" ergo.chat/replay")
+	assertEqual(readLine(conn), "@batch="+ref+" :bob!b@example.com PRIVMSG alice one")
+	assertEqual(readLine(conn), "@batch="+ref+" :bob!b@example.com PRIVMSG alice two")
+	assertEqual(readLine(conn), ":webircproxy BATCH -"+ref)
+}
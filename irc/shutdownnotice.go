@@ -0,0 +1,132 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/ergochat/irc-go/ircmsg"
+)
+
+// Shutdown notices warn clients that they will be disconnected, because their
+// listener was removed by a rehash, or because the process is draining after
+// a handoff, so that webchat frontends can tell their users and reconnect
+// elsewhere ahead of time. The notice is a standard reply:
+//
+//	WARN * GATEWAY_SHUTDOWN <time> <reconnect-url> :<description>
+//
+// where <time> is when the client will be disconnected (RFC 3339, in UTC), and
+// <reconnect-url> is where to reconnect; either may be * if it is unknown.
+
+const (
+	shutdownNoticeCode = "GATEWAY_SHUTDOWN"
+)
+
+type ShutdownNoticeConfig struct {
+	Enabled bool
+	// where clients should reconnect (e.g., another gateway's websocket URL):
+	ReconnectURL string `yaml:"reconnect-url"`
+	// after a rehash removes a listener, how long its clients stay connected
+	// (0 to keep them connected until they disconnect):
+	ListenerDrainTimeout time.Duration `yaml:"listener-drain-timeout"`
+}
+
+func (conf *ShutdownNoticeConfig) postprocess() error {
+	if strings.ContainsAny(conf.ReconnectURL, " \r\n") || strings.HasPrefix(conf.ReconnectURL, ":") {
+		return fmt.Errorf("shutdown-notices reconnect-url is not a valid IRC parameter: %q", conf.ReconnectURL)
+	}
+	if conf.ListenerDrainTimeout < 0 {
+		return fmt.Errorf("shutdown-notices listener-drain-timeout must not be negative")
+	}
+	return nil
+}
+
+// shutdownNotice returns the notice for a disconnection at deadline (or at
+// an unknown time, if it is zero)
+func shutdownNotice(config *Config, deadline time.Time, reason string) ircmsg.Message {
+	when, url := "*", "*"
+	description := reason
+	if !deadline.IsZero() {
+		when = deadline.UTC().Format(time.RFC3339)
+		description += fmt.Sprintf("; you will be disconnected by %s", when)
+	}
+	if config.ShutdownNotices.ReconnectURL != "" {
+		url = config.ShutdownNotices.ReconnectURL
+		description += fmt.Sprintf("; please reconnect to %s", url)
+	}
+	return ircmsg.MakeMessage(nil, config.GatewayName, "WARN", "*", shutdownNoticeCode, when, url, description)
+}
+
+// sendGatewayMessage sends a message from the gateway (e.g., a shutdown
+// notice) to each of the connection's websockets
+func (r *ReverseProxyConn) sendGatewayMessage(notice *ircmsg.Message) {
+	line, err := notice.LineBytesStrict(false, r.maxLineLen)
+	if err != nil {
+		return
+	}
+	line = line[:len(line)-len(crlf)]
+	r.wsMutex.Lock()
+	defer r.wsMutex.Unlock()
+	if r.closing {
+		return
+	}
+	for _, webConn := range r.multiplexed {
+		webConn.WriteMessage(r.messageType, line)
+	}
+	if r.webConn != nil {
+		r.webConn.WriteMessage(r.messageType, line)
+	}
+}
+
+// notifyShutdown sends shutdown notices to the connections that match
+// (all of them, if match is nil), returning them
+func (server *Server) notifyShutdown(match func(*ReverseProxyConn) bool, deadline time.Time, reason string) (notified []*ReverseProxyConn) {
+	config := server.Config()
+	if !config.ShutdownNotices.Enabled {
+		return
+	}
+	notice := shutdownNotice(config, deadline, reason)
+	for _, conn := range server.conns.all() {
+		if match == nil || match(conn) {
+			conn.sendGatewayMessage(&notice)
+			notified = append(notified, conn)
+		}
+	}
+	if len(notified) != 0 {
+		server.Log(LogComponentServer, LogLevelInfo, "sent shutdown notices", slog.Int("connections", len(notified)), slog.String("reason", reason))
+	}
+	return
+}
+
+// notifyListenerRemoved warns the clients of a listener that a rehash
+// removed, and with listener-drain-timeout, disconnects them after it
+// (unless the listener has been configured again by then)
+func (server *Server) notifyListenerRemoved(addr string) {
+	config := server.Config()
+	if !config.ShutdownNotices.Enabled {
+		return
+	}
+	timeout := config.ShutdownNotices.ListenerDrainTimeout
+	var deadline time.Time
+	if timeout != 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	notified := server.notifyShutdown(func(conn *ReverseProxyConn) bool {
+		return conn.client.listener == addr
+	}, deadline, fmt.Sprintf("The listener %s is being removed", addr))
+	if timeout == 0 || len(notified) == 0 {
+		return
+	}
+	time.AfterFunc(timeout, func() {
+		if _, ok := server.Config().trueListeners[addr]; ok {
+			return
+		}
+		for _, conn := range notified {
+			conn.closeWithReason(CloseListenerRemoved, nil)
+		}
+	})
+}
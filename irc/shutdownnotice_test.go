@@ -0,0 +1,93 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ergochat/irc-go/ircmsg"
+	"github.com/gorilla/websocket"
+)
+
+func TestShutdownNotice(t *testing.T) {
+	config := &Config{GatewayName: "webircproxy"}
+	line := func(deadline time.Time) string {
+		notice := shutdownNotice(config, deadline, "This gateway is restarting")
+		result, err := notice.Line()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	assertEqual(line(time.Time{}), ":webircproxy WARN * GATEWAY_SHUTDOWN * * :This gateway is restarting\r\n")
+	config.ShutdownNotices.ReconnectURL = "wss://irc2.example.com/webirc"
+	assertEqual(line(time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)),
+		":webircproxy WARN * GATEWAY_SHUTDOWN 2021-06-01T12:00:00Z wss://irc2.example.com/webirc :This gateway is restarting; you will be disconnected by 2021-06-01T12:00:00Z; please reconnect to wss://irc2.example.com/webirc\r\n")
+
+	config.ShutdownNotices.ReconnectURL = "wss://irc2.example.com/web irc"
+	assertEqual(config.ShutdownNotices.postprocess() != nil, true)
+}
+
+func TestListenerRemovedNotice(t *testing.T) {
+	mock := startMockIRCd(t, "")
+	first, second := freeAddress(t), freeAddress(t)
+	filename := filepath.Join(t.TempDir(), "webircproxy.yaml")
+	writeConfig := func(listener string) {
+		data := fmt.Sprintf("gateway-name: webircproxy\nlog-level: error\nlookup-hostnames: false\nlisteners:\n    %q: {}\nupstreams:\n    - address: %q\nshutdown-notices:\n    enabled: true\n    listener-drain-timeout: 100ms\n", listener, mock.Addr())
+		if err := os.WriteFile(filename, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(first)
+	config, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+first+"/webirc", http.Header{"Origin": []string{"https://example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, line := range []string{"NICK alice", "USER u 0 * :Alice"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeConfig(second)
+	if _, err := server.rehash(); err != nil {
+		t.Fatal(err)
+	}
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	notice, err := ircmsg.ParseLine(string(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(notice.Command, "WARN")
+	assertEqual(notice.Params[1], shutdownNoticeCode)
+	// then, after listener-drain-timeout, the connection is closed:
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+}
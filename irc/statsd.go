@@ -0,0 +1,194 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// keep each UDP packet within a typical MTU:
+	maxStatsDPacket = 1432
+)
+
+var (
+	statsdUnsafeChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+)
+
+// StatsDConfig configures periodic export of the core metrics (connections,
+// bytes, errors) to a StatsD server over UDP.
+type StatsDConfig struct {
+	Enabled bool
+	// host:port of the StatsD server:
+	Address       string
+	Prefix        string
+	FlushInterval time.Duration `yaml:"flush-interval"`
+}
+
+func (conf *StatsDConfig) postprocess() error {
+	if !conf.Enabled {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(conf.Address); err != nil {
+		return fmt.Errorf("invalid statsd address %s: %w", conf.Address, err)
+	}
+	if conf.Prefix == "" {
+		conf.Prefix = "webircproxy"
+	}
+	conf.Prefix = strings.TrimSuffix(conf.Prefix, ".")
+	if conf.FlushInterval <= 0 {
+		conf.FlushInterval = 10 * time.Second
+	}
+	return nil
+}
+
+// statsdName joins the components of a metric name, sanitizing each one
+func statsdName(prefix string, components ...string) string {
+	var buf strings.Builder
+	buf.WriteString(prefix)
+	for _, component := range components {
+		if component == "" {
+			continue
+		}
+		buf.WriteByte('.')
+		buf.WriteString(statsdUnsafeChars.ReplaceAllString(component, "_"))
+	}
+	return buf.String()
+}
+
+// statsdEmitter sends the metrics to StatsD in the background. StatsD counters
+// are deltas, so it remembers the values it last sent.
+type statsdEmitter struct {
+	sync.Mutex // tier 1
+
+	server  *Server
+	config  *StatsDConfig
+	started bool
+
+	// only accessed from the run goroutine:
+	last map[string]uint64
+}
+
+func (se *statsdEmitter) ApplyConfig(server *Server, config *StatsDConfig) {
+	se.Lock()
+	defer se.Unlock()
+
+	se.server = server
+	se.config = config
+	if config.Enabled && !se.started {
+		se.started = true
+		go se.run()
+	}
+}
+
+func (se *statsdEmitter) getConfig() *StatsDConfig {
+	se.Lock()
+	defer se.Unlock()
+	return se.config
+}
+
+func (se *statsdEmitter) run() {
+	defer se.server.HandlePanic()
+
+	for {
+		config := se.getConfig()
+		if !config.Enabled {
+			// disabled by a rehash; check again later
+			if !se.server.sleep(time.Minute) {
+				return
+			}
+			continue
+		}
+		if !se.server.sleep(config.FlushInterval) {
+			return
+		}
+		lines := se.collect(config.Prefix)
+		if err := sendStatsD(config.Address, lines); err != nil {
+			se.server.Log(LogComponentServer, LogLevelWarn, "could not send metrics to statsd", errAttr(err))
+		}
+	}
+}
+
+// collect returns the StatsD lines for the current metric values
+func (se *statsdEmitter) collect(prefix string) (lines []string) {
+	if se.last == nil {
+		se.last = make(map[string]uint64)
+	}
+	counter := func(name string, value uint64) {
+		if delta := value - se.last[name]; delta != 0 {
+			lines = append(lines, fmt.Sprintf("%s:%d|c", name, delta))
+		}
+		se.last[name] = value
+	}
+	gauge := func(name string, value int) {
+		lines = append(lines, fmt.Sprintf("%s:%d|g", name, value))
+	}
+
+	metrics := &se.server.metrics
+	metrics.connections.each(func(labelValues []string, value uint64) {
+		counter(statsdName(prefix, append([]string{"connections", "total"}, labelValues...)...), value)
+	})
+	metrics.errors.each(func(labelValues []string, value uint64) {
+		counter(statsdName(prefix, append([]string{"errors"}, labelValues...)...), value)
+	})
+	metrics.transcoded.each(func(labelValues []string, value uint64) {
+		counter(statsdName(prefix, append([]string{"transcoded"}, labelValues...)...), value)
+	})
+	metrics.disconnects.each(func(labelValues []string, value uint64) {
+		counter(statsdName(prefix, append([]string{"disconnects"}, labelValues...)...), value)
+	})
+	metrics.shed.each(func(labelValues []string, value uint64) {
+		counter(statsdName(prefix, append([]string{"shed"}, labelValues...)...), value)
+	})
+	counter(statsdName(prefix, "bytes", "in"), atomic.LoadUint64(&metrics.bytesIn))
+	counter(statsdName(prefix, "bytes", "out"), atomic.LoadUint64(&metrics.bytesOut))
+
+	byUpstream, byListener := se.server.conns.counts()
+	for _, upstream := range se.server.Config().allUpstreams() {
+		byUpstream[upstream.Name] += 0
+	}
+	for name, value := range byUpstream {
+		gauge(statsdName(prefix, "connections", "active", "upstream", name), value)
+	}
+	for addr, value := range byListener {
+		gauge(statsdName(prefix, "connections", "active", "listener", addr), value)
+	}
+	sort.Strings(lines)
+	return
+}
+
+// sendStatsD sends the lines, batched into as few packets as possible
+func sendStatsD(address string, lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) != 0 && len(packet)+1+len(line) > maxStatsDPacket {
+			if _, err := conn.Write(packet); err != nil {
+				return err
+			}
+			packet = packet[:0]
+		}
+		if len(packet) != 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	_, err = conn.Write(packet)
+	return err
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsDCollect(t *testing.T) {
+	server := &Server{}
+	server.metrics.initialize()
+	server.SetConfig(&Config{Upstreams: []reverseProxyUpstream{{Name: "ircd1"}}})
+	server.metrics.connections.Inc("ircd1")
+	server.metrics.errors.Inc(string(errorUpstreamDialFailed), "ircd1")
+	server.metrics.errors.Inc(string(errorOriginRejected), "")
+	server.metrics.bytesIn = 100
+
+	se := &statsdEmitter{server: server}
+	assertEqual(se.collect("webircproxy"), []string{
+		"webircproxy.bytes.in:100|c",
+		"webircproxy.connections.active.upstream.ircd1:0|g",
+		"webircproxy.connections.total.ircd1:1|c",
+		"webircproxy.errors.origin_rejected:1|c",
+		"webircproxy.errors.upstream_dial_failed.ircd1:1|c",
+	})
+
+	// counters are sent as deltas:
+	server.metrics.bytesIn = 150
+	assertEqual(se.collect("webircproxy"), []string{
+		"webircproxy.bytes.in:50|c",
+		"webircproxy.connections.active.upstream.ircd1:0|g",
+	})
+	assertEqual(statsdName("webircproxy", "connections", "active", "listener", "[::1]:8067"),
+		"webircproxy.connections.active.listener._1_8067")
+}
+
+func TestSendStatsD(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	lines := []string{"webircproxy.bytes.in:50|c", "webircproxy.bytes.out:70|c"}
+	if err := sendStatsD(pc.LocalAddr().String(), lines); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, maxStatsDPacket)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(string(buf[:n]), strings.Join(lines, "\n"))
+}
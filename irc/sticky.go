@@ -0,0 +1,132 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sticky sessions: when several webircproxy instances are behind a load
+// balancer, a client that reconnects may reach a different instance, which
+// would choose an upstream independently. With sticky-sessions, the websocket
+// handshake sets a cookie naming the chosen upstream, signed with a secret
+// shared by all the instances, and any instance that receives the cookie back
+// uses the same upstream (if it's still available to the client).
+
+const (
+	defaultStickyCookieName = "webircproxy_upstream"
+	defaultStickyMaxAge     = 24 * time.Hour
+)
+
+// StickySessionsConfig configures sticky sessions.
+type StickySessionsConfig struct {
+	Enabled bool
+	// shared by all the instances behind the load balancer:
+	Secret     string
+	CookieName string        `yaml:"cookie-name"`
+	MaxAge     time.Duration `yaml:"max-age"`
+}
+
+func (conf *StickySessionsConfig) postprocess() error {
+	if !conf.Enabled {
+		return nil
+	}
+	if conf.Secret == "" {
+		return fmt.Errorf("sticky-sessions requires a secret")
+	}
+	if conf.CookieName == "" {
+		conf.CookieName = defaultStickyCookieName
+	}
+	if conf.MaxAge == 0 {
+		conf.MaxAge = defaultStickyMaxAge
+	}
+	return nil
+}
+
+// makeToken returns a token naming the upstream, valid until expires:
+// base64(name).expires.base64(hmac)
+func (conf *StickySessionsConfig) makeToken(upstream string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(upstream)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + conf.sign(payload)
+}
+
+// checkToken returns the name of the upstream in a token, or ok=false if the
+// token is invalid or expired
+func (conf *StickySessionsConfig) checkToken(token string, now time.Time) (upstream string, ok bool) {
+	i := strings.LastIndexByte(token, '.')
+	if i == -1 {
+		return "", false
+	}
+	payload, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(conf.sign(payload))) {
+		return "", false
+	}
+	encodedName, expiresStr, found := strings.Cut(payload, ".")
+	if !found {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return "", false
+	}
+	name, err := base64.RawURLEncoding.DecodeString(encodedName)
+	if err != nil {
+		return "", false
+	}
+	return string(name), true
+}
+
+func (conf *StickySessionsConfig) sign(payload string) string {
+	mac := hmac.New(sha256.New, []byte(conf.Secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// stickyUpstream chooses the upstream for a client before the websocket
+// handshake: the one named in its cookie if that's still available, otherwise
+// a new one. It returns the Set-Cookie header for the handshake's response
+// (nil if no upstream is available).
+func (server *Server) stickyUpstream(config *Config, client *clientData, r *http.Request) (upstream *reverseProxyUpstream, responseHeader http.Header) {
+	conf := &config.StickySessions
+	if cookie, err := r.Cookie(conf.CookieName); err == nil {
+		if name, ok := conf.checkToken(cookie.Value, time.Now()); ok {
+			for _, available := range server.availableUpstreams(config, client) {
+				if available.Name == name {
+					upstream = available
+					break
+				}
+			}
+		}
+	}
+	if upstream == nil {
+		upstream = server.selectUpstream(config, client)
+		if upstream == nil {
+			return nil, nil
+		}
+	}
+	expires := time.Now().Add(conf.MaxAge)
+	cookie := http.Cookie{
+		Name:     conf.CookieName,
+		Value:    conf.makeToken(upstream.Name, expires),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if client.secure {
+		// the webchat is usually on another site than the proxy:
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	responseHeader = make(http.Header)
+	responseHeader.Add("Set-Cookie", cookie.String())
+	return upstream, responseHeader
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStickyToken(t *testing.T) {
+	conf := StickySessionsConfig{Enabled: true, Secret: "hunter2"}
+	if err := conf.postprocess(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	token := conf.makeToken("network1/irc", now.Add(time.Hour))
+	name, ok := conf.checkToken(token, now)
+	assertEqual(name, "network1/irc")
+	assertEqual(ok, true)
+
+	_, ok = conf.checkToken(token, now.Add(2*time.Hour))
+	assertEqual(ok, false)
+	_, ok = conf.checkToken(conf.makeToken("other", now.Add(time.Hour))[:10]+token[10:], now)
+	assertEqual(ok, false)
+	_, ok = conf.checkToken("garbage", now)
+	assertEqual(ok, false)
+
+	other := StickySessionsConfig{Enabled: true, Secret: "hunter3"}
+	other.postprocess()
+	_, ok = other.checkToken(token, now)
+	assertEqual(ok, false)
+}
+
+func TestStickyUpstream(t *testing.T) {
+	config := &Config{
+		Upstreams: []reverseProxyUpstream{
+			{Name: "a", Address: "192.0.2.1:6667"},
+			{Name: "b", Address: "192.0.2.2:6667"},
+		},
+	}
+	config.StickySessions = StickySessionsConfig{Enabled: true, Secret: "hunter2"}
+	config.StickySessions.postprocess()
+	server := new(Server)
+	server.SetConfig(config)
+
+	request := func(upstream string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/webirc", nil)
+		if upstream != "" {
+			r.AddCookie(&http.Cookie{Name: defaultStickyCookieName, Value: config.StickySessions.makeToken(upstream, time.Now().Add(time.Hour))})
+		}
+		return r
+	}
+	for i := 0; i < 10; i++ {
+		upstream, header := server.stickyUpstream(config, &clientData{}, request("b"))
+		assertEqual(upstream.Name, "b")
+		assertEqual(len(header["Set-Cookie"]), 1)
+	}
+
+	// the cookie's upstream is drained, so another one is chosen (and the cookie updated):
+	server.DrainUpstream("b", true, false)
+	upstream, header := server.stickyUpstream(config, &clientData{secure: true}, request("b"))
+	assertEqual(upstream.Name, "a")
+	cookie := (&http.Response{Header: header}).Cookies()[0]
+	name, _ := config.StickySessions.checkToken(cookie.Value, time.Now())
+	assertEqual(name, "a")
+	assertEqual(cookie.Secure, true)
+
+	server.DrainUpstream("a", true, false)
+	upstream, header = server.stickyUpstream(config, &clientData{}, request(""))
+	assertEqual(upstream == nil, true)
+	assertEqual(header == nil, true)
+}
@@ -0,0 +1,23 @@
+//go:build windows || plan9
+
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+)
+
+type syslogWriter interface {
+	Err(string) error
+	Warning(string) error
+	Info(string) error
+	Debug(string) error
+	Close() error
+	Write([]byte) (int, error)
+}
+
+func newSyslogSink(network, address, tag string) (syslogWriter, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
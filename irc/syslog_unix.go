@@ -0,0 +1,28 @@
+//go:build !windows && !plan9
+
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"log/syslog"
+)
+
+// syslogWriter is the subset of *syslog.Writer used by syslogHandler
+type syslogWriter interface {
+	Err(string) error
+	Warning(string) error
+	Info(string) error
+	Debug(string) error
+	Close() error
+	Write([]byte) (int, error)
+}
+
+func newSyslogSink(network, address, tag string) (syslogWriter, error) {
+	writer, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/ergochat/irc-go/ircmsg"
+)
+
+// With tag-limits, the proxy enforces the IRCv3 limit on the tag data of
+// lines from clients (4094 bytes, not counting the leading @ and the trailing
+// space), which upstreams enforce by disconnecting the client; instead, an
+// oversized line is either rejected with a standard reply:
+//
+//	FAIL <command> INPUT_TOO_LONG :<description>
+//
+// or trimmed, by dropping its client-only (+) tags, largest first, until it
+// fits (it is rejected if it still doesn't, or if it is a TAGMSG with no tags
+// left).
+
+const (
+	tagLimitActionReject = "reject"
+	tagLimitActionTrim   = "trim"
+
+	tagLimitFailCode        = "INPUT_TOO_LONG"
+	tagLimitFailDescription = "Message tags are too long"
+)
+
+type TagLimitConfig struct {
+	Enabled bool
+	// the maximum tag data of a line, in bytes (the default is 4094):
+	MaxBytes int `yaml:"max-bytes"`
+	// reject or trim:
+	Action string
+}
+
+func (conf *TagLimitConfig) postprocess() error {
+	if !conf.Enabled {
+		return nil
+	}
+	if conf.MaxBytes == 0 {
+		conf.MaxBytes = ircmsg.MaxlenClientTagData
+	}
+	if conf.MaxBytes < 0 || conf.MaxBytes > ircmsg.MaxlenClientTagData {
+		return fmt.Errorf("tag-limits max-bytes must be between 1 and %d, not %d", ircmsg.MaxlenClientTagData, conf.MaxBytes)
+	}
+	switch conf.Action {
+	case "":
+		conf.Action = tagLimitActionReject
+	case tagLimitActionReject, tagLimitActionTrim:
+	default:
+		return fmt.Errorf("tag-limits action must be reject or trim, not %q", conf.Action)
+	}
+	return nil
+}
+
+// applyTagLimit returns the line to forward (possibly trimmed), or nil if
+// the line must be rejected
+func applyTagLimit(line []byte, conf *TagLimitConfig) []byte {
+	if len(line) == 0 || line[0] != '@' {
+		return line
+	}
+	end := bytes.IndexByte(line, ' ')
+	if end == -1 {
+		end = len(line)
+	}
+	if end-1 <= conf.MaxBytes {
+		return line
+	}
+	if conf.Action != tagLimitActionTrim {
+		return nil
+	}
+	tags := bytes.Split(line[1:end], []byte{';'})
+	// drop the largest client-only tags first:
+	var clientOnly []int
+	for i, tag := range tags {
+		if len(tag) != 0 && tag[0] == '+' {
+			clientOnly = append(clientOnly, i)
+		}
+	}
+	sort.SliceStable(clientOnly, func(i, j int) bool {
+		return len(tags[clientOnly[i]]) > len(tags[clientOnly[j]])
+	})
+	size := end - 1
+	for _, i := range clientOnly {
+		if size <= conf.MaxBytes {
+			break
+		}
+		// the tag and a semicolon:
+		size -= len(tags[i]) + 1
+		tags[i] = nil
+	}
+	if size > conf.MaxBytes {
+		return nil
+	}
+	rest := bytes.TrimLeft(line[end:], " ")
+	result := make([]byte, 0, len(line))
+	for _, tag := range tags {
+		if tag == nil {
+			continue
+		}
+		if len(result) == 0 {
+			result = append(result, '@')
+		} else {
+			result = append(result, ';')
+		}
+		result = append(result, tag...)
+	}
+	if len(result) == 0 {
+		if bytes.Equal(lineCommand(rest), []byte("TAGMSG")) {
+			return nil
+		}
+		return append(result, rest...)
+	}
+	result = append(result, ' ')
+	return append(result, rest...)
+}
+
+// lineCommand returns the command of a line without tags (or nil)
+func lineCommand(line []byte) []byte {
+	if len(line) != 0 && line[0] == ':' {
+		i := bytes.IndexByte(line, ' ')
+		if i == -1 {
+			return nil
+		}
+		line = bytes.TrimLeft(line[i:], " ")
+	}
+	if i := bytes.IndexByte(line, ' '); i != -1 {
+		line = line[:i]
+	}
+	return bytes.ToUpper(line)
+}
+
+// rejectTagLimit sends the client a FAIL for a line that was rejected
+func (r *ReverseProxyConn) rejectTagLimit(line []byte) error {
+	command := "*"
+	if end := bytes.IndexByte(line, ' '); end != -1 {
+		if c := lineCommand(bytes.TrimLeft(line[end:], " ")); len(c) != 0 {
+			command = string(c)
+		}
+	}
+	fail := ircmsg.MakeMessage(nil, r.gatewayName, "FAIL", command, tagLimitFailCode, tagLimitFailDescription)
+	failLine, err := fail.LineBytesStrict(false, r.maxLineLen)
+	if err != nil {
+		return nil
+	}
+	return r.writeWS(r.messageType, bytes.TrimSuffix(failLine, crlf))
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestApplyTagLimit(t *testing.T) {
+	reject := &TagLimitConfig{Enabled: true, MaxBytes: 20, Action: tagLimitActionReject}
+	trim := &TagLimitConfig{Enabled: true, MaxBytes: 20, Action: tagLimitActionTrim}
+	apply := func(line string, conf *TagLimitConfig) string {
+		result := applyTagLimit([]byte(line), conf)
+		if result == nil {
+			return "<rejected>"
+		}
+		return string(result)
+	}
+
+	assertEqual(apply("PRIVMSG #chan :hi", reject), "PRIVMSG #chan :hi")
+	assertEqual(apply("@label=abc PRIVMSG #chan :hi", reject), "@label=abc PRIVMSG #chan :hi")
+	assertEqual(apply("@label=abc;+draft/reply=123456789 PRIVMSG #chan :hi", reject), "<rejected>")
+
+	// the largest client-only tags are dropped first:
+	assertEqual(apply("@+a=1;label=abc;+draft/reply=123456789 PRIVMSG #chan :hi", trim), "@+a=1;label=abc PRIVMSG #chan :hi")
+	assertEqual(apply("@+draft/react=123456789012345 PRIVMSG #chan :hi", trim), "PRIVMSG #chan :hi")
+	// tags without the client-only prefix are never dropped:
+	assertEqual(apply("@label=abcdefghijklmnopqrstuvwxyz;+a=1 PRIVMSG #chan :hi", trim), "<rejected>")
+	// nor is a TAGMSG forwarded without any tags:
+	assertEqual(apply("@+draft/react=123456789012345 TAGMSG #chan", trim), "<rejected>")
+}
+
+func TestTagLimitValidation(t *testing.T) {
+	config, err := NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667"), WithYAML("tag-limits:\n    enabled: true"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(config.TagLimits.MaxBytes, 4094)
+	assertEqual(config.TagLimits.Action, tagLimitActionReject)
+	_, err = NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667"), WithYAML("tag-limits:\n    enabled: true\n    max-bytes: 8191"))
+	assertEqual(err != nil, true)
+	_, err = NewConfig(WithGatewayName("webircproxy"), WithUpstream("127.0.0.1:6667"), WithYAML("tag-limits:\n    enabled: true\n    action: truncate"))
+	assertEqual(err != nil, true)
+}
+
+func TestTagLimitEndToEnd(t *testing.T) {
+	mock := startMockIRCd(t, "")
+	listen := freeAddress(t)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithListener(listen),
+		WithUpstream(mock.Addr()),
+		WithYAML("log-level: error\nlookup-hostnames: false\ntag-limits:\n    enabled: true"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.RunContext(ctx)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+listen+"/webirc", http.Header{"Origin": []string{"https://example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	readLine := func() string {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(message)
+	}
+
+	writeLines := func(lines ...string) {
+		for _, line := range lines {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	writeLines("NICK alice", "USER u 0 * :Alice")
+	assertEqual(readLine(), ":mock.ircd 001 alice :Welcome to the mock IRC network alice!u@127.0.0.1")
+	writeLines("@+draft/react="+strings.Repeat("a", 4100)+" TAGMSG #chan", "PRIVMSG bob :hi")
+	assertEqual(readLine(), ":webircproxy FAIL TAGMSG INPUT_TOO_LONG :Message tags are too long")
+	// the client is still connected:
+	assertEqual(readLine(), ":alice!u@127.0.0.1 PRIVMSG bob hi")
+}
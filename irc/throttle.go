@@ -0,0 +1,83 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ThrottleConfig limits the number of events (e.g., new connections) per IP
+// in a fixed time window
+type ThrottleConfig struct {
+	Limit  int
+	Window time.Duration
+}
+
+func (t *ThrottleConfig) enabled() bool {
+	return t.Limit > 0 && t.Window > 0
+}
+
+type throttleKey struct {
+	scope string
+	ip    string
+}
+
+type throttleEntry struct {
+	count       int
+	windowStart time.Time
+	window      time.Duration
+}
+
+// ipThrottler tracks per-IP event counts, partitioned into independent scopes
+// (e.g., one scope per origin policy)
+type ipThrottler struct {
+	sync.Mutex // tier 1
+
+	entries   map[throttleKey]throttleEntry
+	lastPrune time.Time
+}
+
+// Allow records an event for the IP within the given scope, returning
+// whether it is within the limit.
+func (t *ipThrottler) Allow(scope string, ip net.IP, config ThrottleConfig) bool {
+	if !config.enabled() {
+		return true
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	if t.entries == nil {
+		t.entries = make(map[throttleKey]throttleEntry)
+	}
+	t.prune(now)
+
+	key := throttleKey{scope: scope, ip: ip.To16().String()}
+	entry := t.entries[key]
+	if now.Sub(entry.windowStart) > config.Window {
+		entry = throttleEntry{windowStart: now, window: config.Window}
+	}
+	if entry.count >= config.Limit {
+		return false
+	}
+	entry.count++
+	t.entries[key] = entry
+	return true
+}
+
+// requires t.Lock
+func (t *ipThrottler) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < time.Minute {
+		return
+	}
+	t.lastPrune = now
+	for key, entry := range t.entries {
+		if now.Sub(entry.windowStart) > entry.window {
+			delete(t.entries, key)
+		}
+	}
+}
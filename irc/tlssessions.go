@@ -0,0 +1,56 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/tls"
+)
+
+// With upstream-tls-session-resumption, the TLS sessions of connections to
+// upstreams are cached in memory (from TLS 1.3 session tickets), so that later
+// connections to the same upstream resume them: the resumed handshake skips
+// the certificate exchange and verification, which makes a burst of
+// reconnects (e.g., after a network problem between clients and the proxy)
+// cheaper for both the proxy and the ircd. (Go's TLS implementation doesn't
+// support 0-RTT early data, so a resumed handshake still takes a round trip.)
+// The cache survives rehashes, and sessions are only offered to the upstream
+// (identified by its name, address, and WEBIRC client certificate) that
+// issued them.
+
+const (
+	// sessions are cached per upstream and server name, so this is plenty:
+	tlsSessionCacheSize = 1024
+)
+
+// upstreamSessionCache is an upstream's view of the shared session cache
+type upstreamSessionCache struct {
+	cache  tls.ClientSessionCache
+	prefix string
+}
+
+func (c upstreamSessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	return c.cache.Get(c.prefix + key)
+}
+
+func (c upstreamSessionCache) Put(key string, session *tls.ClientSessionState) {
+	c.cache.Put(c.prefix+key, session)
+}
+
+// upstreamTLSSessions returns the session cache to use for dialing the
+// upstream, or nil if sessions aren't resumed
+func (server *Server) upstreamTLSSessions(config *Config, upstream *reverseProxyUpstream) tls.ClientSessionCache {
+	if !config.UpstreamTLSSessionResumption || !upstream.TLS {
+		return nil
+	}
+	return upstreamSessionCache{
+		cache:  server.tlsSessions,
+		prefix: upstream.Name + "\x00" + upstream.Address + "\x00" + upstream.Webirc.Cert + "\x00",
+	}
+}
+
+// tlsResumed returns whether a connection to an upstream resumed a TLS session
+func tlsResumed(conn interface{}) bool {
+	tlsConn, ok := conn.(*tls.Conn)
+	return ok && tlsConn.ConnectionState().DidResume
+}
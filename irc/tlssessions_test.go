@@ -0,0 +1,97 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUpstreamTLSSessions(t *testing.T) {
+	server := &Server{tlsSessions: tls.NewLRUClientSessionCache(tlsSessionCacheSize)}
+	config := &Config{UpstreamTLSSessionResumption: true}
+	first := &reverseProxyUpstream{Name: "ircd1", Address: "192.0.2.1:6697", TLS: true}
+	second := &reverseProxyUpstream{Name: "ircd2", Address: "192.0.2.2:6697", TLS: true}
+
+	firstCache := server.upstreamTLSSessions(config, first)
+	firstCache.Put("irc.example.com", new(tls.ClientSessionState))
+	_, ok := firstCache.Get("irc.example.com")
+	assertEqual(ok, true)
+	// sessions aren't shared between upstreams:
+	_, ok = server.upstreamTLSSessions(config, second).Get("irc.example.com")
+	assertEqual(ok, false)
+
+	assertEqual(server.upstreamTLSSessions(config, &reverseProxyUpstream{Name: "plain"}) == nil, true)
+	config.UpstreamTLSSessionResumption = false
+	assertEqual(server.upstreamTLSSessions(config, first) == nil, true)
+}
+
+func TestUpstreamTLSResumption(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: []string{"irc.example.com"}, NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// the client receives the session ticket after the handshake:
+			go func() {
+				conn.Write([]byte(":irc.example.com NOTICE * :hi\r\n"))
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	server := &Server{tlsSessions: tls.NewLRUClientSessionCache(tlsSessionCacheSize)}
+	upstream := &reverseProxyUpstream{Name: "ircd", Address: listener.Addr().String(), TLS: true}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	dial := func() bool {
+		conn, err := net.Dial("tcp", upstream.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         "irc.example.com",
+			RootCAs:            roots,
+			MinVersion:         tls.VersionTLS13,
+			ClientSessionCache: server.upstreamTLSSessions(&Config{UpstreamTLSSessionResumption: true}, upstream),
+		})
+		defer tlsConn.Close()
+		if _, err := tlsConn.Read(make([]byte, 512)); err != nil {
+			t.Fatal(err)
+		}
+		return tlsResumed(tlsConn)
+	}
+	assertEqual(dial(), false)
+	assertEqual(dial(), true)
+}
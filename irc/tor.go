@@ -0,0 +1,46 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"net"
+)
+
+// Connections to listeners with `tor: true` come from a Tor hidden service
+// (via the local tor daemon), so their peer address says nothing about the
+// client. Their WEBIRC line carries a fixed hostname and IP instead, and they
+// can be sent to an upstream dedicated to Tor users.
+
+const (
+	defaultTorHostname = "tor-network.onion"
+)
+
+var (
+	// the IP sent in WEBIRC for Tor clients (as in ergo):
+	torIP = net.ParseIP("127.0.0.2")
+)
+
+// TorConfig configures the handling of connections to Tor listeners.
+type TorConfig struct {
+	// hostname sent in WEBIRC for Tor clients:
+	Hostname string
+	// name of the upstream that Tor clients are sent to; if unset, they are
+	// sent to the same upstreams as everyone else:
+	Upstream string
+	upstream *reverseProxyUpstream
+}
+
+func (conf *TorConfig) postprocess(config *Config) error {
+	if conf.Hostname == "" {
+		conf.Hostname = defaultTorHostname
+	}
+	if conf.Upstream != "" {
+		conf.upstream = config.getUpstream(conf.Upstream)
+		if conf.upstream == nil {
+			return fmt.Errorf("tor references unknown upstream: %s", conf.Upstream)
+		}
+	}
+	return nil
+}
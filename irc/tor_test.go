@@ -0,0 +1,39 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+)
+
+func TestTorUpstream(t *testing.T) {
+	config, err := NewConfig(
+		WithGatewayName("webircproxy.example.com"),
+		WithUpstream("127.0.0.1:6667", UpstreamName("clearnet")),
+		WithUpstream("127.0.0.1:6668", UpstreamName("onion")),
+		WithYAML(`
+tor:
+    upstream: onion
+`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(config.Tor.Hostname, defaultTorHostname)
+	server := new(Server)
+	server.SetConfig(config)
+	for i := 0; i < 10; i++ {
+		assertEqual(server.selectUpstream(config, &clientData{tor: true}).Name, "onion")
+	}
+
+	_, err = NewConfig(
+		WithGatewayName("webircproxy.example.com"),
+		WithUpstream("127.0.0.1:6667"),
+		WithYAML(`
+tor:
+    upstream: onion
+`),
+	)
+	assertEqual(err.Error(), "tor references unknown upstream: onion")
+}
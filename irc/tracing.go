@@ -0,0 +1,405 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal OpenTelemetry tracing: spans are batched and exported with the
+// OTLP/HTTP protocol, using its JSON encoding.
+
+const (
+	tracingQueueSize = 4096
+)
+
+// TracingConfig configures export of connection lifecycle spans to an
+// OpenTelemetry collector.
+type TracingConfig struct {
+	Enabled bool
+	// OTLP/HTTP traces endpoint, e.g. http://localhost:4318/v1/traces
+	Endpoint string
+	// extra HTTP headers for the export requests (e.g., for authentication):
+	Headers     map[string]string
+	ServiceName string `yaml:"service-name"`
+	// fraction of connections to trace (if they don't carry a sampled
+	// `traceparent` header from the web frontend); defaults to 1:
+	SampleRate    *float64      `yaml:"sample-rate"`
+	BatchSize     int           `yaml:"batch-size"`
+	FlushInterval time.Duration `yaml:"flush-interval"`
+
+	sampleRate float64
+	client     *http.Client
+}
+
+func (conf *TracingConfig) postprocess() error {
+	if !conf.Enabled {
+		return nil
+	}
+	u, err := url.Parse(conf.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid tracing endpoint: %s", conf.Endpoint)
+	}
+	if conf.ServiceName == "" {
+		conf.ServiceName = "webircproxy"
+	}
+	conf.sampleRate = 1
+	if conf.SampleRate != nil {
+		conf.sampleRate = *conf.SampleRate
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = 512
+	}
+	if conf.FlushInterval <= 0 {
+		conf.FlushInterval = 5 * time.Second
+	}
+	conf.client = &http.Client{
+		Timeout: 10 * time.Second,
+	}
+	return nil
+}
+
+type spanKind int
+
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+const (
+	spanKindInternal spanKind = 1
+	spanKindServer   spanKind = 2
+	spanKindClient   spanKind = 3
+)
+
+// span is an in-progress or finished span. A nil *span is valid and does nothing,
+// so callers don't need to check whether tracing is enabled.
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // all zeroes for a root span
+	name     string
+	kind     spanKind
+	start    time.Time
+
+	sync.Mutex
+	end   time.Time
+	attrs []slog.Attr
+	err   error
+	ended bool
+}
+
+func (s *span) SetAttrs(attrs ...slog.Attr) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+// End finishes the span (recording an error status if err is non-nil) and queues it for export.
+func (s *span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.err = err
+	s.Unlock()
+	s.tracer.submit(s)
+}
+
+// StartChild starts a span that is a child of this span.
+func (s *span) StartChild(name string, kind spanKind) *span {
+	if s == nil {
+		return nil
+	}
+	child := &span{
+		tracer:   s.tracer,
+		traceID:  s.traceID,
+		parentID: s.spanID,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+	}
+	rand.Read(child.spanID[:])
+	return child
+}
+
+// parseTraceparent parses a W3C Trace Context `traceparent` header:
+// https://www.w3.org/TR/trace-context/#traceparent-header
+func parseTraceparent(header string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	fields := strings.Split(strings.TrimSpace(header), "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" ||
+		len(fields[1]) != 32 || len(fields[2]) != 16 || len(fields[3]) != 2 {
+		return
+	}
+	if _, err := hex.Decode(traceID[:], []byte(fields[1])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(parentID[:], []byte(fields[2])); err != nil {
+		return
+	}
+	flags, err := hex.DecodeString(fields[3])
+	if err != nil || traceID == [16]byte{} || parentID == [8]byte{} {
+		return
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+// tracer batches finished spans and exports them in the background
+type tracer struct {
+	sync.Mutex // tier 1
+
+	server  *Server
+	config  *TracingConfig
+	queue   chan *span
+	started bool
+}
+
+func (t *tracer) ApplyConfig(server *Server, config *TracingConfig) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.server = server
+	t.config = config
+	if config.Enabled && !t.started {
+		t.started = true
+		t.queue = make(chan *span, tracingQueueSize)
+		go t.run(server.done)
+	}
+}
+
+func (t *tracer) getConfig() *TracingConfig {
+	t.Lock()
+	defer t.Unlock()
+	return t.config
+}
+
+// StartConnection starts the root span for an incoming connection, continuing
+// the trace from traceparent if there is one (see incomingRequest.traceparent).
+// It returns nil if tracing is disabled or the connection was not sampled.
+func (t *tracer) StartConnection(name string, traceparent string) *span {
+	config := t.getConfig()
+	if config == nil || !config.Enabled {
+		return nil
+	}
+	result := &span{
+		tracer: t,
+		name:   name,
+		kind:   spanKindServer,
+		start:  time.Now(),
+	}
+	traceID, parentID, sampled, ok := parseTraceparent(traceparent)
+	if ok {
+		result.traceID, result.parentID = traceID, parentID
+	}
+	if !(ok && sampled) && mrand.Float64() >= config.sampleRate {
+		return nil
+	}
+	if !ok {
+		rand.Read(result.traceID[:])
+	}
+	rand.Read(result.spanID[:])
+	return result
+}
+
+func (t *tracer) submit(s *span) {
+	select {
+	case t.queue <- s:
+	default:
+		// queue is full (e.g., the collector is down); drop the span
+	}
+}
+
+// run exports batches of spans until the server is stopped
+func (t *tracer) run(done chan struct{}) {
+	var batch []*span
+	config := t.getConfig()
+	timer := time.NewTimer(config.FlushInterval)
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) < config.BatchSize {
+				continue
+			}
+		case <-timer.C:
+		case <-done:
+			if len(batch) != 0 {
+				t.export(config, batch)
+			}
+			return
+		}
+		if len(batch) != 0 {
+			t.export(config, batch)
+			batch = nil
+		}
+		config = t.getConfig()
+		if config.Enabled {
+			timer.Reset(config.FlushInterval)
+		} else {
+			// tracing was disabled by a rehash; drain the queue slowly
+			timer.Reset(time.Minute)
+		}
+	}
+}
+
+func (t *tracer) export(config *TracingConfig, batch []*span) {
+	if !config.Enabled {
+		return
+	}
+	body, err := json.Marshal(makeOTLPRequest(config.ServiceName, batch))
+	if err == nil {
+		err = postOTLP(config, body)
+	}
+	if err != nil {
+		t.server.Log(LogComponentServer, LogLevelWarn, "could not export traces", slog.Int("spans", len(batch)), errAttr(err))
+	}
+}
+
+func postOTLP(config *TracingConfig, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range config.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := config.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// OTLP JSON encoding:
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func toOTLPAttr(attr slog.Attr) otlpAttr {
+	result := otlpAttr{Key: attr.Key}
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindInt64:
+		s := strconv.FormatInt(value.Int64(), 10)
+		result.Value.IntValue = &s
+	case slog.KindUint64:
+		s := strconv.FormatUint(value.Uint64(), 10)
+		result.Value.IntValue = &s
+	case slog.KindBool:
+		b := value.Bool()
+		result.Value.BoolValue = &b
+	case slog.KindFloat64:
+		f := value.Float64()
+		result.Value.DoubleValue = &f
+	default:
+		s := value.String()
+		result.Value.StringValue = &s
+	}
+	return result
+}
+
+func makeOTLPRequest(serviceName string, batch []*span) (result otlpRequest) {
+	var scopeSpans otlpScopeSpans
+	scopeSpans.Scope.Name = "webircproxy"
+	for _, s := range batch {
+		s.Lock()
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              int(s.kind),
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, attr := range s.attrs {
+			if !attr.Equal(slog.Attr{}) {
+				out.Attributes = append(out.Attributes, toOTLPAttr(attr))
+			}
+		}
+		if s.err != nil {
+			out.Status = otlpStatus{Code: 2, Message: s.err.Error()} // STATUS_CODE_ERROR
+		}
+		s.Unlock()
+		scopeSpans.Spans = append(scopeSpans.Spans, out)
+	}
+
+	var resourceSpans otlpResourceSpans
+	resourceSpans.Resource.Attributes = []otlpAttr{toOTLPAttr(slog.String("service.name", serviceName))}
+	resourceSpans.ScopeSpans = []otlpScopeSpans{scopeSpans}
+	result.ResourceSpans = []otlpResourceSpans{resourceSpans}
+	return
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ergochat/ergo/irc/utils"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	traceID, parentID, sampled, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assertEqual(ok, true)
+	assertEqual(sampled, true)
+	assertEqual(hex.EncodeToString(traceID[:]), "4bf92f3577b34da6a3ce929d0e0e4736")
+	assertEqual(hex.EncodeToString(parentID[:]), "00f067aa0ba902b7")
+
+	_, _, sampled, ok = parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assertEqual(ok, true)
+	assertEqual(sampled, false)
+
+	_, _, _, ok = parseTraceparent("00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	assertEqual(ok, false)
+	_, _, _, ok = parseTraceparent("garbage")
+	assertEqual(ok, false)
+}
+
+func TestTracingExport(t *testing.T) {
+	requests := make(chan otlpRequest, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		requests <- req
+	}))
+	defer ts.Close()
+
+	config := new(Config)
+	config.Tracing = TracingConfig{
+		Enabled:       true,
+		Endpoint:      ts.URL,
+		FlushInterval: 10 * time.Millisecond,
+	}
+	if err := config.Tracing.postprocess(); err != nil {
+		t.Fatal(err)
+	}
+	server := new(Server)
+	server.SetConfig(config)
+	server.tracer.ApplyConfig(server, &config.Tracing)
+
+	root := server.tracer.StartConnection("webircproxy.connection", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	child := root.StartChild("upstream.dial", spanKindClient)
+	child.End(nil)
+	root.SetAttrs(slog.Uint64("bytes_in", 42))
+	root.End(nil)
+
+	var spans []otlpSpan
+	for len(spans) < 2 {
+		select {
+		case req := <-requests:
+			spans = append(spans, req.ResourceSpans[0].ScopeSpans[0].Spans...)
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for export")
+		}
+	}
+	assertEqual(spans[0].Name, "upstream.dial")
+	assertEqual(spans[0].ParentSpanID, spans[1].SpanID)
+	assertEqual(spans[1].TraceID, "4bf92f3577b34da6a3ce929d0e0e4736")
+	assertEqual(spans[1].ParentSpanID, "00f067aa0ba902b7")
+	assertEqual(*spans[1].Attributes[0].Value.IntValue, "42")
+
+	// a nil span (tracing disabled or not sampled) is a no-op:
+	var none *span
+	none.StartChild("x", spanKindInternal).End(nil)
+}
+
+func TestUntrustedTraceparent(t *testing.T) {
+	config := new(Config)
+	sampleRate := 0.0
+	config.Tracing = TracingConfig{Enabled: true, Endpoint: "http://localhost:4318/v1/traces", SampleRate: &sampleRate}
+	if err := config.Tracing.postprocess(); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	config.proxyAllowedFromNets, err = utils.ParseNetList([]string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := new(Server)
+	server.SetConfig(config)
+	server.tracer.ApplyConfig(server, &config.Tracing)
+
+	r := httptest.NewRequest("GET", "/webirc", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	// a client can't force sampling or choose its trace ID:
+	in := incomingRequest{config: config, realIP: net.ParseIP("192.0.2.1")}
+	assertEqual(in.traceparent(r), "")
+	assertEqual(server.tracer.StartConnection("webircproxy.connection", in.traceparent(r)) == nil, true)
+
+	// but a trusted proxy can:
+	in.realIP = net.ParseIP("127.0.0.1")
+	root := server.tracer.StartConnection("webircproxy.connection", in.traceparent(r))
+	assertEqual(hex.EncodeToString(root.traceID[:]), "4bf92f3577b34da6a3ce929d0e0e4736")
+}
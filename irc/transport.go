@@ -0,0 +1,165 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The proxy only needs a small part of a websocket library: upgrading a request,
+// then reading and writing whole messages. messageTransport and messageConn
+// describe that part, so that the library can be chosen with the
+// websocket-implementation setting. gorilla/websocket is the default;
+// other implementations (for example, ones that use fewer
+// resources per connection, for very large deployments) register themselves
+// in websocketTransports, typically from a file with a build tag.
+
+type messageType int
+
+const (
+	textMessage   messageType = 1
+	binaryMessage messageType = 2
+
+	defaultWebsocketImplementation = "gorilla"
+
+	defaultWebsocketCloseTimeout = time.Second
+)
+
+var (
+	// returned by NextReader's reader when a message exceeds the read limit:
+	errReadLimit = errors.New("websocket message exceeds the read limit")
+
+	websocketSubprotocols = []string{"text.ircv3.net", "binary.ircv3.net"}
+
+	websocketTransports = map[string]func() messageTransport{
+		"gorilla": newGorillaTransport,
+	}
+)
+
+// messageTransport accepts websocket connections.
+type messageTransport interface {
+	// upgrade completes the websocket handshake (the origin has already been
+	// checked), negotiating one of websocketSubprotocols if the client offers
+	// it; messages longer than readLimit are refused with errReadLimit.
+	// responseHeader (which may be nil) is added to the handshake's response.
+	// On failure, it has already written an HTTP error response.
+	upgrade(w http.ResponseWriter, r *http.Request, readLimit int64, responseHeader http.Header) (messageConn, error)
+}
+
+// messageConn is an established websocket connection. Reads and writes may
+// happen concurrently with each other, but not with themselves.
+type messageConn interface {
+	Subprotocol() string
+	// NextReader returns a reader for the next data message.
+	NextReader() (io.Reader, error)
+	WriteMessage(mType messageType, data []byte) error
+	// WriteClose sends a close frame (but doesn't close the connection),
+	// giving up after timeout; it may be called concurrently with WriteMessage.
+	WriteClose(code int, reason string, timeout time.Duration) error
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+func newMessageTransport(implementation string) (messageTransport, error) {
+	if implementation == "" {
+		implementation = defaultWebsocketImplementation
+	}
+	constructor, ok := websocketTransports[implementation]
+	if !ok {
+		available := make([]string, 0, len(websocketTransports))
+		for name := range websocketTransports {
+			available = append(available, name)
+		}
+		sort.Strings(available)
+		return nil, fmt.Errorf("websocket-implementation %s is not available in this build (available: %s)", implementation, strings.Join(available, ", "))
+	}
+	return constructor(), nil
+}
+
+// pingWriter is implemented by messageConns that can send websocket pings
+type pingWriter interface {
+	WritePing(timeout time.Duration) error
+}
+
+// writePing sends a websocket ping, if the implementation supports it
+func writePing(webConn messageConn, timeout time.Duration) error {
+	if pinger, ok := webConn.(pingWriter); ok {
+		return pinger.WritePing(timeout)
+	}
+	return nil
+}
+
+type gorillaTransport struct {
+	upgrader websocket.Upgrader
+}
+
+func newGorillaTransport() messageTransport {
+	return &gorillaTransport{
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				// we already checked it
+				return true
+			},
+			Subprotocols: websocketSubprotocols,
+		},
+	}
+}
+
+func (t *gorillaTransport) upgrade(w http.ResponseWriter, r *http.Request, readLimit int64, responseHeader http.Header) (messageConn, error) {
+	conn, err := t.upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		return nil, err
+	}
+	// avoid a DoS attack from buffering excessively large messages:
+	conn.SetReadLimit(readLimit)
+	return gorillaConn{conn}, nil
+}
+
+type gorillaConn struct {
+	*websocket.Conn
+}
+
+func (c gorillaConn) NextReader() (io.Reader, error) {
+	_, reader, err := c.Conn.NextReader()
+	if err != nil {
+		return nil, translateGorillaError(err)
+	}
+	return gorillaReader{reader}, nil
+}
+
+func (c gorillaConn) WriteMessage(mType messageType, data []byte) error {
+	return c.Conn.WriteMessage(int(mType), data)
+}
+
+func (c gorillaConn) WriteClose(code int, reason string, timeout time.Duration) error {
+	return c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(timeout))
+}
+
+func (c gorillaConn) WritePing(timeout time.Duration) error {
+	return c.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout))
+}
+
+type gorillaReader struct {
+	io.Reader
+}
+
+func (r gorillaReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	return n, translateGorillaError(err)
+}
+
+func translateGorillaError(err error) error {
+	if err == websocket.ErrReadLimit {
+		return errReadLimit
+	}
+	return err
+}
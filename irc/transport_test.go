@@ -0,0 +1,20 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+)
+
+func TestNewMessageTransport(t *testing.T) {
+	transport, err := newMessageTransport("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok := transport.(*gorillaTransport)
+	assertEqual(ok, true)
+
+	_, err = newMessageTransport("gobwas")
+	assertEqual(err.Error(), "websocket-implementation gobwas is not available in this build (available: gorilla)")
+}
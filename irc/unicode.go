@@ -27,20 +27,28 @@ func invalidMessageWarning() []byte {
 // Transcode a raw IRC line (without \r\n) to UTF-8, without introducing any new
 // protocol violations.
 func (server *Server) transcodeToUTF8(line []byte, maxLineLen int) (result []byte) {
+	return server.transcodeToUTF8With(&server.Config().Transcoding, line, maxLineLen)
+}
+
+// transcodeToUTF8With transcodes using the settings of a particular
+// connection's profile (a maxLineLen of 0 means no limit)
+func (server *Server) transcodeToUTF8With(config *TranscodingConfig, line []byte, maxLineLen int) (result []byte) {
 	if utf8.Valid(line) {
 		return line
 	}
 
-	config := server.Config()
-	if config.Transcoding.EnableChardet {
+	if config.EnableChardet {
+		server.countTranscoding("chardet")
 		return server.decodeViaParamTranscoding(line, maxLineLen, func(param string) string {
-			return server.decodeParamViaChardet(config.Transcoding.detector, param)
+			return server.decodeParamViaChardet(config.detector, param)
 		})
-	} else if len(config.Transcoding.encodings) != 0 {
+	} else if len(config.encodings) != 0 {
+		server.countTranscoding("encodings")
 		return server.decodeViaParamTranscoding(line, maxLineLen, func(param string) string {
-			return server.decodeParamViaEncodingList(param, config.Transcoding.encodings)
+			return server.decodeParamViaEncodingList(param, config.encodings)
 		})
 	} else {
+		server.countTranscoding("replacement")
 		return server.decodeViaReplacementRune(line, maxLineLen)
 	}
 }
@@ -70,7 +78,7 @@ func (server *Server) decodeViaReplacementRune(line []byte, maxLineLen int) (res
 	for len(line) != 0 {
 		r, l := utf8.DecodeRune(line)
 		if r != utf8.RuneError {
-			if bodyLength+l <= (maxLineLen - 2) {
+			if maxLineLen == 0 || bodyLength+l <= (maxLineLen-2) {
 				out.Write(line[:l])
 				line = line[l:]
 			} else {
@@ -79,7 +87,7 @@ func (server *Server) decodeViaReplacementRune(line []byte, maxLineLen int) (res
 		} else {
 			// use the unicode replacement character, '\uFFFD';
 			// its UTF8 encoding is 3 bytes, '\xef\xbf\xbd'
-			if bodyLength+3 <= (maxLineLen - 2) {
+			if maxLineLen == 0 || bodyLength+3 <= (maxLineLen-2) {
 				out.WriteString("\xef\xbf\xbd")
 				line = line[1:]
 			} else {
@@ -97,7 +105,7 @@ func (server *Server) decodeViaReplacementRune(line []byte, maxLineLen int) (res
 func (server *Server) decodeViaParamTranscoding(line []byte, maxLineLen int, paramTranscoder func(string) string) (result []byte) {
 	msg, err := ircmsg.ParseLine(string(line))
 	if err != nil {
-		server.Log(LogLevelWarn, fmt.Sprintf("invalid message from upstream: %v", err))
+		server.Log(LogComponentTranscoding, LogLevelWarn, fmt.Sprintf("invalid message from upstream: %v", err))
 		return invalidMessageWarning()
 	}
 
@@ -108,7 +116,7 @@ func (server *Server) decodeViaParamTranscoding(line []byte, maxLineLen int, par
 		msg.Prefix = decodeAsUtf8(msg.Prefix)
 	}
 	if !utf8.ValidString(msg.Command) {
-		server.Log(LogLevelWarn, fmt.Sprintf("invalid command from upstream: %v", []byte(msg.Command)))
+		server.Log(LogComponentTranscoding, LogLevelWarn, fmt.Sprintf("invalid command from upstream: %v", []byte(msg.Command)))
 		return invalidMessageWarning()
 	}
 	// transcode each parameter individually
@@ -118,7 +126,7 @@ func (server *Server) decodeViaParamTranscoding(line []byte, maxLineLen int, par
 
 	out, err := msg.LineBytesStrict(false, maxLineLen)
 	if err != nil && err != ircmsg.ErrorBodyTooLong {
-		server.Log(LogLevelWarn, fmt.Sprintf("error reassembling message after transcoding: %v", err))
+		server.Log(LogComponentTranscoding, LogLevelWarn, fmt.Sprintf("error reassembling message after transcoding: %v", err))
 		return invalidMessageWarning()
 	}
 	out = bytes.TrimSuffix(out, crlf)
@@ -132,19 +140,19 @@ func (server *Server) decodeParamViaChardet(detector *chardet.Detector, param st
 
 	det, err := detector.DetectBest([]byte(param))
 	if err != nil {
-		server.Log(LogLevelWarn, fmt.Sprintf("chardet failed: %v", err))
+		server.Log(LogComponentTranscoding, LogLevelWarn, fmt.Sprintf("chardet failed: %v", err))
 		return decodeAsUtf8(param)
 	}
 
 	enc, err := ianaindex.IANA.Encoding(det.Charset)
 	if err != nil {
-		server.Log(LogLevelWarn, fmt.Sprintf("chardet returned unknown charset %s: %v", det.Charset, err))
+		server.Log(LogComponentTranscoding, LogLevelWarn, fmt.Sprintf("chardet returned unknown charset %s: %v", det.Charset, err))
 		return decodeAsUtf8(param)
 	}
 
 	decoded, err := enc.NewDecoder().String(param)
 	if err != nil {
-		server.Log(LogLevelWarn, fmt.Sprintf("chardet detected charset %s but could not decode: %v", det.Charset, err))
+		server.Log(LogComponentTranscoding, LogLevelWarn, fmt.Sprintf("chardet detected charset %s but could not decode: %v", det.Charset, err))
 		return decodeAsUtf8(param)
 	}
 
@@ -0,0 +1,257 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Upstreams can be added, removed, and re-weighted at runtime (via the Go API
+// or the admin API), without a rehash. These changes are an overlay on the
+// upstreams in the config, which is replaced as a whole on each change, so
+// that selecting an upstream never sees a partial update. They last until
+// the next rehash, which restores the upstreams from the config file.
+// (Drains are separate; see upstreamDrains.)
+
+var (
+	errNoSuchUpstream = errors.New("no such upstream")
+)
+
+type upstreamOverlay struct {
+	// upstreams added at runtime, keyed by profile name ("" for the top level):
+	added map[string][]*reverseProxyUpstream
+	// configured upstreams that were removed at runtime (the overlay is reset
+	// whenever the config changes, so these remain valid):
+	removed map[*reverseProxyUpstream]bool
+	// weights set at runtime, by upstream name:
+	weights map[string]int
+}
+
+func (overlay *upstreamOverlay) copy() *upstreamOverlay {
+	result := &upstreamOverlay{
+		added:   make(map[string][]*reverseProxyUpstream, len(overlay.added)),
+		removed: make(map[*reverseProxyUpstream]bool, len(overlay.removed)),
+		weights: make(map[string]int, len(overlay.weights)),
+	}
+	for profile, upstreams := range overlay.added {
+		result.added[profile] = upstreams[:len(upstreams):len(upstreams)]
+	}
+	for upstream := range overlay.removed {
+		result.removed[upstream] = true
+	}
+	for name, weight := range overlay.weights {
+		result.weights[name] = weight
+	}
+	return result
+}
+
+// runtimeUpstreams holds the current overlay
+type runtimeUpstreams struct {
+	sync.Mutex // tier 1; serializes updates
+
+	overlay atomic.Pointer[upstreamOverlay]
+}
+
+func (ru *runtimeUpstreams) get() *upstreamOverlay {
+	if overlay := ru.overlay.Load(); overlay != nil {
+		return overlay
+	}
+	return new(upstreamOverlay)
+}
+
+// update atomically replaces the overlay with a modified copy; if modify
+// returns an error, the overlay is unchanged
+func (ru *runtimeUpstreams) update(modify func(*upstreamOverlay) error) error {
+	ru.Lock()
+	defer ru.Unlock()
+
+	overlay := ru.get().copy()
+	if err := modify(overlay); err != nil {
+		return err
+	}
+	ru.overlay.Store(overlay)
+	return nil
+}
+
+// reset discards the runtime changes (on rehash)
+func (ru *runtimeUpstreams) reset() {
+	ru.Lock()
+	defer ru.Unlock()
+	ru.overlay.Store(nil)
+}
+
+// upstreams returns the upstreams of a config (a top-level or profile
+// config, not including those of the other profiles), with the overlay applied
+func (overlay *upstreamOverlay) upstreams(config *Config) (result []*reverseProxyUpstream) {
+	for i := range config.Upstreams {
+		if !overlay.removed[&config.Upstreams[i]] {
+			result = append(result, &config.Upstreams[i])
+		}
+	}
+	return append(result, overlay.added[config.profileName]...)
+}
+
+// allUpstreams is like (*Config).allUpstreams, with the overlay applied
+func (overlay *upstreamOverlay) allUpstreams(config *Config) (result []*reverseProxyUpstream) {
+	for _, c := range config.allConfigs() {
+		result = append(result, overlay.upstreams(c)...)
+	}
+	return
+}
+
+// weight returns the upstream's current weight
+func (overlay *upstreamOverlay) weight(upstream *reverseProxyUpstream) int {
+	if weight, ok := overlay.weights[upstream.Name]; ok {
+		return weight
+	}
+	if upstream.Weight == 0 {
+		return 1
+	}
+	return upstream.Weight
+}
+
+// findUpstream is like (*Config).findUpstream, with the overlay applied
+func (overlay *upstreamOverlay) findUpstream(config *Config, name string) *reverseProxyUpstream {
+	if upstream := config.findUpstream(name); upstream != nil && !overlay.removed[upstream] {
+		return upstream
+	}
+	for _, upstreams := range overlay.added {
+		for _, upstream := range upstreams {
+			if upstream.Name == name || upstream.Address == name {
+				return upstream
+			}
+		}
+	}
+	return nil
+}
+
+// chooseWeighted chooses an upstream at random, in proportion to the weights;
+// it returns nil if none of them has a positive weight
+func chooseWeighted(overlay *upstreamOverlay, candidates []*reverseProxyUpstream) *reverseProxyUpstream {
+	total := 0
+	for _, upstream := range candidates {
+		total += overlay.weight(upstream)
+	}
+	if total <= 0 {
+		return nil
+	}
+	choice := rand.Intn(total)
+	for _, upstream := range candidates {
+		choice -= overlay.weight(upstream)
+		if choice < 0 {
+			return upstream
+		}
+	}
+	return nil
+}
+
+// AddUpstream adds an upstream at runtime. If its name begins with the name
+// of a profile and a slash (e.g., "network1/irc2"), it is added to the
+// profile; otherwise it is added to the top-level upstreams. It isn't used
+// by origin-policies, which refer to the configured upstreams.
+func (server *Server) AddUpstream(address string, opts ...UpstreamOption) error {
+	upstream := &reverseProxyUpstream{Address: address}
+	for _, opt := range opts {
+		opt(upstream)
+	}
+	if err := upstream.postprocess(); err != nil {
+		return err
+	}
+	config := server.Config()
+	profile := ""
+	if prefix, _, found := strings.Cut(upstream.Name, "/"); found && config.profiles[prefix] != nil {
+		profile = prefix
+	} else if !config.hasOwnListeners() {
+		return fmt.Errorf("upstream name %s must begin with the name of a profile, since all the listeners belong to profiles", upstream.Name)
+	}
+	err := server.runtimeUpstreams.update(func(overlay *upstreamOverlay) error {
+		for _, existing := range overlay.allUpstreams(config) {
+			if existing.Name == upstream.Name {
+				return fmt.Errorf("upstream %s already exists", upstream.Name)
+			}
+		}
+		overlay.added[profile] = append(overlay.added[profile], upstream)
+		// a configured upstream of the same name may have been removed:
+		delete(overlay.weights, upstream.Name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	server.Log(LogComponentServer, LogLevelInfo, "added upstream", slog.String(logKeyUpstream, upstream.Name), slog.String("address", upstream.Address))
+	server.prewarm.update(server)
+	return nil
+}
+
+// RemoveUpstream removes an upstream at runtime, so that it receives no new
+// connections; if kill is set, its existing connections are disconnected.
+// It returns false if there is no such upstream.
+func (server *Server) RemoveUpstream(name string, kill bool) bool {
+	config := server.Config()
+	var removed *reverseProxyUpstream
+	server.runtimeUpstreams.update(func(overlay *upstreamOverlay) error {
+		removed = overlay.findUpstream(config, name)
+		if removed == nil {
+			return nil
+		}
+		for profile, upstreams := range overlay.added {
+			for i, upstream := range upstreams {
+				if upstream == removed {
+					overlay.added[profile] = append(upstreams[:i:i], upstreams[i+1:]...)
+				}
+			}
+		}
+		if config.findUpstream(removed.Name) == removed {
+			overlay.removed[removed] = true
+		}
+		delete(overlay.weights, removed.Name)
+		return nil
+	})
+	if removed == nil {
+		return false
+	}
+	server.Log(LogComponentServer, LogLevelInfo, "removed upstream", slog.String(logKeyUpstream, removed.Name))
+	server.prewarm.update(server)
+	if kill {
+		server.killUpstreamConnections(removed.Name, CloseUpstreamRemoved)
+	}
+	return true
+}
+
+// SetUpstreamWeight changes an upstream's share of new connections at
+// runtime; a weight of 0 sends it no new connections (like draining it).
+func (server *Server) SetUpstreamWeight(name string, weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("weight must not be negative")
+	}
+	config := server.Config()
+	var upstream *reverseProxyUpstream
+	server.runtimeUpstreams.update(func(overlay *upstreamOverlay) error {
+		upstream = overlay.findUpstream(config, name)
+		if upstream != nil {
+			overlay.weights[upstream.Name] = weight
+		}
+		return nil
+	})
+	if upstream == nil {
+		return errNoSuchUpstream
+	}
+	server.Log(LogComponentServer, LogLevelInfo, "changed upstream weight", slog.String(logKeyUpstream, upstream.Name), slog.Int("weight", weight))
+	return nil
+}
+
+func (server *Server) killUpstreamConnections(name string, reason CloseReason) {
+	for _, conn := range server.conns.all() {
+		if conn.upstream.Name == name {
+			conn.log(LogLevelInfo, "killing connection: "+reason.Description())
+			conn.closeWithReason(reason, nil)
+		}
+	}
+}
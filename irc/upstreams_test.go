@@ -0,0 +1,88 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRuntimeUpstreams(t *testing.T) {
+	config := &Config{
+		Upstreams: []reverseProxyUpstream{
+			{Name: "a", Address: "192.0.2.1:6667"},
+		},
+	}
+	server := new(Server)
+	server.SetConfig(config)
+
+	if err := server.AddUpstream("192.0.2.2:6667", UpstreamName("b"), UpstreamWebirc("")); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(server.AddUpstream("192.0.2.3:6667", UpstreamName("a")).Error(), "upstream a already exists")
+	assertEqual(len(server.ListUpstreams()), 2)
+	added := server.ListUpstreams()[1]
+	assertEqual(added, UpstreamInfo{Name: "b", Address: "192.0.2.2:6667", Weight: 1})
+
+	// a weight of 0 receives no connections:
+	if err := server.SetUpstreamWeight("a", 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		assertEqual(server.selectUpstream(config, &clientData{}).Name, "b")
+	}
+	assertEqual(server.SetUpstreamWeight("c", 1), errNoSuchUpstream)
+
+	assertEqual(server.RemoveUpstream("b", false), true)
+	assertEqual(server.RemoveUpstream("b", false), false)
+	assertEqual(server.selectUpstream(config, &clientData{}) == nil, true)
+	server.SetUpstreamWeight("a", 2)
+	assertEqual(server.selectUpstream(config, &clientData{}).Name, "a")
+
+	// a configured upstream can be removed, then re-added:
+	assertEqual(server.RemoveUpstream("a", false), true)
+	assertEqual(len(server.ListUpstreams()), 0)
+	if err := server.AddUpstream("192.0.2.4:6667", UpstreamName("a")); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(server.selectUpstream(config, &clientData{}).Address, "192.0.2.4:6667")
+
+	server.runtimeUpstreams.reset()
+	assertEqual(server.ListUpstreams(), []UpstreamInfo{{Name: "a", Address: "192.0.2.1:6667", Weight: 1}})
+}
+
+func TestChooseWeighted(t *testing.T) {
+	a := &reverseProxyUpstream{Name: "a", Weight: 3}
+	b := &reverseProxyUpstream{Name: "b", Weight: 1}
+	overlay := new(upstreamOverlay)
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		counts[chooseWeighted(overlay, []*reverseProxyUpstream{a, b}).Name]++
+	}
+	if counts["a"] < 2700 || counts["a"] > 3300 {
+		t.Errorf("unexpected distribution: %v", counts)
+	}
+}
+
+func TestAdminUpstreams(t *testing.T) {
+	server := new(Server)
+	server.SetConfig(&Config{Upstreams: []reverseProxyUpstream{{Name: "a", Address: "192.0.2.1:6667"}}})
+
+	request := func(method, path, body string) int {
+		w := httptest.NewRecorder()
+		server.handleAdmin(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w.Code
+	}
+	assertEqual(request(http.MethodPost, "/upstreams", `{"name": "b", "address": "192.0.2.2:6667", "webirc_password": "hunter2"}`), http.StatusCreated)
+	assertEqual(request(http.MethodPost, "/upstreams", `{"name": "c"}`), http.StatusBadRequest)
+	assertEqual(server.runtimeUpstreams.get().findUpstream(server.Config(), "b").Webirc.Password, "hunter2")
+	assertEqual(request(http.MethodPost, "/upstreams/b/weight?weight=5", ""), http.StatusOK)
+	assertEqual(request(http.MethodPost, "/upstreams/b/weight?weight=-1", ""), http.StatusBadRequest)
+	assertEqual(request(http.MethodPost, "/upstreams/c/weight?weight=1", ""), http.StatusNotFound)
+	assertEqual(server.ListUpstreams()[1].Weight, 5)
+	assertEqual(request(http.MethodDelete, "/upstreams/b", ""), http.StatusOK)
+	assertEqual(request(http.MethodDelete, "/upstreams/b", ""), http.StatusNotFound)
+}
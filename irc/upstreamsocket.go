@@ -0,0 +1,70 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"net"
+)
+
+// Socket options for upstream connections: buffer sizes, and for a unix
+// socket shared with a co-located ircd, the user and group IDs that the
+// process listening on it must have (as reported by the kernel, e.g., via
+// SO_PEERCRED on Linux), so that another local user can't impersonate the
+// ircd by replacing the socket.
+
+func (upstream *reverseProxyUpstream) postprocessSocketOptions() error {
+	if upstream.ReadBuffer < 0 || upstream.WriteBuffer < 0 {
+		return fmt.Errorf("upstream %s has a negative socket buffer size", upstream.Name)
+	}
+	if upstream.PeerUID == nil && upstream.PeerGID == nil {
+		return nil
+	}
+	if upstream.network != "unix" {
+		return fmt.Errorf("upstream %s: peer-uid and peer-gid require a unix socket", upstream.Name)
+	}
+	if !peerCredentialsSupported {
+		return fmt.Errorf("upstream %s: peer-uid and peer-gid are not supported on this platform", upstream.Name)
+	}
+	return nil
+}
+
+// configureSocket applies the upstream's socket options to a new connection,
+// returning an error if the peer's credentials don't match
+func (upstream *reverseProxyUpstream) configureSocket(conn net.Conn) error {
+	type bufferedConn interface {
+		SetReadBuffer(bytes int) error
+		SetWriteBuffer(bytes int) error
+	}
+	if bconn, ok := conn.(bufferedConn); ok {
+		if upstream.ReadBuffer != 0 {
+			if err := bconn.SetReadBuffer(upstream.ReadBuffer); err != nil {
+				return err
+			}
+		}
+		if upstream.WriteBuffer != 0 {
+			if err := bconn.SetWriteBuffer(upstream.WriteBuffer); err != nil {
+				return err
+			}
+		}
+	}
+	if upstream.PeerUID == nil && upstream.PeerGID == nil {
+		return nil
+	}
+	uconn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("peer credentials require a unix socket")
+	}
+	uid, gid, err := getPeerCredentials(uconn)
+	if err != nil {
+		return fmt.Errorf("could not get peer credentials: %w", err)
+	}
+	if upstream.PeerUID != nil && uid != *upstream.PeerUID {
+		return fmt.Errorf("upstream peer has uid %d, expected %d", uid, *upstream.PeerUID)
+	}
+	if upstream.PeerGID != nil && gid != *upstream.PeerGID {
+		return fmt.Errorf("upstream peer has gid %d, expected %d", gid, *upstream.PeerGID)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+//go:build linux
+
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPeerCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ircd_sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	config, err := NewConfig(WithListener(":8067"), WithGatewayName("webircproxy"), WithUpstream("unix:"+path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func(uid, gid int) error {
+		upstream := config.Upstreams[0]
+		upstream.PeerUID, upstream.PeerGID = &uid, &gid
+		upstream.ReadBuffer, upstream.WriteBuffer = 65536, 65536
+		conn, err := dialUpstream(config, &upstream, nil, nil)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+	assertEqual(dial(uid, gid), nil)
+	err = dial(uid+1, gid)
+	assertEqual(err != nil && strings.Contains(err.Error(), "uid"), true)
+	err = dial(uid, gid+1)
+	assertEqual(err != nil && strings.Contains(err.Error(), "gid"), true)
+}
+
+func TestPeerCredentialsConfig(t *testing.T) {
+	uid := 0
+	upstream := reverseProxyUpstream{Address: "irc://127.0.0.1", PeerUID: &uid}
+	assertEqual(upstream.postprocess() == nil, false)
+	upstream = reverseProxyUpstream{Address: "unix:/tmp/ircd_sock", PeerUID: &uid}
+	assertEqual(upstream.postprocess(), nil)
+	upstream = reverseProxyUpstream{Address: "unix:/tmp/ircd_sock", ReadBuffer: -1}
+	assertEqual(upstream.postprocess() == nil, false)
+}
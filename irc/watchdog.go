@@ -0,0 +1,107 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/okzk/sdnotify"
+)
+
+// systemd watchdog support: if the service has WatchdogSec= set, systemd passes
+// the interval in $WATCHDOG_USEC, and we send WATCHDOG=1 keepalives as long as
+// an internal health check passes. If the proxy is wedged, the keepalives stop
+// and systemd restarts it.
+
+var (
+	errHealthCheckTimeout = errors.New("timed out acquiring internal locks (possible deadlock)")
+)
+
+// watchdogInterval returns how often to send keepalives, or 0 if the
+// watchdog is not enabled for this process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	// systemd recommends sending keepalives at half the timeout:
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+func (server *Server) runWatchdog(interval time.Duration) {
+	defer server.HandlePanic()
+
+	server.Log(LogComponentServer, LogLevelInfo, "systemd watchdog enabled", slog.Duration("interval", interval))
+	healthy := true
+	for {
+		err := server.healthCheck(interval / 2)
+		if err == nil {
+			sdnotify.Watchdog()
+			if !healthy {
+				server.Log(LogComponentServer, LogLevelInfo, "health check passed, resuming watchdog keepalives")
+			}
+		} else {
+			server.Log(LogComponentServer, LogLevelError, "health check failed, withholding watchdog keepalive", errAttr(err))
+		}
+		healthy = err == nil
+		if !server.sleep(interval) {
+			return
+		}
+	}
+}
+
+// healthCheck verifies that the listeners are still serving, and that the
+// internal locks can be acquired within the timeout
+func (server *Server) healthCheck(timeout time.Duration) error {
+	// if a rehash is in progress, the listeners are being modified; skip checking them
+	if server.rehashMutex.TryLock() {
+		if err := server.listenerBindError(); err != nil {
+			server.rehashMutex.Unlock()
+			return err
+		}
+		for addr, listener := range server.listeners {
+			if err := listener.serveError(); err != nil {
+				server.rehashMutex.Unlock()
+				return fmt.Errorf("listener %s is not serving: %w", addr, err)
+			}
+		}
+		server.rehashMutex.Unlock()
+	}
+
+	locks := []sync.Locker{
+		&server.bans,
+		&server.throttle,
+		&server.bandwidth,
+		&server.reputation,
+		&server.conns,
+		&server.sessions,
+		&server.accountConns,
+		&server.drains,
+		&server.tracer,
+		&server.logSinksMutex,
+	}
+	done := make(chan struct{})
+	go func() {
+		for _, lock := range locks {
+			lock.Lock()
+			lock.Unlock()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return errHealthCheckTimeout
+	}
+}
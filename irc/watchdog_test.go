@@ -0,0 +1,41 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	assertEqual(watchdogInterval(), time.Duration(0))
+
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	assertEqual(watchdogInterval(), 15*time.Second)
+
+	// the watchdog is meant for a different process:
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	assertEqual(watchdogInterval(), time.Duration(0))
+}
+
+func TestHealthCheck(t *testing.T) {
+	server := &Server{listeners: make(map[string]*WSListener)}
+	if err := server.healthCheck(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	server.conns.Lock()
+	assertEqual(server.healthCheck(10*time.Millisecond), errHealthCheckTimeout)
+	server.conns.Unlock()
+
+	server.listeners["127.0.0.1:8067"] = &WSListener{err: errors.New("accept failed")}
+	if server.healthCheck(time.Second) == nil {
+		t.Errorf("failed listener should fail the health check")
+	}
+}
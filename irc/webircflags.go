@@ -0,0 +1,198 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Beyond `secure` (and the TLS fingerprints), WEBIRC can carry key=value
+// flags with what the proxy knows about the client; each upstream chooses
+// which ones it receives (webirc.flags), since ircds differ in what they accept:
+//
+//	account      the client's account, from the OnConnect hook (ClientInfo.Account)
+//	             or from account-header
+//	certfp       the SHA-256 fingerprint of the client's TLS certificate, sent as
+//	             certfp-sha-256 (requires request-client-certs on the listener)
+//	country      the client's country, from the geoip database
+//	asn          the client's autonomous system number, from the geoip database
+//	local-port   the port the client connected to
+//
+// A flag is omitted if its value is unknown.
+
+var (
+	webircFlagNames = map[string]bool{
+		"account":    true,
+		"certfp":     true,
+		"country":    true,
+		"asn":        true,
+		"local-port": true,
+	}
+)
+
+// webircFlagsFor returns the extended WEBIRC flags that the upstream wants
+func (server *Server) webircFlagsFor(config *Config, upstream *reverseProxyUpstream, client *clientData) (flags []string) {
+	var country, asn string
+	for _, name := range upstream.Webirc.Flags {
+		var value string
+		switch name {
+		case "account":
+			if client.info != nil {
+				value = client.info.Account
+			}
+		case "certfp":
+			value = client.certfp
+			name = "certfp-sha-256"
+		case "country", "asn":
+			if country == "" && asn == "" && config.GeoIP.db != nil {
+				country, asn = config.GeoIP.db.lookup(client.ip)
+			}
+			if name == "country" {
+				value = country
+			} else {
+				value = asn
+			}
+		case "local-port":
+			if client.localPort != 0 {
+				value = strconv.Itoa(client.localPort)
+			}
+		}
+		if value != "" && isValidFlagValue(value) {
+			flags = append(flags, name+"="+value)
+		}
+	}
+	return
+}
+
+// flags are space-separated, and mustn't break the WEBIRC line
+func isValidFlagValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] <= ' ' || value[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// certificateFingerprint is the hex SHA-256 of a client certificate
+func certificateFingerprint(certs []*x509.Certificate) string {
+	if len(certs) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(certs[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// GeoIPConfig configures the database for the country and asn WEBIRC flags.
+// Its format is CSV, one non-overlapping network per line: network,country,asn
+// (e.g., `192.0.2.0/24,US,64496`), where the asn may be empty; lines beginning
+// with # are ignored.
+type GeoIPConfig struct {
+	Database string
+	db       *geoipDB
+}
+
+func (conf *GeoIPConfig) postprocess() (err error) {
+	if conf.Database == "" {
+		return nil
+	}
+	conf.db, err = loadGeoIPDB(conf.Database)
+	if err != nil {
+		return fmt.Errorf("couldn't load geoip database %s: %w", conf.Database, err)
+	}
+	return nil
+}
+
+type geoipRange struct {
+	start, end net.IP // 16-byte form
+	country    string
+	asn        string
+}
+
+// geoipDB is sorted by start, for binary search
+type geoipDB struct {
+	ranges []geoipRange
+}
+
+func loadGeoIPDB(filename string) (*geoipDB, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var db geoipDB
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected network,country,asn", lineNum)
+		}
+		_, network, err := net.ParseCIDR(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		entry := geoipRange{country: strings.TrimSpace(fields[1])}
+		if len(fields) > 2 {
+			entry.asn = strings.TrimPrefix(strings.TrimSpace(fields[2]), "AS")
+		}
+		entry.start, entry.end = networkRange(network)
+		db.ranges = append(db.ranges, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return bytes.Compare(db.ranges[i].start, db.ranges[j].start) < 0
+	})
+	return &db, nil
+}
+
+// networkRange returns the first and last addresses of a network, in 16-byte form
+func networkRange(network *net.IPNet) (start, end net.IP) {
+	start = network.IP.To16()
+	mask := network.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.CIDRMask(96, 128)[:12:12], mask...)
+	}
+	end = make(net.IP, net.IPv6len)
+	for i := range start {
+		end[i] = start[i] | ^mask[i]
+	}
+	return
+}
+
+func (db *geoipDB) lookup(ip net.IP) (country, asn string) {
+	ip = ip.To16()
+	if ip == nil {
+		return
+	}
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].start, ip) > 0
+	})
+	if i == 0 {
+		return
+	}
+	entry := &db.ranges[i-1]
+	if bytes.Compare(ip, entry.end) <= 0 {
+		return entry.country, entry.asn
+	}
+	return
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestGeoIPDB(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "geoip.csv")
+	os.WriteFile(filename, []byte(`# network,country,asn
+192.0.2.0/24,US,64496
+198.51.100.0/25,DE,
+2001:db8::/32,NL,AS64511
+`), 0600)
+	db, err := loadGeoIPDB(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(ip string) [2]string {
+		country, asn := db.lookup(net.ParseIP(ip))
+		return [2]string{country, asn}
+	}
+	assertEqual(lookup("192.0.2.0"), [2]string{"US", "64496"})
+	assertEqual(lookup("192.0.2.255"), [2]string{"US", "64496"})
+	assertEqual(lookup("192.0.3.0"), [2]string{"", ""})
+	assertEqual(lookup("198.51.100.127"), [2]string{"DE", ""})
+	assertEqual(lookup("198.51.100.128"), [2]string{"", ""})
+	assertEqual(lookup("2001:db8:1::1"), [2]string{"NL", "64511"})
+	assertEqual(lookup("2001:db9::1"), [2]string{"", ""})
+	assertEqual(lookup("10.0.0.1"), [2]string{"", ""})
+
+	os.WriteFile(filename, []byte("192.0.2.0/33,US\n"), 0600)
+	_, err = loadGeoIPDB(filename)
+	assertEqual(err == nil, false)
+}
+
+func TestWebircFlags(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "geoip.csv")
+	os.WriteFile(filename, []byte("192.0.2.0/24,US,64496\n"), 0600)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy.example.com"),
+		WithYAML(`
+geoip:
+    database: "`+filename+`"
+upstreams:
+    -
+        address: "127.0.0.1:6667"
+        webirc:
+            enabled: true
+            flags: [account, certfp, country, asn, local-port]
+`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := new(Server)
+	server.SetConfig(config)
+	client := &clientData{
+		ip:        net.ParseIP("192.0.2.1"),
+		localPort: 8097,
+		info:      &ClientInfo{Account: "alice"},
+	}
+	assertEqual(server.webircFlagsFor(config, &config.Upstreams[0], client),
+		[]string{"account=alice", "country=US", "asn=64496", "local-port=8097"})
+	// values that would break the WEBIRC line are omitted:
+	client.info.Account = "alice bob"
+	client.certfp = "abcd"
+	assertEqual(server.webircFlagsFor(config, &config.Upstreams[0], client),
+		[]string{"certfp-sha-256=abcd", "country=US", "asn=64496", "local-port=8097"})
+
+	_, err = NewConfig(
+		WithGatewayName("webircproxy.example.com"),
+		WithYAML(`
+upstreams:
+    -
+        address: "127.0.0.1:6667"
+        webirc:
+            enabled: true
+            flags: [shoe-size]
+`),
+	)
+	assertEqual(err.Error(), "upstream 127.0.0.1:6667: unknown webirc flag shoe-size")
+}
+
+// TestWebircCertfp connects to a TLS listener with a client certificate,
+// which must reach the upstream as the certfp flag
+func TestWebircCertfp(t *testing.T) {
+	mock := startMockIRCd(t, "hunter2")
+	listen := freeAddress(t)
+	certPEM, keyPEM := testCertPEM(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, []byte(certPEM), 0600)
+	os.WriteFile(keyFile, []byte(keyPEM), 0600)
+	config, err := NewConfig(
+		WithGatewayName("webircproxy"),
+		WithYAML(`
+log-level: error
+lookup-hostnames: false
+listeners:
+    "`+listen+`":
+        tls: {cert: "`+certFile+`", key: "`+keyFile+`"}
+        request-client-certs: true
+upstreams:
+    - {address: "`+mock.Addr()+`", webirc: {enabled: true, password: hunter2, flags: [certfp]}}
+`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.RunContext(ctx)
+
+	clientCert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{clientCert}}}
+	conn, _, err := dialer.Dial("wss://"+listen+"/webirc", http.Header{"Origin": []string{"https://example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, line := range []string{"NICK alice", "USER u 0 * :Alice"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(clientCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	webircs := mock.Webircs()
+	assertEqual(len(webircs), 1)
+	assertEqual(webircs[0].Flags, "secure certfp-sha-256="+certificateFingerprint([]*x509.Certificate{leaf}))
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/ergochat/irc-go/ircmsg"
+)
+
+// The welcome notice (e.g., identifying the gateway and its abuse contact)
+// is sent to the client right after the upstream's 001 numeric, when the
+// client's registration is complete, so that clients don't mistake it for
+// part of registration. It comes from the gateway name, and each line of
+// the configured text is sent as a separate NOTICE.
+
+// welcomeNoticeLines splits the configured welcome notice into its lines
+func welcomeNoticeLines(notice string) (lines []string) {
+	for _, line := range strings.Split(notice, "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return
+}
+
+// sendWelcomeNotice sends the welcome notice to the client, if the line from
+// the upstream is its 001 numeric; it returns whether it did
+func (r *ReverseProxyConn) sendWelcomeNotice(line []byte) (sent bool, err error) {
+	if !bytes.Contains(line, welcomeNumeric) {
+		return false, nil
+	}
+	msg, err := ircmsg.ParseLine(string(line))
+	if err != nil || msg.Command != "001" || len(msg.Params) == 0 {
+		return false, nil
+	}
+	nick := msg.Params[0]
+	for _, text := range r.welcomeNotice {
+		notice := ircmsg.MakeMessage(nil, r.gatewayName, "NOTICE", nick, text)
+		noticeLine, err := notice.LineBytesStrict(false, r.maxLineLen)
+		if err != nil && noticeLine == nil {
+			continue
+		}
+		if err = r.writeWS(r.messageType, bytes.TrimSuffix(noticeLine, crlf)); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,39 @@
+// Copyright (c) 2021 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+)
+
+func TestWelcomeNoticeLines(t *testing.T) {
+	assertEqual(len(welcomeNoticeLines("")), 0)
+	assertEqual(welcomeNoticeLines("Connected via gateway.example.org\r\n\nabuse: admin@example.org\n"),
+		[]string{"Connected via gateway.example.org", "abuse: admin@example.org"})
+}
+
+func TestSendWelcomeNotice(t *testing.T) {
+	webConn := new(recordingConn)
+	r := &ReverseProxyConn{
+		webConn:       webConn,
+		messageType:   textMessage,
+		maxLineLen:    DefaultMaxLineLen,
+		gatewayName:   "gateway.example.org",
+		welcomeNotice: []string{"Connected via gateway.example.org", "abuse: admin@example.org"},
+	}
+
+	sent, _ := r.sendWelcomeNotice([]byte(":irc.example.com NOTICE * :*** Looking up your hostname"))
+	assertEqual(sent, false)
+	sent, _ = r.sendWelcomeNotice([]byte(":irc.example.com PRIVMSG alice :see 001 here"))
+	assertEqual(sent, false)
+	assertEqual(len(webConn.messages), 0)
+
+	sent, err := r.sendWelcomeNotice([]byte(":irc.example.com 001 alice :Welcome to the network"))
+	assertEqual(sent, true)
+	assertEqual(err, nil)
+	assertEqual(webConn.messages, []string{
+		":gateway.example.org NOTICE alice :Connected via gateway.example.org",
+		":gateway.example.org NOTICE alice :abuse: admin@example.org",
+	})
+}
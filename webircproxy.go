@@ -4,9 +4,16 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/ergochat/webircproxy/irc"
 )
@@ -16,9 +23,42 @@ var commit = ""  // git hash
 var version = "" // tagged version
 
 func main() {
+	irc.Version = version
 	if len(os.Args) < 2 {
 		log.Fatal("must pass config file as argument")
 	}
+	if os.Args[1] == "selftest" {
+		if len(os.Args) < 3 {
+			log.Fatal("usage: webircproxy selftest <config file>")
+		}
+		os.Exit(selftest(os.Args[2]))
+	}
+	switch os.Args[1] {
+	case "service", "install-service":
+		if len(os.Args) < 3 {
+			log.Fatalf("usage: webircproxy %s <config file>", os.Args[1])
+		}
+		var err error
+		if os.Args[1] == "service" {
+			err = irc.RunService(os.Args[2])
+		} else {
+			err = irc.InstallService(os.Args[2])
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "uninstall-service":
+		if err := irc.UninstallService(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "loadtest":
+		os.Exit(loadtest(os.Args[2:]))
+	case "mockircd":
+		mockircd(os.Args[2:])
+		return
+	}
 	configfile := os.Args[1]
 	config, err := irc.LoadConfig(configfile)
 	if err != nil {
@@ -31,3 +71,97 @@ func main() {
 	}
 	server.Run()
 }
+
+// selftest checks that each upstream accepts our WEBIRC registration,
+// returning the exit status
+func selftest(configfile string) int {
+	config, err := irc.LoadConfig(configfile)
+	if err != nil {
+		log.Fatal("Config file did not load successfully: ", err.Error())
+	}
+	status := 0
+	for _, result := range irc.SelfTest(config) {
+		if result.Success {
+			fmt.Printf("ok    %s (%v)\n", result.Upstream, result.Duration.Round(time.Millisecond))
+		} else {
+			fmt.Printf("FAIL  %s: %s\n", result.Upstream, result.Error)
+			status = 1
+		}
+	}
+	return status
+}
+
+// loadtest runs a load test against a running webircproxy, returning the
+// exit status
+func loadtest(args []string) int {
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: webircproxy loadtest [options] <ws:// or wss:// URL>\n")
+		flags.PrintDefaults()
+	}
+	var options irc.LoadTestOptions
+	var subprotocols string
+	var jsonOutput bool
+	flags.IntVar(&options.Connections, "connections", 100, "number of concurrent connections")
+	flags.DurationVar(&options.RampUp, "ramp-up", 10*time.Second, "how long to spread the connection attempts over")
+	flags.DurationVar(&options.Duration, "duration", time.Minute, "how long each connection sends PINGs for, after registering")
+	flags.Float64Var(&options.Rate, "rate", 1, "PINGs per second, per connection (0 to only register)")
+	flags.StringVar(&subprotocols, "subprotocols", "", "comma-separated websocket subprotocols to offer, e.g. text.ircv3.net")
+	flags.StringVar(&options.Origin, "origin", "", "Origin header to send")
+	flags.BoolVar(&options.InsecureSkipVerify, "insecure", false, "don't verify the listener's TLS certificate")
+	flags.DurationVar(&options.Timeout, "timeout", 15*time.Second, "timeout for the handshake and for registration")
+	flags.BoolVar(&jsonOutput, "json", false, "print the results as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	options.URL = flags.Arg(0)
+	if subprotocols != "" {
+		options.Subprotocols = strings.Split(subprotocols, ",")
+	}
+
+	result := irc.LoadTest(options)
+	if jsonOutput {
+		out, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		fmt.Printf("connections:  %d attempted, %d connected, %d registered (in %v)\n",
+			result.Connections, result.Connected, result.Registered, result.Duration.Round(time.Millisecond))
+		fmt.Printf("pings:        %d sent, %d unanswered\n", result.PingsSent, result.PongsMissing)
+		fmt.Printf("handshake:    %v\n", result.Handshake)
+		fmt.Printf("registration: %v\n", result.Registration)
+		fmt.Printf("round trip:   %v\n", result.RoundTrip)
+		for err, count := range result.Errors {
+			fmt.Printf("error (x%d):  %s\n", count, err)
+		}
+	}
+	if result.Registered != result.Connections {
+		return 1
+	}
+	return 0
+}
+
+// mockircd runs a mock IRC server until interrupted, as an upstream for
+// testing the proxy
+func mockircd(args []string) {
+	flags := flag.NewFlagSet("mockircd", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:6667", "address to listen on")
+	password := flags.String("webirc-password", "", "require WEBIRC with this password")
+	trace := flags.Bool("trace", false, "print every line received")
+	flags.Parse(args)
+
+	var traceOutput io.Writer
+	if *trace {
+		traceOutput = os.Stdout
+	}
+	server, err := irc.NewMockIRCd(*listen, *password, traceOutput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("mock ircd listening on %s\n", server.Addr())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	server.Close()
+}